@@ -1,44 +1,325 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"github.com/gin-gonic/gin"
-	"log"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"palyvoua/internal/api/account"
+	"palyvoua/internal/api/catalog"
+	"palyvoua/internal/api/events"
+	"palyvoua/internal/api/fiscal"
+	"palyvoua/internal/api/health"
+	"palyvoua/internal/api/mail"
+	"palyvoua/internal/api/notification"
+	"palyvoua/internal/api/oidc"
+	"palyvoua/internal/api/organization"
 	"palyvoua/internal/api/payment"
+	"palyvoua/internal/api/pricing"
+	"palyvoua/internal/api/promotion"
+	"palyvoua/internal/api/receipt"
+	"palyvoua/internal/api/wallet"
+	"palyvoua/internal/api/webhook"
 	"palyvoua/internal/controllers"
 	"palyvoua/internal/mapper"
 	"palyvoua/internal/repository"
 	"palyvoua/tools"
+	"palyvoua/tools/auth"
+	"palyvoua/tools/config"
 	"palyvoua/tools/data"
 	"palyvoua/tools/jsonHelper"
+	"palyvoua/tools/logging"
+	"palyvoua/tools/metrics"
+	"palyvoua/tools/tracing"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
-func init() {
+func main() {
 
-	tools.LoadEnvVariables()
-	tools.ConnectToDb()
-	tools.ConnectToPostgres()
-	tools.StripeInit()
-	if os.Getenv("SEED_DB") == "true" {
-		log.Println("Seeding database...")
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fatal("loading the config failed", err)
+	}
+	if err = logging.Setup(cfg.Log.Level, cfg.Log.Format); err != nil {
+		fatal("setting up logging failed", err)
+	}
+	slog.Debug("config loaded", "config", cfg)
+	tools.ConnectToDb(cfg.DB)
+	tools.ConnectToPostgres(cfg.DB)
+	tools.StripeInit(cfg.Payment.StripeSecretKey.Value())
+	if cfg.SeedDB {
+		slog.Info("seeding database")
 		seeder:=data.NewDBSeeder()
 		err := seeder.SeedDB()
 		if err != nil {
 			panic(err)
 		}
 	}
-}
+	auth.UseTokens(auth.TokenOptions{
+		Secret: []byte(cfg.Auth.TokenSecret.Value()),
+		// access tokens have always lasted as many hours as refresh tokens last days
+		AccessExpiration:  cfg.Auth.RefreshExpiration / 24,
+		RefreshExpiration: cfg.Auth.RefreshExpiration,
+	})
 
-func main() {
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Options{
+		Exporter:    cfg.Tracing.Exporter,
+		ServiceName: cfg.Tracing.ServiceName,
+		SampleRatio: cfg.Tracing.SampleRatio,
+	})
+	if err != nil {
+		fatal("setting up tracing failed", err)
+	}
 
-	r := gin.Default()
+	r := gin.New()
+	// handlers pass the gin context on, it has to reach the span and request ID on the request context
+	r.ContextWithFallback = true
+	r.Use(otelgin.Middleware(cfg.Tracing.ServiceName, otelgin.WithFilter(func(req *http.Request) bool {
+		return req.URL.Path != "/metrics" && req.URL.Path != "/healthz" && req.URL.Path != "/readyz"
+	})))
+	r.Use(logging.Middleware(), metrics.Middleware(), gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		slog.ErrorContext(c, "panic recovered", "panic", err, "stack", string(debug.Stack()))
+		c.AbortWithStatus(500)
+	}))
 
 	userRepo:=repository.NewUserRepo()
 	adminRepo := repository.NewAdminRepo()
 	ticketRepo := repository.NewTickerRepo()
-	stripePaymentService := payment.NewStripePaymentService()
+	var paymentService payment.PaymentService = payment.NewStripePaymentService(payment.StripePaymentServiceOptions{
+		WebhookSecret: cfg.Payment.StripeWebhookSecret.Value(),
+	})
+	var fakePaymentService payment.FakePaymentService
+	if cfg.Payment.Provider == config.PAYMENT_PROVIDER_FAKE {
+		slog.Warn("using the fake payment provider, no real payments will be taken")
+		webhookURL := cfg.Payment.FakeWebhookURL
+		if webhookURL == "" {
+			webhookURL = "http://localhost:"+cfg.Server.Port+"/payment/webhook"
+		}
+		fakePaymentService = payment.NewFakePaymentService(payment.FakePaymentServiceOptions{
+			WebhookURL:    webhookURL,
+			WebhookSecret: cfg.Payment.FakeWebhookSecret.Value(),
+		})
+		paymentService = fakePaymentService
+	}
+	logMailer := mail.NewLogMailer()
 	consistentProductRepo := repository.NewConsistentProductRepo()
 	productTicketRepo := repository.NewProductTicketRepo()
+	checkoutRepo := repository.NewCheckoutRepo()
+
+	defaultProvider := payment.PROVIDER_STRIPE
+	if fakePaymentService != nil {
+		defaultProvider = payment.PROVIDER_FAKE
+	}
+	checkoutProviders := map[string]payment.CheckoutProvider{defaultProvider: paymentService}
+	if liqpay := cfg.Payment.LiqPay; liqpay.PublicKey != "" {
+		checkoutProviders[payment.PROVIDER_LIQPAY] = payment.NewLiqPayPaymentService(payment.LiqPayOptions{
+			PublicKey:   liqpay.PublicKey,
+			PrivateKey:  liqpay.PrivateKey.Value(),
+			CallbackURL: liqpay.CallbackURL,
+			Sandbox:     liqpay.Sandbox,
+			Products:    productTicketRepo,
+			Checkouts:   checkoutRepo,
+		})
+	}
+	if monobank := cfg.Payment.Monobank; monobank.Token != "" {
+		checkoutProviders[payment.PROVIDER_MONOBANK] = payment.NewMonobankPaymentService(payment.MonobankOptions{
+			Token:      monobank.Token.Value(),
+			BaseURL:    monobank.BaseURL,
+			WebhookURL: monobank.WebhookURL,
+			PublicKey:  monobank.PublicKey,
+			Products:   productTicketRepo,
+			Checkouts:  checkoutRepo,
+		})
+	}
+	providerSelector := payment.NewProviderSelector(payment.ProviderSelectorOptions{
+		Providers:       checkoutProviders,
+		Default:         defaultProvider,
+		SellerProviders: payment.ParseSellerProviders(cfg.Payment.SellerProviders),
+	})
+	returnURLResolver, err := payment.NewReturnURLResolver(cfg.Payment.ReturnURLs)
+	if err != nil {
+		fatal("reading CHECKOUT_RETURN_URLS failed", err)
+	}
+	apiKeyRepo := repository.NewAPIKeyRepo()
+	sessionRepo := repository.NewSessionRepo()
+
+	auth.UseAPIKeys(apiKeyRepo)
+	auth.UseSessions(sessionRepo)
+	metrics.UseProductTickets(productTicketRepo)
+	metrics.UseInventory(consistentProductRepo)
+	loginLimiterOptions := auth.DefaultLoginLimiterOptions()
+	loginLimiterOptions.FreeAttempts = cfg.Auth.LoginFreeAttempts
+	loginLimiterOptions.AccountLockoutThreshold = cfg.Auth.LoginAccountLockoutThreshold
+	loginLimiterOptions.IPLockoutThreshold = cfg.Auth.LoginIPLockoutThreshold
+	loginLimiterOptions.LockoutDuration = cfg.Auth.LoginLockout
+	loginLimiter := auth.NewLoginLimiter(auth.NewMemoryAttemptStore(), loginLimiterOptions)
+	var oidcProviders []oidc.ProviderConfig
+	for _, name := range cfg.OIDC.ProviderNames() {
+		switch name {
+		case config.OIDC_PROVIDER_GOOGLE:
+			google := cfg.OIDC.Google
+			oidcProviders = append(oidcProviders, oidc.ProviderConfig{
+				Name:         name,
+				Issuer:       google.Issuer,
+				ClientID:     google.ClientID,
+				ClientSecret: google.ClientSecret.Value(),
+				RedirectURL:  google.RedirectURL,
+			})
+		case config.OIDC_PROVIDER_APPLE:
+			apple := cfg.OIDC.Apple
+			oidcProviders = append(oidcProviders, oidc.ProviderConfig{
+				Name:            name,
+				Issuer:          apple.Issuer,
+				ClientID:        apple.ClientID,
+				ClientSecret:    apple.ClientSecret.Value(),
+				RedirectURL:     apple.RedirectURL,
+				AppleTeamID:     apple.TeamID,
+				AppleKeyID:      apple.KeyID,
+				ApplePrivateKey: apple.PrivateKey.Value(),
+			})
+		}
+	}
+	oidcService := oidc.NewOIDCService(oidcProviders, oidc.NewMemoryStateStore())
+
+	// jobs is cancelled on shutdown, the jobs then finish the pass they are in and return
+	jobs, stopJobs := context.WithCancel(context.Background())
+	var runningJobs sync.WaitGroup
+	runJob := func(run func(c context.Context)) {
+		runningJobs.Add(1)
+		go func() {
+			defer runningJobs.Done()
+			run(jobs)
+		}()
+	}
+
+	deletionService := account.NewDeletionService(account.DeletionServiceOptions{
+		UserRepo:       userRepo,
+		TicketRepo:     ticketRepo,
+		SessionRepo:    sessionRepo,
+		PaymentService: paymentService,
+		GracePeriod:    cfg.Account.DeletionGrace,
+	})
+	runJob(func(c context.Context) { deletionService.Run(c, time.Hour) })
+
+	// the fake provider has no catalog of its own
+	var stripeCatalog payment.Catalog
+	var catalogReconciler catalog.ReconciliationService
+	if fakePaymentService == nil {
+		stripeCatalog = payment.NewStripeCatalog()
+		catalogReconciler = catalog.NewReconciliationService(catalog.ReconciliationServiceOptions{
+			ProductTickets: productTicketRepo,
+			Products:       paymentService,
+			Catalog:        stripeCatalog,
+		})
+		if interval := cfg.Catalog.ReconcileInterval; interval > 0 {
+			runJob(func(c context.Context) { catalogReconciler.Run(c, interval, cfg.Catalog.ReconcileRepair) })
+		}
+	}
+
+	priceVersionRepo := repository.NewPriceVersionRepo()
+	priceService := pricing.NewPriceService(pricing.PriceServiceOptions{
+		ProductTickets: productTicketRepo,
+		PriceVersions:  priceVersionRepo,
+		Catalog:        stripeCatalog,
+	})
+	runJob(func(c context.Context) { priceService.Run(c, time.Minute) })
+
+	promotionService := promotion.NewPromotionService(promotion.PromotionServiceOptions{
+		PromotionRepo: repository.NewPromotionRepo(),
+		Purchases:     ticketRepo,
+	})
+	runJob(func(c context.Context) { promotionService.Run(c, time.Minute) })
+
+	walletService := wallet.NewWalletService(wallet.WalletServiceOptions{
+		LedgerRepo: repository.NewLedgerRepo(),
+		Currency:   strings.ToUpper(cfg.Wallet.Currency),
+	})
+
+	organizationService := organization.NewOrganizationService(organization.OrganizationServiceOptions{
+		OrganizationRepo: repository.NewOrganizationRepo(),
+		Tickets:          ticketRepo,
+		ProductTickets:   productTicketRepo,
+		Users:            userRepo,
+		Customers:        paymentService,
+	})
+
+	receiptSellers, err := receipt.ParseSellers(cfg.Receipt.Sellers)
+	if err != nil {
+		fatal("reading RECEIPT_SELLERS failed", err)
+	}
+	receiptRepo := repository.NewReceiptRepo()
+	receiptService := receipt.NewReceiptService(receipt.ReceiptServiceOptions{
+		ReceiptRepo:    receiptRepo,
+		ProductTickets: productTicketRepo,
+		PriceVersions:  priceVersionRepo,
+		Issuer:         cfg.Receipt.Issuer,
+		NumberPrefix:   cfg.Receipt.NumberPrefix,
+		Sellers:        receiptSellers,
+		DefaultVATRate: cfg.Receipt.DefaultVATRate,
+	})
+
+	// fiscalization stays off until a FISCAL_PROVIDER is set
+	var fiscalService fiscal.FiscalService
+	fiscalProvider, err := fiscal.NewProvider(cfg.Fiscal.Provider)
+	if err != nil {
+		fatal("setting up FISCAL_PROVIDER failed", err)
+	}
+	if fiscalProvider != nil {
+		fiscalService = fiscal.NewFiscalService(fiscal.FiscalServiceOptions{
+			FiscalRepo:     repository.NewFiscalRepo(),
+			Provider:       fiscalProvider,
+			Sequences:      receiptRepo,
+			CashRegisterID: cfg.Fiscal.CashRegisterID,
+			MaxAttempts:    cfg.Fiscal.MaxAttempts,
+		})
+		runJob(func(c context.Context) { fiscalService.Run(c, cfg.Fiscal.Interval) })
+	}
+
+	ticketEvents := events.NewBroker()
+	expiryService := events.NewExpiryService(events.ExpiryServiceOptions{
+		TicketRepo: ticketRepo,
+		Broker:     ticketEvents,
+	})
+	runJob(func(c context.Context) { expiryService.Run(c, time.Minute) })
+
+	webhookService := webhook.NewWebhookService(webhook.WebhookServiceOptions{
+		WebhookRepo:          repository.NewWebhookRepo(),
+		ProductTicketRepo:    productTicketRepo,
+		MaxAttempts:          cfg.Webhook.MaxAttempts,
+		AllowHTTP:            cfg.Webhook.AllowHTTP,
+		AllowPrivateNetworks: cfg.Webhook.AllowPrivateNetworks,
+	})
+	runJob(func(c context.Context) { webhookService.Run(c, cfg.Webhook.Interval) })
+
+	notificationService := notification.NewNotificationService(notification.NotificationServiceOptions{
+		NotificationRepo:  repository.NewNotificationRepo(),
+		UserRepo:          userRepo,
+		ProductTicketRepo: productTicketRepo,
+		TicketRepo:        ticketRepo,
+		Channels:          notification.NewChannels(logMailer, cfg.Notification.SinkDir),
+		ExpiryNotice:      cfg.Notification.ExpiryNotice,
+		MaxAttempts:       cfg.Notification.MaxAttempts,
+	})
+	runJob(func(c context.Context) { notificationService.Run(c, cfg.Notification.Interval) })
+
+	healthService := health.NewHealthService(health.HealthServiceOptions{
+		Checks: map[string]health.Check{
+			"mongo":    tools.PingMongo,
+			"postgres": tools.PingPostgres,
+			// probes come every few seconds from every replica, the provider rate limits its api
+			"payment": health.Cached(paymentService.Ping, cfg.Health.PaymentCache),
+		},
+		Timeout: cfg.Health.Timeout,
+	})
 
 	ticketMapper := mapper.NewTicketMapper(mapper.TicketMapperOptions{
 		ProductTicketRepo: productTicketRepo,
@@ -58,11 +339,59 @@ func main() {
 
 	paymentRoutesOptions := controllers.PaymentRouterOptions{
 		UserRepository: userRepo,
-		Ps:             stripePaymentService,
+		Ps:             paymentService,
 		Tr:             ticketRepo,
 		Pr:             consistentProductRepo,
 		Ptr:            productTicketRepo,
 		AdminRepo: adminRepo,
+		Providers: providerSelector,
+		Checkouts: checkoutRepo,
+		ReturnURLs: returnURLResolver,
+		TicketMapper: ticketMapper,
+		Promotions: promotionService,
+		Wallet: walletService,
+		Organizations: organizationService,
+		Receipts: receiptService,
+		Fiscal: fiscalService,
+		Notifications: notificationService,
+		Events: ticketEvents,
+		Webhooks: webhookService,
+		TicketExpiration: cfg.Tickets.Expiration,
+	}
+
+	authRoutesOptions := controllers.AuthRoutesOptions{
+		UserRepo:     userRepo,
+		AdminRepo:    adminRepo,
+		Ps:           paymentService,
+		LoginLimiter: loginLimiter,
+		SessionRepo:  sessionRepo,
+		OIDCService:  oidcService,
+		MFAIssuer:    cfg.Auth.MFAIssuer,
+	}
+
+	profileRoutesOptions := controllers.ProfileRoutesOptions{
+		UserRepo:    userRepo,
+		AdminRepo:   adminRepo,
+		SessionRepo: sessionRepo,
+		Ps:          paymentService,
+		Mailer:      logMailer,
+	}
+
+	accountDataRoutesOptions := controllers.AccountDataRoutesOptions{
+		UserRepo:          userRepo,
+		AdminRepo:         adminRepo,
+		TicketRepo:        ticketRepo,
+		ProductTicketRepo: productTicketRepo,
+		SessionRepo:       sessionRepo,
+		DeletionService:   deletionService,
+	}
+
+	adminRoutesOptions := controllers.AdminRoutesOptions{
+		AdminRepo:    adminRepo,
+		UserRepo:     userRepo,
+		LoginLimiter: loginLimiter,
+		APIKeyRepo:   apiKeyRepo,
+		CatalogReconciler: catalogReconciler,
 	}
 
 	ticketRoutesOptions := controllers.TicketRoutesOptions{
@@ -70,16 +399,141 @@ func main() {
 		TicketRepo:   ticketRepo,
 		AdminRepo:    adminRepo,
 		TicketMapper: ticketMapper,
+		Organizations: organizationService,
+		Events: ticketEvents,
 	}
 
-	controllers.SetupAuthRoutes(r, userRepo, stripePaymentService)
-	controllers.SetupOperatorRoutes(r, userRepo, adminRepo, ticketRepo)
+	controllers.SetupAuthRoutes(r, &authRoutesOptions)
+	controllers.SetupMFARoutes(r, &authRoutesOptions)
+	controllers.SetupOIDCRoutes(r, &authRoutesOptions)
+	controllers.SetupSessionRoutes(r, userRepo, adminRepo, sessionRepo)
+	controllers.SetupProfileRoutes(r, &profileRoutesOptions)
+	controllers.SetupAccountDataRoutes(r, &accountDataRoutesOptions)
+	controllers.SetupOperatorRoutes(r, userRepo, adminRepo, ticketRepo, productTicketRepo, notificationService, ticketEvents, webhookService)
 	controllers.SetupPaymentRoutes(r, &paymentRoutesOptions)
-	controllers.SetupAdminRoutes(r, adminRepo, userRepo)
-	controllers.SetupProductRoutes(r, consistentProductRepo, userRepo, adminRepo, stripePaymentService)
+	controllers.SetupAdminRoutes(r, &adminRoutesOptions)
+	controllers.SetupPromotionRoutes(r, &controllers.PromotionRoutesOptions{
+		UserRepo:          userRepo,
+		AdminRepo:         adminRepo,
+		Promotions:        promotionService,
+		ProductTicketRepo: productTicketRepo,
+	})
+	controllers.SetupWalletRoutes(r, &controllers.WalletRoutesOptions{
+		UserRepo:          userRepo,
+		AdminRepo:         adminRepo,
+		Wallet:            walletService,
+		TicketRepo:        ticketRepo,
+		ProductRepo:       consistentProductRepo,
+		ProductTicketRepo: productTicketRepo,
+		PriceVersionRepo:  priceVersionRepo,
+		Providers:         providerSelector,
+		ReturnURLs:        returnURLResolver,
+		Receipts:          receiptService,
+		Fiscal:            fiscalService,
+		Notifications:     notificationService,
+		Events:            ticketEvents,
+		Webhooks:          webhookService,
+		MaxTopUp:          cfg.Wallet.MaxTopUp,
+		TicketExpiration:  cfg.Tickets.Expiration,
+	})
+	controllers.SetupWebhookRoutes(r, &controllers.WebhookRoutesOptions{
+		UserRepo:  userRepo,
+		AdminRepo: adminRepo,
+		Webhooks:  webhookService,
+	})
+	controllers.SetupNotificationRoutes(r, &controllers.NotificationRoutesOptions{
+		UserRepo:  userRepo,
+		AdminRepo: adminRepo,
+	})
+	controllers.SetupOrganizationRoutes(r, &controllers.OrganizationRoutesOptions{
+		UserRepo:          userRepo,
+		AdminRepo:         adminRepo,
+		Organizations:     organizationService,
+		PaymentService:    paymentService,
+		ProductTicketRepo: productTicketRepo,
+		Providers:         providerSelector,
+		ReturnURLs:        returnURLResolver,
+	})
+	controllers.SetupReceiptRoutes(r, &controllers.ReceiptRoutesOptions{
+		UserRepo:      userRepo,
+		AdminRepo:     adminRepo,
+		Receipts:      receiptService,
+		Organizations: organizationService,
+		Fiscal:        fiscalService,
+	})
+	if fiscalService != nil {
+		controllers.SetupFiscalRoutes(r, &controllers.FiscalRoutesOptions{
+			UserRepo:  userRepo,
+			AdminRepo: adminRepo,
+			Fiscal:    fiscalService,
+		})
+	}
+	controllers.SetupProductRoutes(r, consistentProductRepo, userRepo, adminRepo, paymentService)
 	controllers.SetupTicketRoutes(r,&ticketRoutesOptions)
-	controllers.SetupProductTicketRoutes(r,adminRepo, userRepo, productTicketRepo, stripePaymentService)
+	controllers.SetupProductTicketRoutes(r,adminRepo, userRepo, productTicketRepo, paymentService, priceService)
+
+	if fakePaymentService != nil {
+		controllers.SetupFakePaymentRoutes(r, fakePaymentService)
+	}
+	controllers.SetupMetricsRoutes(r, &controllers.MetricsRoutesOptions{Token: cfg.Metrics.Token.Value()})
+	controllers.SetupHealthRoutes(r, healthService)
+
+	srv := &http.Server{
+		Addr:              ":" + cfg.Server.Port,
+		Handler:           r,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+	// Shutdown waits for every connection to go idle, an event stream never does until its broker closes
+	srv.RegisterOnShutdown(ticketEvents.Close)
 
-	r.Run()
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+	slog.Info("listening", "addr", srv.Addr)
+	select {
+	case err = <-served:
+		fatal("serving http failed", err)
+	case <-signals.Done():
+	}
+	// a second signal kills the process right away
+	stopSignals()
+
+	slog.Info("shutting down")
+	healthService.Drain()
+	// load balancers stop routing here once they see /readyz fail
+	time.Sleep(cfg.Server.ShutdownDrain)
 
-}
\ No newline at end of file
+	c, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	stopJobs()
+	if err = srv.Shutdown(c); err != nil {
+		slog.Warn("requests were still running at the shutdown deadline", logging.Err(err))
+	}
+	jobsDone := make(chan struct{})
+	go func() {
+		runningJobs.Wait()
+		close(jobsDone)
+	}()
+	select {
+	case <-jobsDone:
+	case <-c.Done():
+		slog.Warn("background jobs were still running at the shutdown deadline")
+	}
+	if err = shutdownTracing(c); err != nil {
+		slog.Warn("flushing spans failed", logging.Err(err))
+	}
+	tools.DisconnectDbs(c)
+	slog.Info("shut down")
+}
+
+// fatal logs what stopped the server from starting and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, logging.Err(err))
+	os.Exit(1)
+}
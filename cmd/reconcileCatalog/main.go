@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"palyvoua/internal/api/catalog"
+	"palyvoua/internal/api/payment"
+	"palyvoua/internal/repository"
+	"palyvoua/tools"
+	"palyvoua/tools/config"
+	"palyvoua/tools/logging"
+)
+
+// reconcileCatalog diffs the product tickets against the Stripe catalog and prints the report as json.
+// It exits with 1 when mismatches are left unrepaired.
+func main() {
+	repair := flag.Bool("repair", false, "create missing products and prices, archive stale ones and clear dangling ids")
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = logging.Setup(cfg.Log.Level, cfg.Log.Format); err != nil {
+		log.Fatal(err)
+	}
+	tools.ConnectToDb(cfg.DB)
+	tools.StripeInit(cfg.Payment.StripeSecretKey.Value())
+
+	reconciler := catalog.NewReconciliationService(catalog.ReconciliationServiceOptions{
+		ProductTickets: repository.NewProductTicketRepo(),
+		Products:       payment.NewStripePaymentService(payment.StripePaymentServiceOptions{WebhookSecret: cfg.Payment.StripeWebhookSecret.Value()}),
+		Catalog:        payment.NewStripeCatalog(),
+	})
+	report, err := reconciler.Reconcile(context.Background(), *repair)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(report); err != nil {
+		log.Fatal(err)
+	}
+	for _, m := range report.Mismatches {
+		if !m.Repaired {
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package account
+
+import (
+	"context"
+	"log/slog"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/jobs"
+	"palyvoua/tools/logging"
+	"time"
+)
+
+type customerRemover interface {
+	DeleteCustomer(customerID string) error
+}
+
+type DeletionService interface {
+	// GracePeriod is how long a requested deletion can still be cancelled
+	GracePeriod() time.Duration
+	// ProcessDue deletes every account whose grace period is over
+	ProcessDue(c context.Context) error
+	// Run calls ProcessDue every interval until c is cancelled, a pass under way is finished first
+	Run(c context.Context, interval time.Duration)
+}
+
+type DeletionServiceOptions struct {
+	UserRepo repository.UserRepo
+	TicketRepo repository.TicketRepo
+	SessionRepo repository.SessionRepo
+	PaymentService customerRemover
+	GracePeriod time.Duration
+}
+
+func NewDeletionService(options DeletionServiceOptions) DeletionService {
+	return &defaultDeletionService{
+		userRepo:       options.UserRepo,
+		ticketRepo:     options.TicketRepo,
+		sessionRepo:    options.SessionRepo,
+		paymentService: options.PaymentService,
+		gracePeriod:    options.GracePeriod,
+	}
+}
+
+type defaultDeletionService struct {
+	userRepo repository.UserRepo
+	ticketRepo repository.TicketRepo
+	sessionRepo repository.SessionRepo
+	paymentService customerRemover
+	gracePeriod time.Duration
+}
+
+func (s *defaultDeletionService) GracePeriod() time.Duration {
+	return s.gracePeriod
+}
+
+func (s *defaultDeletionService) Run(c context.Context, interval time.Duration) {
+	jobs.Every(c, interval, "account deletion", s.ProcessDue)
+}
+
+func (s *defaultDeletionService) ProcessDue(c context.Context) error {
+	users, err := s.userRepo.GetDueForDeletion(c, int(time.Now().Unix()))
+	if err != nil {
+		return err
+	}
+	for i := range users {
+		// one failing account must not block the others, it is picked up again on the next run
+		if err = s.deleteAccount(c, &users[i]); err != nil {
+			slog.ErrorContext(c, "account deletion failed", "user_id", users[i].ID, logging.Err(err))
+		}
+	}
+	return nil
+}
+
+// deleteAccount removes the payment customer and the personal data. Paid tickets stay,
+// they are tied to payments we have to keep for accounting.
+func (s *defaultDeletionService) deleteAccount(c context.Context, user *models.User) error {
+	if user.CustomerID != "" {
+		if err := s.paymentService.DeleteCustomer(user.CustomerID); err != nil {
+			return err
+		}
+	}
+	if err := s.ticketRepo.DeleteUnpaidByUserID(c, user.ID); err != nil {
+		return err
+	}
+	if err := s.sessionRepo.DeleteAllByUserID(c, user.ID); err != nil {
+		return err
+	}
+	return s.userRepo.Anonymize(c, user.ID, int(time.Now().Unix()))
+}
@@ -0,0 +1,298 @@
+package catalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"log/slog"
+	"palyvoua/internal/api/payment"
+	"palyvoua/internal/models"
+	"palyvoua/tools/jobs"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MISMATCH_MISSING_PRODUCT is a product ticket that was never saved to the provider
+	MISMATCH_MISSING_PRODUCT = "missing_product"
+	// MISMATCH_DANGLING_PRODUCT is a product ticket pointing at a deleted or archived product
+	MISMATCH_DANGLING_PRODUCT = "dangling_product"
+	// MISMATCH_PRICE is a product without an active price equal to the ticket's
+	MISMATCH_PRICE = "price_mismatch"
+	// MISMATCH_EXTRA_PRICE is an active price besides the one checkouts should use
+	MISMATCH_EXTRA_PRICE = "extra_price"
+	MISMATCH_NAME = "name_mismatch"
+	// MISMATCH_ORPHAN_PRODUCT is an active product of ours no product ticket points at
+	MISMATCH_ORPHAN_PRODUCT = "orphan_product"
+)
+
+var ErrAlreadyRunning = errors.New("catalog reconciliation is already running")
+
+type Mismatch struct {
+	Kind string `json:"kind"`
+	ProductTicketID string `json:"productTicketId,omitempty"`
+	ProductID string `json:"productId,omitempty"`
+	PriceID string `json:"priceId,omitempty"`
+	Detail string `json:"detail"`
+	Repaired bool `json:"repaired"`
+	// RepairError is set when the repair was attempted and failed
+	RepairError string `json:"repairError,omitempty"`
+}
+
+type Report struct {
+	StartedAt int `json:"startedAt"`
+	FinishedAt int `json:"finishedAt"`
+	Repair bool `json:"repair"`
+	ProductTickets int `json:"productTickets"`
+	Products int `json:"products"`
+	Mismatches []Mismatch `json:"mismatches"`
+}
+
+type productTicketStore interface {
+	GetAllProductTickets(c context.Context) ([]models.ProductTicket, error)
+	UpdateStripeProductID(c context.Context, prID uuid.UUID, stripeProductID string) (models.ProductTicket, error)
+}
+
+type productSaver interface {
+	SaveProduct(p *models.ProductTicket) (*payment.Product, error)
+}
+
+type ReconciliationService interface {
+	// Reconcile diffs the product tickets against the provider's catalog, repair also fixes what it finds
+	Reconcile(c context.Context, repair bool) (*Report, error)
+	// Run calls Reconcile every interval until c is cancelled, cancelling does not cut a reconciliation short
+	Run(c context.Context, interval time.Duration, repair bool)
+}
+
+type ReconciliationServiceOptions struct {
+	ProductTickets productTicketStore
+	Products productSaver
+	Catalog payment.Catalog
+}
+
+func NewReconciliationService(options ReconciliationServiceOptions) ReconciliationService {
+	return &defaultReconciliationService{
+		productTickets: options.ProductTickets,
+		products:       options.Products,
+		catalog:        options.Catalog,
+	}
+}
+
+type defaultReconciliationService struct {
+	productTickets productTicketStore
+	products productSaver
+	catalog payment.Catalog
+	// running keeps a scheduled run and an admin run from repairing the same product twice
+	running sync.Mutex
+}
+
+func (s *defaultReconciliationService) Run(c context.Context, interval time.Duration, repair bool) {
+	jobs.Every(c, interval, "catalog reconciliation", func(c context.Context) error {
+		report, err := s.Reconcile(c, repair)
+		if err != nil {
+			return err
+		}
+		logReport(report)
+		return nil
+	})
+}
+
+func logReport(report *Report) {
+	slog.Info("catalog reconciled", "product_tickets", report.ProductTickets, "products", report.Products, "mismatches", len(report.Mismatches))
+	for _, m := range report.Mismatches {
+		status := "not repaired"
+		if m.Repaired {
+			status = "repaired"
+		} else if m.RepairError != "" {
+			status = "repair failed: " + m.RepairError
+		}
+		slog.Warn("catalog mismatch", "kind", m.Kind, "product_ticket_id", m.ProductTicketID, "product_id", m.ProductID, "price_id", m.PriceID, "detail", m.Detail, "status", status)
+	}
+}
+
+func (s *defaultReconciliationService) Reconcile(c context.Context, repair bool) (*Report, error) {
+	if !s.running.TryLock() {
+		return nil, ErrAlreadyRunning
+	}
+	defer s.running.Unlock()
+
+	report := Report{StartedAt: int(time.Now().Unix()), Repair: repair, Mismatches: []Mismatch{}}
+	tickets, err := s.productTickets.GetAllProductTickets(c)
+	if err != nil {
+		return nil, err
+	}
+	products, err := s.catalog.ListProducts()
+	if err != nil {
+		return nil, err
+	}
+	report.ProductTickets = len(tickets)
+	report.Products = len(products)
+
+	productsByID := map[string]*payment.CatalogProduct{}
+	for i := range products {
+		productsByID[products[i].ID] = &products[i]
+	}
+	referenced := map[string]bool{}
+	for i := range tickets {
+		if productID := s.reconcileTicket(c, &report, &tickets[i], productsByID, repair); productID != "" {
+			referenced[productID] = true
+		}
+	}
+
+	for _, p := range products {
+		// products without our metadata were made by hand in the dashboard and are left alone
+		if !p.Active || p.ProductTicketID == "" || referenced[p.ID] {
+			continue
+		}
+		m := Mismatch{
+			Kind:            MISMATCH_ORPHAN_PRODUCT,
+			ProductTicketID: p.ProductTicketID,
+			ProductID:       p.ID,
+			Detail:          fmt.Sprintf("no product ticket points at %q", p.Name),
+		}
+		if repair {
+			repaired(&m, s.catalog.ArchiveProduct(p.ID))
+		}
+		report.Mismatches = append(report.Mismatches, m)
+	}
+
+	report.FinishedAt = int(time.Now().Unix())
+	return &report, nil
+}
+
+// reconcileTicket returns the id of the product the ticket ends up pointing at
+func (s *defaultReconciliationService) reconcileTicket(c context.Context, report *Report, ticket *models.ProductTicket, productsByID map[string]*payment.CatalogProduct, repair bool) string {
+	ticketID := ticket.ID.String()
+	if ticket.StripeID != "" {
+		p, ok := productsByID[ticket.StripeID]
+		if ok && p.Active {
+			s.reconcilePrices(report, ticket, p, repair)
+			return p.ID
+		}
+		m := Mismatch{
+			Kind:            MISMATCH_DANGLING_PRODUCT,
+			ProductTicketID: ticketID,
+			ProductID:       ticket.StripeID,
+			Detail:          "product does not exist",
+		}
+		if ok {
+			m.Detail = "product is archived"
+		}
+		if repair {
+			_, err := s.productTickets.UpdateStripeProductID(c, ticket.ID, "")
+			repaired(&m, err)
+		}
+		report.Mismatches = append(report.Mismatches, m)
+		if !m.Repaired {
+			return ""
+		}
+		ticket.StripeID = ""
+	}
+
+	m := Mismatch{
+		Kind:            MISMATCH_MISSING_PRODUCT,
+		ProductTicketID: ticketID,
+		Detail:          fmt.Sprintf("%q has no product", ticket.Title),
+	}
+	if repair {
+		product, err := s.products.SaveProduct(ticket)
+		if err == nil {
+			m.ProductID = product.ID
+			_, err = s.productTickets.UpdateStripeProductID(c, ticket.ID, product.ID)
+		}
+		repaired(&m, err)
+	}
+	report.Mismatches = append(report.Mismatches, m)
+	return m.ProductID
+}
+
+// reconcilePrices leaves exactly one active price, the newest one equal to the ticket's price,
+// which is the one checkouts pick up
+func (s *defaultReconciliationService) reconcilePrices(report *Report, ticket *models.ProductTicket, p *payment.CatalogProduct, repair bool) {
+	ticketID := ticket.ID.String()
+	if p.Name != ticket.Title {
+		m := Mismatch{
+			Kind:            MISMATCH_NAME,
+			ProductTicketID: ticketID,
+			ProductID:       p.ID,
+			Detail:          fmt.Sprintf("product is named %q, ticket %q", p.Name, ticket.Title),
+		}
+		if repair {
+			repaired(&m, s.catalog.UpdateProductName(p.ID, ticket.Title))
+		}
+		report.Mismatches = append(report.Mismatches, m)
+	}
+
+	var keep *payment.CatalogPrice
+	for i := range p.Prices {
+		price := &p.Prices[i]
+		if price.UnitAmount == ticket.Price && strings.EqualFold(price.Currency, ticket.Currency) {
+			if keep == nil || price.Created > keep.Created {
+				keep = price
+			}
+		}
+	}
+	if keep == nil {
+		m := Mismatch{
+			Kind:            MISMATCH_PRICE,
+			ProductTicketID: ticketID,
+			ProductID:       p.ID,
+			Detail:          fmt.Sprintf("no active price of %d %s, found %s", ticket.Price, ticket.Currency, describePrices(p.Prices)),
+		}
+		if repair {
+			price, err := s.catalog.CreatePrice(p.ID, ticket.Price, ticket.Currency, priceVersionID(ticket), true)
+			if err == nil {
+				m.PriceID = price.ID
+				keep = price
+			}
+			repaired(&m, err)
+		}
+		report.Mismatches = append(report.Mismatches, m)
+	}
+
+	for _, price := range p.Prices {
+		if keep != nil && price.ID == keep.ID {
+			continue
+		}
+		m := Mismatch{
+			Kind:            MISMATCH_EXTRA_PRICE,
+			ProductTicketID: ticketID,
+			ProductID:       p.ID,
+			PriceID:         price.ID,
+			Detail:          fmt.Sprintf("active price of %d %s", price.UnitAmount, price.Currency),
+		}
+		// without a price to replace it archiving would leave the product unsellable
+		if repair && keep != nil {
+			repaired(&m, s.catalog.ArchivePrice(price.ID))
+		}
+		report.Mismatches = append(report.Mismatches, m)
+	}
+}
+
+func priceVersionID(ticket *models.ProductTicket) string {
+	if ticket.PriceVersionID == uuid.Nil {
+		return ""
+	}
+	return ticket.PriceVersionID.String()
+}
+
+func describePrices(prices []payment.CatalogPrice) string {
+	if len(prices) == 0 {
+		return "none"
+	}
+	described := make([]string, 0, len(prices))
+	for _, p := range prices {
+		described = append(described, fmt.Sprintf("%d %s", p.UnitAmount, p.Currency))
+	}
+	return strings.Join(described, ", ")
+}
+
+func repaired(m *Mismatch, err error) {
+	if err != nil {
+		m.RepairError = err.Error()
+		return
+	}
+	m.Repaired = true
+}
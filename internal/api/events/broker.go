@@ -0,0 +1,108 @@
+package events
+
+import (
+	"github.com/google/uuid"
+	"palyvoua/internal/models"
+	"sync"
+	"time"
+)
+
+// SUBSCRIBER_BUFFER events wait for a slow subscriber, newer ones are dropped for it after that
+const SUBSCRIBER_BUFFER = 32
+
+// Broker fans ticket events out to the streams of their holder, it lives in this process only
+type Broker interface {
+	Publish(event models.TicketEvent)
+	// Subscribe streams the events of a user until the returned func is called
+	Subscribe(userID uuid.UUID) (<-chan models.TicketEvent, func())
+	// Close ends every stream, streams subscribed after it end right away
+	Close()
+}
+
+func NewBroker() Broker {
+	return &defaultBroker{subscribers: map[uuid.UUID]map[chan models.TicketEvent]struct{}{}}
+}
+
+type defaultBroker struct {
+	mu sync.RWMutex
+	subscribers map[uuid.UUID]map[chan models.TicketEvent]struct{}
+	closed bool
+}
+
+func (b *defaultBroker) Publish(event models.TicketEvent) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for ch := range b.subscribers[event.UserID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (b *defaultBroker) Subscribe(userID uuid.UUID) (<-chan models.TicketEvent, func()) {
+	ch := make(chan models.TicketEvent, SUBSCRIBER_BUFFER)
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		close(ch)
+		return ch, func() {}
+	}
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = map[chan models.TicketEvent]struct{}{}
+	}
+	b.subscribers[userID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			// Close may have ended the stream already
+			if _, ok := b.subscribers[userID][ch]; !ok {
+				return
+			}
+			delete(b.subscribers[userID], ch)
+			if len(b.subscribers[userID]) == 0 {
+				delete(b.subscribers, userID)
+			}
+			close(ch)
+		})
+	}
+}
+
+func (b *defaultBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for userID, channels := range b.subscribers {
+		for ch := range channels {
+			close(ch)
+		}
+		delete(b.subscribers, userID)
+	}
+}
+
+// PublishTickets publishes an event for every ticket that has a holder, a nil broker publishes nothing
+func PublishTickets(broker Broker, eventType string, tickets ...models.Ticket) {
+	if broker == nil {
+		return
+	}
+	now := int(time.Now().Unix())
+	for _, ticket := range tickets {
+		if ticket.UserId == uuid.Nil {
+			continue
+		}
+		broker.Publish(models.TicketEvent{
+			ID:       uuid.New(),
+			Type:     eventType,
+			UserID:   ticket.UserId,
+			TicketID: ticket.ID,
+			Status:   ticket.Status,
+			Amount:   ticket.Amount,
+			Used:     ticket.Used,
+			At:       now,
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package events
+
+import (
+	"context"
+	"palyvoua/internal/models"
+	"palyvoua/tools/jobs"
+	"palyvoua/tools/metrics"
+	"time"
+)
+
+type ticketExpirer interface {
+	Expire(c context.Context, now int) ([]models.Ticket, error)
+}
+
+type ExpiryServiceOptions struct {
+	TicketRepo ticketExpirer
+	Broker Broker
+}
+
+// ExpiryService marks tickets that ran out as expired and tells their holders
+type ExpiryService interface {
+	ExpireDue(c context.Context) error
+	Run(c context.Context, interval time.Duration)
+}
+
+func NewExpiryService(options ExpiryServiceOptions) ExpiryService {
+	return &defaultExpiryService{options: options}
+}
+
+type defaultExpiryService struct {
+	options ExpiryServiceOptions
+}
+
+func (s *defaultExpiryService) ExpireDue(c context.Context) error {
+	expired, err := s.options.TicketRepo.Expire(c, int(time.Now().Unix()))
+	metrics.CountTickets(c, metrics.TICKETS_EXPIRED, expired...)
+	PublishTickets(s.options.Broker, models.TICKET_EXPIRED, expired...)
+	return err
+}
+
+func (s *defaultExpiryService) Run(c context.Context, interval time.Duration) {
+	jobs.Every(c, interval, "expiring tickets", s.ExpireDue)
+}
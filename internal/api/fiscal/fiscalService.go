@@ -0,0 +1,244 @@
+package fiscal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log/slog"
+	"net/url"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/jobs"
+	"palyvoua/tools/logging"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// OFFLINE_LIMIT is how long a PRRO may work offline before the checks must be delivered
+	OFFLINE_LIMIT = 72 * time.Hour
+	MAX_RETRY_DELAY = time.Hour
+	FIRST_RETRY_DELAY = 30 * time.Second
+	DEFAULT_MAX_ATTEMPTS = 20
+	PROCESS_BATCH = 50
+	// CLAIM_LEASE keeps a claimed document from other instances while it is submitted
+	CLAIM_LEASE = 5 * time.Minute
+)
+
+var ErrNotFailed = errors.New("only failed documents can be retried")
+
+type sequencer interface {
+	NextSequence(c context.Context, name string) (int, error)
+}
+
+type FiscalService interface {
+	// Enqueue builds the fiscal check of a receipt, run it in the transaction that records the payment.
+	// A payment that already has one gets it back.
+	Enqueue(c context.Context, receipt *models.Receipt, paymentType string) (*models.FiscalDocument, error)
+	GetByReference(c context.Context, reference string) (models.FiscalDocument, error)
+	GetByStatus(c context.Context, status string, limit int) ([]models.FiscalDocument, error)
+	// Retry queues a failed document again
+	Retry(c context.Context, id uuid.UUID) (*models.FiscalDocument, error)
+	// ProcessDue submits the documents whose attempt is due
+	ProcessDue(c context.Context) error
+	Run(c context.Context, interval time.Duration)
+}
+
+type FiscalServiceOptions struct {
+	FiscalRepo repository.FiscalRepo
+	Provider Provider
+	// Sequences numbers the offline checks
+	Sequences sequencer
+	// CashRegisterID is the fiscal number of the PRRO
+	CashRegisterID string
+	// MaxAttempts before a rejected document is failed, outages are retried until delivered
+	MaxAttempts int
+}
+
+func NewFiscalService(options FiscalServiceOptions) FiscalService {
+	if options.MaxAttempts == 0 {
+		options.MaxAttempts = DEFAULT_MAX_ATTEMPTS
+	}
+	return &defaultFiscalService{options: options}
+}
+
+type defaultFiscalService struct {
+	options FiscalServiceOptions
+	// outage is set while the provider is known to be unreachable, checks sold meanwhile are offline from the start
+	outage atomic.Bool
+}
+
+func (s *defaultFiscalService) Enqueue(c context.Context, receipt *models.Receipt, paymentType string) (*models.FiscalDocument, error) {
+	existing, err := s.options.FiscalRepo.GetByReference(c, receipt.Reference)
+	if err == nil {
+		return &existing, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+	now := int(time.Now().Unix())
+	document := models.FiscalDocument{
+		ID:             uuid.New(),
+		Reference:      receipt.Reference,
+		ReceiptID:      receipt.ID,
+		CashRegisterID: s.options.CashRegisterID,
+		PaymentType:    paymentType,
+		Currency:       receipt.Currency,
+		Total:          receipt.Total,
+		Status:         models.FISCAL_PENDING,
+		NextAttemptAt:  now,
+		CreatedAt:      now,
+	}
+	for _, line := range receipt.Lines {
+		document.Lines = append(document.Lines, models.FiscalLine{
+			Code:      line.ProductTicketID.String(),
+			Name:      line.Title,
+			Quantity:  line.Quantity,
+			UnitPrice: line.UnitPrice,
+			Discount:  line.Discount,
+			Amount:    line.Gross,
+			VATRate:   line.VATRate,
+			VAT:       line.VAT,
+		})
+	}
+	if s.outage.Load() {
+		if err = s.numberOffline(c, &document); err != nil {
+			return nil, err
+		}
+	}
+	if err = s.options.FiscalRepo.Save(c, &document); err != nil {
+		return nil, err
+	}
+	return &document, nil
+}
+
+func (s *defaultFiscalService) GetByReference(c context.Context, reference string) (models.FiscalDocument, error) {
+	return s.options.FiscalRepo.GetByReference(c, reference)
+}
+
+func (s *defaultFiscalService) GetByStatus(c context.Context, status string, limit int) ([]models.FiscalDocument, error) {
+	return s.options.FiscalRepo.GetByStatus(c, status, limit)
+}
+
+func (s *defaultFiscalService) Retry(c context.Context, id uuid.UUID) (*models.FiscalDocument, error) {
+	document, err := s.options.FiscalRepo.GetByID(c, id)
+	if err != nil {
+		return nil, err
+	}
+	if document.Status != models.FISCAL_FAILED {
+		return nil, ErrNotFailed
+	}
+	document.Status = models.FISCAL_PENDING
+	if document.OfflineNumber != "" {
+		document.Status = models.FISCAL_OFFLINE
+	}
+	document.Attempts = 0
+	document.NextAttemptAt = int(time.Now().Unix())
+	if err = s.options.FiscalRepo.Update(c, &document); err != nil {
+		return nil, err
+	}
+	return &document, nil
+}
+
+// qr builds the check link of the tax office, the one its QR codes point to
+func (s *defaultFiscalService) qr(document *models.FiscalDocument, number string, at time.Time) string {
+	query := url.Values{
+		"fn":   {document.CashRegisterID},
+		"id":   {number},
+		"sm":   {fmt.Sprintf("%d.%02d", document.Total/100, document.Total%100)},
+		"date": {at.Format("20060102")},
+		"time": {at.Format("150405")},
+	}
+	return "https://cabinet.tax.gov.ua/cashregs/check?" + query.Encode()
+}
+
+// numberOffline gives a check its number in the offline session of the cash register,
+// the QR printed on the sold check points to it
+func (s *defaultFiscalService) numberOffline(c context.Context, document *models.FiscalDocument) error {
+	sequence, err := s.options.Sequences.NextSequence(c, "fiscal:offline:"+document.CashRegisterID)
+	if err != nil {
+		return err
+	}
+	document.Status = models.FISCAL_OFFLINE
+	document.OfflineNumber = fmt.Sprintf("%s-OFF-%d", document.CashRegisterID, sequence)
+	document.QR = s.qr(document, document.OfflineNumber, time.Unix(int64(document.CreatedAt), 0))
+	return nil
+}
+
+func (s *defaultFiscalService) process(c context.Context, document *models.FiscalDocument) error {
+	now := time.Now()
+	result, err := s.options.Provider.Submit(c, document)
+	document.Attempts++
+	switch {
+	case err == nil:
+		s.outage.Store(false)
+		document.Status = models.FISCAL_DONE
+		document.FiscalNumber = result.FiscalNumber
+		document.FiscalizedAt = result.FiscalizedAt
+		if document.FiscalizedAt == 0 {
+			document.FiscalizedAt = int(now.Unix())
+		}
+		// an offline check keeps the link it was sold with
+		if document.OfflineNumber == "" {
+			document.QR = result.QR
+			if document.QR == "" {
+				document.QR = s.qr(document, result.FiscalNumber, time.Unix(int64(document.FiscalizedAt), 0))
+			}
+		}
+		document.LastError = ""
+	case errors.Is(err, ErrUnavailable):
+		s.outage.Store(true)
+		// a check enqueued before the outage was noticed was never delivered, it joins the offline
+		// session the failed attempt opened, numbered with the time it was sold at
+		if document.Status == models.FISCAL_PENDING {
+			if err := s.numberOffline(c, document); err != nil {
+				return err
+			}
+		}
+		if now.Sub(time.Unix(int64(document.CreatedAt), 0)) > OFFLINE_LIMIT {
+			slog.WarnContext(c, "fiscal check offline for too long", "offline_number", document.OfflineNumber, "limit", OFFLINE_LIMIT)
+		}
+		document.LastError = err.Error()
+		document.NextAttemptAt = int(now.Add(jobs.Backoff(document.Attempts, FIRST_RETRY_DELAY, MAX_RETRY_DELAY)).Unix())
+	default:
+		document.LastError = err.Error()
+		document.NextAttemptAt = int(now.Add(jobs.Backoff(document.Attempts, FIRST_RETRY_DELAY, MAX_RETRY_DELAY)).Unix())
+		if document.Attempts >= s.options.MaxAttempts {
+			document.Status = models.FISCAL_FAILED
+			slog.ErrorContext(c, "fiscal check failed", "reference", document.Reference, "attempts", document.Attempts, logging.Err(err))
+		}
+	}
+	return s.options.FiscalRepo.Update(c, document)
+}
+
+func (s *defaultFiscalService) ProcessDue(c context.Context) error {
+	now := time.Now()
+	documents, err := s.options.FiscalRepo.ClaimDue(c, int(now.Unix()), int(now.Add(CLAIM_LEASE).Unix()), PROCESS_BATCH)
+	if err != nil {
+		return err
+	}
+	for i := range documents {
+		// one failing document must not hold up the others, it is picked up again when its claim runs out
+		if err = s.process(c, &documents[i]); err != nil {
+			slog.ErrorContext(c, "processing fiscal check failed", "reference", documents[i].Reference, logging.Err(err))
+		}
+	}
+	return nil
+}
+
+func (s *defaultFiscalService) Run(c context.Context, interval time.Duration) {
+	jobs.Every(c, interval, "processing fiscal checks", s.ProcessDue)
+}
+
+// NewProvider picks the provider by name, nil when the name is empty and fiscalization is off
+func NewProvider(name string) (Provider, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "stub":
+		return NewStubProvider(), nil
+	}
+	return nil, fmt.Errorf("unknown provider %q", name)
+}
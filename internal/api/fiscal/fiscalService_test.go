@@ -0,0 +1,363 @@
+package fiscal
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+	"palyvoua/internal/models"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testCashRegister = "4000123456"
+
+// memoryFiscalRepo keeps documents in memory, due ones are found like the mongo repo finds them
+type memoryFiscalRepo struct {
+	mu sync.Mutex
+	documents map[uuid.UUID]models.FiscalDocument
+}
+
+func newMemoryFiscalRepo() *memoryFiscalRepo {
+	return &memoryFiscalRepo{documents: map[uuid.UUID]models.FiscalDocument{}}
+}
+
+func (m *memoryFiscalRepo) Save(c context.Context, document *models.FiscalDocument) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.documents[document.ID] = *document
+	return nil
+}
+
+func (m *memoryFiscalRepo) GetByID(c context.Context, id uuid.UUID) (models.FiscalDocument, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	document, ok := m.documents[id]
+	if !ok {
+		return models.FiscalDocument{}, mongo.ErrNoDocuments
+	}
+	return document, nil
+}
+
+func (m *memoryFiscalRepo) GetByReference(c context.Context, reference string) (models.FiscalDocument, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, document := range m.documents {
+		if document.Reference == reference {
+			return document, nil
+		}
+	}
+	return models.FiscalDocument{}, mongo.ErrNoDocuments
+}
+
+func (m *memoryFiscalRepo) GetByStatus(c context.Context, status string, limit int) ([]models.FiscalDocument, error) {
+	return m.find(func(document *models.FiscalDocument) bool { return document.Status == status }, limit), nil
+}
+
+func (m *memoryFiscalRepo) ClaimDue(c context.Context, now int, until int, limit int) ([]models.FiscalDocument, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	claimed := m.findLocked(func(document *models.FiscalDocument) bool {
+		return (document.Status == models.FISCAL_PENDING || document.Status == models.FISCAL_OFFLINE) && document.NextAttemptAt <= now
+	}, limit)
+	for i := range claimed {
+		claimed[i].NextAttemptAt = until
+		m.documents[claimed[i].ID] = claimed[i]
+	}
+	return claimed, nil
+}
+
+func (m *memoryFiscalRepo) Update(c context.Context, document *models.FiscalDocument) error {
+	return m.Save(c, document)
+}
+
+func (m *memoryFiscalRepo) find(match func(document *models.FiscalDocument) bool, limit int) []models.FiscalDocument {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.findLocked(match, limit)
+}
+
+func (m *memoryFiscalRepo) findLocked(match func(document *models.FiscalDocument) bool, limit int) []models.FiscalDocument {
+	found := []models.FiscalDocument{}
+	for _, document := range m.documents {
+		if match(&document) {
+			found = append(found, document)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Reference < found[j].Reference })
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	return found
+}
+
+// makeDue brings the next attempt of every document forward, as if their retry delay had passed
+func (m *memoryFiscalRepo) makeDue() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, document := range m.documents {
+		document.NextAttemptAt = 0
+		m.documents[id] = document
+	}
+}
+
+type memorySequences struct {
+	mu sync.Mutex
+	next map[string]int
+}
+
+func (m *memorySequences) NextSequence(c context.Context, name string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.next[name]++
+	return m.next[name], nil
+}
+
+func newTestService(t *testing.T, maxAttempts int) (FiscalService, *StubProvider, *memoryFiscalRepo) {
+	provider := NewStubProvider()
+	repo := newMemoryFiscalRepo()
+	service := NewFiscalService(FiscalServiceOptions{
+		FiscalRepo:     repo,
+		Provider:       provider,
+		Sequences:      &memorySequences{next: map[string]int{}},
+		CashRegisterID: testCashRegister,
+		MaxAttempts:    maxAttempts,
+	})
+	return service, provider, repo
+}
+
+// enqueue queues the check of a paid 1250.00 receipt, an empty one is rejected by the stub
+func enqueue(t *testing.T, service FiscalService, reference string, paid bool) *models.FiscalDocument {
+	t.Helper()
+	receipt := models.Receipt{ID: uuid.New(), Reference: reference, Currency: "UAH"}
+	if paid {
+		receipt.Total = 125000
+		receipt.Lines = []models.ReceiptLine{{ProductTicketID: uuid.New(), Title: "A-95, 25 l", Quantity: 1, UnitPrice: 125000, Gross: 125000, VATRate: 20, VAT: 20833}}
+	}
+	document, err := service.Enqueue(context.Background(), &receipt, models.FISCAL_PAYMENT_CARD)
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	return document
+}
+
+func get(t *testing.T, service FiscalService, reference string) models.FiscalDocument {
+	t.Helper()
+	document, err := service.GetByReference(context.Background(), reference)
+	if err != nil {
+		t.Fatalf("get %s: %v", reference, err)
+	}
+	return document
+}
+
+func processDue(t *testing.T, service FiscalService) {
+	t.Helper()
+	if err := service.ProcessDue(context.Background()); err != nil {
+		t.Fatalf("process: %v", err)
+	}
+}
+
+func TestProcessOnline(t *testing.T) {
+	service, _, _ := newTestService(t, 0)
+	enqueue(t, service, "pi_online", true)
+	processDue(t, service)
+
+	document := get(t, service, "pi_online")
+	if document.Status != models.FISCAL_DONE || document.FiscalNumber != "STUB0000000001" || document.OfflineNumber != "" {
+		t.Fatalf("document = %+v, want done with the stub's first number", document)
+	}
+	if !strings.Contains(document.QR, "id=STUB0000000001") || !strings.Contains(document.QR, "fn="+testCashRegister) || !strings.Contains(document.QR, "sm=1250.00") {
+		t.Fatalf("QR = %q, want the tax office link of the fiscal number", document.QR)
+	}
+	if document.Attempts != 1 || document.LastError != "" || document.FiscalizedAt == 0 {
+		t.Fatalf("document = %+v, want one clean attempt", document)
+	}
+}
+
+func TestProcessOffline(t *testing.T) {
+	service, provider, repo := newTestService(t, 0)
+	provider.SetAvailable(false)
+	for _, reference := range []string{"pi_1", "pi_2", "pi_3"} {
+		enqueue(t, service, reference, true)
+	}
+	processDue(t, service)
+
+	qrs := map[string]string{}
+	for i, reference := range []string{"pi_1", "pi_2", "pi_3"} {
+		document := get(t, service, reference)
+		want := fmt.Sprintf("%s-OFF-%d", testCashRegister, i+1)
+		if document.Status != models.FISCAL_OFFLINE || document.OfflineNumber != want {
+			t.Fatalf("%s: status %s, offline number %q, want offline as %q", reference, document.Status, document.OfflineNumber, want)
+		}
+		if !strings.Contains(document.QR, "id="+want) {
+			t.Fatalf("%s: QR = %q, want the link of the offline number", reference, document.QR)
+		}
+		if document.LastError == "" || document.NextAttemptAt <= int(time.Now().Unix()) {
+			t.Fatalf("%s: document = %+v, want a later attempt", reference, document)
+		}
+		qrs[reference] = document.QR
+	}
+
+	// still down, the checks keep the numbers they were sold with
+	repo.makeDue()
+	processDue(t, service)
+	if document := get(t, service, "pi_2"); document.OfflineNumber != testCashRegister+"-OFF-2" || document.Attempts != 2 {
+		t.Fatalf("document = %+v, want its offline number kept over a second attempt", document)
+	}
+
+	provider.SetAvailable(true)
+	repo.makeDue()
+	processDue(t, service)
+	for _, reference := range []string{"pi_1", "pi_2", "pi_3"} {
+		document := get(t, service, reference)
+		if document.Status != models.FISCAL_DONE || !strings.HasPrefix(document.FiscalNumber, "STUB") {
+			t.Fatalf("%s: document = %+v, want delivered", reference, document)
+		}
+		if document.QR != qrs[reference] {
+			t.Fatalf("%s: QR = %q, want the offline link %q printed on the sold check", reference, document.QR, qrs[reference])
+		}
+	}
+}
+
+func TestEnqueueDuringKnownOutage(t *testing.T) {
+	service, provider, _ := newTestService(t, 0)
+	provider.SetAvailable(false)
+	enqueue(t, service, "pi_1", true)
+	processDue(t, service)
+
+	// the outage is known now, the next check is sold offline before any attempt
+	document := enqueue(t, service, "pi_2", true)
+	want := testCashRegister + "-OFF-2"
+	if document.Status != models.FISCAL_OFFLINE || document.OfflineNumber != want || document.Attempts != 0 {
+		t.Fatalf("document = %+v, want offline as %q when enqueued", document, want)
+	}
+	if !strings.Contains(document.QR, "id="+want) {
+		t.Fatalf("QR = %q, want the link of the offline number", document.QR)
+	}
+
+	// once a check is delivered the outage is over and checks are pending again
+	provider.SetAvailable(true)
+	processDue(t, service)
+	if document = enqueue(t, service, "pi_3", true); document.Status != models.FISCAL_PENDING || document.OfflineNumber != "" {
+		t.Fatalf("document = %+v, want pending after the outage", document)
+	}
+}
+
+// countingProvider counts the submits of every document
+type countingProvider struct {
+	*StubProvider
+	mu sync.Mutex
+	submits map[string]int
+}
+
+func (p *countingProvider) Submit(c context.Context, document *models.FiscalDocument) (*Result, error) {
+	p.mu.Lock()
+	p.submits[document.Reference]++
+	p.mu.Unlock()
+	return p.StubProvider.Submit(c, document)
+}
+
+func TestProcessDueClaimsDocuments(t *testing.T) {
+	provider := &countingProvider{StubProvider: NewStubProvider(), submits: map[string]int{}}
+	repo := newMemoryFiscalRepo()
+	options := FiscalServiceOptions{
+		FiscalRepo:     repo,
+		Provider:       provider,
+		Sequences:      &memorySequences{next: map[string]int{}},
+		CashRegisterID: testCashRegister,
+	}
+	// two instances share the queue
+	instances := []FiscalService{NewFiscalService(options), NewFiscalService(options)}
+	references := []string{}
+	for i := 0; i < 20; i++ {
+		references = append(references, fmt.Sprintf("pi_%02d", i))
+		enqueue(t, instances[0], references[i], true)
+	}
+
+	var wg sync.WaitGroup
+	for _, instance := range instances {
+		wg.Add(1)
+		go func(instance FiscalService) {
+			defer wg.Done()
+			if err := instance.ProcessDue(context.Background()); err != nil {
+				t.Errorf("process: %v", err)
+			}
+		}(instance)
+	}
+	wg.Wait()
+
+	for _, reference := range references {
+		if submits := provider.submits[reference]; submits != 1 {
+			t.Fatalf("%s submitted %d times, want once", reference, submits)
+		}
+		if document := get(t, instances[0], reference); document.Status != models.FISCAL_DONE {
+			t.Fatalf("%s: document = %+v, want done", reference, document)
+		}
+	}
+}
+
+func TestProcessFailedAndRetry(t *testing.T) {
+	service, _, repo := newTestService(t, 3)
+	document := enqueue(t, service, "pi_rejected", false)
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		repo.makeDue()
+		processDue(t, service)
+		got := get(t, service, "pi_rejected")
+		want := models.FISCAL_PENDING
+		if attempt == 3 {
+			want = models.FISCAL_FAILED
+		}
+		if got.Status != want || got.Attempts != attempt || got.LastError == "" {
+			t.Fatalf("after attempt %d: document = %+v, want %s", attempt, got, want)
+		}
+	}
+	// a failed document is not picked up again on its own
+	repo.makeDue()
+	processDue(t, service)
+	if got := get(t, service, "pi_rejected"); got.Attempts != 3 {
+		t.Fatalf("failed document attempted again, %d attempts", got.Attempts)
+	}
+
+	retried, err := service.Retry(context.Background(), document.ID)
+	if err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if retried.Status != models.FISCAL_PENDING || retried.Attempts != 0 {
+		t.Fatalf("retried = %+v, want pending with no attempts", retried)
+	}
+	if _, err = service.Retry(context.Background(), document.ID); err != ErrNotFailed {
+		t.Fatalf("retrying a pending document: %v, want ErrNotFailed", err)
+	}
+	processDue(t, service)
+	if got := get(t, service, "pi_rejected"); got.Status != models.FISCAL_PENDING || got.Attempts != 1 {
+		t.Fatalf("document = %+v, want attempted again after the retry", got)
+	}
+}
+
+func TestRetryOfflineDocument(t *testing.T) {
+	service, provider, repo := newTestService(t, 1)
+	provider.SetAvailable(false)
+	document := enqueue(t, service, "pi_offline", false)
+	processDue(t, service)
+
+	// the outage is over but the check is rejected, it fails with its offline number
+	provider.SetAvailable(true)
+	repo.makeDue()
+	processDue(t, service)
+	failed := get(t, service, "pi_offline")
+	if failed.Status != models.FISCAL_FAILED || failed.OfflineNumber == "" {
+		t.Fatalf("document = %+v, want failed with its offline number", failed)
+	}
+
+	retried, err := service.Retry(context.Background(), document.ID)
+	if err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if retried.Status != models.FISCAL_OFFLINE || retried.OfflineNumber != failed.OfflineNumber || retried.QR != failed.QR {
+		t.Fatalf("retried = %+v, want offline again with the number and QR it was sold with", retried)
+	}
+}
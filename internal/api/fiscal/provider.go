@@ -0,0 +1,59 @@
+package fiscal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"palyvoua/internal/models"
+	"sync"
+	"time"
+)
+
+// ErrUnavailable is returned by providers that couldn't reach the tax service, the document
+// then goes offline and is delivered later. Any other error is a rejection of the document.
+var ErrUnavailable = errors.New("fiscal service unavailable")
+
+type Result struct {
+	FiscalNumber string
+	// QR is the verification link, empty lets the service build the tax office one
+	QR string
+	FiscalizedAt int
+}
+
+// Provider registers checks through a PRRO, the software cash register of the tax service.
+// A document with an OfflineNumber was sold during an outage and must be delivered as an offline check.
+type Provider interface {
+	Submit(c context.Context, document *models.FiscalDocument) (*Result, error)
+}
+
+// StubProvider fiscalizes locally without a tax service, for development and tests
+type StubProvider struct {
+	mu sync.Mutex
+	next int
+	unavailable bool
+}
+
+func NewStubProvider() *StubProvider {
+	return &StubProvider{next: 1}
+}
+
+// SetAvailable simulates an outage of the tax service
+func (p *StubProvider) SetAvailable(available bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.unavailable = !available
+}
+
+func (p *StubProvider) Submit(c context.Context, document *models.FiscalDocument) (*Result, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.unavailable {
+		return nil, ErrUnavailable
+	}
+	if len(document.Lines) == 0 || document.Total <= 0 {
+		return nil, fmt.Errorf("check has no paid lines")
+	}
+	number := fmt.Sprintf("STUB%010d", p.next)
+	p.next++
+	return &Result{FiscalNumber: number, FiscalizedAt: int(time.Now().Unix())}, nil
+}
@@ -0,0 +1,107 @@
+package health
+
+import (
+	"context"
+	"log/slog"
+	"palyvoua/tools/logging"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	STATUS_UP = "up"
+	STATUS_DOWN = "down"
+	// STATUS_DRAINING is reported once shutdown has started, while requests in flight finish
+	STATUS_DRAINING = "draining"
+
+	DEFAULT_TIMEOUT = 3 * time.Second
+)
+
+// Check tells whether a dependency can be used, it gives up when c is done
+type Check func(c context.Context) error
+
+type HealthServiceOptions struct {
+	// Checks are the dependencies the api cannot serve without, by name
+	Checks map[string]Check
+	// Timeout bounds a readiness check as a whole, a check still running by then is down
+	Timeout time.Duration
+}
+
+// Report is the outcome of a readiness check, the errors of failing checks are logged, not reported
+type Report struct {
+	Status string `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// HealthService tells load balancers and orchestrators whether the api should get traffic
+type HealthService interface {
+	// Ready runs the checks at once, the api is up when all of them pass
+	Ready(c context.Context) Report
+	// Drain makes every later Ready report STATUS_DRAINING
+	Drain()
+}
+
+func NewHealthService(options HealthServiceOptions) HealthService {
+	if options.Timeout <= 0 {
+		options.Timeout = DEFAULT_TIMEOUT
+	}
+	return &defaultHealthService{options: options}
+}
+
+type defaultHealthService struct {
+	options HealthServiceOptions
+	draining atomic.Bool
+}
+
+func (s *defaultHealthService) Ready(c context.Context) Report {
+	if s.draining.Load() {
+		return Report{Status: STATUS_DRAINING}
+	}
+	c, cancel := context.WithTimeout(c, s.options.Timeout)
+	defer cancel()
+
+	report := Report{Status: STATUS_UP, Checks: make(map[string]string, len(s.options.Checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range s.options.Checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			status := STATUS_UP
+			if err := check(c); err != nil {
+				slog.WarnContext(c, "health check failed", "check", name, logging.Err(err))
+				status = STATUS_DOWN
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = status
+			if status == STATUS_DOWN {
+				report.Status = STATUS_DOWN
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	return report
+}
+
+func (s *defaultHealthService) Drain() {
+	s.draining.Store(true)
+}
+
+// Cached reuses the outcome of check for ttl, for dependencies that should not be called on every probe
+func Cached(check Check, ttl time.Duration) Check {
+	var mu sync.Mutex
+	var checkedAt time.Time
+	var last error
+	return func(c context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !checkedAt.IsZero() && time.Since(checkedAt) < ttl {
+			return last
+		}
+		last = check(c)
+		checkedAt = time.Now()
+		return last
+	}
+}
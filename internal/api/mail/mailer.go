@@ -0,0 +1,20 @@
+package mail
+
+import "log/slog"
+
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// NewLogMailer returns a mailer that only writes messages to the log, for local development
+func NewLogMailer() Mailer {
+	return &logMailer{}
+}
+
+type logMailer struct {
+}
+
+func (m *logMailer) Send(to string, subject string, body string) error {
+	slog.Info("mail", "email", to, "subject", subject, "body", body)
+	return nil
+}
@@ -0,0 +1,97 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"palyvoua/internal/api/mail"
+	"palyvoua/internal/models"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Channel delivers rendered notifications, an error leaves the notification queued for a retry
+type Channel interface {
+	Send(c context.Context, notification *models.Notification) error
+}
+
+// NewEmailChannel sends through the mailer the rest of the app uses
+func NewEmailChannel(mailer mail.Mailer) Channel {
+	return &emailChannel{mailer: mailer}
+}
+
+type emailChannel struct {
+	mailer mail.Mailer
+}
+
+func (e *emailChannel) Send(c context.Context, notification *models.Notification) error {
+	return e.mailer.Send(notification.Recipient, notification.Subject, notification.Body)
+}
+
+// NewLogChannel only writes notifications to the log, for local development
+func NewLogChannel(name string) Channel {
+	return &logChannel{name: name}
+}
+
+type logChannel struct {
+	name string
+}
+
+func (l *logChannel) Send(c context.Context, notification *models.Notification) error {
+	// the keys tell the logger what to mask
+	recipient := slog.String("recipient", notification.Recipient)
+	switch notification.Channel {
+	case models.CHANNEL_SMS:
+		recipient = slog.String("phone", notification.Recipient)
+	case models.CHANNEL_PUSH:
+		recipient = slog.String("push_token", notification.Recipient)
+	}
+	slog.InfoContext(c, l.name+" notification", recipient, "subject", notification.Subject, "body", notification.Body)
+	return nil
+}
+
+// NewFileChannel appends notifications as json lines to a file, for local development and tests
+func NewFileChannel(path string) Channel {
+	return &fileChannel{path: path}
+}
+
+type fileChannel struct {
+	mu sync.Mutex
+	path string
+}
+
+func (f *fileChannel) Send(c context.Context, notification *models.Notification) error {
+	line, err := json.Marshal(struct {
+		*models.Notification
+		WrittenAt int `json:"writtenAt"`
+	}{notification, int(time.Now().Unix())})
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// NewChannels writes SMS and push to files in sinkDir when it is set and to the log otherwise,
+// there is no SMS or push gateway yet
+func NewChannels(mailer mail.Mailer, sinkDir string) map[string]Channel {
+	channels := map[string]Channel{
+		models.CHANNEL_EMAIL: NewEmailChannel(mailer),
+		models.CHANNEL_SMS:   NewLogChannel("sms"),
+		models.CHANNEL_PUSH:  NewLogChannel("push"),
+	}
+	if sinkDir != "" {
+		channels[models.CHANNEL_SMS] = NewFileChannel(filepath.Join(sinkDir, "sms.jsonl"))
+		channels[models.CHANNEL_PUSH] = NewFileChannel(filepath.Join(sinkDir, "push.jsonl"))
+	}
+	return channels
+}
@@ -0,0 +1,262 @@
+package notification
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"log/slog"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/jobs"
+	"palyvoua/tools/logging"
+	"slices"
+	"time"
+)
+
+const (
+	FIRST_RETRY_DELAY = 30 * time.Second
+	MAX_RETRY_DELAY = time.Hour
+	DEFAULT_MAX_ATTEMPTS = 10
+	DEFAULT_EXPIRY_NOTICE = 48 * time.Hour
+	PROCESS_BATCH = 100
+	DATE_FORMAT = "02.01.2006 15:04"
+)
+
+type userGetter interface {
+	GetByID(c context.Context, id uuid.UUID) (models.User, error)
+}
+
+type productTicketGetter interface {
+	GetByID(c context.Context, id uuid.UUID) (models.ProductTicket, error)
+}
+
+type expiringTickets interface {
+	GetExpiring(c context.Context, from int, to int) ([]models.Ticket, error)
+}
+
+// TicketNotice is an event that happened to tickets, they may belong to several users
+type TicketNotice struct {
+	Event string
+	// Key identifies the event, a notice with a key that was already notified is dropped
+	Key string
+	Tickets []models.Ticket
+	// Amount and Currency are the money a refund paid back
+	Amount int
+	Currency string
+}
+
+type NotificationService interface {
+	// NotifyTickets queues the messages of a notice on every channel the owners have enabled
+	NotifyTickets(c context.Context, notice TicketNotice) error
+	// RemindExpiring queues a reminder for the tickets expiring within the notice period
+	RemindExpiring(c context.Context) error
+	// ProcessDue sends the queued messages whose attempt is due
+	ProcessDue(c context.Context) error
+	Run(c context.Context, interval time.Duration)
+}
+
+type NotificationServiceOptions struct {
+	NotificationRepo repository.NotificationRepo
+	UserRepo userGetter
+	ProductTicketRepo productTicketGetter
+	TicketRepo expiringTickets
+	Channels map[string]Channel
+	// ExpiryNotice is how long before a ticket expires its owner is reminded
+	ExpiryNotice time.Duration
+	MaxAttempts int
+}
+
+func NewNotificationService(options NotificationServiceOptions) NotificationService {
+	if options.ExpiryNotice == 0 {
+		options.ExpiryNotice = DEFAULT_EXPIRY_NOTICE
+	}
+	if options.MaxAttempts == 0 {
+		options.MaxAttempts = DEFAULT_MAX_ATTEMPTS
+	}
+	return &defaultNotificationService{options: options}
+}
+
+type defaultNotificationService struct {
+	options NotificationServiceOptions
+}
+
+func formatAmount(amount int, currency string) string {
+	return fmt.Sprintf("%d.%02d %s", amount/100, amount%100, currency)
+}
+
+func formatTime(at int) string {
+	return time.Unix(int64(at), 0).Format(DATE_FORMAT)
+}
+
+func (s *defaultNotificationService) templateData(c context.Context, notice TicketNotice, tickets []models.Ticket) (TemplateData, error) {
+	productTicket, err := s.options.ProductTicketRepo.GetByID(c, tickets[0].ProductTicketID)
+	if err != nil {
+		return TemplateData{}, err
+	}
+	data := TemplateData{
+		Title:  productTicket.Title,
+		Count:  len(tickets),
+		At:     formatTime(int(time.Now().Unix())),
+		Amount: formatAmount(notice.Amount, notice.Currency),
+	}
+	expiresAt := tickets[0].ExpiresAt
+	for _, ticket := range tickets {
+		data.Liters += ticket.Amount
+		expiresAt = min(expiresAt, ticket.ExpiresAt)
+	}
+	data.ExpiresAt = formatTime(expiresAt)
+	return data, nil
+}
+
+// recipients lists every address of the user on the channels they did not disable
+func (s *defaultNotificationService) recipients(user *models.User) map[string][]string {
+	recipients := map[string][]string{}
+	if user.Email != "" {
+		recipients[models.CHANNEL_EMAIL] = []string{user.Email}
+	}
+	if user.Phone != "" {
+		recipients[models.CHANNEL_SMS] = []string{user.Phone}
+	}
+	if len(user.Notifications.PushTokens) > 0 {
+		recipients[models.CHANNEL_PUSH] = user.Notifications.PushTokens
+	}
+	for _, channel := range user.Notifications.DisabledChannels {
+		delete(recipients, channel)
+	}
+	for channel := range recipients {
+		if _, ok := s.options.Channels[channel]; !ok {
+			delete(recipients, channel)
+		}
+	}
+	return recipients
+}
+
+func (s *defaultNotificationService) NotifyTickets(c context.Context, notice TicketNotice) error {
+	byUser := map[uuid.UUID][]models.Ticket{}
+	for _, ticket := range notice.Tickets {
+		// fleet tickets waiting for a driver have no one to tell
+		if ticket.UserId == uuid.Nil {
+			continue
+		}
+		byUser[ticket.UserId] = append(byUser[ticket.UserId], ticket)
+	}
+	for userID, tickets := range byUser {
+		key := notice.Key + ":" + userID.String()
+		exists, err := s.options.NotificationRepo.ExistsByKey(c, key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		user, err := s.options.UserRepo.GetByID(c, userID)
+		if err != nil {
+			return err
+		}
+		if user.Deletion.DeletedAt != 0 {
+			continue
+		}
+		data, err := s.templateData(c, notice, tickets)
+		if err != nil {
+			return err
+		}
+		subject, body, err := render(notice.Event, user.PreferredLanguage, data)
+		if err != nil {
+			return err
+		}
+		now := int(time.Now().Unix())
+		notifications := []models.Notification{}
+		for channel, addresses := range s.recipients(&user) {
+			for _, recipient := range addresses {
+				notifications = append(notifications, models.Notification{
+					ID:            uuid.New(),
+					UserID:        userID,
+					Event:         notice.Event,
+					Key:           key,
+					Channel:       channel,
+					Recipient:     recipient,
+					Language:      user.PreferredLanguage,
+					Subject:       subject,
+					Body:          body,
+					Status:        models.NOTIFICATION_PENDING,
+					NextAttemptAt: now,
+					CreatedAt:     now,
+				})
+			}
+		}
+		if err = s.options.NotificationRepo.SaveAll(c, notifications); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *defaultNotificationService) RemindExpiring(c context.Context) error {
+	now := time.Now()
+	tickets, err := s.options.TicketRepo.GetExpiring(c, int(now.Unix()), int(now.Add(s.options.ExpiryNotice).Unix()))
+	if err != nil {
+		return err
+	}
+	for _, ticket := range tickets {
+		notice := TicketNotice{
+			Event:   models.NOTIFY_TICKET_EXPIRING,
+			Key:     "expiring:" + ticket.ID.String(),
+			Tickets: []models.Ticket{ticket},
+		}
+		if err = s.NotifyTickets(c, notice); err != nil {
+			slog.ErrorContext(c, "queueing expiry reminder failed", "ticket_id", ticket.ID, logging.Err(err))
+		}
+	}
+	return nil
+}
+
+func (s *defaultNotificationService) send(c context.Context, notification *models.Notification) error {
+	now := time.Now()
+	channel, ok := s.options.Channels[notification.Channel]
+	err := fmt.Errorf("no %s channel", notification.Channel)
+	if ok {
+		err = channel.Send(c, notification)
+	}
+	notification.Attempts++
+	if err == nil {
+		notification.Status = models.NOTIFICATION_SENT
+		notification.SentAt = int(now.Unix())
+		notification.LastError = ""
+	} else {
+		notification.LastError = err.Error()
+		notification.NextAttemptAt = int(now.Add(jobs.Backoff(notification.Attempts, FIRST_RETRY_DELAY, MAX_RETRY_DELAY)).Unix())
+		if notification.Attempts >= s.options.MaxAttempts {
+			notification.Status = models.NOTIFICATION_FAILED
+			slog.ErrorContext(c, "notification failed", "notification_id", notification.ID, "channel", notification.Channel, "attempts", notification.Attempts, logging.Err(err))
+		}
+	}
+	return s.options.NotificationRepo.Update(c, notification)
+}
+
+func (s *defaultNotificationService) ProcessDue(c context.Context) error {
+	notifications, err := s.options.NotificationRepo.GetDue(c, int(time.Now().Unix()), PROCESS_BATCH)
+	if err != nil {
+		return err
+	}
+	for i := range notifications {
+		if err = s.send(c, &notifications[i]); err != nil {
+			slog.ErrorContext(c, "sending notification failed", "notification_id", notifications[i].ID, logging.Err(err))
+		}
+	}
+	return nil
+}
+
+func (s *defaultNotificationService) Run(c context.Context, interval time.Duration) {
+	jobs.Every(c, interval, "sending notifications", func(c context.Context) error {
+		// reminders that failed to queue don't hold up the notifications already queued
+		if err := s.RemindExpiring(c); err != nil {
+			slog.ErrorContext(c, "queueing expiry reminders failed", logging.Err(err))
+		}
+		return s.ProcessDue(c)
+	})
+}
+
+// HasChannel reports whether channel is one users can turn off
+func HasChannel(channel string) bool {
+	return slices.Contains([]string{models.CHANNEL_EMAIL, models.CHANNEL_SMS, models.CHANNEL_PUSH}, channel)
+}
@@ -0,0 +1,89 @@
+package notification
+
+import (
+	"fmt"
+	"palyvoua/internal/models"
+	"strings"
+	"text/template"
+)
+
+// TemplateData is what the messages can mention
+type TemplateData struct {
+	Title string
+	// Count tickets holding Liters together
+	Count int
+	Liters int
+	ExpiresAt string
+	// At is when the event happened
+	At string
+	// Amount is formatted with its currency
+	Amount string
+}
+
+type messageTemplate struct {
+	subject *template.Template
+	body *template.Template
+}
+
+func newTemplate(subject string, body string) messageTemplate {
+	return messageTemplate{
+		subject: template.Must(template.New("subject").Parse(subject)),
+		body:    template.Must(template.New("body").Parse(body)),
+	}
+}
+
+// templates are keyed by event and then language, every event has both languages
+var templates = map[string]map[string]messageTemplate{
+	models.NOTIFY_TICKET_ISSUED: {
+		models.LANGUAGE_UK: newTemplate(
+			"Ваші талони готові",
+			"Видано талонів: {{.Count}} «{{.Title}}», разом {{.Liters}} л. Діють до {{.ExpiresAt}}."),
+		models.LANGUAGE_EN: newTemplate(
+			"Your tickets are ready",
+			"{{.Count}} {{if eq .Count 1}}ticket{{else}}tickets{{end}} for {{.Title}} issued, {{.Liters}} l in total. Valid until {{.ExpiresAt}}."),
+	},
+	models.NOTIFY_TICKET_EXPIRING: {
+		models.LANGUAGE_UK: newTemplate(
+			"Талон скоро згорить",
+			"Талон «{{.Title}}» на {{.Liters}} л діє до {{.ExpiresAt}}. Встигніть ним скористатися."),
+		models.LANGUAGE_EN: newTemplate(
+			"Your ticket expires soon",
+			"Your {{.Title}} ticket for {{.Liters}} l is valid until {{.ExpiresAt}}. Use it before then."),
+	},
+	models.NOTIFY_TICKET_REDEEMED: {
+		models.LANGUAGE_UK: newTemplate(
+			"Талон використано",
+			"Талон «{{.Title}}» на {{.Liters}} л використано {{.At}}."),
+		models.LANGUAGE_EN: newTemplate(
+			"Ticket redeemed",
+			"Your {{.Title}} ticket for {{.Liters}} l was redeemed on {{.At}}."),
+	},
+	models.NOTIFY_TICKET_REFUNDED: {
+		models.LANGUAGE_UK: newTemplate(
+			"Кошти за талон повернено",
+			"Кошти за талон «{{.Title}}» ({{.Amount}}) зараховано на ваш гаманець."),
+		models.LANGUAGE_EN: newTemplate(
+			"Ticket refunded",
+			"{{.Amount}} for your {{.Title}} ticket was credited to your wallet."),
+	},
+}
+
+// render falls back to Ukrainian for users without a language
+func render(event string, language string, data TemplateData) (string, string, error) {
+	byLanguage, ok := templates[event]
+	if !ok {
+		return "", "", fmt.Errorf("no template for %s", event)
+	}
+	message, ok := byLanguage[language]
+	if !ok {
+		message = byLanguage[models.LANGUAGE_UK]
+	}
+	var subject, body strings.Builder
+	if err := message.subject.Execute(&subject, data); err != nil {
+		return "", "", err
+	}
+	if err := message.body.Execute(&body, data); err != nil {
+		return "", "", err
+	}
+	return subject.String(), body.String(), nil
+}
@@ -0,0 +1,35 @@
+package oidc
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"strings"
+	"time"
+)
+
+const appleClientSecretExpiration = 5 * time.Minute
+
+// appleClientSecret signs the ES256 client secret apple expects instead of a static one
+func appleClientSecret(config ProviderConfig) (string, error) {
+	// env files usually carry the key on one line with escaped newlines
+	block, _ := pem.Decode([]byte(strings.ReplaceAll(config.ApplePrivateKey, `\n`, "\n")))
+	if block == nil {
+		return "", fmt.Errorf("invalid apple private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.RegisteredClaims{
+		Issuer:    config.AppleTeamID,
+		Subject:   config.ClientID,
+		Audience:  jwt.ClaimStrings{config.Issuer},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(appleClientSecretExpiration)),
+	})
+	token.Header["kid"] = config.AppleKeyID
+	return token.SignedString(key)
+}
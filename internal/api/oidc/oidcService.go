@@ -0,0 +1,223 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	gooidc "github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"sync"
+	"time"
+)
+
+const stateExpiration = 10 * time.Minute
+
+// Identity is what we learn about a user from a verified ID token
+type Identity struct {
+	Provider string
+	Subject string
+	Email string
+	EmailVerified bool
+	Name string
+}
+
+type OIDCService interface {
+	Providers() []string
+	// AuthCodeURL starts an authorization code flow with PKCE and returns where to send the user
+	AuthCodeURL(c context.Context, provider string) (string, error)
+	// Exchange trades the code for tokens and returns the identity from the verified ID token
+	Exchange(c context.Context, provider string, code string, state string) (*Identity, error)
+}
+
+type ProviderConfig struct {
+	Name string
+	Issuer string
+	ClientID string
+	ClientSecret string
+	RedirectURL string
+	// Scopes default to openid, email and profile, or name for apple
+	Scopes []string
+	// Apple signs no static client secret, it is a short-lived JWT built from these
+	AppleTeamID string
+	AppleKeyID string
+	ApplePrivateKey string
+}
+
+func NewOIDCService(configs []ProviderConfig, store StateStore) OIDCService {
+	s := defaultOIDCService{
+		configs:   map[string]ProviderConfig{},
+		providers: map[string]*gooidc.Provider{},
+		store:     store,
+	}
+	for _, config := range configs {
+		if len(config.Scopes) == 0 {
+			config.Scopes = []string{gooidc.ScopeOpenID, "email", "profile"}
+			if config.Name == "apple" {
+				// apple has no "profile" scope
+				config.Scopes = []string{gooidc.ScopeOpenID, "email", "name"}
+			}
+		}
+		s.configs[config.Name] = config
+	}
+	return &s
+}
+
+type defaultOIDCService struct {
+	configs map[string]ProviderConfig
+	// discovery documents are fetched on first use, so a provider being down doesn't stop startup
+	mu sync.Mutex
+	providers map[string]*gooidc.Provider
+	store StateStore
+}
+
+func (s *defaultOIDCService) Providers() []string {
+	var names []string
+	for name := range s.configs {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (s *defaultOIDCService) provider(c context.Context, name string) (*gooidc.Provider, ProviderConfig, error) {
+	config, ok := s.configs[name]
+	if !ok {
+		return nil, ProviderConfig{}, fmt.Errorf("unknown provider %q", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.providers[name]; ok {
+		return p, config, nil
+	}
+	// the provider keeps this context to refresh its keys later, a request context would be cancelled by then
+	p, err := gooidc.NewProvider(context.WithoutCancel(c), config.Issuer)
+	if err != nil {
+		return nil, ProviderConfig{}, err
+	}
+	s.providers[name] = p
+	return p, config, nil
+}
+
+func (s *defaultOIDCService) oauthConfig(p *gooidc.Provider, config ProviderConfig) (*oauth2.Config, error) {
+	clientSecret := config.ClientSecret
+	if config.AppleKeyID != "" {
+		var err error
+		clientSecret, err = appleClientSecret(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &oauth2.Config{
+		ClientID:     config.ClientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  config.RedirectURL,
+		Endpoint:     p.Endpoint(),
+		Scopes:       config.Scopes,
+	}, nil
+}
+
+func (s *defaultOIDCService) AuthCodeURL(c context.Context, provider string) (string, error) {
+	p, config, err := s.provider(c, provider)
+	if err != nil {
+		return "", err
+	}
+	oauthConfig, err := s.oauthConfig(p, config)
+	if err != nil {
+		return "", err
+	}
+	state, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	flow := PendingFlow{
+		Provider:     provider,
+		CodeVerifier: oauth2.GenerateVerifier(),
+		Nonce:        nonce,
+		ExpiresAt:    time.Now().Add(stateExpiration),
+	}
+	if err = s.store.Save(state, flow); err != nil {
+		return "", err
+	}
+	options := []oauth2.AuthCodeOption{
+		oauth2.S256ChallengeOption(flow.CodeVerifier),
+		gooidc.Nonce(nonce),
+	}
+	if provider == "apple" {
+		// apple only returns the email scope with form_post
+		options = append(options, oauth2.SetAuthURLParam("response_mode", "form_post"))
+	}
+	return oauthConfig.AuthCodeURL(state, options...), nil
+}
+
+// idTokenClaims accepts email_verified as a bool or as the "true" string apple sends
+type idTokenClaims struct {
+	Email string `json:"email"`
+	EmailVerified interface{} `json:"email_verified"`
+	Name string `json:"name"`
+}
+
+func (c idTokenClaims) emailVerified() bool {
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+func (s *defaultOIDCService) Exchange(c context.Context, provider string, code string, state string) (*Identity, error) {
+	flow, err := s.store.Take(state)
+	if err != nil {
+		return nil, err
+	}
+	if flow.Provider != provider || time.Now().After(flow.ExpiresAt) {
+		return nil, fmt.Errorf("invalid or expired state")
+	}
+	p, config, err := s.provider(c, provider)
+	if err != nil {
+		return nil, err
+	}
+	oauthConfig, err := s.oauthConfig(p, config)
+	if err != nil {
+		return nil, err
+	}
+	token, err := oauthConfig.Exchange(c, code, oauth2.VerifierOption(flow.CodeVerifier))
+	if err != nil {
+		return nil, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("no id_token in token response")
+	}
+	idToken, err := p.Verifier(&gooidc.Config{ClientID: config.ClientID}).Verify(c, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if idToken.Nonce != flow.Nonce {
+		return nil, fmt.Errorf("nonce mismatch")
+	}
+	var claims idTokenClaims
+	if err = idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	return &Identity{
+		Provider:      provider,
+		Subject:       idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.emailVerified(),
+		Name:          claims.Name,
+	}, nil
+}
+
+func randomString() (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
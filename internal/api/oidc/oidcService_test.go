@@ -0,0 +1,144 @@
+package oidc
+
+import (
+	"context"
+	"palyvoua/internal/api/oidc/oidctest"
+	"testing"
+	"time"
+)
+
+const clientID = "palyvo"
+
+func newTestService(t *testing.T) (*oidctest.Issuer, OIDCService, StateStore) {
+	issuer := oidctest.NewIssuer(t)
+	store := NewMemoryStateStore()
+	// both providers trust the same issuer, only the flow tells them apart
+	service := NewOIDCService([]ProviderConfig{
+		{Name: "mock", Issuer: issuer.URL, ClientID: clientID, ClientSecret: "secret", RedirectURL: "http://localhost/callback"},
+		{Name: "other", Issuer: issuer.URL, ClientID: clientID, ClientSecret: "secret", RedirectURL: "http://localhost/callback"},
+	}, store)
+	return issuer, service, store
+}
+
+func TestExchange(t *testing.T) {
+	user := oidctest.Claims{Subject: "sub-1", Email: "user@example.com", EmailVerified: true, Name: "User"}
+
+	tests := []struct {
+		name string
+		// exchange starts flows at the issuer and returns what the callback would get
+		exchange func(t *testing.T, issuer *oidctest.Issuer, service OIDCService, store StateStore) (*Identity, error)
+		want *Identity
+	}{
+		{
+			name: "verified identity",
+			exchange: func(t *testing.T, issuer *oidctest.Issuer, service OIDCService, store StateStore) (*Identity, error) {
+				code, state := authorize(t, issuer, service, "mock", user)
+				return service.Exchange(context.Background(), "mock", code, state)
+			},
+			want: &Identity{Provider: "mock", Subject: "sub-1", Email: "user@example.com", EmailVerified: true, Name: "User"},
+		},
+		{
+			name: "unverified email is reported",
+			exchange: func(t *testing.T, issuer *oidctest.Issuer, service OIDCService, store StateStore) (*Identity, error) {
+				code, state := authorize(t, issuer, service, "mock", oidctest.Claims{Subject: "sub-2", Email: "new@example.com"})
+				return service.Exchange(context.Background(), "mock", code, state)
+			},
+			want: &Identity{Provider: "mock", Subject: "sub-2", Email: "new@example.com"},
+		},
+		{
+			name: "unknown state",
+			exchange: func(t *testing.T, issuer *oidctest.Issuer, service OIDCService, store StateStore) (*Identity, error) {
+				code, _ := authorize(t, issuer, service, "mock", user)
+				return service.Exchange(context.Background(), "mock", code, "forged")
+			},
+		},
+		{
+			name: "state used twice",
+			exchange: func(t *testing.T, issuer *oidctest.Issuer, service OIDCService, store StateStore) (*Identity, error) {
+				code, state := authorize(t, issuer, service, "mock", user)
+				if _, err := service.Exchange(context.Background(), "mock", code, state); err != nil {
+					t.Fatalf("first exchange: %v", err)
+				}
+				return service.Exchange(context.Background(), "mock", code, state)
+			},
+		},
+		{
+			name: "state of another provider",
+			exchange: func(t *testing.T, issuer *oidctest.Issuer, service OIDCService, store StateStore) (*Identity, error) {
+				code, state := authorize(t, issuer, service, "mock", user)
+				return service.Exchange(context.Background(), "other", code, state)
+			},
+		},
+		{
+			name: "expired state",
+			exchange: func(t *testing.T, issuer *oidctest.Issuer, service OIDCService, store StateStore) (*Identity, error) {
+				code, state := authorize(t, issuer, service, "mock", user)
+				flow, err := store.Take(state)
+				if err != nil {
+					t.Fatal(err)
+				}
+				flow.ExpiresAt = time.Now().Add(-time.Second)
+				store.Save(state, flow)
+				return service.Exchange(context.Background(), "mock", code, state)
+			},
+		},
+		{
+			name: "code verifier of another flow",
+			exchange: func(t *testing.T, issuer *oidctest.Issuer, service OIDCService, store StateStore) (*Identity, error) {
+				code, _ := authorize(t, issuer, service, "mock", user)
+				_, otherState := authorize(t, issuer, service, "mock", user)
+				return service.Exchange(context.Background(), "mock", code, otherState)
+			},
+		},
+		{
+			name: "nonce of another flow",
+			exchange: func(t *testing.T, issuer *oidctest.Issuer, service OIDCService, store StateStore) (*Identity, error) {
+				claims := user
+				claims.Nonce = "replayed"
+				code, state := authorize(t, issuer, service, "mock", claims)
+				return service.Exchange(context.Background(), "mock", code, state)
+			},
+		},
+		{
+			name: "token for another client",
+			exchange: func(t *testing.T, issuer *oidctest.Issuer, service OIDCService, store StateStore) (*Identity, error) {
+				claims := user
+				claims.Audience = "someone-else"
+				code, state := authorize(t, issuer, service, "mock", claims)
+				return service.Exchange(context.Background(), "mock", code, state)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer, service, store := newTestService(t)
+			identity, err := tt.exchange(t, issuer, service, store)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("exchange succeeded with %+v, want an error", identity)
+				}
+				t.Logf("rejected: %v", err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("exchange: %v", err)
+			}
+			if *identity != *tt.want {
+				t.Fatalf("identity = %+v, want %+v", identity, tt.want)
+			}
+		})
+	}
+}
+
+func authorize(t *testing.T, issuer *oidctest.Issuer, service OIDCService, provider string, claims oidctest.Claims) (string, string) {
+	t.Helper()
+	authURL, err := service.AuthCodeURL(context.Background(), provider)
+	if err != nil {
+		t.Fatalf("auth code URL: %v", err)
+	}
+	code, state, err := issuer.Authorize(authURL, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, state
+}
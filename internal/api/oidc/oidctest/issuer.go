@@ -0,0 +1,176 @@
+// Package oidctest runs a local OpenID provider, so sign in can be tested without google or apple
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+const keyID = "oidctest"
+
+// Claims are what the user signing in tells the provider. Audience and Nonce override what goes in the ID token,
+// to hand out tokens meant for another client or another flow.
+type Claims struct {
+	Subject string
+	Email string
+	EmailVerified bool
+	Name string
+	Audience string
+	Nonce string
+}
+
+// Issuer serves discovery, its JWKS and a token endpoint that checks PKCE before handing out a signed ID token
+type Issuer struct {
+	URL string
+	server *httptest.Server
+	key *rsa.PrivateKey
+	mu sync.Mutex
+	grants map[string]grant
+}
+
+type grant struct {
+	clientID string
+	challenge string
+	nonce string
+	claims Claims
+}
+
+// NewIssuer starts an issuer that is closed when t ends
+func NewIssuer(t testing.TB) *Issuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &Issuer{key: key, grants: map[string]grant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/keys", issuer.keys)
+	mux.HandleFunc("/token", issuer.token)
+	issuer.server = httptest.NewServer(mux)
+	issuer.URL = issuer.server.URL
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+// Authorize does what the provider's sign in page does with an auth code URL, it returns the code and state
+// the provider would redirect back with
+func (i *Issuer) Authorize(authURL string, claims Claims) (string, string, error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", "", err
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		return "", "", fmt.Errorf("auth URL has no S256 code challenge")
+	}
+	code := randomString()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.grants[code] = grant{
+		clientID:  query.Get("client_id"),
+		challenge: query.Get("code_challenge"),
+		nonce:     query.Get("nonce"),
+		claims:    claims,
+	}
+	return code, query.Get("state"), nil
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, map[string]interface{}{
+		"issuer":                                i.URL,
+		"authorization_endpoint":                i.URL + "/authorize",
+		"token_endpoint":                        i.URL + "/token",
+		"jwks_uri":                              i.URL + "/keys",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (i *Issuer) keys(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(i.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(i.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, 400, map[string]string{"error": "invalid_request"})
+		return
+	}
+	i.mu.Lock()
+	code := r.PostForm.Get("code")
+	g, ok := i.grants[code]
+	delete(i.grants, code)
+	i.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != g.challenge {
+		writeJSON(w, 400, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	audience := g.clientID
+	if g.claims.Audience != "" {
+		audience = g.claims.Audience
+	}
+	nonce := g.nonce
+	if g.claims.Nonce != "" {
+		nonce = g.claims.Nonce
+	}
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            i.URL,
+		"sub":            g.claims.Subject,
+		"aud":            audience,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          nonce,
+		"email":          g.claims.Email,
+		"email_verified": g.claims.EmailVerified,
+		"name":           g.claims.Name,
+	})
+	idToken.Header["kid"] = keyID
+	signed, err := idToken.SignedString(i.key)
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, 200, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     signed,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func randomString() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
@@ -0,0 +1,56 @@
+package oidc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PendingFlow is remembered between the redirect to the provider and the callback
+type PendingFlow struct {
+	Provider string
+	CodeVerifier string
+	Nonce string
+	ExpiresAt time.Time
+}
+
+// StateStore keeps pending flows by their state parameter. The in-memory store is enough for a
+// single node, a shared store is needed once the callback can land on another instance.
+type StateStore interface {
+	Save(state string, flow PendingFlow) error
+	// Take returns the flow and forgets it, a state can only be used once
+	Take(state string) (PendingFlow, error)
+}
+
+func NewMemoryStateStore() StateStore {
+	return &memoryStateStore{entries: map[string]PendingFlow{}}
+}
+
+type memoryStateStore struct {
+	mu sync.Mutex
+	entries map[string]PendingFlow
+}
+
+func (m *memoryStateStore) Save(state string, flow PendingFlow) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for key, pending := range m.entries {
+		if pending.ExpiresAt.Before(now) {
+			delete(m.entries, key)
+		}
+	}
+	m.entries[state] = flow
+	return nil
+}
+
+func (m *memoryStateStore) Take(state string) (PendingFlow, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	flow, ok := m.entries[state]
+	if !ok {
+		return PendingFlow{}, fmt.Errorf("unknown state")
+	}
+	delete(m.entries, state)
+	return flow, nil
+}
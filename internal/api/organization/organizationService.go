@@ -0,0 +1,520 @@
+package organization
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RejectedError is a request the organization can't take, its reason is safe to show the member
+type RejectedError struct {
+	Reason string
+}
+
+func (e RejectedError) Error() string {
+	return e.Reason
+}
+
+var (
+	ErrNotMember = errors.New("not a member of the organization")
+	ErrNotManager = errors.New("only managers can do this")
+
+	ErrUnknownUser = RejectedError{Reason: "no user with this email"}
+	ErrAlreadyMember = RejectedError{Reason: "user is already a member"}
+	ErrUnknownRole = RejectedError{Reason: "role must be manager or driver"}
+	ErrLastManager = RejectedError{Reason: "an organization keeps at least one manager"}
+	ErrNotDriver = RejectedError{Reason: "tickets can only be allocated to drivers of the organization"}
+	ErrTicketUnavailable = RejectedError{Reason: "ticket is not held by the organization"}
+	ErrInvalidLiters = RejectedError{Reason: "liters must be positive and at most what the ticket holds"}
+	ErrInvalidLimit = RejectedError{Reason: "limits can't be negative"}
+)
+
+// LimitError is an allocation over one of the driver's limits
+type LimitError struct {
+	FuelType string
+	Period string
+	Limit int
+	Used int
+}
+
+func (e LimitError) Error() string {
+	fuel := e.FuelType
+	if fuel == "" {
+		fuel = "all fuels"
+	}
+	return "allocation is over the " + e.Period + " limit for " + fuel
+}
+
+type ticketStore interface {
+	Create(c context.Context, ticket models.Ticket) error
+	GetByID(c context.Context, id uuid.UUID) (models.Ticket, error)
+	GetByOrganizationID(c context.Context, organizationID uuid.UUID) ([]models.Ticket, error)
+	AssignDriver(c context.Context, id uuid.UUID, driverID uuid.UUID) (bool, error)
+	TakeAmount(c context.Context, id uuid.UUID, amount int) (bool, error)
+}
+
+type productTicketLookup interface {
+	GetByID(c context.Context, id uuid.UUID) (models.ProductTicket, error)
+}
+
+type userLookup interface {
+	GetUserByEmail(c context.Context, email string) (models.User, error)
+}
+
+type customerCreator interface {
+	CreateCustomer(email string) (string, error)
+}
+
+// FuelTotals sums an organization's liters of one fuel over a report period
+type FuelTotals struct {
+	FuelType string `json:"fuelType"`
+	Tickets int `json:"tickets"`
+	PurchasedLiters int `json:"purchasedLiters"`
+	AllocatedLiters int `json:"allocatedLiters"`
+	// UsedLiters are allocated liters whose ticket has been redeemed
+	UsedLiters int `json:"usedLiters"`
+}
+
+type DriverTotals struct {
+	DriverID uuid.UUID `json:"driverId"`
+	FuelType string `json:"fuelType"`
+	AllocatedLiters int `json:"allocatedLiters"`
+	UsedLiters int `json:"usedLiters"`
+}
+
+type Report struct {
+	From int `json:"from"`
+	To int `json:"to"`
+	Fuels []FuelTotals `json:"fuels"`
+	Drivers []DriverTotals `json:"drivers"`
+}
+
+type OrganizationService interface {
+	// Create opens an organization with its own payment customer, the creator becomes its first manager
+	Create(c context.Context, name string, creator *models.User) (*models.Organization, error)
+	GetByID(c context.Context, id uuid.UUID) (models.Organization, error)
+	GetByCustomerID(c context.Context, customerID string) (models.Organization, error)
+	Memberships(c context.Context, userID uuid.UUID) ([]models.OrganizationMember, error)
+	// Authorize returns the user's membership, ErrNotManager when a manager is required and the user is a driver
+	Authorize(c context.Context, organizationID uuid.UUID, userID uuid.UUID, managerOnly bool) (*models.OrganizationMember, error)
+	Members(c context.Context, organizationID uuid.UUID) ([]models.OrganizationMember, error)
+	AddMember(c context.Context, organizationID uuid.UUID, email string, role string) (*models.OrganizationMember, error)
+	RemoveMember(c context.Context, organizationID uuid.UUID, userID uuid.UUID) error
+	SetLimits(c context.Context, organizationID uuid.UUID, userID uuid.UUID, limits []models.DriverLimit) error
+	Tickets(c context.Context, organizationID uuid.UUID) ([]models.Ticket, error)
+	// Allocate hands liters of an organization ticket to a driver, the whole ticket when liters is 0
+	Allocate(c context.Context, organizationID uuid.UUID, managerID uuid.UUID, ticketID uuid.UUID, driverID uuid.UUID, liters int) (*models.Allocation, error)
+	Report(c context.Context, organizationID uuid.UUID, from int, to int) (*Report, error)
+	// CanAccessTicket is true for the ticket's holder and for managers of the organization that bought it
+	CanAccessTicket(c context.Context, userID uuid.UUID, ticket *models.Ticket) (bool, error)
+}
+
+type OrganizationServiceOptions struct {
+	OrganizationRepo repository.OrganizationRepo
+	Tickets ticketStore
+	ProductTickets productTicketLookup
+	Users userLookup
+	Customers customerCreator
+}
+
+func NewOrganizationService(options OrganizationServiceOptions) OrganizationService {
+	return &defaultOrganizationService{
+		organizationRepo: options.OrganizationRepo,
+		tickets:          options.Tickets,
+		productTickets:   options.ProductTickets,
+		users:            options.Users,
+		customers:        options.Customers,
+	}
+}
+
+type defaultOrganizationService struct {
+	organizationRepo repository.OrganizationRepo
+	tickets ticketStore
+	productTickets productTicketLookup
+	users userLookup
+	customers customerCreator
+}
+
+func (s *defaultOrganizationService) Create(c context.Context, name string, creator *models.User) (*models.Organization, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, RejectedError{Reason: "an organization needs a name"}
+	}
+	customerID, err := s.customers.CreateCustomer(creator.Email)
+	if err != nil {
+		return nil, err
+	}
+	now := int(time.Now().Unix())
+	organization := models.Organization{
+		ID:         uuid.New(),
+		Name:       name,
+		CustomerID: customerID,
+		CreatedAt:  now,
+	}
+	_, err = tools.WithTransaction(c, func(ctx context.Context) (interface{}, error) {
+		if err := s.organizationRepo.Save(ctx, &organization); err != nil {
+			return nil, err
+		}
+		return nil, s.organizationRepo.SaveMember(ctx, &models.OrganizationMember{
+			ID:             uuid.New(),
+			OrganizationID: organization.ID,
+			UserID:         creator.ID,
+			Role:           models.ORG_MANAGER,
+			CreatedAt:      now,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &organization, nil
+}
+
+func (s *defaultOrganizationService) GetByID(c context.Context, id uuid.UUID) (models.Organization, error) {
+	return s.organizationRepo.GetByID(c, id)
+}
+
+func (s *defaultOrganizationService) GetByCustomerID(c context.Context, customerID string) (models.Organization, error) {
+	return s.organizationRepo.GetByCustomerID(c, customerID)
+}
+
+func (s *defaultOrganizationService) Memberships(c context.Context, userID uuid.UUID) ([]models.OrganizationMember, error) {
+	return s.organizationRepo.GetMembershipsByUserID(c, userID)
+}
+
+func (s *defaultOrganizationService) Authorize(c context.Context, organizationID uuid.UUID, userID uuid.UUID, managerOnly bool) (*models.OrganizationMember, error) {
+	member, err := s.organizationRepo.GetMember(c, organizationID, userID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotMember
+	}
+	if err != nil {
+		return nil, err
+	}
+	if managerOnly && member.Role != models.ORG_MANAGER {
+		return nil, ErrNotManager
+	}
+	return &member, nil
+}
+
+func (s *defaultOrganizationService) Members(c context.Context, organizationID uuid.UUID) ([]models.OrganizationMember, error) {
+	return s.organizationRepo.GetMembers(c, organizationID)
+}
+
+func (s *defaultOrganizationService) AddMember(c context.Context, organizationID uuid.UUID, email string, role string) (*models.OrganizationMember, error) {
+	if role != models.ORG_MANAGER && role != models.ORG_DRIVER {
+		return nil, ErrUnknownRole
+	}
+	user, err := s.users.GetUserByEmail(c, strings.TrimSpace(email))
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrUnknownUser
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.organizationRepo.GetMember(c, organizationID, user.ID)
+	if err == nil {
+		return nil, ErrAlreadyMember
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+	member := models.OrganizationMember{
+		ID:             uuid.New(),
+		OrganizationID: organizationID,
+		UserID:         user.ID,
+		Role:           role,
+		Limits:         []models.DriverLimit{},
+		CreatedAt:      int(time.Now().Unix()),
+	}
+	if err = s.organizationRepo.SaveMember(c, &member); err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (s *defaultOrganizationService) RemoveMember(c context.Context, organizationID uuid.UUID, userID uuid.UUID) error {
+	members, err := s.organizationRepo.GetMembers(c, organizationID)
+	if err != nil {
+		return err
+	}
+	managers := 0
+	var removed *models.OrganizationMember
+	for i, member := range members {
+		if member.Role == models.ORG_MANAGER {
+			managers++
+		}
+		if member.UserID == userID {
+			removed = &members[i]
+		}
+	}
+	if removed == nil {
+		return ErrNotMember
+	}
+	if removed.Role == models.ORG_MANAGER && managers == 1 {
+		return ErrLastManager
+	}
+	return s.organizationRepo.DeleteMember(c, organizationID, userID)
+}
+
+func (s *defaultOrganizationService) SetLimits(c context.Context, organizationID uuid.UUID, userID uuid.UUID, limits []models.DriverLimit) error {
+	member, err := s.organizationRepo.GetMember(c, organizationID, userID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotMember
+	}
+	if err != nil {
+		return err
+	}
+	if member.Role != models.ORG_DRIVER {
+		return ErrNotDriver
+	}
+	for i := range limits {
+		if limits[i].DailyLiters < 0 || limits[i].MonthlyLiters < 0 {
+			return ErrInvalidLimit
+		}
+		limits[i].FuelType = strings.TrimSpace(limits[i].FuelType)
+	}
+	if limits == nil {
+		limits = []models.DriverLimit{}
+	}
+	return s.organizationRepo.UpdateLimits(c, member.ID, limits)
+}
+
+func (s *defaultOrganizationService) Tickets(c context.Context, organizationID uuid.UUID) ([]models.Ticket, error) {
+	return s.tickets.GetByOrganizationID(c, organizationID)
+}
+
+// checkLimits runs in the allocation transaction, after the driver was locked
+func (s *defaultOrganizationService) checkLimits(c context.Context, driver *models.OrganizationMember, fuelType string, liters int, now time.Time) error {
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	for _, limit := range driver.Limits {
+		if limit.FuelType != "" && !strings.EqualFold(limit.FuelType, fuelType) {
+			continue
+		}
+		periods := []struct {
+			name string
+			limit int
+			since time.Time
+		}{
+			{"daily", limit.DailyLiters, startOfDay},
+			{"monthly", limit.MonthlyLiters, startOfMonth},
+		}
+		for _, period := range periods {
+			if period.limit == 0 {
+				continue
+			}
+			used, err := s.organizationRepo.SumAllocated(c, driver.OrganizationID, driver.UserID, limit.FuelType, int(period.since.Unix()))
+			if err != nil {
+				return err
+			}
+			if used+liters > period.limit {
+				return LimitError{FuelType: limit.FuelType, Period: period.name, Limit: period.limit, Used: used}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *defaultOrganizationService) Allocate(c context.Context, organizationID uuid.UUID, managerID uuid.UUID, ticketID uuid.UUID, driverID uuid.UUID, liters int) (*models.Allocation, error) {
+	driver, err := s.organizationRepo.GetMember(c, organizationID, driverID)
+	if errors.Is(err, mongo.ErrNoDocuments) || (err == nil && driver.Role != models.ORG_DRIVER) {
+		return nil, ErrNotDriver
+	}
+	if err != nil {
+		return nil, err
+	}
+	ticket, err := s.tickets.GetByID(c, ticketID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrTicketUnavailable
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ticket.OrganizationID != organizationID || ticket.DriverID != uuid.Nil || ticket.Status != models.ACTIVATED {
+		return nil, ErrTicketUnavailable
+	}
+	if liters == 0 {
+		liters = ticket.Amount
+	}
+	if liters <= 0 || liters > ticket.Amount {
+		return nil, ErrInvalidLiters
+	}
+	productTicket, err := s.productTickets.GetByID(c, ticket.ProductTicketID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	res, err := tools.WithTransaction(c, func(ctx context.Context) (interface{}, error) {
+		// concurrent allocations to the same driver conflict here and are retried, so both see the other's liters
+		if err := s.organizationRepo.LockMember(ctx, driver.ID); err != nil {
+			return nil, err
+		}
+		if err := s.checkLimits(ctx, &driver, productTicket.FuelType, liters, now); err != nil {
+			return nil, err
+		}
+		allocation := models.Allocation{
+			ID:             uuid.New(),
+			OrganizationID: organizationID,
+			DriverID:       driverID,
+			ManagerID:      managerID,
+			SourceTicketID: ticket.ID,
+			TicketID:       ticket.ID,
+			FuelType:       productTicket.FuelType,
+			Liters:         liters,
+			CreatedAt:      int(now.Unix()),
+		}
+		if liters == ticket.Amount {
+			ok, err := s.tickets.AssignDriver(ctx, ticket.ID, driverID)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, ErrTicketUnavailable
+			}
+		} else {
+			ok, err := s.tickets.TakeAmount(ctx, ticket.ID, liters)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, ErrInvalidLiters
+			}
+			// the driver's part keeps the purchase it came from
+			part := ticket
+			part.ID = uuid.New()
+			part.CreatedAt = allocation.CreatedAt
+			part.Amount = liters
+			part.UserId = driverID
+			part.DriverID = driverID
+			part.SetSecret("Huy")
+			if err = s.tickets.Create(ctx, part); err != nil {
+				return nil, err
+			}
+			allocation.TicketID = part.ID
+		}
+		if err := s.organizationRepo.SaveAllocation(ctx, &allocation); err != nil {
+			return nil, err
+		}
+		return &allocation, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*models.Allocation), nil
+}
+
+func (s *defaultOrganizationService) Report(c context.Context, organizationID uuid.UUID, from int, to int) (*Report, error) {
+	tickets, err := s.tickets.GetByOrganizationID(c, organizationID)
+	if err != nil {
+		return nil, err
+	}
+	allocations, err := s.organizationRepo.GetAllocations(c, organizationID, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ticketsByID := map[uuid.UUID]models.Ticket{}
+	for _, ticket := range tickets {
+		ticketsByID[ticket.ID] = ticket
+	}
+	// a ticket split for a driver is not a purchase, its liters count on the ticket it was split from
+	splitOff := map[uuid.UUID]bool{}
+	takenFrom := map[uuid.UUID]int{}
+	for _, allocation := range allocations {
+		if allocation.TicketID != allocation.SourceTicketID {
+			splitOff[allocation.TicketID] = true
+			takenFrom[allocation.SourceTicketID] += allocation.Liters
+		}
+	}
+
+	inPeriod := func(at int) bool {
+		return at >= from && (to == 0 || at < to)
+	}
+	fuels := map[string]*FuelTotals{}
+	fuel := func(fuelType string) *FuelTotals {
+		if fuels[fuelType] == nil {
+			fuels[fuelType] = &FuelTotals{FuelType: fuelType}
+		}
+		return fuels[fuelType]
+	}
+	fuelTypes := map[uuid.UUID]string{}
+	for _, ticket := range tickets {
+		if splitOff[ticket.ID] || !inPeriod(ticket.CreatedAt) {
+			continue
+		}
+		fuelType, ok := fuelTypes[ticket.ProductTicketID]
+		if !ok {
+			productTicket, err := s.productTickets.GetByID(c, ticket.ProductTicketID)
+			if err != nil {
+				return nil, err
+			}
+			fuelType = productTicket.FuelType
+			fuelTypes[ticket.ProductTicketID] = fuelType
+		}
+		totals := fuel(fuelType)
+		totals.Tickets++
+		totals.PurchasedLiters += ticket.Amount + takenFrom[ticket.ID]
+	}
+
+	type driverFuel struct {
+		driverID uuid.UUID
+		fuelType string
+	}
+	drivers := map[driverFuel]*DriverTotals{}
+	for _, allocation := range allocations {
+		if !inPeriod(allocation.CreatedAt) {
+			continue
+		}
+		key := driverFuel{allocation.DriverID, allocation.FuelType}
+		if drivers[key] == nil {
+			drivers[key] = &DriverTotals{DriverID: allocation.DriverID, FuelType: allocation.FuelType}
+		}
+		used := 0
+		if ticket, ok := ticketsByID[allocation.TicketID]; ok && ticket.Status == models.USED {
+			used = allocation.Liters
+		}
+		drivers[key].AllocatedLiters += allocation.Liters
+		drivers[key].UsedLiters += used
+		fuel(allocation.FuelType).AllocatedLiters += allocation.Liters
+		fuel(allocation.FuelType).UsedLiters += used
+	}
+
+	report := Report{From: from, To: to, Fuels: []FuelTotals{}, Drivers: []DriverTotals{}}
+	for _, totals := range fuels {
+		report.Fuels = append(report.Fuels, *totals)
+	}
+	for _, totals := range drivers {
+		report.Drivers = append(report.Drivers, *totals)
+	}
+	sort.Slice(report.Fuels, func(i, j int) bool {
+		return report.Fuels[i].FuelType < report.Fuels[j].FuelType
+	})
+	sort.Slice(report.Drivers, func(i, j int) bool {
+		if report.Drivers[i].DriverID != report.Drivers[j].DriverID {
+			return report.Drivers[i].DriverID.String() < report.Drivers[j].DriverID.String()
+		}
+		return report.Drivers[i].FuelType < report.Drivers[j].FuelType
+	})
+	return &report, nil
+}
+
+func (s *defaultOrganizationService) CanAccessTicket(c context.Context, userID uuid.UUID, ticket *models.Ticket) (bool, error) {
+	if ticket.UserId == userID {
+		return true, nil
+	}
+	if ticket.OrganizationID == uuid.Nil {
+		return false, nil
+	}
+	_, err := s.Authorize(c, ticket.OrganizationID, userID, true)
+	if errors.Is(err, ErrNotMember) || errors.Is(err, ErrNotManager) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,240 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"net/http"
+	"palyvoua/internal/models"
+	"strings"
+	"time"
+)
+
+const (
+	PROVIDER_STRIPE = "stripe"
+	PROVIDER_FAKE = "fake"
+	PROVIDER_LIQPAY = "liqpay"
+	PROVIDER_MONOBANK = "monobank"
+)
+
+// CheckoutProvider is the part of a payment service needed to sell product tickets.
+// Stripe and the fake provider do more, LiqPay and Monobank only take one-off payments.
+type CheckoutProvider interface {
+	CreateCheckoutSession(c context.Context, productList []ProductDto, customerID string, returnURLs ReturnURLs, discount *Discount) (*CheckoutSession, error)
+	// CreateTopUpSession takes a payment of amount minor units for the customer's wallet
+	CreateTopUpSession(c context.Context, customerID string, amount int, currency string, returnURLs ReturnURLs) (*CheckoutSession, error)
+	GetCheckoutSession(c context.Context, sessionID string) (*CheckoutSession, error)
+	ParseWebhook(c context.Context, payload []byte, header http.Header) (*Event, error)
+}
+
+type ProviderSelector interface {
+	Get(name string) (CheckoutProvider, bool)
+	// Select returns the requested provider, else the one configured for the seller, else the default
+	Select(requested string, seller string) (string, CheckoutProvider, error)
+}
+
+type ProviderSelectorOptions struct {
+	Providers map[string]CheckoutProvider
+	Default string
+	// SellerProviders maps a seller to the provider its checkouts go through
+	SellerProviders map[string]string
+}
+
+func NewProviderSelector(options ProviderSelectorOptions) ProviderSelector {
+	return &defaultProviderSelector{options: options}
+}
+
+type defaultProviderSelector struct {
+	options ProviderSelectorOptions
+}
+
+func (s *defaultProviderSelector) Get(name string) (CheckoutProvider, bool) {
+	provider, ok := s.options.Providers[name]
+	return provider, ok
+}
+
+func (s *defaultProviderSelector) Select(requested string, seller string) (string, CheckoutProvider, error) {
+	name := requested
+	if name == "" {
+		name = s.options.SellerProviders[seller]
+	}
+	if name == "" {
+		name = s.options.Default
+	}
+	provider, ok := s.Get(name)
+	if !ok {
+		return "", nil, fmt.Errorf("payment provider %q is not available", name)
+	}
+	return name, provider, nil
+}
+
+// ParseSellerProviders reads seller:provider pairs like wog:liqpay,okko:monobank
+func ParseSellerProviders(pairs string) map[string]string {
+	sellerProviders := map[string]string{}
+	for _, entry := range strings.Split(pairs, ",") {
+		seller, provider, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if !found {
+			continue
+		}
+		sellerProviders[strings.TrimSpace(seller)] = strings.TrimSpace(provider)
+	}
+	return sellerProviders
+}
+
+type productTicketLookup interface {
+	GetByStripeProductID(c context.Context, productID string) (models.ProductTicket, error)
+}
+
+type checkoutStore interface {
+	Save(c context.Context, checkout *models.Checkout) error
+	GetByID(c context.Context, id string) (models.Checkout, error)
+	UpdateStatus(c context.Context, id string, status string, paymentID string, updatedAt int) (bool, error)
+}
+
+// newCheckout prices the products from our own catalog, for providers that have none
+func newCheckout(c context.Context, provider string, productList []ProductDto, customerID string, products productTicketLookup, discount *Discount) (*models.Checkout, error) {
+	if len(productList) == 0 {
+		return nil, fmt.Errorf("checkout has no products")
+	}
+	now := int(time.Now().Unix())
+	checkout := models.Checkout{
+		ID:         uuid.NewString(),
+		Provider:   provider,
+		Purpose:    CHECKOUT_PURPOSE_TICKETS,
+		CustomerID: customerID,
+		Status:     models.CHECKOUT_PENDING,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	for _, p := range productList {
+		if p.Amount <= 0 {
+			return nil, fmt.Errorf("invalid quantity for %s", p.ProductStripeID)
+		}
+		productTicket, err := products.GetByStripeProductID(c, p.ProductStripeID)
+		if err != nil {
+			return nil, err
+		}
+		currency := strings.ToUpper(productTicket.Currency)
+		if checkout.Currency != "" && checkout.Currency != currency {
+			return nil, fmt.Errorf("products in one checkout must share a currency")
+		}
+		if checkout.Seller != "" && checkout.Seller != productTicket.Seller {
+			return nil, fmt.Errorf("products in one checkout must come from one seller")
+		}
+		checkout.Currency = currency
+		checkout.Seller = productTicket.Seller
+		checkout.Total += productTicket.Price * p.Amount
+		checkout.LineItems = append(checkout.LineItems, models.CheckoutLineItem{
+			ProductID: p.ProductStripeID,
+			Title:     productTicket.Title,
+			Quantity:  p.Amount,
+			UnitPrice: productTicket.Price,
+			PriceVersionID: priceVersionID(&productTicket),
+		})
+	}
+	if discount != nil {
+		if !strings.EqualFold(discount.Currency, checkout.Currency) {
+			return nil, fmt.Errorf("discount in %s on a checkout in %s", discount.Currency, checkout.Currency)
+		}
+		if discount.Amount >= checkout.Total {
+			return nil, fmt.Errorf("discount leaves nothing to pay")
+		}
+		checkout.Discount = discount.Amount
+		checkout.Total -= discount.Amount
+	}
+	return &checkout, nil
+}
+
+func newTopUpCheckout(provider string, customerID string, amount int, currency string) (*models.Checkout, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("invalid top up amount")
+	}
+	now := int(time.Now().Unix())
+	return &models.Checkout{
+		ID:         uuid.NewString(),
+		Provider:   provider,
+		Purpose:    CHECKOUT_PURPOSE_TOP_UP,
+		CustomerID: customerID,
+		LineItems:  []models.CheckoutLineItem{{Title: "Wallet top up", Quantity: 1, UnitPrice: amount}},
+		Total:      amount,
+		Currency:   strings.ToUpper(currency),
+		Status:     models.CHECKOUT_PENDING,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}, nil
+}
+
+// priceVersionID is empty for product tickets priced before versioning
+func priceVersionID(p *models.ProductTicket) string {
+	if p.PriceVersionID == uuid.Nil {
+		return ""
+	}
+	return p.PriceVersionID.String()
+}
+
+func checkoutSessionFromCheckout(checkout *models.Checkout, url string) *CheckoutSession {
+	sess := CheckoutSession{
+		ID:         checkout.ID,
+		URL:        url,
+		CustomerID: checkout.CustomerID,
+		PaymentID:  checkout.PaymentID,
+		Status:     checkout.Status,
+		Purpose:    checkout.Purpose,
+		AmountTotal: checkout.Total,
+		Currency:   checkout.Currency,
+	}
+	// checkouts stored before top ups existed were all ticket purchases
+	if sess.Purpose == "" {
+		sess.Purpose = CHECKOUT_PURPOSE_TICKETS
+	}
+	if sess.Purpose == CHECKOUT_PURPOSE_TOP_UP {
+		return &sess
+	}
+	for _, item := range checkout.LineItems {
+		sess.LineItems = append(sess.LineItems, LineItem{ProductID: item.ProductID, Quantity: item.Quantity, PriceVersionID: item.PriceVersionID})
+	}
+	return &sess
+}
+
+// settleCheckout turns a verified callback into the event the stripe webhook would have produced.
+// Providers deliver callbacks more than once, only the first one to settle the checkout is acted on.
+func settleCheckout(c context.Context, store checkoutStore, eventID string, checkoutID string, paid bool, paymentID string, total int, currency string) (*Event, error) {
+	checkout, err := store.GetByID(c, checkoutID)
+	if err != nil {
+		return nil, fmt.Errorf("unknown checkout %s", checkoutID)
+	}
+	redelivered := &Event{ID: eventID, Type: EVENT_CHECKOUT_REDELIVERED, CheckoutSession: checkoutSessionFromCheckout(&checkout, "")}
+	if checkout.Status != models.CHECKOUT_PENDING {
+		return redelivered, nil
+	}
+	status, eventType := models.CHECKOUT_FAILED, EVENT_CHECKOUT_FAILED
+	if paid {
+		if total != checkout.Total || !strings.EqualFold(currency, checkout.Currency) {
+			return nil, fmt.Errorf("paid %d %s for checkout %s of %d %s", total, currency, checkout.ID, checkout.Total, checkout.Currency)
+		}
+		status, eventType = models.CHECKOUT_COMPLETED, EVENT_CHECKOUT_COMPLETED
+	}
+	settled, err := store.UpdateStatus(c, checkout.ID, status, paymentID, int(time.Now().Unix()))
+	if err != nil {
+		return nil, err
+	}
+	if !settled {
+		// a concurrent delivery got there first
+		return redelivered, nil
+	}
+	checkout.PaymentID = paymentID
+	checkout.Status = status
+	return &Event{ID: eventID, Type: eventType, CheckoutSession: checkoutSessionFromCheckout(&checkout, "")}, nil
+}
+
+// getStoredCheckout serves GetCheckoutSession for providers that keep their checkouts with us
+func getStoredCheckout(c context.Context, store checkoutStore, provider string, sessionID string) (*CheckoutSession, error) {
+	checkout, err := store.GetByID(c, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if checkout.Provider != provider {
+		return nil, fmt.Errorf("checkout %s belongs to %s", sessionID, checkout.Provider)
+	}
+	return checkoutSessionFromCheckout(&checkout, ""), nil
+}
@@ -0,0 +1,110 @@
+package payment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"palyvoua/internal/models"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testCheckoutID is the order of the recorded callbacks in testdata
+const testCheckoutID = "3b8f8a3e-5d0c-4a44-9d6e-2f0c1c7b9a10"
+
+type memoryCheckoutStore struct {
+	mu sync.Mutex
+	checkouts map[string]models.Checkout
+}
+
+// newMemoryCheckoutStore holds the pending 1250 UAH checkout the recorded callbacks pay for
+func newMemoryCheckoutStore(provider string, status string) *memoryCheckoutStore {
+	return &memoryCheckoutStore{checkouts: map[string]models.Checkout{
+		testCheckoutID: {
+			ID:         testCheckoutID,
+			Provider:   provider,
+			Purpose:    CHECKOUT_PURPOSE_TICKETS,
+			CustomerID: "cus_test",
+			LineItems:  []models.CheckoutLineItem{{ProductID: "prod_a95", Title: "A-95, 25 l", Quantity: 1, UnitPrice: 125000}},
+			Total:      125000,
+			Currency:   "UAH",
+			Status:     status,
+		},
+	}}
+}
+
+func (m *memoryCheckoutStore) Save(c context.Context, checkout *models.Checkout) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkouts[checkout.ID] = *checkout
+	return nil
+}
+
+func (m *memoryCheckoutStore) GetByID(c context.Context, id string) (models.Checkout, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	checkout, ok := m.checkouts[id]
+	if !ok {
+		return models.Checkout{}, fmt.Errorf("no checkout %s", id)
+	}
+	return checkout, nil
+}
+
+func (m *memoryCheckoutStore) UpdateStatus(c context.Context, id string, status string, paymentID string, updatedAt int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	checkout, ok := m.checkouts[id]
+	if !ok || checkout.Status != models.CHECKOUT_PENDING {
+		return false, nil
+	}
+	checkout.Status = status
+	checkout.PaymentID = paymentID
+	checkout.UpdatedAt = updatedAt
+	m.checkouts[id] = checkout
+	return true, nil
+}
+
+func (m *memoryCheckoutStore) status(t *testing.T) string {
+	t.Helper()
+	checkout, err := m.GetByID(context.Background(), testCheckoutID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return checkout.Status
+}
+
+// readFixture returns a recorded callback from testdata as a map, so a test can change fields before signing it
+func readFixture(t *testing.T, name string) map[string]interface{} {
+	t.Helper()
+	raw, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixture map[string]interface{}
+	if err = json.Unmarshal(raw, &fixture); err != nil {
+		t.Fatal(err)
+	}
+	return fixture
+}
+
+// checkEvent compares what ParseWebhook returned with what a case expects, an empty wantType expects an error
+func checkEvent(t *testing.T, event *Event, err error, wantType string) {
+	t.Helper()
+	if wantType == "" {
+		if err == nil {
+			t.Fatalf("got event %+v, want an error", event)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("parse webhook: %v", err)
+	}
+	if event.Type != wantType {
+		t.Fatalf("event type = %q, want %q", event.Type, wantType)
+	}
+	if (wantType == EVENT_CHECKOUT_COMPLETED || wantType == EVENT_CHECKOUT_FAILED) && event.CheckoutSession.ID != testCheckoutID {
+		t.Fatalf("event for checkout %q, want %q", event.CheckoutSession.ID, testCheckoutID)
+	}
+}
@@ -0,0 +1,349 @@
+package payment
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"net/http"
+	"palyvoua/internal/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fakeSignatureHeader = "X-Fake-Signature"
+
+// FakePaymentService keeps everything in memory, so the purchase flow can run without a provider.
+// Checkouts stay open until CompleteCheckout pays them and sends the webhook a real provider would.
+type FakePaymentService interface {
+	PaymentService
+	CompleteCheckout(sessionID string) (string, error)
+}
+
+type FakePaymentServiceOptions struct {
+	// WebhookURL receives the signed events, usually this api's own /payment/webhook
+	WebhookURL string
+	WebhookSecret string
+}
+
+func NewFakePaymentService(options FakePaymentServiceOptions) FakePaymentService {
+	return &fakePaymentService{
+		options:   options,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		customers: map[string]*fakeCustomer{},
+		products:  map[string]models.ProductTicket{},
+		sessions:  map[string]*fakeCheckoutSession{},
+	}
+}
+
+type fakeCustomer struct {
+	Customer
+	defaultPaymentMethod string
+	paymentMethods []PaymentMethod
+}
+
+type fakeCheckoutSession struct {
+	CheckoutSession
+	returnURLs ReturnURLs
+}
+
+type fakePaymentService struct {
+	options FakePaymentServiceOptions
+	client *http.Client
+	mu sync.Mutex
+	customers map[string]*fakeCustomer
+	products map[string]models.ProductTicket
+	sessions map[string]*fakeCheckoutSession
+}
+
+func fakeID(prefix string) string {
+	return prefix + "_fake_" + uuid.NewString()
+}
+
+func (f *fakePaymentService) customer(customerID string) (*fakeCustomer, error) {
+	c, ok := f.customers[customerID]
+	if !ok {
+		return nil, fmt.Errorf("no such customer: %s", customerID)
+	}
+	return c, nil
+}
+
+func (f *fakePaymentService) CreateCustomer(email string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := fakeCustomer{Customer: Customer{ID: fakeID("cus"), Email: email}}
+	f.customers[c.ID] = &c
+	return c.ID, nil
+}
+
+func (f *fakePaymentService) GetCustomerByID(cid string) (*Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.customer(cid)
+	if err != nil {
+		return &Customer{}, err
+	}
+	customer := c.Customer
+	return &customer, nil
+}
+
+func (f *fakePaymentService) UpdateCustomer(customerID string, details CustomerDetails) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.customer(customerID)
+	if err != nil {
+		return err
+	}
+	c.Email = details.Email
+	c.Name = details.Name
+	return nil
+}
+
+func (f *fakePaymentService) DeleteCustomer(customerID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.customers, customerID)
+	return nil
+}
+
+func (f *fakePaymentService) Ping(c context.Context) error {
+	return nil
+}
+
+// CreateSetupIntent saves a test card right away, there is no client side to confirm it
+func (f *fakePaymentService) CreateSetupIntent(cid string) (*SetupIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.customer(cid)
+	if err != nil {
+		return &SetupIntent{}, err
+	}
+	c.paymentMethods = append(c.paymentMethods, PaymentMethod{
+		ID:       fakeID("pm"),
+		Brand:    "visa",
+		Last4:    "4242",
+		ExpMonth: 12,
+		ExpYear:  time.Now().Year() + 5,
+	})
+	id := fakeID("seti")
+	return &SetupIntent{ID: id, ClientSecret: id + "_secret", CustomerID: cid}, nil
+}
+
+func (f *fakePaymentService) ListPaymentMethods(customerID string) ([]PaymentMethod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.customer(customerID)
+	if err != nil {
+		return nil, err
+	}
+	return append([]PaymentMethod{}, c.paymentMethods...), nil
+}
+
+func (f *fakePaymentService) SetDefaultPaymentMethod(customerID string, paymentMethodID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.customer(customerID)
+	if err != nil {
+		return err
+	}
+	for _, pm := range c.paymentMethods {
+		if pm.ID == paymentMethodID {
+			c.defaultPaymentMethod = paymentMethodID
+			return nil
+		}
+	}
+	return PaymentError{}
+}
+
+func (f *fakePaymentService) GetDefaultPaymentMethod(customerID string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.customer(customerID)
+	if err != nil {
+		return "", err
+	}
+	return c.defaultPaymentMethod, nil
+}
+
+func (f *fakePaymentService) DeletePaymentMethodByIDAndCustomerID(paymentMethodID string, customerID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.customer(customerID)
+	if err != nil {
+		return err
+	}
+	for i, pm := range c.paymentMethods {
+		if pm.ID == paymentMethodID {
+			c.paymentMethods = append(c.paymentMethods[:i], c.paymentMethods[i+1:]...)
+			if c.defaultPaymentMethod == paymentMethodID {
+				c.defaultPaymentMethod = ""
+			}
+			return nil
+		}
+	}
+	return PaymentError{}
+}
+
+func (f *fakePaymentService) ChargeCustomer(c context.Context, customerID string, amount int) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	customer, err := f.customer(customerID)
+	if err != nil {
+		return "", err
+	}
+	if len(customer.paymentMethods) == 0 {
+		return "", fmt.Errorf("customer %s has no payment method", customerID)
+	}
+	return fakeID("ch"), nil
+}
+
+func (f *fakePaymentService) SaveProduct(p *models.ProductTicket) (*Product, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	product := Product{ID: fakeID("prod"), PriceID: fakeID("price")}
+	f.products[product.ID] = *p
+	return &product, nil
+}
+
+func (f *fakePaymentService) DeleteProductByID(productID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.products, productID)
+	return nil
+}
+
+func (f *fakePaymentService) CreateCheckoutSession(c context.Context, productList []ProductDto, customerID string, returnURLs ReturnURLs, discount *Discount) (*CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.customer(customerID); err != nil {
+		return nil, err
+	}
+	sess := fakeCheckoutSession{CheckoutSession: CheckoutSession{
+		ID:         fakeID("cs"),
+		CustomerID: customerID,
+		Status:     models.CHECKOUT_PENDING,
+		Purpose:    CHECKOUT_PURPOSE_TICKETS,
+	}}
+	for _, p := range productList {
+		product, ok := f.products[p.ProductStripeID]
+		if !ok {
+			return nil, fmt.Errorf("no such product: %s", p.ProductStripeID)
+		}
+		sess.LineItems = append(sess.LineItems, LineItem{ProductID: p.ProductStripeID, Quantity: p.Amount})
+		sess.AmountTotal += product.Price * p.Amount
+		sess.Currency = strings.ToUpper(product.Currency)
+	}
+	if discount != nil {
+		sess.AmountTotal -= discount.Amount
+	}
+	return f.openSession(&sess, returnURLs), nil
+}
+
+func (f *fakePaymentService) CreateTopUpSession(c context.Context, customerID string, amount int, currency string, returnURLs ReturnURLs) (*CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.customer(customerID); err != nil {
+		return nil, err
+	}
+	if amount <= 0 {
+		return nil, fmt.Errorf("invalid top up amount")
+	}
+	sess := fakeCheckoutSession{CheckoutSession: CheckoutSession{
+		ID:          fakeID("cs"),
+		CustomerID:  customerID,
+		Status:      models.CHECKOUT_PENDING,
+		Purpose:     CHECKOUT_PURPOSE_TOP_UP,
+		AmountTotal: amount,
+		Currency:    strings.ToUpper(currency),
+	}}
+	return f.openSession(&sess, returnURLs), nil
+}
+
+// openSession stores a new session, f.mu must be held
+func (f *fakePaymentService) openSession(sess *fakeCheckoutSession, returnURLs ReturnURLs) *CheckoutSession {
+	sess.returnURLs = returnURLs.ForSession(sess.ID)
+	sess.URL = "fake://checkout/" + sess.ID
+	f.sessions[sess.ID] = sess
+	checkoutSession := sess.CheckoutSession
+	return &checkoutSession
+}
+
+func (f *fakePaymentService) GetCheckoutSession(c context.Context, sessionID string) (*CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sess, ok := f.sessions[sessionID]
+	if !ok {
+		return nil, fmt.Errorf("no such checkout session: %s", sessionID)
+	}
+	checkoutSession := sess.CheckoutSession
+	return &checkoutSession, nil
+}
+
+// CompleteCheckout returns the success url the customer would have been sent to.
+// A completed session sends its event again, so a webhook that failed can be retried with the same payment.
+func (f *fakePaymentService) CompleteCheckout(sessionID string) (string, error) {
+	f.mu.Lock()
+	sess, ok := f.sessions[sessionID]
+	if !ok {
+		f.mu.Unlock()
+		return "", fmt.Errorf("no such checkout session: %s", sessionID)
+	}
+	if sess.Status != models.CHECKOUT_COMPLETED {
+		sess.Status = models.CHECKOUT_COMPLETED
+		sess.PaymentID = fakeID("pi")
+	}
+	checkoutSession := sess.CheckoutSession
+	successURL := sess.returnURLs.Success
+	f.mu.Unlock()
+
+	err := f.sendWebhook(Event{
+		ID:              fakeID("evt"),
+		Type:            EVENT_CHECKOUT_COMPLETED,
+		CheckoutSession: &checkoutSession,
+	})
+	return successURL, err
+}
+
+func (f *fakePaymentService) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(f.options.WebhookSecret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (f *fakePaymentService) sendWebhook(event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, f.options.WebhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(fakeSignatureHeader, f.sign(payload))
+	res, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered with %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (f *fakePaymentService) ParseWebhook(c context.Context, payload []byte, header http.Header) (*Event, error) {
+	if !hmac.Equal([]byte(header.Get(fakeSignatureHeader)), []byte(f.sign(payload))) {
+		return nil, fmt.Errorf("invalid webhook signature")
+	}
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
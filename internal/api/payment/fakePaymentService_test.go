@@ -0,0 +1,66 @@
+package payment
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"palyvoua/internal/models"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFakeCompleteCheckoutAfterFailedWebhook(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	var events []*Event
+	var service FakePaymentService
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		payload, _ := io.ReadAll(r.Body)
+		event, err := service.ParseWebhook(r.Context(), payload, r.Header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events = append(events, event)
+	}))
+	defer server.Close()
+	service = NewFakePaymentService(FakePaymentServiceOptions{WebhookURL: server.URL, WebhookSecret: "fake"})
+
+	customerID, err := service.CreateCustomer("buyer@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := service.CreateTopUpSession(context.Background(), customerID, 50000, "uah", ReturnURLs{Success: "https://palyvo.ua/ok/" + CHECKOUT_SESSION_ID_PLACEHOLDER})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = service.CompleteCheckout(sess.ID); err == nil {
+		t.Fatal("completed while the webhook was down")
+	}
+
+	failing.Store(false)
+	successURL, err := service.CompleteCheckout(sess.ID)
+	if err != nil {
+		t.Fatalf("completing again: %v", err)
+	}
+	if successURL != "https://palyvo.ua/ok/"+sess.ID {
+		t.Fatalf("success url = %q", successURL)
+	}
+	if len(events) != 1 || events[0].Type != EVENT_CHECKOUT_COMPLETED || events[0].CheckoutSession.Status != models.CHECKOUT_COMPLETED {
+		t.Fatalf("events = %+v, want the completed event delivered", events)
+	}
+	paymentID := events[0].CheckoutSession.PaymentID
+
+	// a completed session sends the same payment again, the webhook handler issues it once
+	if _, err = service.CompleteCheckout(sess.ID); err != nil {
+		t.Fatalf("resending: %v", err)
+	}
+	if len(events) != 2 || events[1].CheckoutSession.PaymentID != paymentID {
+		t.Fatalf("events = %+v, want the event resent with payment %s", events, paymentID)
+	}
+}
@@ -0,0 +1,142 @@
+package payment
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"palyvoua/internal/models"
+)
+
+const liqpayCheckoutURL = "https://www.liqpay.ua/api/3/checkout"
+
+type LiqPayOptions struct {
+	PublicKey string
+	PrivateKey string
+	// CallbackURL is our /payment/webhook/liqpay, LiqPay posts the result there
+	CallbackURL string
+	Sandbox bool
+	Products productTicketLookup
+	Checkouts checkoutStore
+}
+
+func NewLiqPayPaymentService(options LiqPayOptions) CheckoutProvider {
+	return &liqpayPaymentService{options: options}
+}
+
+type liqpayPaymentService struct {
+	options LiqPayOptions
+}
+
+// liqpayPayment is the data of a checkout request and of a callback, LiqPay uses one shape for both
+type liqpayPayment struct {
+	Version int `json:"version"`
+	PublicKey string `json:"public_key"`
+	Action string `json:"action,omitempty"`
+	Amount float64 `json:"amount"`
+	Currency string `json:"currency"`
+	Description string `json:"description,omitempty"`
+	OrderID string `json:"order_id"`
+	ServerURL string `json:"server_url,omitempty"`
+	ResultURL string `json:"result_url,omitempty"`
+	Sandbox int `json:"sandbox,omitempty"`
+	Status string `json:"status,omitempty"`
+	PaymentID int64 `json:"payment_id,omitempty"`
+	TransactionID int64 `json:"transaction_id,omitempty"`
+}
+
+// sign follows the LiqPay scheme, base64(sha1(private_key + data + private_key))
+func (l *liqpayPaymentService) sign(data string) string {
+	sum := sha1.Sum([]byte(l.options.PrivateKey + data + l.options.PrivateKey))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// CreateCheckoutSession sends the customer back to the success url whatever the outcome, LiqPay has no cancel url
+func (l *liqpayPaymentService) CreateCheckoutSession(c context.Context, productList []ProductDto, customerID string, returnURLs ReturnURLs, discount *Discount) (*CheckoutSession, error) {
+	checkout, err := newCheckout(c, PROVIDER_LIQPAY, productList, customerID, l.options.Products, discount)
+	if err != nil {
+		return nil, err
+	}
+	return l.startCheckout(c, checkout, returnURLs)
+}
+
+func (l *liqpayPaymentService) CreateTopUpSession(c context.Context, customerID string, amount int, currency string, returnURLs ReturnURLs) (*CheckoutSession, error) {
+	checkout, err := newTopUpCheckout(PROVIDER_LIQPAY, customerID, amount, currency)
+	if err != nil {
+		return nil, err
+	}
+	return l.startCheckout(c, checkout, returnURLs)
+}
+
+func (l *liqpayPaymentService) startCheckout(c context.Context, checkout *models.Checkout, returnURLs ReturnURLs) (*CheckoutSession, error) {
+	request := liqpayPayment{
+		Version:     3,
+		PublicKey:   l.options.PublicKey,
+		Action:      "pay",
+		Amount:      float64(checkout.Total) / 100,
+		Currency:    checkout.Currency,
+		Description: fmt.Sprintf("Palyvo order %s", checkout.ID),
+		OrderID:     checkout.ID,
+		ServerURL:   l.options.CallbackURL,
+		ResultURL:   returnURLs.ForSession(checkout.ID).Success,
+	}
+	if l.options.Sandbox {
+		request.Sandbox = 1
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	if err = l.options.Checkouts.Save(c, checkout); err != nil {
+		return nil, err
+	}
+	data := base64.StdEncoding.EncodeToString(payload)
+	query := url.Values{"data": {data}, "signature": {l.sign(data)}}
+	return checkoutSessionFromCheckout(checkout, liqpayCheckoutURL+"?"+query.Encode()), nil
+}
+
+func (l *liqpayPaymentService) GetCheckoutSession(c context.Context, sessionID string) (*CheckoutSession, error) {
+	return getStoredCheckout(c, l.options.Checkouts, PROVIDER_LIQPAY, sessionID)
+}
+
+// ParseWebhook reads the form LiqPay posts to the server_url
+func (l *liqpayPaymentService) ParseWebhook(c context.Context, payload []byte, header http.Header) (*Event, error) {
+	form, err := url.ParseQuery(string(payload))
+	if err != nil {
+		return nil, err
+	}
+	data := form.Get("data")
+	if data == "" || subtle.ConstantTimeCompare([]byte(form.Get("signature")), []byte(l.sign(data))) != 1 {
+		return nil, fmt.Errorf("invalid callback signature")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	var callback liqpayPayment
+	if err = json.Unmarshal(decoded, &callback); err != nil {
+		return nil, err
+	}
+	if callback.PublicKey != l.options.PublicKey {
+		return nil, fmt.Errorf("callback is for another merchant")
+	}
+
+	eventID := fmt.Sprintf("liqpay_%d_%s", callback.PaymentID, callback.Status)
+	paymentID := fmt.Sprintf("%d", callback.PaymentID)
+	total := int(math.Round(callback.Amount * 100))
+	// "sandbox" is what a test payment succeeds with, it must not count on a live merchant
+	if callback.Status == "success" || (l.options.Sandbox && callback.Status == "sandbox") {
+		return settleCheckout(c, l.options.Checkouts, eventID, callback.OrderID, true, paymentID, total, callback.Currency)
+	}
+	switch callback.Status {
+	case "failure", "error", "reversed":
+		return settleCheckout(c, l.options.Checkouts, eventID, callback.OrderID, false, paymentID, total, callback.Currency)
+	}
+	// intermediate statuses (3ds_verify, processing, ...) are followed by a final callback
+	return &Event{ID: eventID, Type: "liqpay." + callback.Status}, nil
+}
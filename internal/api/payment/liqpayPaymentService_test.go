@@ -0,0 +1,150 @@
+package payment
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"palyvoua/internal/models"
+	"testing"
+)
+
+func TestLiqPayParseWebhook(t *testing.T) {
+	const publicKey = "i31415926535"
+
+	tests := []struct {
+		name string
+		fixture string
+		sandbox bool
+		// status is the checkout's status before the callback, pending when empty
+		status string
+		edit func(callback map[string]interface{})
+		tamper func(form url.Values)
+		wantType string
+		wantStatus string
+	}{
+		{
+			name:       "success",
+			fixture:    "liqpay_success.json",
+			wantType:   EVENT_CHECKOUT_COMPLETED,
+			wantStatus: models.CHECKOUT_COMPLETED,
+		},
+		{
+			name:       "failure",
+			fixture:    "liqpay_failure.json",
+			wantType:   EVENT_CHECKOUT_FAILED,
+			wantStatus: models.CHECKOUT_FAILED,
+		},
+		{
+			name:       "sandbox payment on a sandbox merchant",
+			fixture:    "liqpay_sandbox.json",
+			sandbox:    true,
+			wantType:   EVENT_CHECKOUT_COMPLETED,
+			wantStatus: models.CHECKOUT_COMPLETED,
+		},
+		{
+			name:       "sandbox payment on a live merchant",
+			fixture:    "liqpay_sandbox.json",
+			wantType:   "liqpay.sandbox",
+			wantStatus: models.CHECKOUT_PENDING,
+		},
+		{
+			name:       "intermediate status",
+			fixture:    "liqpay_success.json",
+			edit:       func(callback map[string]interface{}) { callback["status"] = "3ds_verify" },
+			wantType:   "liqpay.3ds_verify",
+			wantStatus: models.CHECKOUT_PENDING,
+		},
+		{
+			name:       "redelivered success",
+			fixture:    "liqpay_success.json",
+			status:     models.CHECKOUT_COMPLETED,
+			wantType:   EVENT_CHECKOUT_REDELIVERED,
+			wantStatus: models.CHECKOUT_COMPLETED,
+		},
+		{
+			name:    "tampered data",
+			fixture: "liqpay_success.json",
+			tamper: func(form url.Values) {
+				data, _ := base64.StdEncoding.DecodeString(form.Get("data"))
+				var callback map[string]interface{}
+				json.Unmarshal(data, &callback)
+				callback["amount"] = 1.0
+				data, _ = json.Marshal(callback)
+				form.Set("data", base64.StdEncoding.EncodeToString(data))
+			},
+			wantStatus: models.CHECKOUT_PENDING,
+		},
+		{
+			name:       "tampered signature",
+			fixture:    "liqpay_success.json",
+			tamper:     func(form url.Values) { form.Set("signature", base64.StdEncoding.EncodeToString(make([]byte, 20))) },
+			wantStatus: models.CHECKOUT_PENDING,
+		},
+		{
+			name:       "missing signature",
+			fixture:    "liqpay_success.json",
+			tamper:     func(form url.Values) { form.Del("signature") },
+			wantStatus: models.CHECKOUT_PENDING,
+		},
+		{
+			name:       "wrong merchant",
+			fixture:    "liqpay_success.json",
+			edit:       func(callback map[string]interface{}) { callback["public_key"] = "i27182818284" },
+			wantStatus: models.CHECKOUT_PENDING,
+		},
+		{
+			name:       "amount mismatch",
+			fixture:    "liqpay_success.json",
+			edit:       func(callback map[string]interface{}) { callback["amount"] = 12.5 },
+			wantStatus: models.CHECKOUT_PENDING,
+		},
+		{
+			name:       "currency mismatch",
+			fixture:    "liqpay_success.json",
+			edit:       func(callback map[string]interface{}) { callback["currency"] = "USD" },
+			wantStatus: models.CHECKOUT_PENDING,
+		},
+		{
+			name:       "unknown order",
+			fixture:    "liqpay_success.json",
+			edit:       func(callback map[string]interface{}) { callback["order_id"] = "9d2a4c61-0000-4000-8000-000000000000" },
+			wantStatus: models.CHECKOUT_PENDING,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := tt.status
+			if status == "" {
+				status = models.CHECKOUT_PENDING
+			}
+			store := newMemoryCheckoutStore(PROVIDER_LIQPAY, status)
+			service := &liqpayPaymentService{options: LiqPayOptions{
+				PublicKey:  publicKey,
+				PrivateKey: "sandbox_private_key",
+				Sandbox:    tt.sandbox,
+				Checkouts:  store,
+			}}
+
+			callback := readFixture(t, tt.fixture)
+			if tt.edit != nil {
+				tt.edit(callback)
+			}
+			raw, err := json.Marshal(callback)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := base64.StdEncoding.EncodeToString(raw)
+			form := url.Values{"data": {data}, "signature": {service.sign(data)}}
+			if tt.tamper != nil {
+				tt.tamper(form)
+			}
+
+			event, err := service.ParseWebhook(context.Background(), []byte(form.Encode()), nil)
+			checkEvent(t, event, err, tt.wantType)
+			if got := store.status(t); got != tt.wantStatus {
+				t.Fatalf("checkout status = %s, want %s", got, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package payment
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"palyvoua/internal/models"
+	"sync"
+	"time"
+)
+
+const (
+	monobankSignatureHeader = "X-Sign"
+	monobankKeyRefreshInterval = time.Minute
+)
+
+// monobank takes ISO 4217 numeric codes
+var monobankCurrencyCodes = map[string]int{
+	"UAH": 980,
+	"USD": 840,
+	"EUR": 978,
+}
+
+type MonobankOptions struct {
+	Token string
+	// BaseURL defaults to https://api.monobank.ua
+	BaseURL string
+	// WebhookURL is our /payment/webhook/monobank
+	WebhookURL string
+	// PublicKey verifies webhooks, fetched from the api when empty
+	PublicKey string
+	Products productTicketLookup
+	Checkouts checkoutStore
+}
+
+func NewMonobankPaymentService(options MonobankOptions) CheckoutProvider {
+	if options.BaseURL == "" {
+		options.BaseURL = "https://api.monobank.ua"
+	}
+	return &monobankPaymentService{
+		options: options,
+		client:  &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+type monobankPaymentService struct {
+	options MonobankOptions
+	client *http.Client
+	mu sync.Mutex
+	publicKey *ecdsa.PublicKey
+	refreshedAt time.Time
+}
+
+type monobankBasketItem struct {
+	Name string `json:"name"`
+	Qty int `json:"qty"`
+	Sum int `json:"sum"`
+	Code string `json:"code"`
+}
+
+type monobankInvoiceRequest struct {
+	Amount int `json:"amount"`
+	Ccy int `json:"ccy"`
+	MerchantPaymInfo struct {
+		Reference string `json:"reference"`
+		Destination string `json:"destination"`
+		BasketOrder []monobankBasketItem `json:"basketOrder"`
+	} `json:"merchantPaymInfo"`
+	RedirectURL string `json:"redirectUrl,omitempty"`
+	WebHookURL string `json:"webHookUrl,omitempty"`
+}
+
+type monobankInvoiceResponse struct {
+	InvoiceID string `json:"invoiceId"`
+	PageURL string `json:"pageUrl"`
+}
+
+// monobankWebhook is the invoice status monobank posts on every change
+type monobankWebhook struct {
+	InvoiceID string `json:"invoiceId"`
+	Status string `json:"status"`
+	Amount int `json:"amount"`
+	Ccy int `json:"ccy"`
+	Reference string `json:"reference"`
+	ModifiedDate string `json:"modifiedDate"`
+}
+
+func (m *monobankPaymentService) do(c context.Context, method string, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(c, method, m.options.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Token", m.options.Token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		errBody, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("monobank answered %d: %s", res.StatusCode, errBody)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// CreateCheckoutSession sends the customer back to the success url whatever the outcome, monobank has no cancel url
+func (m *monobankPaymentService) CreateCheckoutSession(c context.Context, productList []ProductDto, customerID string, returnURLs ReturnURLs, discount *Discount) (*CheckoutSession, error) {
+	checkout, err := newCheckout(c, PROVIDER_MONOBANK, productList, customerID, m.options.Products, discount)
+	if err != nil {
+		return nil, err
+	}
+	return m.startCheckout(c, checkout, returnURLs)
+}
+
+func (m *monobankPaymentService) CreateTopUpSession(c context.Context, customerID string, amount int, currency string, returnURLs ReturnURLs) (*CheckoutSession, error) {
+	checkout, err := newTopUpCheckout(PROVIDER_MONOBANK, customerID, amount, currency)
+	if err != nil {
+		return nil, err
+	}
+	return m.startCheckout(c, checkout, returnURLs)
+}
+
+func (m *monobankPaymentService) startCheckout(c context.Context, checkout *models.Checkout, returnURLs ReturnURLs) (*CheckoutSession, error) {
+	ccy, ok := monobankCurrencyCodes[checkout.Currency]
+	if !ok {
+		return nil, fmt.Errorf("monobank does not take %s", checkout.Currency)
+	}
+	var request monobankInvoiceRequest
+	request.Amount = checkout.Total
+	request.Ccy = ccy
+	request.MerchantPaymInfo.Reference = checkout.ID
+	request.MerchantPaymInfo.Destination = fmt.Sprintf("Palyvo order %s", checkout.ID)
+	// monobank expects the basket to add up to the amount and to hold products,
+	// discounted checkouts and top ups go without one
+	for _, item := range checkout.LineItems {
+		if checkout.Discount > 0 || checkout.Purpose == CHECKOUT_PURPOSE_TOP_UP {
+			break
+		}
+		request.MerchantPaymInfo.BasketOrder = append(request.MerchantPaymInfo.BasketOrder, monobankBasketItem{
+			Name: item.Title,
+			Qty:  item.Quantity,
+			Sum:  item.UnitPrice,
+			Code: item.ProductID,
+		})
+	}
+	request.RedirectURL = returnURLs.ForSession(checkout.ID).Success
+	request.WebHookURL = m.options.WebhookURL
+
+	var invoice monobankInvoiceResponse
+	if err := m.do(c, http.MethodPost, "/api/merchant/invoice/create", request, &invoice); err != nil {
+		return nil, err
+	}
+	checkout.PaymentID = invoice.InvoiceID
+	if err := m.options.Checkouts.Save(c, checkout); err != nil {
+		return nil, err
+	}
+	return checkoutSessionFromCheckout(checkout, invoice.PageURL), nil
+}
+
+func (m *monobankPaymentService) GetCheckoutSession(c context.Context, sessionID string) (*CheckoutSession, error) {
+	return getStoredCheckout(c, m.options.Checkouts, PROVIDER_MONOBANK, sessionID)
+}
+
+// key returns the webhook verification key, from the options or fetched from monobank on first use
+func (m *monobankPaymentService) key(c context.Context) (*ecdsa.PublicKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.publicKey != nil {
+		return m.publicKey, nil
+	}
+	encoded := m.options.PublicKey
+	if encoded == "" {
+		var err error
+		if encoded, err = m.fetchKey(c); err != nil {
+			return nil, err
+		}
+		m.refreshedAt = time.Now()
+	}
+	publicKey, err := parseMonobankKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	m.publicKey = publicKey
+	return publicKey, nil
+}
+
+// refreshKey fetches the key again after monobank rotated it, at most once per monobankKeyRefreshInterval
+// so forged callbacks can't have us call monobank on every request. False means it was too soon.
+func (m *monobankPaymentService) refreshKey(c context.Context) (*ecdsa.PublicKey, bool, error) {
+	m.mu.Lock()
+	if time.Since(m.refreshedAt) < monobankKeyRefreshInterval {
+		m.mu.Unlock()
+		return nil, false, nil
+	}
+	m.refreshedAt = time.Now()
+	m.mu.Unlock()
+
+	encoded, err := m.fetchKey(c)
+	if err != nil {
+		return nil, false, err
+	}
+	publicKey, err := parseMonobankKey(encoded)
+	if err != nil {
+		return nil, false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.publicKey = publicKey
+	return publicKey, true, nil
+}
+
+// fetchKey outlives a cancelled callback, the key is cached for the callbacks after it
+func (m *monobankPaymentService) fetchKey(c context.Context) (string, error) {
+	var res struct {
+		Key string `json:"key"`
+	}
+	if err := m.do(context.WithoutCancel(c), http.MethodGet, "/api/merchant/pubkey", nil, &res); err != nil {
+		return "", err
+	}
+	return res.Key, nil
+}
+
+// parseMonobankKey reads the base64 encoded PEM monobank hands out
+func parseMonobankKey(encoded string) (*ecdsa.PublicKey, error) {
+	pemBytes, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("invalid monobank public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("monobank public key is not ECDSA")
+	}
+	return publicKey, nil
+}
+
+// ecdsaSignature is the ASN.1 form of the signatures monobank sends
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+func wellFormedSignature(sig []byte) bool {
+	var parsed ecdsaSignature
+	rest, err := asn1.Unmarshal(sig, &parsed)
+	return err == nil && len(rest) == 0 && parsed.R.Sign() > 0 && parsed.S.Sign() > 0
+}
+
+func (m *monobankPaymentService) verify(c context.Context, payload []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !wellFormedSignature(sig) {
+		return fmt.Errorf("invalid webhook signature")
+	}
+	hash := sha256.Sum256(payload)
+	publicKey, err := m.key(c)
+	if err != nil {
+		return err
+	}
+	if ecdsa.VerifyASN1(publicKey, hash[:], sig) {
+		return nil
+	}
+	// the cached key rejecting a well formed signature is what a rotated key looks like
+	publicKey, refreshed, err := m.refreshKey(c)
+	if err != nil {
+		return err
+	}
+	if refreshed && ecdsa.VerifyASN1(publicKey, hash[:], sig) {
+		return nil
+	}
+	return fmt.Errorf("invalid webhook signature")
+}
+
+func (m *monobankPaymentService) ParseWebhook(c context.Context, payload []byte, header http.Header) (*Event, error) {
+	if err := m.verify(c, payload, header.Get(monobankSignatureHeader)); err != nil {
+		return nil, err
+	}
+	var webhook monobankWebhook
+	if err := json.Unmarshal(payload, &webhook); err != nil {
+		return nil, err
+	}
+
+	currency := ""
+	for code, number := range monobankCurrencyCodes {
+		if number == webhook.Ccy {
+			currency = code
+		}
+	}
+	eventID := fmt.Sprintf("monobank_%s_%s", webhook.InvoiceID, webhook.Status)
+	switch webhook.Status {
+	case "success":
+		return settleCheckout(c, m.options.Checkouts, eventID, webhook.Reference, true, webhook.InvoiceID, webhook.Amount, currency)
+	case "failure", "expired", "reversed":
+		return settleCheckout(c, m.options.Checkouts, eventID, webhook.Reference, false, webhook.InvoiceID, webhook.Amount, currency)
+	}
+	// created, processing and hold are followed by a final status
+	return &Event{ID: eventID, Type: "monobank." + webhook.Status}, nil
+}
@@ -0,0 +1,258 @@
+package payment
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"palyvoua/internal/models"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// monobankKeyServer serves the webhook key the way /api/merchant/pubkey does and counts how often it is asked
+type monobankKeyServer struct {
+	mu sync.Mutex
+	key *ecdsa.PrivateKey
+	fetches atomic.Int32
+}
+
+func newMonobankKeyServer(t *testing.T) (*monobankKeyServer, *httptest.Server) {
+	keys := &monobankKeyServer{key: newMonobankKey(t)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/merchant/pubkey" || r.Header.Get("X-Token") != "test-token" {
+			http.NotFound(w, r)
+			return
+		}
+		keys.fetches.Add(1)
+		keys.mu.Lock()
+		defer keys.mu.Unlock()
+		der, err := x509.MarshalPKIXPublicKey(&keys.key.PublicKey)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		encoded := base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		json.NewEncoder(w).Encode(map[string]string{"key": encoded})
+	}))
+	t.Cleanup(server.Close)
+	return keys, server
+}
+
+// rotate makes the server hand out a new key, callbacks signed with the old one no longer verify
+func (k *monobankKeyServer) rotate(t *testing.T) *ecdsa.PrivateKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.key = newMonobankKey(t)
+	return k.key
+}
+
+func (k *monobankKeyServer) current() *ecdsa.PrivateKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.key
+}
+
+func newMonobankKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func signMonobank(t *testing.T, key *ecdsa.PrivateKey, payload []byte) http.Header {
+	hash := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return http.Header{monobankSignatureHeader: {base64.StdEncoding.EncodeToString(sig)}}
+}
+
+func newTestMonobank(t *testing.T, status string) (*monobankPaymentService, *monobankKeyServer, *memoryCheckoutStore) {
+	keys, server := newMonobankKeyServer(t)
+	store := newMemoryCheckoutStore(PROVIDER_MONOBANK, status)
+	service := NewMonobankPaymentService(MonobankOptions{
+		Token:     "test-token",
+		BaseURL:   server.URL,
+		Checkouts: store,
+	}).(*monobankPaymentService)
+	return service, keys, store
+}
+
+func TestMonobankParseWebhook(t *testing.T) {
+	tests := []struct {
+		name string
+		fixture string
+		// status is the checkout's status before the callback, pending when empty
+		status string
+		edit func(webhook map[string]interface{})
+		// sign returns the headers sent with the payload, a valid signature when nil
+		sign func(t *testing.T, keys *monobankKeyServer, payload []byte) http.Header
+		wantType string
+		wantStatus string
+		// wantFetches is how often the key is fetched, a forged callback must not fetch it again
+		wantFetches int32
+	}{
+		{
+			name:        "success",
+			fixture:     "monobank_success.json",
+			wantType:    EVENT_CHECKOUT_COMPLETED,
+			wantStatus:  models.CHECKOUT_COMPLETED,
+			wantFetches: 1,
+		},
+		{
+			name:        "failure",
+			fixture:     "monobank_failure.json",
+			wantType:    EVENT_CHECKOUT_FAILED,
+			wantStatus:  models.CHECKOUT_FAILED,
+			wantFetches: 1,
+		},
+		{
+			name:        "expired",
+			fixture:     "monobank_failure.json",
+			edit:        func(webhook map[string]interface{}) { webhook["status"] = "expired" },
+			wantType:    EVENT_CHECKOUT_FAILED,
+			wantStatus:  models.CHECKOUT_FAILED,
+			wantFetches: 1,
+		},
+		{
+			name:        "processing",
+			fixture:     "monobank_processing.json",
+			wantType:    "monobank.processing",
+			wantStatus:  models.CHECKOUT_PENDING,
+			wantFetches: 1,
+		},
+		{
+			name:        "redelivered success",
+			fixture:     "monobank_success.json",
+			status:      models.CHECKOUT_COMPLETED,
+			wantType:    EVENT_CHECKOUT_REDELIVERED,
+			wantStatus:  models.CHECKOUT_COMPLETED,
+			wantFetches: 1,
+		},
+		{
+			name:    "tampered signature",
+			fixture: "monobank_success.json",
+			sign: func(t *testing.T, keys *monobankKeyServer, payload []byte) http.Header {
+				return signMonobank(t, newMonobankKey(t), payload)
+			},
+			wantStatus:  models.CHECKOUT_PENDING,
+			wantFetches: 1,
+		},
+		{
+			name:    "malformed signature",
+			fixture: "monobank_success.json",
+			sign: func(t *testing.T, keys *monobankKeyServer, payload []byte) http.Header {
+				return http.Header{monobankSignatureHeader: {base64.StdEncoding.EncodeToString([]byte("not a signature"))}}
+			},
+			wantStatus: models.CHECKOUT_PENDING,
+		},
+		{
+			name:    "missing signature",
+			fixture: "monobank_success.json",
+			sign: func(t *testing.T, keys *monobankKeyServer, payload []byte) http.Header {
+				return http.Header{}
+			},
+			wantStatus: models.CHECKOUT_PENDING,
+		},
+		{
+			name:        "invoice of another merchant",
+			fixture:     "monobank_success.json",
+			edit:        func(webhook map[string]interface{}) { webhook["reference"] = "9d2a4c61-0000-4000-8000-000000000000" },
+			wantStatus:  models.CHECKOUT_PENDING,
+			wantFetches: 1,
+		},
+		{
+			name:        "amount mismatch",
+			fixture:     "monobank_success.json",
+			edit:        func(webhook map[string]interface{}) { webhook["amount"] = 1250 },
+			wantStatus:  models.CHECKOUT_PENDING,
+			wantFetches: 1,
+		},
+		{
+			name:        "currency mismatch",
+			fixture:     "monobank_success.json",
+			edit:        func(webhook map[string]interface{}) { webhook["ccy"] = 840 },
+			wantStatus:  models.CHECKOUT_PENDING,
+			wantFetches: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := tt.status
+			if status == "" {
+				status = models.CHECKOUT_PENDING
+			}
+			service, keys, store := newTestMonobank(t, status)
+
+			webhook := readFixture(t, tt.fixture)
+			if tt.edit != nil {
+				tt.edit(webhook)
+			}
+			payload, err := json.Marshal(webhook)
+			if err != nil {
+				t.Fatal(err)
+			}
+			header := signMonobank(t, keys.current(), payload)
+			if tt.sign != nil {
+				header = tt.sign(t, keys, payload)
+			}
+
+			event, err := service.ParseWebhook(context.Background(), payload, header)
+			checkEvent(t, event, err, tt.wantType)
+			if got := store.status(t); got != tt.wantStatus {
+				t.Fatalf("checkout status = %s, want %s", got, tt.wantStatus)
+			}
+			if got := keys.fetches.Load(); got != tt.wantFetches {
+				t.Fatalf("key fetched %d times, want %d", got, tt.wantFetches)
+			}
+		})
+	}
+}
+
+func TestMonobankKeyRotation(t *testing.T) {
+	service, keys, store := newTestMonobank(t, models.CHECKOUT_PENDING)
+	processing, err := json.Marshal(readFixture(t, "monobank_processing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = service.ParseWebhook(context.Background(), processing, signMonobank(t, keys.current(), processing)); err != nil {
+		t.Fatalf("first callback: %v", err)
+	}
+
+	// right after a fetch, a callback signed with a rotated key is turned away without asking monobank
+	success, err := json.Marshal(readFixture(t, "monobank_success.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := keys.rotate(t)
+	if _, err = service.ParseWebhook(context.Background(), success, signMonobank(t, rotated, success)); err == nil {
+		t.Fatal("callback verified with a stale key")
+	}
+	if got := keys.fetches.Load(); got != 1 {
+		t.Fatalf("key fetched %d times within the refresh interval, want 1", got)
+	}
+
+	service.mu.Lock()
+	service.refreshedAt = time.Now().Add(-monobankKeyRefreshInterval)
+	service.mu.Unlock()
+	event, err := service.ParseWebhook(context.Background(), success, signMonobank(t, rotated, success))
+	checkEvent(t, event, err, EVENT_CHECKOUT_COMPLETED)
+	if got := keys.fetches.Load(); got != 2 {
+		t.Fatalf("key fetched %d times, want a refresh", got)
+	}
+	if got := store.status(t); got != models.CHECKOUT_COMPLETED {
+		t.Fatalf("checkout status = %s, want %s", got, models.CHECKOUT_COMPLETED)
+	}
+}
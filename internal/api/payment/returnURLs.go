@@ -0,0 +1,94 @@
+package payment
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	// CHECKOUT_SESSION_ID_PLACEHOLDER is replaced with the session id, stripe does it for its own sessions
+	CHECKOUT_SESSION_ID_PLACEHOLDER = "{CHECKOUT_SESSION_ID}"
+
+	PLATFORM_WEB = "web"
+	PLATFORM_IOS = "ios"
+	PLATFORM_ANDROID = "android"
+)
+
+// ReturnURLs are where the customer lands after paying or giving up, web pages or app deep links
+type ReturnURLs struct {
+	Success string `json:"success"`
+	Cancel string `json:"cancel"`
+}
+
+// ForSession fills in the session id for providers that don't do it themselves
+func (r ReturnURLs) ForSession(sessionID string) ReturnURLs {
+	return ReturnURLs{
+		Success: strings.ReplaceAll(r.Success, CHECKOUT_SESSION_ID_PLACEHOLDER, sessionID),
+		Cancel:  strings.ReplaceAll(r.Cancel, CHECKOUT_SESSION_ID_PLACEHOLDER, sessionID),
+	}
+}
+
+type ReturnURLResolver interface {
+	// Resolve looks up "client/platform", then "platform", then "web"
+	Resolve(client string, platform string) (ReturnURLs, error)
+}
+
+var defaultReturnURLs = map[string]ReturnURLs{
+	PLATFORM_WEB: {
+		Success: "http://localhost:4200/checkout/success?sessionId=" + CHECKOUT_SESSION_ID_PLACEHOLDER,
+		Cancel:  "http://localhost:4200/checkout/cancel?sessionId=" + CHECKOUT_SESSION_ID_PLACEHOLDER,
+	},
+}
+
+// NewReturnURLResolver reads a json object keyed by "platform" or "client/platform", e.g.
+// {"web": {"success": "https://palyvo.ua/checkout/success?sessionId={CHECKOUT_SESSION_ID}", "cancel": "..."},
+// "ios": {"success": "palyvo://checkout/success/{CHECKOUT_SESSION_ID}", "cancel": "palyvo://checkout/cancel"}}
+// An empty one sends the web to localhost.
+func NewReturnURLResolver(raw string) (ReturnURLResolver, error) {
+	urls := defaultReturnURLs
+	if raw != "" {
+		urls = map[string]ReturnURLs{}
+		if err := json.Unmarshal([]byte(raw), &urls); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := urls[PLATFORM_WEB]; !ok {
+		return nil, fmt.Errorf("a %q entry is needed", PLATFORM_WEB)
+	}
+	for key, returnURLs := range urls {
+		for _, u := range []string{returnURLs.Success, returnURLs.Cancel} {
+			parsed, err := url.Parse(u)
+			if err != nil || parsed.Scheme == "" {
+				return nil, fmt.Errorf("invalid url %q for %s", u, key)
+			}
+		}
+		if !strings.Contains(returnURLs.Success, CHECKOUT_SESSION_ID_PLACEHOLDER) {
+			return nil, fmt.Errorf("success url for %s must contain %s", key, CHECKOUT_SESSION_ID_PLACEHOLDER)
+		}
+	}
+	return &defaultReturnURLResolver{urls: urls}, nil
+}
+
+type defaultReturnURLResolver struct {
+	urls map[string]ReturnURLs
+}
+
+func (r *defaultReturnURLResolver) Resolve(client string, platform string) (ReturnURLs, error) {
+	if platform == "" {
+		platform = PLATFORM_WEB
+	}
+	if platform != PLATFORM_WEB && platform != PLATFORM_IOS && platform != PLATFORM_ANDROID {
+		return ReturnURLs{}, fmt.Errorf("unknown platform %q", platform)
+	}
+	if client != "" {
+		if returnURLs, ok := r.urls[client+"/"+platform]; ok {
+			return returnURLs, nil
+		}
+	}
+	if returnURLs, ok := r.urls[platform]; ok {
+		return returnURLs, nil
+	}
+	return r.urls[PLATFORM_WEB], nil
+}
@@ -0,0 +1,159 @@
+package payment
+
+import (
+	"fmt"
+	"github.com/stripe/stripe-go/v75"
+	"github.com/stripe/stripe-go/v75/price"
+	"github.com/stripe/stripe-go/v75/product"
+)
+
+// PRICE_VERSION_METADATA_KEY ties a provider price to the models.PriceVersion it was made for
+const PRICE_VERSION_METADATA_KEY = "priceVersionID"
+
+// CatalogPrice is one of the provider's prices of a product, amounts are in cents
+type CatalogPrice struct {
+	ID string `json:"id"`
+	UnitAmount int `json:"unitAmount"`
+	Currency string `json:"currency"`
+	Created int `json:"created"`
+	PriceVersionID string `json:"priceVersionId"`
+}
+
+// CatalogProduct is a product as the provider holds it, with its active prices
+type CatalogProduct struct {
+	ID string `json:"id"`
+	Name string `json:"name"`
+	Active bool `json:"active"`
+	// ProductTicketID is the metadata SaveProduct sets, empty on products made elsewhere
+	ProductTicketID string `json:"productTicketId"`
+	Prices []CatalogPrice `json:"prices"`
+}
+
+// Catalog gives the reconciliation job and the price changes access to the provider's products and prices
+type Catalog interface {
+	// ListProducts returns every product that hasn't been deleted, archived ones included
+	ListProducts() ([]CatalogProduct, error)
+	// CreatePrice makes an inactive price when active is false, so it can be prepared ahead of a price change
+	CreatePrice(productID string, unitAmount int, currency string, priceVersionID string, active bool) (*CatalogPrice, error)
+	// SetActivePrice activates a price and archives every other price of its product
+	SetActivePrice(productID string, priceID string) error
+	ArchivePrice(priceID string) error
+	ArchiveProduct(productID string) error
+	UpdateProductName(productID string, name string) error
+}
+
+func NewStripeCatalog() Catalog {
+	return &stripeCatalog{}
+}
+
+type stripeCatalog struct {
+}
+
+func (s *stripeCatalog) ListProducts() ([]CatalogProduct, error) {
+	var products []CatalogProduct
+	index := map[string]int{}
+	productIterator := product.List(&stripe.ProductListParams{})
+	for productIterator.Next() {
+		p := productIterator.Product()
+		index[p.ID] = len(products)
+		products = append(products, CatalogProduct{
+			ID:              p.ID,
+			Name:            p.Name,
+			Active:          p.Active,
+			ProductTicketID: p.Metadata["productID"],
+		})
+	}
+	if err := productIterator.Err(); err != nil {
+		return nil, err
+	}
+
+	// one listing of all active prices is far cheaper than one per product
+	priceIterator := price.List(&stripe.PriceListParams{Active: stripe.Bool(true)})
+	for priceIterator.Next() {
+		p := priceIterator.Price()
+		if p.Product == nil {
+			continue
+		}
+		i, ok := index[p.Product.ID]
+		if !ok {
+			continue
+		}
+		products[i].Prices = append(products[i].Prices, toCatalogPrice(p))
+	}
+	if err := priceIterator.Err(); err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+func toCatalogPrice(p *stripe.Price) CatalogPrice {
+	return CatalogPrice{
+		ID:         p.ID,
+		UnitAmount: int(p.UnitAmount),
+		Currency:   string(p.Currency),
+		Created:    int(p.Created),
+		PriceVersionID: p.Metadata[PRICE_VERSION_METADATA_KEY],
+	}
+}
+
+func priceMetadata(priceVersionID string) map[string]string {
+	if priceVersionID == "" {
+		return nil
+	}
+	return map[string]string{PRICE_VERSION_METADATA_KEY: priceVersionID}
+}
+
+func (s *stripeCatalog) CreatePrice(productID string, unitAmount int, currency string, priceVersionID string, active bool) (*CatalogPrice, error) {
+	p, err := price.New(&stripe.PriceParams{
+		Product:    stripe.String(productID),
+		UnitAmount: stripe.Int64(int64(unitAmount)),
+		Currency:   stripe.String(currency),
+		Active:     stripe.Bool(active),
+		Metadata:   priceMetadata(priceVersionID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	catalogPrice := toCatalogPrice(p)
+	return &catalogPrice, nil
+}
+
+func (s *stripeCatalog) SetActivePrice(productID string, priceID string) error {
+	p, err := price.Update(priceID, &stripe.PriceParams{Active: stripe.Bool(true)})
+	if err != nil {
+		return err
+	}
+	if p.Product == nil || p.Product.ID != productID {
+		return fmt.Errorf("price %s is not a price of %s", priceID, productID)
+	}
+	_, err = product.Update(productID, &stripe.ProductParams{DefaultPrice: stripe.String(priceID)})
+	if err != nil {
+		return err
+	}
+
+	priceIterator := price.List(&stripe.PriceListParams{Product: stripe.String(productID), Active: stripe.Bool(true)})
+	for priceIterator.Next() {
+		if other := priceIterator.Price(); other.ID != priceID {
+			if err = s.ArchivePrice(other.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return priceIterator.Err()
+}
+
+// ArchivePrice deactivates a price, stripe doesn't delete prices that may have been paid with
+func (s *stripeCatalog) ArchivePrice(priceID string) error {
+	_, err := price.Update(priceID, &stripe.PriceParams{Active: stripe.Bool(false)})
+	return err
+}
+
+func (s *stripeCatalog) ArchiveProduct(productID string) error {
+	_, err := product.Update(productID, &stripe.ProductParams{Active: stripe.Bool(false)})
+	return err
+}
+
+func (s *stripeCatalog) UpdateProductName(productID string, name string) error {
+	_, err := product.Update(productID, &stripe.ProductParams{Name: stripe.String(name)})
+	return err
+}
@@ -1,16 +1,26 @@
 package payment
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/stripe/stripe-go/v75"
+	"github.com/stripe/stripe-go/v75/balance"
 	"github.com/stripe/stripe-go/v75/charge"
 	"github.com/stripe/stripe-go/v75/checkout/session"
+	"github.com/stripe/stripe-go/v75/coupon"
 	"github.com/stripe/stripe-go/v75/customer"
 	"github.com/stripe/stripe-go/v75/paymentmethod"
 	"github.com/stripe/stripe-go/v75/price"
 	"github.com/stripe/stripe-go/v75/product"
 	"github.com/stripe/stripe-go/v75/setupintent"
+	"github.com/stripe/stripe-go/v75/webhook"
+	"log/slog"
+	"net/http"
 	"palyvoua/internal/models"
+	"palyvoua/tools/logging"
+	"palyvoua/tools/tracing"
+	"strings"
 )
 
 type PaymentError struct {}
@@ -22,13 +32,30 @@ type PaymentService interface {
 	SetDefaultPaymentMethod(customerID string, paymentMethodID string) error
 	CreateCustomer(email string) (string, error)
 	GetDefaultPaymentMethod(customerID string) (string, error)
+	ListPaymentMethods(customerID string) ([]PaymentMethod, error)
 	DeletePaymentMethodByIDAndCustomerID(paymentMethodID string, customerID string) error
-	ChargeCustomer(customerID string, amount int) (string, error)
-	CreateSetupIntent(cid string) (*stripe.SetupIntent, error)
-	GetCustomerByID(cid string) (*stripe.Customer, error)
-	SaveProduct(p *models.ProductTicket) (*stripe.Product,error)
-	CreateCheckoutSession(productList []ProductDto, customerID string) (*stripe.CheckoutSession, error)
+	ChargeCustomer(c context.Context, customerID string, amount int) (string, error)
+	CreateSetupIntent(cid string) (*SetupIntent, error)
+	GetCustomerByID(cid string) (*Customer, error)
+	SaveProduct(p *models.ProductTicket) (*Product,error)
+	CreateCheckoutSession(c context.Context, productList []ProductDto, customerID string, returnURLs ReturnURLs, discount *Discount) (*CheckoutSession, error)
+	CreateTopUpSession(c context.Context, customerID string, amount int, currency string, returnURLs ReturnURLs) (*CheckoutSession, error)
+	GetCheckoutSession(c context.Context, sessionID string) (*CheckoutSession, error)
 	DeleteProductByID(productID string) error
+	UpdateCustomer(customerID string, details CustomerDetails) error
+	DeleteCustomer(customerID string) error
+	// ParseWebhook verifies the signature of a webhook request and translates its event
+	ParseWebhook(c context.Context, payload []byte, header http.Header) (*Event, error)
+	// Ping checks that the provider answers and accepts the configured credentials
+	Ping(c context.Context) error
+}
+
+// CustomerDetails is the user data mirrored on the provider's customer record
+type CustomerDetails struct {
+	Email string
+	Name string
+	Phone string
+	PreferredLanguage string
 }
 
 type ProductDto struct {
@@ -36,12 +63,17 @@ type ProductDto struct {
 	Amount int `json:"amount" bson:"amount"`
 }
 
-func NewStripePaymentService() PaymentService {
-	return &stripePaymentService{}
+type StripePaymentServiceOptions struct {
+	// WebhookSecret verifies the signature of the events Stripe sends
+	WebhookSecret string
 }
 
-type stripePaymentService struct {
+func NewStripePaymentService(options StripePaymentServiceOptions) PaymentService {
+	return &stripePaymentService{options: options}
+}
 
+type stripePaymentService struct {
+	options StripePaymentServiceOptions
 }
 
 func (s *stripePaymentService) DeleteProductByID(productID string) error {
@@ -57,24 +89,35 @@ func (s *stripePaymentService) DeleteProductByID(productID string) error {
 	return nil
 }
 
-func (s *stripePaymentService) getPriceIDByProductID(productID string) (string, error) {
+// getPriceIDByProductID returns the newest active price, the catalog reconciliation archives the older ones
+func (s *stripePaymentService) getPriceIDByProductID(c context.Context, productID string) (string, error) {
 
-	var err error
 	params := &stripe.PriceListParams{
 		Product: stripe.String(productID),
+		Active:  stripe.Bool(true),
 	}
+	params.Context = c
 
+	var newest *stripe.Price
 	pricesIterator := price.List(params)
-
-	if err = pricesIterator.Err();err != nil {
+	for pricesIterator.Next() {
+		p := pricesIterator.Price()
+		if newest == nil || p.Created > newest.Created {
+			newest = p
+		}
+	}
+	if err := pricesIterator.Err();err != nil {
 		return "", err
 	}
-
-	priceList := pricesIterator.PriceList()
-	return priceList.Data[0].ID, nil
+	if newest == nil {
+		return "", fmt.Errorf("product %s has no active price", productID)
+	}
+	return newest.ID, nil
 }
 
-func (s *stripePaymentService) CreateCheckoutSession(productList []ProductDto, customerID string) (*stripe.CheckoutSession, error) {
+func (s *stripePaymentService) CreateCheckoutSession(c context.Context, productList []ProductDto, customerID string, returnURLs ReturnURLs, discount *Discount) (_ *CheckoutSession, err error) {
+	c, span := tracing.Tracer.Start(c, "stripe.CreateCheckoutSession")
+	defer tracing.End(span, &err)
 
 	var lineItems []*stripe.CheckoutSessionLineItemParams
 
@@ -82,7 +125,7 @@ func (s *stripePaymentService) CreateCheckoutSession(productList []ProductDto, c
 
 		quantity := int64(p.Amount)
 
-		priceID, err := s.getPriceIDByProductID(p.ProductStripeID)
+		priceID, err := s.getPriceIDByProductID(c, p.ProductStripeID)
 
 		if err!=nil {
 			return nil, err
@@ -103,26 +146,164 @@ func (s *stripePaymentService) CreateCheckoutSession(productList []ProductDto, c
 
 	// Create a checkout session with the product's price
 
-	fmt.Println("ZALUPA")
-	fmt.Println(*lineItems[0])
+	slog.DebugContext(c, "creating checkout session", "customer_id", customerID, "line_items", len(lineItems))
 	params := &stripe.CheckoutSessionParams{
+		Params: stripe.Params{Context: c},
 		Customer: stripe.String(customerID),
 		PaymentMethodTypes: stripe.StringSlice([]string{
 			"card",
 		}),
 		LineItems: lineItems,
 		Mode: stripe.String(string(stripe.CheckoutSessionModePayment)),
-		SuccessURL: stripe.String("https://example.com/success"),
-		CancelURL: stripe.String("https://example.com/cancel"),
+		// stripe fills in {CHECKOUT_SESSION_ID} itself
+		SuccessURL: stripe.String(returnURLs.Success),
+		CancelURL: stripe.String(returnURLs.Cancel),
 		RedirectOnCompletion: nil,
 	}
+	if discount != nil {
+		// a single use coupon per checkout, the promotion itself is ours and not stripe's
+		stripeCoupon, err := coupon.New(&stripe.CouponParams{
+			Params:         stripe.Params{Context: c},
+			AmountOff:      stripe.Int64(int64(discount.Amount)),
+			Currency:       stripe.String(strings.ToLower(discount.Currency)),
+			Duration:       stripe.String(string(stripe.CouponDurationOnce)),
+			MaxRedemptions: stripe.Int64(1),
+			Name:           stripe.String(discount.Name),
+		})
+		if err != nil {
+			return nil, err
+		}
+		params.Discounts = []*stripe.CheckoutSessionDiscountParams{{Coupon: stripe.String(stripeCoupon.ID)}}
+	}
 
 	sess, err := session.New(params)
-	return sess,err
+	if err != nil {
+		return nil, err
+	}
+	return toCheckoutSession(sess), nil
+}
+
+// CreateTopUpSession charges an ad hoc price, a top up has no product in the catalog
+func (s *stripePaymentService) CreateTopUpSession(c context.Context, customerID string, amount int, currency string, returnURLs ReturnURLs) (_ *CheckoutSession, err error) {
+	c, span := tracing.Tracer.Start(c, "stripe.CreateTopUpSession")
+	defer tracing.End(span, &err)
+	if amount <= 0 {
+		return nil, fmt.Errorf("invalid top up amount")
+	}
+	params := &stripe.CheckoutSessionParams{
+		Params: stripe.Params{Context: c},
+		Customer: stripe.String(customerID),
+		PaymentMethodTypes: stripe.StringSlice([]string{
+			"card",
+		}),
+		LineItems: []*stripe.CheckoutSessionLineItemParams{{
+			PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
+				Currency:   stripe.String(strings.ToLower(currency)),
+				UnitAmount: stripe.Int64(int64(amount)),
+				ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
+					Name: stripe.String("Wallet top up"),
+				},
+			},
+			Quantity: stripe.Int64(1),
+		}},
+		Mode:       stripe.String(string(stripe.CheckoutSessionModePayment)),
+		SuccessURL: stripe.String(returnURLs.Success),
+		CancelURL:  stripe.String(returnURLs.Cancel),
+	}
+	params.AddMetadata(checkoutPurposeMetadataKey, CHECKOUT_PURPOSE_TOP_UP)
+	sess, err := session.New(params)
+	if err != nil {
+		return nil, err
+	}
+	return toCheckoutSession(sess), nil
+}
+
+const checkoutPurposeMetadataKey = "purpose"
+
+func toCheckoutSession(sess *stripe.CheckoutSession) *CheckoutSession {
+	checkoutSession := CheckoutSession{
+		ID:          sess.ID,
+		URL:         sess.URL,
+		Status:      models.CHECKOUT_PENDING,
+		Purpose:     CHECKOUT_PURPOSE_TICKETS,
+		AmountTotal: int(sess.AmountTotal),
+		Currency:    strings.ToUpper(string(sess.Currency)),
+	}
+	if purpose := sess.Metadata[checkoutPurposeMetadataKey]; purpose != "" {
+		checkoutSession.Purpose = purpose
+	}
+	switch {
+	case sess.Status == stripe.CheckoutSessionStatusComplete && sess.PaymentStatus != stripe.CheckoutSessionPaymentStatusUnpaid:
+		checkoutSession.Status = models.CHECKOUT_COMPLETED
+	case sess.Status == stripe.CheckoutSessionStatusExpired:
+		checkoutSession.Status = models.CHECKOUT_EXPIRED
+	}
+	if sess.Customer != nil {
+		checkoutSession.CustomerID = sess.Customer.ID
+	}
+	if sess.PaymentIntent != nil {
+		checkoutSession.PaymentID = sess.PaymentIntent.ID
+	}
+	if sess.LineItems != nil && checkoutSession.Purpose == CHECKOUT_PURPOSE_TICKETS {
+		for _, item := range sess.LineItems.Data {
+			checkoutSession.LineItems = append(checkoutSession.LineItems, LineItem{
+				ProductID:      item.Price.Product.ID,
+				Quantity:       int(item.Quantity),
+				PriceVersionID: item.Price.Metadata[PRICE_VERSION_METADATA_KEY],
+			})
+		}
+	}
+	return &checkoutSession
 }
 
+func (s *stripePaymentService) GetCheckoutSession(c context.Context, sessionID string) (_ *CheckoutSession, err error) {
+	c, span := tracing.Tracer.Start(c, "stripe.GetCheckoutSession")
+	defer tracing.End(span, &err)
+	sess, err := session.Get(sessionID, &stripe.CheckoutSessionParams{Params: stripe.Params{Context: c}})
+	if err != nil {
+		return nil, err
+	}
+	return toCheckoutSession(sess), nil
+}
 
-func (s *stripePaymentService) SaveProduct(p *models.ProductTicket) (*stripe.Product,error) {
+func (s *stripePaymentService) ParseWebhook(c context.Context, payload []byte, header http.Header) (*Event, error) {
+	event, err := webhook.ConstructEventWithOptions(payload, header.Get("Stripe-Signature"), s.options.WebhookSecret, webhook.ConstructEventOptions{IgnoreAPIVersionMismatch: true})
+	if err != nil {
+		return nil, err
+	}
+	if event.Type != "checkout.session.completed" && event.Type != "checkout.session.expired" {
+		return &Event{ID: event.ID, Type: string(event.Type)}, nil
+	}
+
+	var checkoutSession stripe.CheckoutSession
+	if err = json.Unmarshal(event.Data.Raw, &checkoutSession); err != nil {
+		return nil, err
+	}
+	// an expired session bought nothing, only its id matters
+	if event.Type == "checkout.session.expired" {
+		return &Event{
+			ID:              event.ID,
+			Type:            EVENT_CHECKOUT_FAILED,
+			CheckoutSession: toCheckoutSession(&checkoutSession),
+		}, nil
+	}
+	// the event doesn't carry the line items, they have to be expanded on a fresh copy
+	var param = "line_items"
+	sess, err := session.Get(checkoutSession.ID, &stripe.CheckoutSessionParams{
+		Expand: []*string{&param},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Event{
+		ID:              event.ID,
+		Type:            EVENT_CHECKOUT_COMPLETED,
+		CheckoutSession: toCheckoutSession(sess),
+	}, nil
+}
+
+
+func (s *stripePaymentService) SaveProduct(p *models.ProductTicket) (*Product,error) {
 	stripeProduct, err := product.New(&stripe.ProductParams{
 		Name: stripe.String(p.Title),
 		Type: stripe.String(string(stripe.ProductTypeGood)),
@@ -134,27 +315,28 @@ func (s *stripePaymentService) SaveProduct(p *models.ProductTicket) (*stripe.Pro
 	if err != nil {
 		return nil, err
 	}
-	_, err = price.New(&stripe.PriceParams{
+	stripePrice, err := price.New(&stripe.PriceParams{
 		Product:    stripe.String(stripeProduct.ID),
 		UnitAmount: stripe.Int64(int64(p.Price)), // price in cents
 		Currency:   stripe.String(p.Currency),
+		Metadata:   priceMetadata(priceVersionID(p)),
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	return stripeProduct,nil
+	return &Product{ID: stripeProduct.ID, PriceID: stripePrice.ID},nil
 }
 
-func (s *stripePaymentService) GetCustomerByID(cid string) (*stripe.Customer, error) {
+func (s *stripePaymentService) GetCustomerByID(cid string) (*Customer, error) {
 	c, err := customer.Get(cid, nil)
 	if err != nil {
-		return &stripe.Customer{}, err
+		return &Customer{}, err
 	}
-	return c, nil
+	return &Customer{ID: c.ID, Email: c.Email, Name: c.Name}, nil
 }
 
-func (s *stripePaymentService) CreateSetupIntent(cid string) (*stripe.SetupIntent, error) {
+func (s *stripePaymentService) CreateSetupIntent(cid string) (*SetupIntent, error) {
 	params := &stripe.SetupIntentParams{
 		AutomaticPaymentMethods: &stripe.SetupIntentAutomaticPaymentMethodsParams{
 			Enabled: stripe.Bool(true),
@@ -163,9 +345,9 @@ func (s *stripePaymentService) CreateSetupIntent(cid string) (*stripe.SetupInten
 	}
 	si, err := setupintent.New(params)
 	if err != nil {
-		return &stripe.SetupIntent{}, err
+		return &SetupIntent{}, err
 	}
-	return si, nil
+	return &SetupIntent{ID: si.ID, ClientSecret: si.ClientSecret, CustomerID: cid}, nil
 }
 
 func (s *stripePaymentService) SetDefaultPaymentMethod(customerID string, paymentMethodID string) error {
@@ -190,6 +372,51 @@ func (s *stripePaymentService) CreateCustomer(email string) (string, error) {
 	return c.ID, err
 }
 
+func (s *stripePaymentService) UpdateCustomer(customerID string, details CustomerDetails) error {
+	params := &stripe.CustomerParams{
+		Email: stripe.String(details.Email),
+		Name:  stripe.String(details.Name),
+		Phone: stripe.String(details.Phone),
+	}
+	if details.PreferredLanguage != "" {
+		params.PreferredLocales = stripe.StringSlice([]string{details.PreferredLanguage})
+	}
+	_, err := customer.Update(customerID, params)
+	return err
+}
+
+// DeleteCustomer detaches every saved payment method before deleting the customer.
+// A customer that is already gone counts as deleted, so a retried deletion can finish.
+func (s *stripePaymentService) DeleteCustomer(customerID string) error {
+	i := paymentmethod.List(&stripe.PaymentMethodListParams{
+		Customer: stripe.String(customerID),
+	})
+	for i.Next() {
+		if _, err := paymentmethod.Detach(i.PaymentMethod().ID, nil); err != nil {
+			return err
+		}
+	}
+	if err := i.Err(); err != nil && !isResourceMissing(err) {
+		return err
+	}
+	_, err := customer.Del(customerID, nil)
+	if err != nil && !isResourceMissing(err) {
+		return err
+	}
+	return nil
+}
+
+// Ping reads the account balance, the cheapest call that needs a valid key
+func (s *stripePaymentService) Ping(c context.Context) error {
+	_, err := balance.Get(&stripe.BalanceParams{Params: stripe.Params{Context: c}})
+	return err
+}
+
+func isResourceMissing(err error) bool {
+	stripeErr, ok := err.(*stripe.Error)
+	return ok && stripeErr.Code == stripe.ErrorCodeResourceMissing
+}
+
 func (s *stripePaymentService) GetDefaultPaymentMethod(customerID string) (string, error) {
 	a := "invoice_settings.default_payment_method"
 
@@ -205,6 +432,25 @@ func (s *stripePaymentService) GetDefaultPaymentMethod(customerID string) (strin
 }
 
 
+func (s *stripePaymentService) ListPaymentMethods(customerID string) ([]PaymentMethod, error) {
+	var paymentMethods []PaymentMethod
+	i := paymentmethod.List(&stripe.PaymentMethodListParams{
+		Customer: stripe.String(customerID),
+		Type:     stripe.String("card"),
+	})
+	for i.Next() {
+		pm := i.PaymentMethod()
+		paymentMethod := PaymentMethod{ID: pm.ID}
+		if pm.Card != nil {
+			paymentMethod.Brand = string(pm.Card.Brand)
+			paymentMethod.Last4 = pm.Card.Last4
+			paymentMethod.ExpMonth = int(pm.Card.ExpMonth)
+			paymentMethod.ExpYear = int(pm.Card.ExpYear)
+		}
+		paymentMethods = append(paymentMethods, paymentMethod)
+	}
+	return paymentMethods, i.Err()
+}
 
 func (s *stripePaymentService) DeletePaymentMethodByIDAndCustomerID(paymentMethodID string, customerID string) error {
 	pm, err := paymentmethod.Get(paymentMethodID, nil)
@@ -222,15 +468,18 @@ func (s *stripePaymentService) DeletePaymentMethodByIDAndCustomerID(paymentMetho
 	return nil
 }
 
-func (s *stripePaymentService) ChargeCustomer(customerID string, amount int) (string, error) {
+func (s *stripePaymentService) ChargeCustomer(c context.Context, customerID string, amount int) (_ string, err error) {
+	c, span := tracing.Tracer.Start(c, "stripe.ChargeCustomer")
+	defer tracing.End(span, &err)
 	params := &stripe.ChargeParams{
+		Params:   stripe.Params{Context: c},
 		Amount:   stripe.Int64(int64(amount)),
 		Currency: stripe.String(string(stripe.CurrencyUAH)),
 		Customer: stripe.String(customerID),
 	}
 	ch, err := charge.New(params)
 	if err != nil {
-		fmt.Println("Failed to charge customer:", err)
+		slog.ErrorContext(c, "charging customer failed", "customer_id", customerID, "amount", amount, logging.Err(err))
 		return "", err
 	}
 
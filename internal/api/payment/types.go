@@ -0,0 +1,83 @@
+package payment
+
+const (
+	// EVENT_CHECKOUT_COMPLETED is sent once a checkout session has been paid
+	EVENT_CHECKOUT_COMPLETED = "checkout.completed"
+	// EVENT_CHECKOUT_FAILED is sent when the provider gives up on a checkout, nothing is bought
+	EVENT_CHECKOUT_FAILED = "checkout.failed"
+	// EVENT_CHECKOUT_REDELIVERED is a callback for a checkout settled before, there is nothing left to do
+	EVENT_CHECKOUT_REDELIVERED = "checkout.redelivered"
+
+	// CHECKOUT_PURPOSE_TICKETS buys the product tickets in the line items
+	CHECKOUT_PURPOSE_TICKETS = "tickets"
+	// CHECKOUT_PURPOSE_TOP_UP adds the amount paid to the customer's wallet
+	CHECKOUT_PURPOSE_TOP_UP = "wallet_top_up"
+)
+
+type Customer struct {
+	ID string `json:"id"`
+	Email string `json:"email"`
+	Name string `json:"name"`
+}
+
+// SetupIntent lets the client save a payment method for later charges
+type SetupIntent struct {
+	ID string `json:"id"`
+	ClientSecret string `json:"clientSecret"`
+	CustomerID string `json:"customerId"`
+}
+
+type PaymentMethod struct {
+	ID string `json:"id"`
+	Brand string `json:"brand"`
+	Last4 string `json:"last4"`
+	ExpMonth int `json:"expMonth"`
+	ExpYear int `json:"expYear"`
+}
+
+// Product is the provider's copy of a product ticket
+type Product struct {
+	ID string `json:"id"`
+	PriceID string `json:"priceId"`
+}
+
+type LineItem struct {
+	ProductID string `json:"productId"`
+	Quantity int `json:"quantity"`
+	// PriceVersionID is the version the item was priced at, empty when the provider can't tell
+	PriceVersionID string `json:"priceVersionId"`
+}
+
+// Discount is taken off the total of a checkout, it is nil when there is none
+type Discount struct {
+	// Amount in minor units of Currency
+	Amount int `json:"amount"`
+	Currency string `json:"currency"`
+	// Name is shown to the customer next to the discount
+	Name string `json:"name"`
+}
+
+type CheckoutSession struct {
+	ID string `json:"id"`
+	// URL is where the customer pays, empty when the client opens the checkout through an sdk
+	URL string `json:"url"`
+	CustomerID string `json:"customerId"`
+	// PaymentID identifies the money movement, it is stored on every ticket bought with it
+	PaymentID string `json:"paymentId"`
+	LineItems []LineItem `json:"lineItems"`
+	// Status is one of the models.CHECKOUT_ constants
+	Status string `json:"status"`
+	// Purpose is one of the CHECKOUT_PURPOSE_ constants
+	Purpose string `json:"purpose"`
+	// AmountTotal in minor units of Currency, after discounts
+	AmountTotal int `json:"amountTotal"`
+	Currency string `json:"currency"`
+}
+
+// Event is a verified webhook translated into our own terms
+type Event struct {
+	ID string `json:"id"`
+	// Type is one of the EVENT_ constants, or the provider's own type for events we don't handle
+	Type string `json:"type"`
+	CheckoutSession *CheckoutSession `json:"checkoutSession"`
+}
@@ -0,0 +1,253 @@
+package pricing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"log/slog"
+	"palyvoua/internal/api/payment"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/jobs"
+	"palyvoua/tools/logging"
+	"sync"
+	"time"
+)
+
+var ErrNotScheduled = errors.New("price version is not scheduled")
+
+type productTicketStore interface {
+	GetAllProductTickets(c context.Context) ([]models.ProductTicket, error)
+	GetByID(c context.Context, id uuid.UUID) (models.ProductTicket, error)
+	UpdatePrice(c context.Context, id uuid.UUID, price int, currency string, priceVersionID uuid.UUID) error
+}
+
+type PriceService interface {
+	// StartHistory makes the first version of a new product ticket and points the ticket at it
+	StartHistory(c context.Context, ticket *models.ProductTicket) error
+	// LinkProviderPrice records the provider price made for a version outside of this service
+	LinkProviderPrice(c context.Context, versionID uuid.UUID, stripePriceID string) error
+	// ChangePrice adds a version taking over at effectiveFrom, a time that has passed applies it right away
+	ChangePrice(c context.Context, productTicketID uuid.UUID, price int, currency string, effectiveFrom int) (*models.PriceVersion, error)
+	CancelScheduled(c context.Context, versionID uuid.UUID) error
+	History(c context.Context, productTicketID uuid.UUID) ([]models.PriceVersion, error)
+	// ApplyDue applies every scheduled version whose time has come
+	ApplyDue(c context.Context) error
+	// Run starts the history of product tickets priced before versioning, then calls ApplyDue every interval until c is cancelled
+	Run(c context.Context, interval time.Duration)
+}
+
+type PriceServiceOptions struct {
+	ProductTickets productTicketStore
+	PriceVersions repository.PriceVersionRepo
+	// Catalog is nil when the payment provider keeps no prices of its own
+	Catalog payment.Catalog
+}
+
+func NewPriceService(options PriceServiceOptions) PriceService {
+	return &defaultPriceService{
+		productTickets: options.ProductTickets,
+		priceVersions:  options.PriceVersions,
+		catalog:        options.Catalog,
+	}
+}
+
+type defaultPriceService struct {
+	productTickets productTicketStore
+	priceVersions repository.PriceVersionRepo
+	catalog payment.Catalog
+	// applying keeps an immediate change and the scheduler from activating prices at the same time
+	applying sync.Mutex
+}
+
+func newVersion(productTicketID uuid.UUID, version int, price int, currency string, effectiveFrom int) models.PriceVersion {
+	return models.PriceVersion{
+		ID:              uuid.New(),
+		ProductTicketID: productTicketID,
+		Version:         version,
+		Price:           price,
+		Currency:        currency,
+		EffectiveFrom:   effectiveFrom,
+		CreatedAt:       int(time.Now().Unix()),
+	}
+}
+
+func (s *defaultPriceService) StartHistory(c context.Context, ticket *models.ProductTicket) error {
+	now := int(time.Now().Unix())
+	version := newVersion(ticket.ID, 1, ticket.Price, ticket.Currency, now)
+	version.AppliedAt = now
+	if err := s.priceVersions.Save(c, &version); err != nil {
+		return err
+	}
+	ticket.PriceVersionID = version.ID
+	return nil
+}
+
+func (s *defaultPriceService) LinkProviderPrice(c context.Context, versionID uuid.UUID, stripePriceID string) error {
+	return s.priceVersions.UpdateStripePriceID(c, versionID, stripePriceID)
+}
+
+func (s *defaultPriceService) History(c context.Context, productTicketID uuid.UUID) ([]models.PriceVersion, error) {
+	return s.priceVersions.GetByProductTicketID(c, productTicketID)
+}
+
+func (s *defaultPriceService) ChangePrice(c context.Context, productTicketID uuid.UUID, price int, currency string, effectiveFrom int) (*models.PriceVersion, error) {
+	if price <= 0 || currency == "" {
+		return nil, fmt.Errorf("a price needs a positive amount and a currency")
+	}
+	now := int(time.Now().Unix())
+	if effectiveFrom < now {
+		effectiveFrom = now
+	}
+	ticket, err := s.productTickets.GetByID(c, productTicketID)
+	if err != nil {
+		return nil, err
+	}
+	history, err := s.priceVersions.GetByProductTicketID(c, productTicketID)
+	if err != nil {
+		return nil, err
+	}
+	number := 1
+	for _, v := range history {
+		if v.Version >= number {
+			number = v.Version + 1
+		}
+	}
+
+	version := newVersion(productTicketID, number, price, currency, effectiveFrom)
+	// the price is made inactive now so the change only has to switch it on when it is due
+	if s.catalog != nil && ticket.StripeID != "" {
+		providerPrice, err := s.catalog.CreatePrice(ticket.StripeID, price, currency, version.ID.String(), false)
+		if err != nil {
+			return nil, err
+		}
+		version.StripePriceID = providerPrice.ID
+	}
+	if err = s.priceVersions.Save(c, &version); err != nil {
+		return nil, err
+	}
+
+	if effectiveFrom <= now {
+		s.applying.Lock()
+		defer s.applying.Unlock()
+		if err = s.apply(c, &version); err != nil {
+			return nil, err
+		}
+	}
+	return &version, nil
+}
+
+func (s *defaultPriceService) CancelScheduled(c context.Context, versionID uuid.UUID) error {
+	version, err := s.priceVersions.GetByID(c, versionID)
+	if err != nil {
+		return ErrNotScheduled
+	}
+	deleted, err := s.priceVersions.DeleteScheduled(c, versionID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrNotScheduled
+	}
+	// the price was never switched on, archiving only keeps the dashboard tidy
+	if s.catalog != nil && version.StripePriceID != "" {
+		if err = s.catalog.ArchivePrice(version.StripePriceID); err != nil {
+			slog.WarnContext(c, "archiving price failed", "price_id", version.StripePriceID, logging.Err(err))
+		}
+	}
+	return nil
+}
+
+// apply makes the version the ticket's current price, with the provider first so checkouts never
+// charge a price the ticket doesn't show
+func (s *defaultPriceService) apply(c context.Context, version *models.PriceVersion) error {
+	ticket, err := s.productTickets.GetByID(c, version.ProductTicketID)
+	if err != nil {
+		return err
+	}
+	if s.catalog != nil && ticket.StripeID != "" {
+		// the ticket got its product after the change was scheduled
+		if version.StripePriceID == "" {
+			providerPrice, err := s.catalog.CreatePrice(ticket.StripeID, version.Price, version.Currency, version.ID.String(), false)
+			if err != nil {
+				return err
+			}
+			version.StripePriceID = providerPrice.ID
+			if err = s.priceVersions.UpdateStripePriceID(c, version.ID, version.StripePriceID); err != nil {
+				return err
+			}
+		}
+		if err = s.catalog.SetActivePrice(ticket.StripeID, version.StripePriceID); err != nil {
+			return err
+		}
+	}
+	if err = s.productTickets.UpdatePrice(c, ticket.ID, version.Price, version.Currency, version.ID); err != nil {
+		return err
+	}
+	version.AppliedAt = int(time.Now().Unix())
+	return s.priceVersions.MarkApplied(c, version.ID, version.AppliedAt)
+}
+
+func (s *defaultPriceService) ApplyDue(c context.Context) error {
+	s.applying.Lock()
+	defer s.applying.Unlock()
+
+	due, err := s.priceVersions.GetDue(c, int(time.Now().Unix()))
+	if err != nil {
+		return err
+	}
+	// when several versions of a ticket came due since the last run only the latest is applied,
+	// the ones it supersedes are marked applied without ever being a price
+	latest := map[uuid.UUID]int{}
+	for i := range due {
+		latest[due[i].ProductTicketID] = i
+	}
+	for i := range due {
+		version := &due[i]
+		if latest[version.ProductTicketID] != i {
+			continue
+		}
+		if err = s.apply(c, version); err != nil {
+			slog.ErrorContext(c, "applying price version failed", "price_version_id", version.ID, logging.Err(err))
+			continue
+		}
+		for j := 0; j < i; j++ {
+			if due[j].ProductTicketID != version.ProductTicketID {
+				continue
+			}
+			if err = s.priceVersions.MarkApplied(c, due[j].ID, version.AppliedAt); err != nil {
+				slog.ErrorContext(c, "marking price version superseded failed", "price_version_id", due[j].ID, logging.Err(err))
+			}
+		}
+	}
+	return nil
+}
+
+// startMissingHistories gives product tickets created before versioning a first version of their current price
+func (s *defaultPriceService) startMissingHistories(c context.Context) error {
+	tickets, err := s.productTickets.GetAllProductTickets(c)
+	if err != nil {
+		return err
+	}
+	for i := range tickets {
+		ticket := &tickets[i]
+		if ticket.PriceVersionID != uuid.Nil {
+			continue
+		}
+		if err = s.StartHistory(c, ticket); err != nil {
+			return err
+		}
+		if err = s.productTickets.UpdatePrice(c, ticket.ID, ticket.Price, ticket.Currency, ticket.PriceVersionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *defaultPriceService) Run(c context.Context, interval time.Duration) {
+	if err := s.startMissingHistories(context.WithoutCancel(c)); err != nil {
+		slog.ErrorContext(c, "starting price histories failed", logging.Err(err))
+	}
+	jobs.Every(c, interval, "applying price versions", s.ApplyDue)
+}
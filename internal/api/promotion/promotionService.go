@@ -0,0 +1,306 @@
+package promotion
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log/slog"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/jobs"
+	"slices"
+	"strings"
+	"time"
+)
+
+// RejectedError is a promotion that can't be used, its reason is safe to show the customer
+type RejectedError struct {
+	Reason string
+}
+
+func (e RejectedError) Error() string {
+	return e.Reason
+}
+
+var (
+	ErrUnknownCode = RejectedError{Reason: "unknown promo code"}
+	ErrNotRunning = RejectedError{Reason: "promo code is not valid at this time"}
+	ErrUsedUp = RejectedError{Reason: "promo code has been used up"}
+	ErrUserLimit = RejectedError{Reason: "promo code has already been used on this account"}
+	ErrFirstPurchaseOnly = RejectedError{Reason: "promo code is only valid on a first purchase"}
+	ErrNotEligible = RejectedError{Reason: "promo code does not apply to these products"}
+	ErrCodeTaken = RejectedError{Reason: "promo code already exists"}
+)
+
+// reservationExpiration outlives the checkout sessions of the providers, stripe's expire after a day
+const reservationExpiration = 25 * time.Hour
+
+// QuoteLine is one product of a checkout the promotion is checked against
+type QuoteLine struct {
+	ProductTicket models.ProductTicket
+	Quantity int
+}
+
+// Quote is what a promotion gives on a checkout
+type Quote struct {
+	Promotion models.Promotion `json:"promotion"`
+	// Discount in minor units of Currency, taken off the checkout total
+	Discount int `json:"discount"`
+	Currency string `json:"currency"`
+	BonusLiters int `json:"bonusLiters"`
+	BonusProductTicketID uuid.UUID `json:"bonusProductTicketId"`
+}
+
+type purchaseHistory interface {
+	GetAllTicketsByUserID(c context.Context, userID uuid.UUID) ([]models.Ticket, error)
+}
+
+type PromotionService interface {
+	Create(c context.Context, promotion *models.Promotion) error
+	GetAll(c context.Context) ([]models.Promotion, error)
+	SetActive(c context.Context, id uuid.UUID, active bool) error
+	// Quote validates a code for the user and prices it on the checkout lines
+	Quote(c context.Context, code string, user *models.User, lines []QuoteLine) (*Quote, error)
+	// Reserve ties a quote to a checkout session. It holds a place under the promotion's limits
+	// until Complete counts it, or it is released.
+	Reserve(c context.Context, quote *Quote, userID uuid.UUID, sessionID string) error
+	// Complete counts the redemption of a paid checkout and returns it, nil when the checkout
+	// had no promotion or was already counted. Call it in the transaction that creates the tickets.
+	Complete(c context.Context, sessionID string) (*models.PromotionRedemption, error)
+	// Release gives up the redemption of a checkout that won't be paid
+	Release(c context.Context, sessionID string) error
+	// ReleaseExpired gives up the redemptions of checkouts that can no longer be paid
+	ReleaseExpired(c context.Context) error
+	Run(c context.Context, interval time.Duration)
+}
+
+type PromotionServiceOptions struct {
+	PromotionRepo repository.PromotionRepo
+	Purchases purchaseHistory
+}
+
+func NewPromotionService(options PromotionServiceOptions) PromotionService {
+	return &defaultPromotionService{
+		promotionRepo: options.PromotionRepo,
+		purchases:     options.Purchases,
+	}
+}
+
+type defaultPromotionService struct {
+	promotionRepo repository.PromotionRepo
+	purchases purchaseHistory
+}
+
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func (s *defaultPromotionService) Create(c context.Context, promotion *models.Promotion) error {
+	promotion.Code = normalizeCode(promotion.Code)
+	if promotion.Code == "" || promotion.Value <= 0 {
+		return RejectedError{Reason: "a promotion needs a code and a positive value"}
+	}
+	switch promotion.Type {
+	case models.PROMOTION_PERCENT:
+		if promotion.Value > 100 {
+			return RejectedError{Reason: "a percentage can't be over 100"}
+		}
+	case models.PROMOTION_FIXED:
+		if promotion.Currency == "" {
+			return RejectedError{Reason: "a fixed discount needs a currency"}
+		}
+	case models.PROMOTION_BONUS_LITERS:
+	default:
+		return RejectedError{Reason: "unknown promotion type"}
+	}
+	if promotion.StartsAt != 0 && promotion.EndsAt != 0 && promotion.EndsAt <= promotion.StartsAt {
+		return RejectedError{Reason: "a promotion must end after it starts"}
+	}
+
+	_, err := s.promotionRepo.GetByCode(c, promotion.Code)
+	if err == nil {
+		return ErrCodeTaken
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+	promotion.ID = uuid.New()
+	promotion.Redemptions = 0
+	promotion.Active = true
+	promotion.CreatedAt = int(time.Now().Unix())
+	return s.promotionRepo.Save(c, promotion)
+}
+
+func (s *defaultPromotionService) GetAll(c context.Context) ([]models.Promotion, error) {
+	return s.promotionRepo.GetAll(c)
+}
+
+func (s *defaultPromotionService) SetActive(c context.Context, id uuid.UUID, active bool) error {
+	return s.promotionRepo.SetActive(c, id, active)
+}
+
+func eligible(promotion *models.Promotion, ticket *models.ProductTicket) bool {
+	if len(promotion.FuelTypes) > 0 && !slices.Contains(promotion.FuelTypes, ticket.FuelType) {
+		return false
+	}
+	if len(promotion.Sellers) > 0 && !slices.Contains(promotion.Sellers, ticket.Seller) {
+		return false
+	}
+	return true
+}
+
+func (s *defaultPromotionService) Quote(c context.Context, code string, user *models.User, lines []QuoteLine) (*Quote, error) {
+	promotion, err := s.promotionRepo.GetByCode(c, normalizeCode(code))
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrUnknownCode
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := int(time.Now().Unix())
+	if !promotion.Active || (promotion.StartsAt != 0 && now < promotion.StartsAt) || (promotion.EndsAt != 0 && now >= promotion.EndsAt) {
+		return nil, ErrNotRunning
+	}
+	if promotion.MaxRedemptions > 0 && promotion.Redemptions+promotion.Reserved >= promotion.MaxRedemptions {
+		return nil, ErrUsedUp
+	}
+	if err = s.checkUserLimit(c, &promotion, user.ID); err != nil {
+		return nil, err
+	}
+	if promotion.FirstPurchaseOnly {
+		tickets, err := s.purchases.GetAllTicketsByUserID(c, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, ticket := range tickets {
+			if ticket.PaymentID != "" {
+				return nil, ErrFirstPurchaseOnly
+			}
+		}
+	}
+
+	quote := Quote{Promotion: promotion}
+	subtotal := 0
+	for _, line := range lines {
+		if !eligible(&promotion, &line.ProductTicket) {
+			continue
+		}
+		if quote.BonusProductTicketID == uuid.Nil {
+			quote.BonusProductTicketID = line.ProductTicket.ID
+			quote.Currency = strings.ToUpper(line.ProductTicket.Currency)
+		}
+		subtotal += line.ProductTicket.Price * line.Quantity
+	}
+	if quote.BonusProductTicketID == uuid.Nil {
+		return nil, ErrNotEligible
+	}
+
+	switch promotion.Type {
+	case models.PROMOTION_PERCENT:
+		quote.Discount = subtotal * promotion.Value / 100
+	case models.PROMOTION_FIXED:
+		if !strings.EqualFold(promotion.Currency, quote.Currency) {
+			return nil, ErrNotEligible
+		}
+		quote.Discount = min(promotion.Value, subtotal)
+	case models.PROMOTION_BONUS_LITERS:
+		quote.BonusLiters = promotion.Value
+	}
+	if promotion.Type != models.PROMOTION_BONUS_LITERS {
+		quote.BonusProductTicketID = uuid.Nil
+	}
+	return &quote, nil
+}
+
+// checkUserLimit counts the checkouts still holding the code along with the paid ones
+func (s *defaultPromotionService) checkUserLimit(c context.Context, promotion *models.Promotion, userID uuid.UUID) error {
+	if promotion.MaxRedemptionsPerUser <= 0 {
+		return nil
+	}
+	used, err := s.promotionRepo.CountUsedByUser(c, promotion.ID, userID)
+	if err != nil {
+		return err
+	}
+	if used >= promotion.MaxRedemptionsPerUser {
+		return ErrUserLimit
+	}
+	return nil
+}
+
+// Reserve checks the limits again, the quote may be stale and checkouts started at once all pass Quote
+func (s *defaultPromotionService) Reserve(c context.Context, quote *Quote, userID uuid.UUID, sessionID string) error {
+	now := time.Now()
+	redemption := models.PromotionRedemption{
+		ID:                   uuid.New(),
+		PromotionID:          quote.Promotion.ID,
+		Code:                 quote.Promotion.Code,
+		UserID:               userID,
+		CheckoutSessionID:    sessionID,
+		Discount:             quote.Discount,
+		Currency:             quote.Currency,
+		BonusLiters:          quote.BonusLiters,
+		BonusProductTicketID: quote.BonusProductTicketID,
+		Status:               models.REDEMPTION_PENDING,
+		CreatedAt:            int(now.Unix()),
+		ExpiresAt:            int(now.Add(reservationExpiration).Unix()),
+	}
+	return s.promotionRepo.WithTransaction(c, func(c context.Context) error {
+		if err := s.checkUserLimit(c, &quote.Promotion, userID); err != nil {
+			return err
+		}
+		reserved, err := s.promotionRepo.Reserve(c, &redemption)
+		if err != nil {
+			return err
+		}
+		if !reserved {
+			return ErrUsedUp
+		}
+		return nil
+	})
+}
+
+func (s *defaultPromotionService) Complete(c context.Context, sessionID string) (*models.PromotionRedemption, error) {
+	redemption, err := s.promotionRepo.GetRedemptionBySessionID(c, sessionID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// a checkout paid after its reservation expired still gets what it was priced with
+	if redemption.Status == models.REDEMPTION_REDEEMED {
+		return nil, nil
+	}
+	redemption.RedeemedAt = int(time.Now().Unix())
+	counted, err := s.promotionRepo.Redeem(c, &redemption, redemption.RedeemedAt)
+	if err != nil || !counted {
+		return nil, err
+	}
+
+	// the limits were checked when the checkout started, a paid checkout keeps its discount
+	// even when others used the code up in the meantime
+	promotion, err := s.promotionRepo.GetByID(c, redemption.PromotionID)
+	if err == nil && promotion.MaxRedemptions > 0 && promotion.Redemptions > promotion.MaxRedemptions {
+		slog.WarnContext(c, "promotion redeemed over its limit", "code", promotion.Code, "redemptions", promotion.Redemptions, "limit", promotion.MaxRedemptions)
+	}
+	redemption.Status = models.REDEMPTION_REDEEMED
+	return &redemption, nil
+}
+
+func (s *defaultPromotionService) Release(c context.Context, sessionID string) error {
+	return s.promotionRepo.ReleaseBySessionID(c, sessionID)
+}
+
+func (s *defaultPromotionService) ReleaseExpired(c context.Context) error {
+	released, err := s.promotionRepo.ReleaseExpired(c, int(time.Now().Unix()))
+	if released > 0 {
+		slog.InfoContext(c, "released expired promotion reservations", "count", released)
+	}
+	return err
+}
+
+func (s *defaultPromotionService) Run(c context.Context, interval time.Duration) {
+	jobs.Every(c, interval, "releasing expired promotion reservations", s.ReleaseExpired)
+}
@@ -0,0 +1,125 @@
+package receipt
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// A4 in points
+const (
+	PAGE_WIDTH = 595.0
+	PAGE_HEIGHT = 842.0
+)
+
+// pdfDocument writes plain text pages with the built in Courier fonts. Courier is monospaced,
+// so columns line up without font metrics, and the standard fonts need nothing embedded.
+type pdfDocument struct {
+	pages []*bytes.Buffer
+}
+
+func (d *pdfDocument) addPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+}
+
+func (d *pdfDocument) page() *bytes.Buffer {
+	if len(d.pages) == 0 {
+		d.addPage()
+	}
+	return d.pages[len(d.pages)-1]
+}
+
+// text draws s with its baseline at x, y measured from the bottom left corner
+func (d *pdfDocument) text(x float64, y float64, size float64, bold bool, s string) {
+	font := "/F1"
+	if bold {
+		font = "/F2"
+	}
+	fmt.Fprintf(d.page(), "BT %s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, escapePDF(winAnsi(s)))
+}
+
+// textRight draws s ending at x
+func (d *pdfDocument) textRight(x float64, y float64, size float64, bold bool, s string) {
+	d.text(x-textWidth(s, size), y, size, bold, s)
+}
+
+func (d *pdfDocument) line(x1 float64, y1 float64, x2 float64, y2 float64) {
+	fmt.Fprintf(d.page(), "0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, y1, x2, y2)
+}
+
+// textWidth is exact for Courier, every glyph is 600 units wide
+func textWidth(s string, size float64) float64 {
+	return float64(len(winAnsi(s))) * size * 0.6
+}
+
+// bytes lays out the objects: catalog, page tree, two fonts, then a page and its content per page
+func (d *pdfDocument) bytes() []byte {
+	if len(d.pages) == 0 {
+		d.addPage()
+	}
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier-Bold /Encoding /WinAnsiEncoding >>")
+	for i, content := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", PAGE_WIDTH, PAGE_HEIGHT, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+func escapePDF(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`, "\r", "", "\n", " ").Replace(s)
+}
+
+// cyrillicLatin follows the official Ukrainian romanization, the standard fonts have no cyrillic glyphs
+var cyrillicLatin = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "h", 'ґ': "g", 'д': "d", 'е': "e", 'є': "ie", 'ж': "zh",
+	'з': "z", 'и': "y", 'і': "i", 'ї': "i", 'й': "i", 'к': "k", 'л': "l", 'м': "m", 'н': "n",
+	'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "shch", 'ь': "", 'ю': "iu", 'я': "ia", 'ы': "y", 'э': "e",
+	'ъ': "", 'ё': "io", '’': "",
+}
+
+// winAnsi turns s into single byte WinAnsi text, Latin-1 passes through and cyrillic is romanized
+func winAnsi(s string) string {
+	var out strings.Builder
+	for _, r := range s {
+		if latin, ok := cyrillicLatin[unicode.ToLower(r)]; ok && r > unicode.MaxASCII {
+			if unicode.IsUpper(r) && latin != "" {
+				latin = strings.ToUpper(latin[:1]) + latin[1:]
+			}
+			out.WriteString(latin)
+			continue
+		}
+		switch {
+		case r == '№':
+			out.WriteString("No.")
+		case r < 0x80 || (r >= 0xa0 && r <= 0xff):
+			out.WriteByte(byte(r))
+		default:
+			out.WriteByte('?')
+		}
+	}
+	return out.String()
+}
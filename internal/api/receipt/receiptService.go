@@ -0,0 +1,269 @@
+package receipt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+	"palyvoua/internal/api/payment"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Item is a product ticket bought Quantity times at UnitPrice, VAT included
+type Item struct {
+	ProductTicket models.ProductTicket
+	Quantity int
+	UnitPrice int
+}
+
+type Request struct {
+	UserID uuid.UUID
+	OrganizationID uuid.UUID
+	// Buyer is printed on the receipt, an email or an organization name
+	Buyer string
+	Reference string
+	CheckoutSessionID string
+	Currency string
+	// Total is what was paid, the difference to the items is printed as a discount. 0 takes the items' sum.
+	Total int
+	Items []Item
+}
+
+type productTicketLookup interface {
+	GetByStripeProductID(c context.Context, productID string) (models.ProductTicket, error)
+}
+
+type priceVersionLookup interface {
+	GetByID(c context.Context, id uuid.UUID) (models.PriceVersion, error)
+}
+
+type ReceiptService interface {
+	// Issue numbers, renders and stores the receipt of a payment, a payment that has one gets it back.
+	// Run it in the transaction that records the payment so every payment has a receipt and no number is skipped.
+	Issue(c context.Context, request Request) (*models.Receipt, error)
+	// IssueForCheckout issues the receipt of a paid ticket checkout
+	IssueForCheckout(c context.Context, userID uuid.UUID, organizationID uuid.UUID, buyer string, sess *payment.CheckoutSession) (*models.Receipt, error)
+	Get(c context.Context, id uuid.UUID) (models.Receipt, error)
+	List(c context.Context, userID uuid.UUID, organizationID uuid.UUID) ([]models.Receipt, error)
+	// Regenerate renders the receipt again with the current seller details, its number and amounts stay
+	Regenerate(c context.Context, id uuid.UUID) (*models.Receipt, error)
+}
+
+type ReceiptServiceOptions struct {
+	ReceiptRepo repository.ReceiptRepo
+	ProductTickets productTicketLookup
+	PriceVersions priceVersionLookup
+	// Issuer is printed at the top of every receipt
+	Issuer string
+	// NumberPrefix starts every receipt number, PV-2026-000001
+	NumberPrefix string
+	Sellers map[string]models.SellerDetails
+	// DefaultVATRate applies to sellers without details, in percent
+	DefaultVATRate int
+}
+
+// ParseSellers reads a json object of seller details keyed by seller, an empty one has no details
+func ParseSellers(raw string) (map[string]models.SellerDetails, error) {
+	sellers := map[string]models.SellerDetails{}
+	if raw == "" {
+		return sellers, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &sellers); err != nil {
+		return nil, err
+	}
+	return sellers, nil
+}
+
+func NewReceiptService(options ReceiptServiceOptions) ReceiptService {
+	return &defaultReceiptService{options: options}
+}
+
+type defaultReceiptService struct {
+	options ReceiptServiceOptions
+}
+
+func (s *defaultReceiptService) seller(seller string) models.SellerDetails {
+	details, ok := s.options.Sellers[seller]
+	if !ok {
+		return models.SellerDetails{Seller: seller, Name: seller, VATRate: s.options.DefaultVATRate}
+	}
+	details.Seller = seller
+	if details.Name == "" {
+		details.Name = seller
+	}
+	return details
+}
+
+// vatOf takes the VAT out of a gross amount, rounded half up
+func vatOf(gross int, rate int) int {
+	if rate == 0 {
+		return 0
+	}
+	return (gross*rate*2/(100+rate) + 1) / 2
+}
+
+// price spreads the discount over the lines by their share of the subtotal and sums the VAT per rate
+func (s *defaultReceiptService) price(receipt *models.Receipt, items []Item, total int) error {
+	subtotal := 0
+	for _, item := range items {
+		if item.Quantity <= 0 || item.UnitPrice < 0 {
+			return fmt.Errorf("invalid receipt item %s", item.ProductTicket.ID)
+		}
+		subtotal += item.UnitPrice * item.Quantity
+	}
+	if total == 0 {
+		total = subtotal
+	}
+	if total > subtotal {
+		return fmt.Errorf("paid %d for items worth %d", total, subtotal)
+	}
+	receipt.Discount = subtotal - total
+	receipt.Total = total
+
+	sellers := map[string]bool{}
+	vat := map[int]*models.VATLine{}
+	left := receipt.Discount
+	for i, item := range items {
+		details := s.seller(item.ProductTicket.Seller)
+		gross := item.UnitPrice * item.Quantity
+		discount := left
+		if i < len(items)-1 && subtotal > 0 {
+			discount = receipt.Discount * gross / subtotal
+		}
+		left -= discount
+		line := models.ReceiptLine{
+			ProductTicketID: item.ProductTicket.ID,
+			Title:           item.ProductTicket.Title,
+			Seller:          item.ProductTicket.Seller,
+			FuelType:        item.ProductTicket.FuelType,
+			Quantity:        item.Quantity,
+			Liters:          item.ProductTicket.Amount,
+			UnitPrice:       item.UnitPrice,
+			Discount:        discount,
+			Gross:           gross - discount,
+			VATRate:         details.VATRate,
+		}
+		line.VAT = vatOf(line.Gross, line.VATRate)
+		receipt.Lines = append(receipt.Lines, line)
+
+		if vat[line.VATRate] == nil {
+			vat[line.VATRate] = &models.VATLine{Rate: line.VATRate}
+		}
+		vat[line.VATRate].Gross += line.Gross
+		vat[line.VATRate].VAT += line.VAT
+		vat[line.VATRate].Net += line.Gross - line.VAT
+		if !sellers[details.Seller] {
+			sellers[details.Seller] = true
+			receipt.Sellers = append(receipt.Sellers, details)
+		}
+	}
+	receipt.VAT = []models.VATLine{}
+	for _, line := range vat {
+		receipt.VAT = append(receipt.VAT, *line)
+	}
+	sort.Slice(receipt.VAT, func(i, j int) bool {
+		return receipt.VAT[i].Rate > receipt.VAT[j].Rate
+	})
+	return nil
+}
+
+func (s *defaultReceiptService) Issue(c context.Context, request Request) (*models.Receipt, error) {
+	existing, err := s.options.ReceiptRepo.GetByReference(c, request.Reference)
+	if err == nil {
+		return &existing, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+	if len(request.Items) == 0 {
+		return nil, fmt.Errorf("receipt for %s has no items", request.Reference)
+	}
+
+	now := time.Now()
+	receipt := models.Receipt{
+		ID:                uuid.New(),
+		UserID:            request.UserID,
+		OrganizationID:    request.OrganizationID,
+		Buyer:             request.Buyer,
+		Reference:         request.Reference,
+		CheckoutSessionID: request.CheckoutSessionID,
+		Currency:          strings.ToUpper(request.Currency),
+		IssuedAt:          int(now.Unix()),
+	}
+	if err = s.price(&receipt, request.Items, request.Total); err != nil {
+		return nil, err
+	}
+	sequence, err := s.options.ReceiptRepo.NextSequence(c, fmt.Sprintf("receipt:%d", now.Year()))
+	if err != nil {
+		return nil, err
+	}
+	receipt.Number = fmt.Sprintf("%s-%d-%06d", s.options.NumberPrefix, now.Year(), sequence)
+	receipt.PDF = render(&receipt, s.options.Issuer)
+	if err = s.options.ReceiptRepo.Save(c, &receipt); err != nil {
+		return nil, err
+	}
+	return &receipt, nil
+}
+
+func (s *defaultReceiptService) IssueForCheckout(c context.Context, userID uuid.UUID, organizationID uuid.UUID, buyer string, sess *payment.CheckoutSession) (*models.Receipt, error) {
+	request := Request{
+		UserID:            userID,
+		OrganizationID:    organizationID,
+		Buyer:             buyer,
+		Reference:         sess.PaymentID,
+		CheckoutSessionID: sess.ID,
+		Currency:          sess.Currency,
+		Total:             sess.AmountTotal,
+	}
+	if request.Reference == "" {
+		request.Reference = sess.ID
+	}
+	for _, lineItem := range sess.LineItems {
+		productTicket, err := s.options.ProductTickets.GetByStripeProductID(c, lineItem.ProductID)
+		if err != nil {
+			return nil, err
+		}
+		// the version the item was paid at, the ticket may have a newer price by now
+		unitPrice := productTicket.Price
+		if versionID, err := uuid.Parse(lineItem.PriceVersionID); err == nil {
+			if version, err := s.options.PriceVersions.GetByID(c, versionID); err == nil {
+				unitPrice = version.Price
+			}
+		}
+		if request.Currency == "" {
+			request.Currency = productTicket.Currency
+		}
+		request.Items = append(request.Items, Item{ProductTicket: productTicket, Quantity: lineItem.Quantity, UnitPrice: unitPrice})
+	}
+	return s.Issue(c, request)
+}
+
+func (s *defaultReceiptService) Get(c context.Context, id uuid.UUID) (models.Receipt, error) {
+	return s.options.ReceiptRepo.GetByID(c, id)
+}
+
+func (s *defaultReceiptService) List(c context.Context, userID uuid.UUID, organizationID uuid.UUID) ([]models.Receipt, error) {
+	return s.options.ReceiptRepo.GetByOwner(c, userID, organizationID)
+}
+
+func (s *defaultReceiptService) Regenerate(c context.Context, id uuid.UUID) (*models.Receipt, error) {
+	receipt, err := s.options.ReceiptRepo.GetByID(c, id)
+	if err != nil {
+		return nil, err
+	}
+	for i := range receipt.Sellers {
+		receipt.Sellers[i] = s.seller(receipt.Sellers[i].Seller)
+	}
+	receipt.RegeneratedAt = int(time.Now().Unix())
+	receipt.PDF = render(&receipt, s.options.Issuer)
+	if err = s.options.ReceiptRepo.UpdateDocument(c, receipt.ID, receipt.Sellers, receipt.PDF, receipt.RegeneratedAt); err != nil {
+		return nil, err
+	}
+	return &receipt, nil
+}
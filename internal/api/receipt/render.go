@@ -0,0 +1,158 @@
+package receipt
+
+import (
+	"fmt"
+	"palyvoua/internal/models"
+	"strings"
+	"time"
+)
+
+const (
+	MARGIN = 40.0
+	BODY_SIZE = 9.0
+	LINE_HEIGHT = 13.0
+)
+
+// receiptWriter keeps the cursor and starts a new page when the current one is full
+type receiptWriter struct {
+	doc pdfDocument
+	y float64
+}
+
+func (w *receiptWriter) newline(lines int) {
+	w.y -= LINE_HEIGHT * float64(lines)
+	if w.y < MARGIN+LINE_HEIGHT {
+		w.doc.addPage()
+		w.y = PAGE_HEIGHT - MARGIN
+	}
+}
+
+func (w *receiptWriter) text(x float64, bold bool, s string) {
+	w.doc.text(x, w.y, BODY_SIZE, bold, s)
+}
+
+func (w *receiptWriter) right(x float64, bold bool, s string) {
+	w.doc.textRight(x, w.y, BODY_SIZE, bold, s)
+}
+
+func (w *receiptWriter) rule() {
+	w.doc.line(MARGIN, w.y+LINE_HEIGHT/2-1, PAGE_WIDTH-MARGIN, w.y+LINE_HEIGHT/2-1)
+}
+
+// money prints minor units as 1234.56
+func money(amount int) string {
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, amount/100, amount%100)
+}
+
+// clip cuts s to fit n characters of the table
+func clip(s string, n int) string {
+	if len(winAnsi(s)) <= n {
+		return s
+	}
+	runes := []rune(s)
+	for len(runes) > 0 && len(winAnsi(string(runes))) > n-1 {
+		runes = runes[:len(runes)-1]
+	}
+	return string(runes) + "~"
+}
+
+// render lays the receipt out on A4 pages: header, sellers, the items, the VAT breakdown and the total
+func render(receipt *models.Receipt, issuer string) []byte {
+	w := receiptWriter{y: PAGE_HEIGHT - MARGIN}
+	w.doc.addPage()
+	right := PAGE_WIDTH - MARGIN
+
+	w.doc.text(MARGIN, w.y, 16, true, issuer)
+	w.doc.textRight(right, w.y, 12, true, "Receipt / Invoice No. "+receipt.Number)
+	w.newline(2)
+	w.text(MARGIN, false, "Issued: "+time.Unix(int64(receipt.IssuedAt), 0).UTC().Format("2006-01-02 15:04 UTC"))
+	if receipt.RegeneratedAt != 0 {
+		w.right(right, false, "Regenerated: "+time.Unix(int64(receipt.RegeneratedAt), 0).UTC().Format("2006-01-02 15:04 UTC"))
+	}
+	w.newline(1)
+	w.text(MARGIN, false, "Payment reference: "+receipt.Reference)
+	w.newline(1)
+	if receipt.Buyer != "" {
+		w.text(MARGIN, false, "Buyer: "+receipt.Buyer)
+		w.newline(1)
+	}
+
+	w.newline(1)
+	for _, seller := range receipt.Sellers {
+		w.text(MARGIN, true, "Seller: "+seller.Name)
+		w.newline(1)
+		details := []string{seller.Address}
+		if seller.TaxID != "" {
+			details = append(details, "Tax ID "+seller.TaxID)
+		}
+		if seller.VATNumber != "" {
+			details = append(details, "VAT No. "+seller.VATNumber)
+		}
+		if seller.IBAN != "" {
+			details = append(details, "IBAN "+seller.IBAN)
+		}
+		if seller.VATRate == 0 {
+			details = append(details, "not a VAT payer")
+		}
+		for _, detail := range details {
+			if detail == "" {
+				continue
+			}
+			w.text(MARGIN+12, false, detail)
+			w.newline(1)
+		}
+	}
+
+	w.newline(1)
+	columns := []float64{MARGIN, 290, 320, 360, 420, 470, right}
+	w.text(columns[0], true, "Item")
+	w.right(columns[2], true, "Qty")
+	w.right(columns[3], true, "Liters")
+	w.right(columns[4], true, "Unit")
+	w.right(columns[5], true, "Discount")
+	w.right(columns[6], true, "Amount  VAT")
+	w.newline(1)
+	w.rule()
+	for _, line := range receipt.Lines {
+		title := line.Title
+		if line.Seller != "" && len(receipt.Sellers) > 1 {
+			title += " (" + line.Seller + ")"
+		}
+		w.text(columns[0], false, clip(title, 40))
+		w.right(columns[2], false, fmt.Sprintf("%d", line.Quantity))
+		w.right(columns[3], false, fmt.Sprintf("%d", line.Liters*line.Quantity))
+		w.right(columns[4], false, money(line.UnitPrice))
+		w.right(columns[5], false, money(line.Discount))
+		w.right(columns[6], false, fmt.Sprintf("%s %3d%%", money(line.Gross), line.VATRate))
+		w.newline(1)
+	}
+	w.rule()
+
+	w.newline(1)
+	w.text(MARGIN, true, "VAT")
+	w.right(380, true, "Net")
+	w.right(460, true, "VAT")
+	w.right(right, true, "Gross")
+	w.newline(1)
+	for _, vat := range receipt.VAT {
+		w.text(MARGIN, false, fmt.Sprintf("%d%%", vat.Rate))
+		w.right(380, false, money(vat.Net))
+		w.right(460, false, money(vat.VAT))
+		w.right(right, false, money(vat.Gross))
+		w.newline(1)
+	}
+
+	w.newline(1)
+	if receipt.Discount > 0 {
+		w.text(MARGIN, false, "Discount")
+		w.right(right, false, money(receipt.Discount)+" "+receipt.Currency)
+		w.newline(1)
+	}
+	w.doc.text(MARGIN, w.y, 12, true, "Total paid")
+	w.doc.textRight(right, w.y, 12, true, money(receipt.Total)+" "+strings.ToUpper(receipt.Currency))
+	return w.doc.bytes()
+}
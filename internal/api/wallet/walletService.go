@@ -0,0 +1,225 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools"
+	"time"
+)
+
+// ErrAlreadyPosted is returned with the earlier transaction when the same posting is made twice
+var ErrAlreadyPosted = errors.New("transaction was already posted")
+
+var ErrInvalidAmount = errors.New("amount must be positive")
+
+// StatementLine is one transaction as the wallet owner sees it
+type StatementLine struct {
+	TransactionID uuid.UUID `json:"transactionId"`
+	Kind string `json:"kind"`
+	Reference string `json:"reference"`
+	// Amount is positive for money in and negative for money out
+	Amount int `json:"amount"`
+	BalanceAfter int `json:"balanceAfter"`
+	CreatedAt int `json:"createdAt"`
+}
+
+type WalletService interface {
+	// Currency is the one currency wallets are kept in
+	Currency() string
+	Balance(c context.Context, userID uuid.UUID) (int, error)
+	// TopUp credits a paid top up, reference is the checkout session so a redelivered webhook counts once
+	TopUp(c context.Context, userID uuid.UUID, amount int, reference string) (*models.LedgerTransaction, error)
+	// Purchase debits the wallet and calls issue in the same database transaction, when either fails nothing is kept
+	Purchase(c context.Context, userID uuid.UUID, amount int, reference string, issue func(c context.Context, transaction *models.LedgerTransaction) error) (*models.LedgerTransaction, error)
+	// Refund credits the wallet, once per reference, and calls settle in the same database transaction
+	Refund(c context.Context, userID uuid.UUID, amount int, reference string, settle func(c context.Context, transaction *models.LedgerTransaction) error) (*models.LedgerTransaction, error)
+	Statement(c context.Context, userID uuid.UUID, before int, limit int) ([]StatementLine, error)
+}
+
+type WalletServiceOptions struct {
+	LedgerRepo repository.LedgerRepo
+	Currency string
+}
+
+func NewWalletService(options WalletServiceOptions) WalletService {
+	return &defaultWalletService{
+		ledgerRepo: options.LedgerRepo,
+		currency:   options.Currency,
+	}
+}
+
+type defaultWalletService struct {
+	ledgerRepo repository.LedgerRepo
+	currency string
+}
+
+// posting is one side of a transaction before it is applied
+type posting struct {
+	account models.LedgerAccount
+	amount int
+}
+
+func (s *defaultWalletService) walletAccount(userID uuid.UUID) models.LedgerAccount {
+	return models.LedgerAccount{
+		ID:       "wallet:" + userID.String() + ":" + s.currency,
+		Kind:     models.LEDGER_WALLET,
+		UserID:   userID,
+		Currency: s.currency,
+	}
+}
+
+func (s *defaultWalletService) systemAccount(kind string) models.LedgerAccount {
+	return models.LedgerAccount{
+		ID:       "system:" + kind + ":" + s.currency,
+		Kind:     kind,
+		Currency: s.currency,
+	}
+}
+
+func (s *defaultWalletService) Currency() string {
+	return s.currency
+}
+
+func (s *defaultWalletService) Balance(c context.Context, userID uuid.UUID) (int, error) {
+	account, err := s.ledgerRepo.GetAccount(c, s.walletAccount(userID).ID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return account.Balance, nil
+}
+
+// post applies the postings and records them as one transaction. It must run inside a database
+// transaction, a failed debit then leaves no trace of the postings applied before it.
+func (s *defaultWalletService) post(c context.Context, kind string, key string, reference string, postings []posting) (*models.LedgerTransaction, error) {
+	existing, err := s.ledgerRepo.GetTransactionByKey(c, key)
+	if err == nil {
+		return &existing, ErrAlreadyPosted
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+
+	sum := 0
+	for _, p := range postings {
+		sum += p.amount
+	}
+	if sum != 0 {
+		return nil, fmt.Errorf("postings of %s add up to %d", key, sum)
+	}
+
+	now := int(time.Now().Unix())
+	transaction := models.LedgerTransaction{
+		ID:             uuid.New(),
+		Kind:           kind,
+		IdempotencyKey: key,
+		Reference:      reference,
+		Currency:       s.currency,
+		CreatedAt:      now,
+	}
+	for _, p := range postings {
+		// only system accounts may run negative, a clearing account is owed by the providers
+		balance, err := s.ledgerRepo.ApplyEntry(c, p.account, p.amount, p.account.Kind != models.LEDGER_WALLET, now)
+		if err != nil {
+			return nil, err
+		}
+		transaction.Entries = append(transaction.Entries, models.LedgerEntry{
+			AccountID:    p.account.ID,
+			Amount:       p.amount,
+			BalanceAfter: balance,
+		})
+	}
+	if err = s.ledgerRepo.SaveTransaction(c, &transaction); err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+func (s *defaultWalletService) postInTransaction(c context.Context, kind string, key string, reference string, postings []posting, then func(c context.Context, transaction *models.LedgerTransaction) error) (*models.LedgerTransaction, error) {
+	var existing *models.LedgerTransaction
+	res, err := tools.WithTransaction(c, func(ctx context.Context) (interface{}, error) {
+		transaction, err := s.post(ctx, kind, key, reference, postings)
+		if errors.Is(err, ErrAlreadyPosted) {
+			existing = transaction
+			return nil, err
+		}
+		if err != nil {
+			return nil, err
+		}
+		if then != nil {
+			if err = then(ctx, transaction); err != nil {
+				return nil, err
+			}
+		}
+		return transaction, nil
+	})
+	if errors.Is(err, ErrAlreadyPosted) {
+		return existing, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res.(*models.LedgerTransaction), nil
+}
+
+func (s *defaultWalletService) TopUp(c context.Context, userID uuid.UUID, amount int, reference string) (*models.LedgerTransaction, error) {
+	if amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
+	return s.postInTransaction(c, models.LEDGER_TOP_UP, "topup:"+reference, reference, []posting{
+		{account: s.systemAccount(models.LEDGER_CLEARING), amount: -amount},
+		{account: s.walletAccount(userID), amount: amount},
+	}, nil)
+}
+
+func (s *defaultWalletService) Purchase(c context.Context, userID uuid.UUID, amount int, reference string, issue func(c context.Context, transaction *models.LedgerTransaction) error) (*models.LedgerTransaction, error) {
+	if amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
+	return s.postInTransaction(c, models.LEDGER_PURCHASE, "purchase:"+reference, reference, []posting{
+		{account: s.walletAccount(userID), amount: -amount},
+		{account: s.systemAccount(models.LEDGER_REVENUE), amount: amount},
+	}, issue)
+}
+
+func (s *defaultWalletService) Refund(c context.Context, userID uuid.UUID, amount int, reference string, settle func(c context.Context, transaction *models.LedgerTransaction) error) (*models.LedgerTransaction, error) {
+	if amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
+	return s.postInTransaction(c, models.LEDGER_REFUND, "refund:"+reference, reference, []posting{
+		{account: s.systemAccount(models.LEDGER_REVENUE), amount: -amount},
+		{account: s.walletAccount(userID), amount: amount},
+	}, settle)
+}
+
+func (s *defaultWalletService) Statement(c context.Context, userID uuid.UUID, before int, limit int) ([]StatementLine, error) {
+	accountID := s.walletAccount(userID).ID
+	transactions, err := s.ledgerRepo.GetByAccountID(c, accountID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	lines := []StatementLine{}
+	for _, transaction := range transactions {
+		for _, entry := range transaction.Entries {
+			if entry.AccountID != accountID {
+				continue
+			}
+			lines = append(lines, StatementLine{
+				TransactionID: transaction.ID,
+				Kind:          transaction.Kind,
+				Reference:     transaction.Reference,
+				Amount:        entry.Amount,
+				BalanceAfter:  entry.BalanceAfter,
+				CreatedAt:     transaction.CreatedAt,
+			})
+		}
+	}
+	return lines, nil
+}
@@ -0,0 +1,107 @@
+package webhook
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+)
+
+// ErrPrivateAddress is a delivery to an address inside our own network, endpoints must be public
+var ErrPrivateAddress = errors.New("endpoint resolves to a private address")
+
+// newClient builds the client deliveries are sent with.
+// The address is checked after DNS resolution so a public name can't point back at us,
+// redirects are returned as they are and no proxy is used, the dialed address is the endpoint's.
+func newClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: DEFAULT_TIMEOUT}
+	if !allowPrivate {
+		dialer.Control = func(network string, address string, conn syscall.RawConn) error {
+			return checkAddress(address)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Transport: transport,
+		Timeout:   DEFAULT_TIMEOUT,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// checkAddress rejects a dialed "ip:port" that is in privateNetworks, directly or embedded in an IPv6 address
+func checkAddress(address string) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if isPrivate(addrPort.Addr()) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// privateNetworks are the ranges a delivery must never reach: this network, private, carrier-grade nat,
+// loopback, link-local, unique local and multicast
+var privateNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+var (
+	// nat64Networks carry an IPv4 address in their last 32 bits
+	nat64Networks = []netip.Prefix{
+		netip.MustParsePrefix("64:ff9b::/96"),
+		netip.MustParsePrefix("64:ff9b:1::/48"),
+	}
+	// sixToFourNetwork carries an IPv4 address in bits 16 to 48
+	sixToFourNetwork = netip.MustParsePrefix("2002::/16")
+)
+
+func isPrivate(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	if embedded, ok := embeddedIPv4(ip); ok {
+		return isPrivate(embedded)
+	}
+	return false
+}
+
+// embeddedIPv4 returns the IPv4 address a NAT64 or 6to4 address translates to
+func embeddedIPv4(ip netip.Addr) (netip.Addr, bool) {
+	if !ip.Is6() {
+		return netip.Addr{}, false
+	}
+	bytes := ip.As16()
+	for _, network := range nat64Networks {
+		if network.Contains(ip) {
+			return netip.AddrFrom4([4]byte(bytes[12:16])), true
+		}
+	}
+	if sixToFourNetwork.Contains(ip) {
+		return netip.AddrFrom4([4]byte(bytes[2:6])), true
+	}
+	return netip.Addr{}, false
+}
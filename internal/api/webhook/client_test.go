@@ -0,0 +1,86 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		private bool
+	}{
+		{address: "127.0.0.1:443", private: true},
+		{address: "[::1]:443", private: true},
+		{address: "10.1.2.3:443", private: true},
+		{address: "172.16.0.1:443", private: true},
+		{address: "192.168.1.1:443", private: true},
+		{address: "169.254.169.254:80", private: true},
+		{address: "[fe80::1]:443", private: true},
+		{address: "0.0.0.0:443", private: true},
+		{address: "[::]:443", private: true},
+		{address: "[::ffff:127.0.0.1]:443", private: true},
+		{address: "[fd00::1]:443", private: true},
+		{address: "100.64.0.1:443", private: true},
+		{address: "100.127.255.254:443", private: true},
+		{address: "0.1.2.3:443", private: true},
+		{address: "[ff02::1]:443", private: true},
+		{address: "[64:ff9b::7f00:1]:443", private: true},
+		{address: "[64:ff9b::a00:1]:443", private: true},
+		{address: "[64:ff9b:1::a9fe:a9fe]:443", private: true},
+		{address: "[2002:7f00:1::1]:443", private: true},
+		{address: "[2002:c0a8:101::1]:443", private: true},
+		{address: "100.128.0.1:443", private: false},
+		{address: "[64:ff9b::5db8:d822]:443", private: false},
+		{address: "[2002:5db8:d822::1]:443", private: false},
+		{address: "93.184.216.34:443", private: false},
+		{address: "[2606:2800:220:1::1]:443", private: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := checkAddress(tt.address)
+			if got := errors.Is(err, ErrPrivateAddress); got != tt.private {
+				t.Fatalf("checkAddress(%s) = %v, want private %v", tt.address, err, tt.private)
+			}
+		})
+	}
+}
+
+func TestClientRefusesLoopback(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	_, err := newClient(false).Post(server.URL, "application/json", nil)
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Fatalf("post to %s: %v, want ErrPrivateAddress", server.URL, err)
+	}
+	if called {
+		t.Fatal("request reached the loopback server")
+	}
+}
+
+func TestClientDoesNotFollowRedirects(t *testing.T) {
+	followed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/internal" {
+			followed = true
+			return
+		}
+		http.Redirect(w, r, "/internal", http.StatusFound)
+	}))
+	defer server.Close()
+
+	response, err := newClient(true).Post(server.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusFound || followed {
+		t.Fatalf("status %d, followed %v, want the redirect returned as it is", response.StatusCode, followed)
+	}
+}
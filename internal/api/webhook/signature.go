@@ -0,0 +1,34 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+const (
+	SIGNATURE_HEADER = "X-Palyvo-Signature"
+	EVENT_HEADER = "X-Palyvo-Event"
+	DELIVERY_HEADER = "X-Palyvo-Delivery"
+	IDEMPOTENCY_HEADER = "Idempotency-Key"
+)
+
+// newSecret generates the signing secret of an endpoint
+func newSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(secret), nil
+}
+
+// Sign builds the signature header, the HMAC-SHA256 of "<timestamp>.<body>" under the endpoint secret.
+// Receivers recompute it and reject old timestamps so a captured delivery can't be replayed.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
@@ -0,0 +1,439 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/jobs"
+	"palyvoua/tools/logging"
+	"palyvoua/tools/metrics"
+	"palyvoua/tools/tracing"
+	"slices"
+	"time"
+)
+
+const (
+	FIRST_RETRY_DELAY = 30 * time.Second
+	MAX_RETRY_DELAY = 6 * time.Hour
+	DEFAULT_MAX_ATTEMPTS = 12
+	DEFAULT_TIMEOUT = 10 * time.Second
+	PROCESS_BATCH = 50
+	MAX_LOGGED_ATTEMPTS = 50
+)
+
+var (
+	ErrNotFound = errors.New("webhook not found")
+	ErrNotDead = errors.New("only dead deliveries can be redelivered")
+)
+
+// RejectedError is a request that can't be served as it is, Reason is safe to show
+type RejectedError struct {
+	Reason string
+}
+
+func (e RejectedError) Error() string {
+	return e.Reason
+}
+
+type productTicketGetter interface {
+	GetByID(c context.Context, id uuid.UUID) (models.ProductTicket, error)
+}
+
+// Envelope is the body of every delivery
+type Envelope struct {
+	ID string `json:"id"`
+	Type string `json:"type"`
+	Seller string `json:"seller"`
+	CreatedAt int `json:"createdAt"`
+	Data interface{} `json:"data"`
+}
+
+// PingData is the body of a test ping
+type PingData struct {
+	EndpointID uuid.UUID `json:"endpointId"`
+}
+
+// TicketData describes a ticket of the seller in ticket events
+type TicketData struct {
+	TicketID uuid.UUID `json:"ticketId"`
+	ProductTicketID uuid.UUID `json:"productTicketId"`
+	Title string `json:"title"`
+	FuelType string `json:"fuelType"`
+	Status string `json:"status"`
+	// Liters the event is about, what was bought, redeemed or refunded
+	Liters int `json:"liters"`
+	// Remaining is what is left on the ticket
+	Remaining int `json:"remaining"`
+	Price int `json:"price"`
+	Currency string `json:"currency"`
+	CheckoutSessionID string `json:"checkoutSessionId,omitempty"`
+	ExpiresAt int `json:"expiresAt"`
+}
+
+type WebhookService interface {
+	// Register adds an endpoint and returns it with its signing secret
+	Register(c context.Context, seller string, endpointURL string, events []string) (*models.WebhookEndpoint, string, error)
+	GetEndpoints(c context.Context, seller string) ([]models.WebhookEndpoint, error)
+	UpdateEndpoint(c context.Context, seller string, id uuid.UUID, endpointURL string, events []string, active bool) (*models.WebhookEndpoint, error)
+	DeleteEndpoint(c context.Context, seller string, id uuid.UUID) error
+	RotateSecret(c context.Context, seller string, id uuid.UUID) (string, error)
+
+	// PublishTicket queues an event about a ticket for the endpoints of its seller, a key is queued once per endpoint
+	PublishTicket(c context.Context, event string, key string, ticket *models.Ticket, liters int) error
+	GetDeliveries(c context.Context, seller string, endpointID uuid.UUID, status string, limit int) ([]models.WebhookDelivery, error)
+	GetDelivery(c context.Context, seller string, id uuid.UUID) (*models.WebhookDelivery, error)
+	// Redeliver queues a dead delivery again with a fresh set of attempts
+	Redeliver(c context.Context, seller string, id uuid.UUID) (*models.WebhookDelivery, error)
+	// Ping sends a test event right away and returns how it went, pings are not retried
+	Ping(c context.Context, seller string, endpointID uuid.UUID) (*models.WebhookDelivery, error)
+
+	ProcessDue(c context.Context) error
+	Run(c context.Context, interval time.Duration)
+}
+
+type WebhookServiceOptions struct {
+	WebhookRepo repository.WebhookRepo
+	ProductTicketRepo productTicketGetter
+	Client *http.Client
+	MaxAttempts int
+	// AllowHTTP accepts plain http endpoints, for local development
+	AllowHTTP bool
+	// AllowPrivateNetworks delivers to loopback and private addresses, for local development
+	AllowPrivateNetworks bool
+}
+
+func NewWebhookService(options WebhookServiceOptions) WebhookService {
+	if options.Client == nil {
+		options.Client = newClient(options.AllowPrivateNetworks)
+	}
+	if options.MaxAttempts == 0 {
+		options.MaxAttempts = DEFAULT_MAX_ATTEMPTS
+	}
+	return &defaultWebhookService{options: options}
+}
+
+type defaultWebhookService struct {
+	options WebhookServiceOptions
+}
+
+func (s *defaultWebhookService) validate(endpointURL string, events []string) error {
+	parsed, err := url.Parse(endpointURL)
+	if err != nil || parsed.Host == "" {
+		return RejectedError{Reason: "url must be absolute"}
+	}
+	if parsed.Scheme != "https" && !(s.options.AllowHTTP && parsed.Scheme == "http") {
+		return RejectedError{Reason: "url must use https"}
+	}
+	if !s.options.AllowPrivateNetworks {
+		host := parsed.Hostname()
+		ip, err := netip.ParseAddr(host)
+		if host == "localhost" || (err == nil && isPrivate(ip)) {
+			return RejectedError{Reason: "url must point to a public address"}
+		}
+	}
+	if len(events) == 0 {
+		return RejectedError{Reason: "subscribe to at least one event"}
+	}
+	for _, event := range events {
+		if !slices.Contains(models.WebhookEventTypes, event) {
+			return RejectedError{Reason: "unknown event " + event}
+		}
+	}
+	return nil
+}
+
+func normalizeEvents(events []string) []string {
+	events = slices.Clone(events)
+	slices.Sort(events)
+	return slices.Compact(events)
+}
+
+func (s *defaultWebhookService) Register(c context.Context, seller string, endpointURL string, events []string) (*models.WebhookEndpoint, string, error) {
+	if err := s.validate(endpointURL, events); err != nil {
+		return nil, "", err
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	now := int(time.Now().Unix())
+	endpoint := models.WebhookEndpoint{
+		ID:        uuid.New(),
+		Seller:    seller,
+		URL:       endpointURL,
+		Secret:    secret,
+		Events:    normalizeEvents(events),
+		Active:    true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err = s.options.WebhookRepo.SaveEndpoint(c, &endpoint); err != nil {
+		return nil, "", err
+	}
+	return &endpoint, secret, nil
+}
+
+func (s *defaultWebhookService) GetEndpoints(c context.Context, seller string) ([]models.WebhookEndpoint, error) {
+	return s.options.WebhookRepo.GetEndpointsBySeller(c, seller)
+}
+
+// endpoint returns the endpoint of a seller, other sellers' endpoints are not found
+func (s *defaultWebhookService) endpoint(c context.Context, seller string, id uuid.UUID) (*models.WebhookEndpoint, error) {
+	endpoint, err := s.options.WebhookRepo.GetEndpoint(c, id)
+	if err != nil || endpoint.Seller != seller {
+		return nil, ErrNotFound
+	}
+	return &endpoint, nil
+}
+
+func (s *defaultWebhookService) UpdateEndpoint(c context.Context, seller string, id uuid.UUID, endpointURL string, events []string, active bool) (*models.WebhookEndpoint, error) {
+	endpoint, err := s.endpoint(c, seller, id)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.validate(endpointURL, events); err != nil {
+		return nil, err
+	}
+	endpoint.URL = endpointURL
+	endpoint.Events = normalizeEvents(events)
+	endpoint.Active = active
+	endpoint.UpdatedAt = int(time.Now().Unix())
+	if err = s.options.WebhookRepo.UpdateEndpoint(c, endpoint); err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+func (s *defaultWebhookService) DeleteEndpoint(c context.Context, seller string, id uuid.UUID) error {
+	if _, err := s.endpoint(c, seller, id); err != nil {
+		return err
+	}
+	return s.options.WebhookRepo.DeleteEndpoint(c, id)
+}
+
+func (s *defaultWebhookService) RotateSecret(c context.Context, seller string, id uuid.UUID) (string, error) {
+	endpoint, err := s.endpoint(c, seller, id)
+	if err != nil {
+		return "", err
+	}
+	if endpoint.Secret, err = newSecret(); err != nil {
+		return "", err
+	}
+	endpoint.UpdatedAt = int(time.Now().Unix())
+	if err = s.options.WebhookRepo.UpdateEndpoint(c, endpoint); err != nil {
+		return "", err
+	}
+	return endpoint.Secret, nil
+}
+
+func (s *defaultWebhookService) newDelivery(endpoint *models.WebhookEndpoint, event string, key string, data interface{}) (*models.WebhookDelivery, error) {
+	now := int(time.Now().Unix())
+	payload, err := json.Marshal(Envelope{ID: key, Type: event, Seller: endpoint.Seller, CreatedAt: now, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	return &models.WebhookDelivery{
+		ID:             uuid.New(),
+		EndpointID:     endpoint.ID,
+		Seller:         endpoint.Seller,
+		Event:          event,
+		IdempotencyKey: key,
+		Payload:        string(payload),
+		Status:         models.DELIVERY_PENDING,
+		Attempts:       []models.WebhookAttempt{},
+		NextAttemptAt:  now,
+		CreatedAt:      now,
+	}, nil
+}
+
+func (s *defaultWebhookService) PublishTicket(c context.Context, event string, key string, ticket *models.Ticket, liters int) error {
+	productTicket, err := s.options.ProductTicketRepo.GetByID(c, ticket.ProductTicketID)
+	if err != nil {
+		return err
+	}
+	if productTicket.Seller == "" {
+		return nil
+	}
+	endpoints, err := s.options.WebhookRepo.GetSubscribed(c, productTicket.Seller, event)
+	if err != nil {
+		return err
+	}
+	data := TicketData{
+		TicketID:          ticket.ID,
+		ProductTicketID:   productTicket.ID,
+		Title:             productTicket.Title,
+		FuelType:          productTicket.FuelType,
+		Status:            ticket.Status,
+		Liters:            liters,
+		Remaining:         ticket.Amount,
+		Price:             productTicket.Price,
+		Currency:          productTicket.Currency,
+		CheckoutSessionID: ticket.CheckoutSessionID,
+		ExpiresAt:         ticket.ExpiresAt,
+	}
+	for i := range endpoints {
+		exists, err := s.options.WebhookRepo.ExistsDelivery(c, endpoints[i].ID, key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		delivery, err := s.newDelivery(&endpoints[i], event, key, data)
+		if err != nil {
+			return err
+		}
+		if err = s.options.WebhookRepo.SaveDelivery(c, delivery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *defaultWebhookService) GetDeliveries(c context.Context, seller string, endpointID uuid.UUID, status string, limit int) ([]models.WebhookDelivery, error) {
+	return s.options.WebhookRepo.GetDeliveries(c, seller, endpointID, status, limit)
+}
+
+func (s *defaultWebhookService) GetDelivery(c context.Context, seller string, id uuid.UUID) (*models.WebhookDelivery, error) {
+	delivery, err := s.options.WebhookRepo.GetDelivery(c, id)
+	if err != nil || delivery.Seller != seller {
+		return nil, ErrNotFound
+	}
+	return &delivery, nil
+}
+
+func (s *defaultWebhookService) Redeliver(c context.Context, seller string, id uuid.UUID) (*models.WebhookDelivery, error) {
+	delivery, err := s.GetDelivery(c, seller, id)
+	if err != nil {
+		return nil, err
+	}
+	if delivery.Status != models.DELIVERY_DEAD {
+		return nil, ErrNotDead
+	}
+	delivery.Status = models.DELIVERY_PENDING
+	delivery.Tries = 0
+	delivery.NextAttemptAt = int(time.Now().Unix())
+	if err = s.options.WebhookRepo.UpdateDelivery(c, delivery); err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+func (s *defaultWebhookService) Ping(c context.Context, seller string, endpointID uuid.UUID) (*models.WebhookDelivery, error) {
+	endpoint, err := s.endpoint(c, seller, endpointID)
+	if err != nil {
+		return nil, err
+	}
+	delivery, err := s.newDelivery(endpoint, models.WEBHOOK_PING, "ping:"+uuid.NewString(), PingData{EndpointID: endpoint.ID})
+	if err != nil {
+		return nil, err
+	}
+	attempt := s.send(c, endpoint, delivery)
+	delivery.Tries = 1
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	delivery.Status = models.DELIVERY_DEAD
+	if attempt.Error == "" {
+		delivery.Status = models.DELIVERY_DELIVERED
+		delivery.DeliveredAt = attempt.At
+	}
+	if err = s.options.WebhookRepo.SaveDelivery(c, delivery); err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// send makes one attempt, any answer but 2xx is a failure.
+// Only the status of the answer is logged, its body is never shown back to the seller.
+func (s *defaultWebhookService) send(c context.Context, endpoint *models.WebhookEndpoint, delivery *models.WebhookDelivery) models.WebhookAttempt {
+	started := time.Now()
+	attempt := models.WebhookAttempt{At: int(started.Unix())}
+	body := []byte(delivery.Payload)
+	request, err := http.NewRequestWithContext(c, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "palyvoua-webhooks/1")
+	request.Header.Set(EVENT_HEADER, delivery.Event)
+	request.Header.Set(DELIVERY_HEADER, delivery.ID.String())
+	request.Header.Set(IDEMPOTENCY_HEADER, delivery.IdempotencyKey)
+	request.Header.Set(SIGNATURE_HEADER, Sign(endpoint.Secret, started.Unix(), body))
+	response, err := s.options.Client.Do(request)
+	attempt.DurationMs = int(time.Since(started).Milliseconds())
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer response.Body.Close()
+	attempt.StatusCode = response.StatusCode
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		attempt.Error = response.Status
+	}
+	return attempt
+}
+
+func (s *defaultWebhookService) process(c context.Context, delivery *models.WebhookDelivery) (err error) {
+	c, span := tracing.Tracer.Start(c, "webhook.deliver "+delivery.Event, trace.WithAttributes(
+		attribute.String("webhook.delivery_id", delivery.ID.String()),
+		attribute.String("webhook.seller", delivery.Seller),
+	))
+	defer tracing.End(span, &err)
+	endpoint, err := s.options.WebhookRepo.GetEndpoint(c, delivery.EndpointID)
+	var attempt models.WebhookAttempt
+	switch {
+	case err == nil && endpoint.Active:
+		attempt = s.send(c, &endpoint, delivery)
+	case err == nil:
+		attempt = models.WebhookAttempt{At: int(time.Now().Unix()), Error: "endpoint is disabled"}
+	case errors.Is(err, mongo.ErrNoDocuments):
+		attempt = models.WebhookAttempt{At: int(time.Now().Unix()), Error: "endpoint was deleted"}
+	default:
+		return err
+	}
+	delivery.Tries++
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	if len(delivery.Attempts) > MAX_LOGGED_ATTEMPTS {
+		delivery.Attempts = delivery.Attempts[len(delivery.Attempts)-MAX_LOGGED_ATTEMPTS:]
+	}
+	if attempt.Error == "" {
+		delivery.Status = models.DELIVERY_DELIVERED
+		delivery.DeliveredAt = attempt.At
+	} else {
+		delivery.NextAttemptAt = int(time.Now().Add(jobs.Backoff(delivery.Tries, FIRST_RETRY_DELAY, MAX_RETRY_DELAY)).Unix())
+		if delivery.Tries >= s.options.MaxAttempts {
+			delivery.Status = models.DELIVERY_DEAD
+			slog.WarnContext(c, "webhook delivery dead", "delivery_id", delivery.ID, "seller", delivery.Seller, "attempts", delivery.Tries, "last_error", attempt.Error)
+		}
+	}
+	metrics.CountWebhookDelivery(delivery.Event, delivery.Status)
+	return s.options.WebhookRepo.UpdateDelivery(c, delivery)
+}
+
+func (s *defaultWebhookService) ProcessDue(c context.Context) error {
+	deliveries, err := s.options.WebhookRepo.GetDueDeliveries(c, int(time.Now().Unix()), PROCESS_BATCH)
+	if err != nil {
+		return err
+	}
+	for i := range deliveries {
+		if err = s.process(c, &deliveries[i]); err != nil {
+			slog.ErrorContext(c, "processing webhook delivery failed", "delivery_id", deliveries[i].ID, logging.Err(err))
+		}
+	}
+	return nil
+}
+
+func (s *defaultWebhookService) Run(c context.Context, interval time.Duration) {
+	jobs.Every(c, interval, "processing webhook deliveries", s.ProcessDue)
+}
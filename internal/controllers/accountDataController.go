@@ -0,0 +1,248 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"palyvoua/internal/api/account"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/auth"
+	"palyvoua/tools/jsonHelper"
+	"time"
+)
+
+type accountDataController struct {
+	userRepo repository.UserRepo
+	ticketRepo repository.TicketRepo
+	productTicketRepo repository.ProductTicketRepo
+	sessionRepo repository.SessionRepo
+	deletionService account.DeletionService
+}
+
+type AccountDataRoutesOptions struct {
+	UserRepo repository.UserRepo
+	AdminRepo repository.AdminRepo
+	TicketRepo repository.TicketRepo
+	ProductTicketRepo repository.ProductTicketRepo
+	SessionRepo repository.SessionRepo
+	DeletionService account.DeletionService
+}
+
+func SetupAccountDataRoutes(r *gin.Engine, options *AccountDataRoutesOptions) {
+	accountGroup := r.Group("/me")
+
+	adc := accountDataController{
+		userRepo:          options.UserRepo,
+		ticketRepo:        options.TicketRepo,
+		productTicketRepo: options.ProductTicketRepo,
+		sessionRepo:       options.SessionRepo,
+		deletionService:   options.DeletionService,
+	}
+
+	accountGroup.Use(auth.AuthMiddleware(options.UserRepo, options.AdminRepo))
+	accountGroup.GET("/export", jsonHelper.MakeHttpHandler(adc.export))
+	accountGroup.GET("/deletion", jsonHelper.MakeHttpHandler(adc.getDeletion))
+	accountGroup.POST("/deletion", jsonHelper.MakeHttpHandler(adc.requestDeletion))
+	accountGroup.DELETE("/deletion", jsonHelper.MakeHttpHandler(adc.cancelDeletion))
+}
+
+// PaymentExport groups the user's tickets by the payment that bought them
+type PaymentExport struct {
+	PaymentID string `json:"paymentId"`
+	TicketIDs []string `json:"ticketIds"`
+	Total int `json:"total"`
+	Currency string `json:"currency"`
+}
+
+type AccountExport struct {
+	ExportedAt int `json:"exportedAt"`
+	Profile models.User `json:"profile"`
+	Tickets []models.Ticket `json:"tickets"`
+	Redemptions []models.Ticket `json:"redemptions"`
+	Payments []PaymentExport `json:"payments"`
+	Sessions []models.Session `json:"sessions"`
+}
+
+func (adc *accountDataController) currentUser(c *gin.Context) (models.User, error) {
+	authBodyField, exists := c.Get("authBody")
+	if !exists {
+		return models.User{}, jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	authBody, ok := authBodyField.(auth.AuthBody)
+	if !ok {
+		return models.User{}, jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	return *authBody.GetUser(), nil
+}
+
+func (adc *accountDataController) buildExport(c *gin.Context, user *models.User) (*AccountExport, error) {
+	tickets, err := adc.ticketRepo.GetAllTicketsByUserID(c, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := adc.sessionRepo.GetAllByUserID(c, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	export := AccountExport{
+		ExportedAt:  int(time.Now().Unix()),
+		Profile:     *user,
+		Tickets:     tickets,
+		Redemptions: []models.Ticket{},
+		Payments:    []PaymentExport{},
+		Sessions:    sessions,
+	}
+	payments := map[string]*PaymentExport{}
+	for _, ticket := range tickets {
+		if ticket.Status == models.USED {
+			export.Redemptions = append(export.Redemptions, ticket)
+		}
+		if ticket.PaymentID == "" {
+			continue
+		}
+		p, ok := payments[ticket.PaymentID]
+		if !ok {
+			p = &PaymentExport{PaymentID: ticket.PaymentID}
+			payments[ticket.PaymentID] = p
+		}
+		p.TicketIDs = append(p.TicketIDs, ticket.ID.String())
+		if productTicket, err := adc.productTicketRepo.GetByID(c, ticket.ProductTicketID); err == nil {
+			p.Total += productTicket.Price
+			p.Currency = productTicket.Currency
+		}
+	}
+	for _, p := range payments {
+		export.Payments = append(export.Payments, *p)
+	}
+	return &export, nil
+}
+
+func (adc *accountDataController) export(c *gin.Context) error {
+	user, err := adc.currentUser(c)
+	if err != nil {
+		return err
+	}
+	export, err := adc.buildExport(c, &user)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error collecting account data",
+			Status: 500,
+		}
+	}
+	if c.Query("format") != "zip" {
+		c.Header("Content-Disposition", `attachment; filename="palyvo-export.json"`)
+		c.JSON(200, export)
+		return nil
+	}
+
+	archive, err := exportArchive(export)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error building export archive",
+			Status: 500,
+		}
+	}
+	c.Header("Content-Disposition", `attachment; filename="palyvo-export.zip"`)
+	c.Data(200, "application/zip", archive)
+	return nil
+}
+
+// exportArchive writes one json file per section, easier to read than a single large document
+func exportArchive(export *AccountExport) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := map[string]interface{}{
+		"profile.json":     export.Profile,
+		"tickets.json":     export.Tickets,
+		"redemptions.json": export.Redemptions,
+		"payments.json":    export.Payments,
+		"sessions.json":    export.Sessions,
+	}
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (adc *accountDataController) getDeletion(c *gin.Context) error {
+	user, err := adc.currentUser(c)
+	if err != nil {
+		return err
+	}
+	c.JSON(200, gin.H{"deletion": user.Deletion})
+	return nil
+}
+
+type RequestDeletionRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	// TOTPCode confirms the request of a user without a password
+	TOTPCode string `json:"totpCode"`
+}
+
+func (adc *accountDataController) requestDeletion(c *gin.Context) error {
+	var body RequestDeletionRequest
+	if err := c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	user, err := adc.currentUser(c)
+	if err != nil {
+		return err
+	}
+	if err = reauthenticate(c, adc.userRepo, adc.sessionRepo, &user, body.CurrentPassword, body.TOTPCode); err != nil {
+		return err
+	}
+	if user.Deletion.ScheduledAt != 0 {
+		return jsonHelper.ApiError{
+			Err:    "Deletion is already scheduled",
+			Status: 409,
+		}
+	}
+	now := time.Now()
+	deletion := models.AccountDeletion{
+		RequestedAt: int(now.Unix()),
+		ScheduledAt: int(now.Add(adc.deletionService.GracePeriod()).Unix()),
+	}
+	if err = adc.userRepo.UpdateDeletion(c, user.ID, deletion); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error scheduling deletion",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{"deletion": deletion})
+	return nil
+}
+
+func (adc *accountDataController) cancelDeletion(c *gin.Context) error {
+	user, err := adc.currentUser(c)
+	if err != nil {
+		return err
+	}
+	if user.Deletion.ScheduledAt == 0 {
+		return jsonHelper.ApiError{
+			Err:    "No deletion is scheduled",
+			Status: 404,
+		}
+	}
+	if err = adc.userRepo.UpdateDeletion(c, user.ID, models.AccountDeletion{}); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error cancelling deletion",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{})
+	return nil
+}
@@ -1,40 +1,72 @@
 package controllers
 
 import (
+	"context"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"palyvoua/internal/api/catalog"
 	"palyvoua/internal/models"
 	"palyvoua/internal/repository"
 	"palyvoua/tools/auth"
 	"palyvoua/tools/jsonHelper"
+	"slices"
+	"time"
 )
 
 type adminController struct {
 	adminRepo adminRepo
 	userRepo repository.UserRepo
+	loginLimiter auth.LoginLimiter
+	apiKeyRepo repository.APIKeyRepo
+	catalogReconciler catalog.ReconciliationService
 }
 
 type adminRepo interface {
-	GetAllRoles() ([]models.Role, error)
-	SaveRole(role models.Role) error
-	DeleteRoleByID(roleID uuid.UUID) error
-	GetRoleByID(uuid.UUID) (models.Role, error)
-	GetRoleByName(string) (models.Role, error)
+	GetAllRoles(c context.Context) ([]models.Role, error)
+	SaveRole(c context.Context, role models.Role) error
+	DeleteRoleByID(c context.Context, roleID uuid.UUID) error
+	GetRoleByID(c context.Context, id uuid.UUID) (models.Role, error)
+	GetRoleByName(c context.Context, name string) (models.Role, error)
+	UpdateRoleMFAPolicy(c context.Context, roleID uuid.UUID, required bool) error
 }
 
-func SetupAdminRoutes(r *gin.Engine, ar adminRepo, ur repository.UserRepo) {
+type AdminRoutesOptions struct {
+	AdminRepo repository.AdminRepo
+	UserRepo repository.UserRepo
+	LoginLimiter auth.LoginLimiter
+	APIKeyRepo repository.APIKeyRepo
+	// CatalogReconciler is nil when the payment provider has no catalog to reconcile
+	CatalogReconciler catalog.ReconciliationService
+}
+
+func SetupAdminRoutes(r *gin.Engine, options *AdminRoutesOptions) {
 
 	adminGroup := r.Group("/admin")
 
-	ac := adminController{ar, ur}
+	ac := adminController{
+		adminRepo:    options.AdminRepo,
+		userRepo:     options.UserRepo,
+		loginLimiter: options.LoginLimiter,
+		apiKeyRepo:   options.APIKeyRepo,
+		catalogReconciler: options.CatalogReconciler,
+	}
 
 	adminGroup.GET("/role/byId",)
 
-	adminGroup.Use(auth.AuthMiddleware(ur, ar))
-	adminGroup.Use(auth.RoleMiddleware(3, ur ,ar))
+	adminGroup.Use(auth.AuthMiddleware(options.UserRepo, options.AdminRepo))
+	adminGroup.Use(auth.RoleMiddleware(3, options.UserRepo, options.AdminRepo))
 	adminGroup.GET("/role", jsonHelper.MakeHttpHandler(ac.getAllRoles))
 	adminGroup.POST("/role", jsonHelper.MakeHttpHandler(ac.createRole))
 	adminGroup.DELETE("/role/:id", jsonHelper.MakeHttpHandler(ac.deleteRoleByID))
+	adminGroup.PUT("/role/:id/mfa", jsonHelper.MakeHttpHandler(ac.updateRoleMFAPolicy))
+	adminGroup.POST("/user/unlock", jsonHelper.MakeHttpHandler(ac.unlockUser))
+	adminGroup.POST("/user/:id/mfaEnrollment", jsonHelper.MakeHttpHandler(ac.issueMFAEnrollment))
+	adminGroup.GET("/apiKey", jsonHelper.MakeHttpHandler(ac.getAllAPIKeys))
+	adminGroup.POST("/apiKey", jsonHelper.MakeHttpHandler(ac.createAPIKey))
+	adminGroup.DELETE("/apiKey/:id", jsonHelper.MakeHttpHandler(ac.revokeAPIKey))
+	adminGroup.GET("/catalog/reconcile", jsonHelper.MakeHttpHandler(ac.checkCatalog))
+	adminGroup.POST("/catalog/reconcile", jsonHelper.MakeHttpHandler(ac.repairCatalog))
 }
 
 func (ac *adminController) getRoleByID(c *gin.Context) error {
@@ -44,7 +76,7 @@ func (ac *adminController) getRoleByID(c *gin.Context) error {
 	if err != nil {
 		return err
 	}
-	role, err := ac.adminRepo.GetRoleByID(id)
+	role, err := ac.adminRepo.GetRoleByID(c, id)
 	if err != nil {
 		return err
 	}
@@ -54,7 +86,7 @@ func (ac *adminController) getRoleByID(c *gin.Context) error {
 
 func (ac *adminController) getAllRoles(c *gin.Context) error {
 
-	roles, err := ac.adminRepo.GetAllRoles()
+	roles, err := ac.adminRepo.GetAllRoles(c)
 	if err != nil {
 		return jsonHelper.ApiError{
 			Err:    "Error retrieving roles",
@@ -68,6 +100,7 @@ func (ac *adminController) getAllRoles(c *gin.Context) error {
 type CreateRoleRequest struct {
 	Name string `bson:"name" json:"name"`
 	AuthorityLevel int `json:"authorityLevel" bson:"authorityLevel"`
+	RequireMFA bool `json:"requireMfa" bson:"requireMfa"`
 }
 
 func (ac *adminController) createRole(c *gin.Context) error {
@@ -85,9 +118,10 @@ func (ac *adminController) createRole(c *gin.Context) error {
 		ID: roleID,
 		Name:           body.Name,
 		AuthorityLevel: body.AuthorityLevel,
+		RequireMFA:     body.RequireMFA,
 	}
 
-	err = ac.adminRepo.SaveRole(role)
+	err = ac.adminRepo.SaveRole(c, role)
 	if err != nil {
 		return jsonHelper.ApiError{
 			Err:    "Error saving role",
@@ -100,7 +134,7 @@ func (ac *adminController) createRole(c *gin.Context) error {
 
 func (ac *adminController) deleteRoleByID(c *gin.Context) error {
 	roleToDelete := c.Param("id")
-	err := ac.adminRepo.DeleteRoleByID(uuid.MustParse(roleToDelete))
+	err := ac.adminRepo.DeleteRoleByID(c, uuid.MustParse(roleToDelete))
 	if err != nil {
 		return jsonHelper.ApiError{
 			Err:    "Error deleting role with given id",
@@ -110,3 +144,239 @@ func (ac *adminController) deleteRoleByID(c *gin.Context) error {
 	c.JSON(200, gin.H{})
 	return nil
 }
+
+type UpdateRoleMFAPolicyRequest struct {
+	RequireMFA bool `json:"requireMfa"`
+}
+
+func (ac *adminController) updateRoleMFAPolicy(c *gin.Context) error {
+	var body UpdateRoleMFAPolicyRequest
+	if err := c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	roleID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	err = ac.adminRepo.UpdateRoleMFAPolicy(c, roleID, body.RequireMFA)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error updating role",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{})
+	return nil
+}
+
+type UnlockUserRequest struct {
+	Email string `json:"email"`
+}
+
+func (ac *adminController) unlockUser(c *gin.Context) error {
+	var body UnlockUserRequest
+	if err := c.Bind(&body); err != nil || body.Email == "" {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	if err := ac.loginLimiter.Unlock(body.Email); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error unlocking user",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{})
+	return nil
+}
+
+// issueMFAEnrollment hands out the token a user needs to enroll their first second factor,
+// the admin passes it on outside of the api. A new token replaces the previous one.
+func (ac *adminController) issueMFAEnrollment(c *gin.Context) error {
+	userID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	user, err := ac.userRepo.GetByID(c, userID)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "No such user",
+			Status: 404,
+		}
+	}
+	if user.MFA.TOTPEnabled {
+		return jsonHelper.ApiError{
+			Err:    "Two-factor authentication is already enabled",
+			Status: 409,
+		}
+	}
+	token, hash, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	user.MFA.EnrollmentTokenHash = hash
+	user.MFA.EnrollmentExpiresAt = int(time.Now().Add(auth.MFAEnrollmentExpiration).Unix())
+	if err = ac.userRepo.UpdateMFASettings(c, user.ID, user.MFA); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error saving MFA settings",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{"enrollmentToken": token, "expiresAt": user.MFA.EnrollmentExpiresAt})
+	return nil
+}
+
+type CreateAPIKeyRequest struct {
+	Name string `json:"name"`
+	UserID string `json:"userId"`
+	Seller string `json:"seller"`
+	Station string `json:"station"`
+	Scopes []string `json:"scopes"`
+	AllowedIPs []string `json:"allowedIps"`
+	ExpiresAt int `json:"expiresAt"`
+}
+
+func (ac *adminController) createAPIKey(c *gin.Context) error {
+	var body CreateAPIKeyRequest
+	if err := c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	authBodyField, _ := c.Get("authBody")
+	authBody, ok := authBodyField.(auth.AuthBody)
+	if !ok {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+
+	userID, err := uuid.Parse(body.UserID)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Invalid user id",
+			Status: 400,
+		}
+	}
+	if _, err = ac.userRepo.GetByID(c, userID); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "No such user",
+			Status: 404,
+		}
+	}
+	if len(body.Scopes) == 0 {
+		return jsonHelper.ApiError{
+			Err:    "At least one scope is required",
+			Status: 400,
+		}
+	}
+	for _, scope := range body.Scopes {
+		if !slices.Contains(models.APIKeyScopes, scope) {
+			return jsonHelper.ApiError{
+				Err:    "Unknown scope " + scope,
+				Status: 400,
+			}
+		}
+	}
+	if err = auth.ValidateIPAllowlist(body.AllowedIPs); err != nil {
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 400,
+		}
+	}
+	now := int(time.Now().Unix())
+	if body.ExpiresAt != 0 && body.ExpiresAt <= now {
+		return jsonHelper.ApiError{
+			Err:    "Expiry must be in the future",
+			Status: 400,
+		}
+	}
+
+	plainKey, prefix, hash, err := auth.GenerateAPIKey()
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	keyID, err := uuid.NewRandom()
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	apiKey := models.APIKey{
+		ID:         keyID,
+		Name:       body.Name,
+		Prefix:     prefix,
+		Hash:       hash,
+		UserID:     userID,
+		Seller:     body.Seller,
+		Station:    body.Station,
+		Scopes:     body.Scopes,
+		AllowedIPs: body.AllowedIPs,
+		CreatedBy:  authBody.GetUser().ID,
+		CreatedAt:  now,
+		ExpiresAt:  body.ExpiresAt,
+	}
+	if err = ac.apiKeyRepo.Save(c, &apiKey); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error saving API key",
+			Status: 500,
+		}
+	}
+	// the plain key is never stored, this is the only time it is returned
+	c.JSON(200, gin.H{"apiKey": apiKey, "key": plainKey})
+	return nil
+}
+
+func (ac *adminController) getAllAPIKeys(c *gin.Context) error {
+	keys, err := ac.apiKeyRepo.GetAll(c)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error retrieving API keys",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{"apiKeys": keys})
+	return nil
+}
+
+func (ac *adminController) revokeAPIKey(c *gin.Context) error {
+	keyID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	err = ac.apiKeyRepo.Revoke(c, keyID, int(time.Now().Unix()))
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error revoking API key",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{})
+	return nil
+}
+
+// checkCatalog only reports how the product tickets differ from the provider's catalog
+func (ac *adminController) checkCatalog(c *gin.Context) error {
+	return ac.reconcileCatalog(c, false)
+}
+
+// repairCatalog also fixes the differences it reports
+func (ac *adminController) repairCatalog(c *gin.Context) error {
+	return ac.reconcileCatalog(c, true)
+}
+
+func (ac *adminController) reconcileCatalog(c *gin.Context, repair bool) error {
+	if ac.catalogReconciler == nil {
+		return jsonHelper.ApiError{
+			Err:    "Catalog reconciliation is not available for this payment provider",
+			Status: 404,
+		}
+	}
+	report, err := ac.catalogReconciler.Reconcile(c, repair)
+	if errors.Is(err, catalog.ErrAlreadyRunning) {
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 409,
+		}
+	}
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error reconciling catalog",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{"report": report})
+	return nil
+}
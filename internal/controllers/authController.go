@@ -1,23 +1,53 @@
 package controllers
 
 import (
-	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
+	"math"
+	"palyvoua/internal/api/oidc"
 	"palyvoua/internal/models"
 	"palyvoua/internal/repository"
 	"palyvoua/tools/auth"
 	"palyvoua/tools/jsonHelper"
+	"strconv"
 )
 
 type authController struct {
 	AuthRepo repository.UserRepo
+	adminRepo adminRepo
 	paymentService paymentService
+	loginLimiter auth.LoginLimiter
+	sessionRepo repository.SessionRepo
 }
 
-func SetupAuthRoutes(r *gin.Engine, authRepo repository.UserRepo, ps paymentService) {
-	ac := authController{AuthRepo: authRepo, paymentService:ps}
+type AuthRoutesOptions struct {
+	UserRepo repository.UserRepo
+	AdminRepo repository.AdminRepo
+	Ps paymentService
+	LoginLimiter auth.LoginLimiter
+	SessionRepo repository.SessionRepo
+	OIDCService oidc.OIDCService
+	// MFAIssuer names the service in authenticator apps
+	MFAIssuer string
+}
+
+// compared against when the email is unknown, so both failures take the same time
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+var invalidCredentialsError = jsonHelper.ApiError{
+	Err:    "Invalid email or password",
+	Status: 401,
+}
+
+func SetupAuthRoutes(r *gin.Engine, options *AuthRoutesOptions) {
+	ac := authController{
+		AuthRepo:       options.UserRepo,
+		adminRepo:      options.AdminRepo,
+		paymentService: options.Ps,
+		loginLimiter:   options.LoginLimiter,
+		sessionRepo:    options.SessionRepo,
+	}
 
 	authGroup := r.Group("/auth")
 
@@ -58,11 +88,27 @@ func (ac *authController) refresh(c *gin.Context) error {
 			Status: 400,
 		}
 	}
-	tokens := auth.GenerateTokens(map[string]interface{}{
-		"email": userFromDb.Email,
-		"_id":userFromDb.ID.String(),
-		"roleId":userFromDb.Role.String(),
-	}, c)
+	mfaVerified := auth.HasMFAClaim(body.RefreshToken)
+	role, err := ac.adminRepo.GetRoleByID(c, userFromDb.Role)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "No role found",
+			Status: 403,
+		}
+	}
+	if role.RequireMFA && !mfaVerified {
+		return jsonHelper.ApiError{
+			Err:    "Two-factor authentication required",
+			Status: 403,
+		}
+	}
+	if err = auth.CheckSession(c, body.RefreshToken); err != nil {
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 401,
+		}
+	}
+	tokens := auth.GenerateTokens(tokenBody(&userFromDb, mfaVerified, auth.GetSessionID(body.RefreshToken)), c)
 	c.JSON(200, gin.H{
 		"accessToken":  tokens.AccessToken,
 		"refreshToken": tokens.RefreshToken,
@@ -71,6 +117,35 @@ func (ac *authController) refresh(c *gin.Context) error {
 }
 
 
+// checkLoginAllowed answers 429 with Retry-After while the account or the ip is backing off or locked
+func checkLoginAllowed(c *gin.Context, limiter auth.LoginLimiter, email string) error {
+	wait, err := limiter.Check(email, c.ClientIP())
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return jsonHelper.ApiError{
+			Err:    "Too many login attempts, try again later",
+			Status: 429,
+		}
+	}
+	return nil
+}
+
+func tokenBody(user *models.User, mfaVerified bool, sessionID uuid.UUID) map[string]interface{} {
+	body := map[string]interface{}{
+		"email": user.Email,
+		"_id":user.ID.String(),
+		"roleId":user.Role.String(),
+		auth.SessionClaim: sessionID.String(),
+	}
+	if mfaVerified {
+		body[auth.MFAClaim] = true
+	}
+	return body
+}
+
 type LoginRequest struct {
 	Email string `json:"email"`
 	Password string `json:"password"`
@@ -83,26 +158,58 @@ func (ac *authController) login(c *gin.Context) error {
 		return jsonHelper.DefaultHttpErrors["BadRequest"]
 	}
 
+	if err := checkLoginAllowed(c, ac.loginLimiter, body.Email); err != nil {
+		return err
+	}
+
 	userFromDB, err := ac.AuthRepo.GetUserByEmail(c,body.Email)
+	passwordHash := []byte(userFromDB.Password)
 	if err != nil {
-		return jsonHelper.ApiError{
-			Err:    err.Error(),
-			Status: 404,
+		passwordHash = dummyPasswordHash
+	}
+
+	if bcryptErr := bcrypt.CompareHashAndPassword(passwordHash, []byte(body.Password)); bcryptErr != nil || err != nil {
+		if err := ac.loginLimiter.RegisterFailure(body.Email, c.ClientIP()); err != nil {
+			return jsonHelper.DefaultHttpErrors["InternalServerError"]
 		}
+		return invalidCredentialsError
 	}
+	if err := ac.loginLimiter.RegisterSuccess(body.Email, c.ClientIP()); err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+
+	return ac.completeLogin(c, &userFromDB)
+}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(userFromDB.Password), []byte(body.Password)); err != nil {
-		fmt.Println(err.Error())
+// completeLogin runs after the user proved who they are, it either asks for the second factor or opens a session
+func (ac *authController) completeLogin(c *gin.Context, user *models.User) error {
+	role, err := ac.adminRepo.GetRoleByID(c, user.Role)
+	if err != nil {
 		return jsonHelper.ApiError{
-			Err:    "Invalid password",
+			Err:    "No role found",
 			Status: 403,
 		}
 	}
-	tokens := auth.GenerateTokens(map[string]interface{}{
-		"email": userFromDB.Email,
-		"_id":userFromDB.ID.String(),
-		"roleId":userFromDB.Role.String(),
-	}, c)
+	if user.MFA.TOTPEnabled || role.RequireMFA {
+		mfaToken, err := auth.CreateMFAChallengeToken(user.Email)
+		if err != nil {
+			return jsonHelper.ApiError{
+				Err:    "Error generating MFA challenge",
+				Status: 500,
+			}
+		}
+		c.JSON(200, gin.H{
+			"mfaRequired":        true,
+			"enrollmentRequired": !user.MFA.TOTPEnabled,
+			"mfaToken":           mfaToken,
+		})
+		return nil
+	}
+
+	tokens, err := startSession(c, ac.sessionRepo, user, false)
+	if err != nil {
+		return err
+	}
 
 	c.JSON(200, gin.H{
 		"accessToken":  tokens.AccessToken,
@@ -122,15 +229,15 @@ type RegisterResponse struct {
 	RefreshToken string `json:"refreshToken"`
 }
 
+// register signs up a customer, other roles are given out by admins
 func (ac *authController) register(c *gin.Context) error {
-	adminRepo := repository.NewAdminRepo()
 	var body RegisterRequest
 
 	if err := c.Bind(&body);err!=nil {
 		return jsonHelper.DefaultHttpErrors["BadRequest"]
 	}
 
-	userExists := auth.UserExists(body.Email)
+	userExists := auth.UserExists(c, body.Email)
 	if userExists {
 		return jsonHelper.ApiError{
 			Err:    "User already exists",
@@ -153,9 +260,7 @@ func (ac *authController) register(c *gin.Context) error {
 		}
 	}
 
-	role,err := adminRepo.GetRoleByName("ROLE_ADMIN")
-	//role,err := adminRepo.GetRoleByName("ROLE_OPERATOR")
-	//role,err := adminRepo.GetRoleByName("ROLE_USER")
+	role,err := ac.adminRepo.GetRoleByName(c, "ROLE_USER")
 	if err != nil {
 		return jsonHelper.ApiError{
 			Err:    "No role found",
@@ -165,13 +270,7 @@ func (ac *authController) register(c *gin.Context) error {
 	newUser := models.User{
 		ID: userId, Email: body.Email, Password: string(hashedPassword), Role:role.ID,
 	}
-	tokens := auth.GenerateTokens(map[string]interface{}{
-		"email": newUser.Email,
-		"_id":newUser.ID.String(),
-		"roleId":newUser.Role.String(),
-	}, c)
-
-	if err := ac.AuthRepo.SaveUser(&newUser); err != nil {
+	if err := ac.AuthRepo.SaveUser(c, &newUser); err != nil {
 		return jsonHelper.ApiError{
 			Err:    err.Error(),
 			Status: 500,
@@ -185,19 +284,16 @@ func (ac *authController) register(c *gin.Context) error {
 			Status: 500,
 		}
 	}
-	err = ac.AuthRepo.UpdateCustomerIDByEmail(body.Email, customerID)
+	err = ac.AuthRepo.UpdateCustomerIDByEmail(c, body.Email, customerID)
 	if err != nil {
 		return jsonHelper.ApiError{
 			Err:    err.Error(),
 			Status: 500,
 		}
 	}
+	newUser.CustomerID = customerID
 
-	c.JSON(200, gin.H{
-		"accessToken":  tokens.AccessToken,
-		"refreshToken": tokens.RefreshToken,
-	})
-	return nil
+	return ac.completeLogin(c, &newUser)
 }
 
 
@@ -0,0 +1,31 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"palyvoua/internal/api/payment"
+	"palyvoua/tools/jsonHelper"
+)
+
+type fakePaymentController struct {
+	fakePaymentService payment.FakePaymentService
+}
+
+// SetupFakePaymentRoutes lets a developer pay a checkout of the fake provider, it is only mounted with PAYMENT_PROVIDER=fake
+func SetupFakePaymentRoutes(r *gin.Engine, fps payment.FakePaymentService) {
+	fpc := fakePaymentController{fakePaymentService: fps}
+
+	fakeGroup := r.Group("/payment/fake")
+	fakeGroup.POST("/checkout/:sessionId/complete", jsonHelper.MakeHttpHandler(fpc.completeCheckout))
+}
+
+func (fpc *fakePaymentController) completeCheckout(c *gin.Context) error {
+	successURL, err := fpc.fakePaymentService.CompleteCheckout(c.Param("sessionId"))
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 400,
+		}
+	}
+	c.JSON(200, gin.H{"successUrl": successURL})
+	return nil
+}
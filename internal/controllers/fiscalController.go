@@ -0,0 +1,94 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+	"palyvoua/internal/api/fiscal"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/auth"
+	"palyvoua/tools/jsonHelper"
+	"strconv"
+)
+
+type fiscalController struct {
+	fiscal fiscal.FiscalService
+}
+
+type FiscalRoutesOptions struct {
+	UserRepo repository.UserRepo
+	AdminRepo repository.AdminRepo
+	Fiscal fiscal.FiscalService
+}
+
+// SetupFiscalRoutes gives admins the checks stuck offline or rejected by the tax service
+func SetupFiscalRoutes(r *gin.Engine, options *FiscalRoutesOptions) {
+	fiscalGroup := r.Group("/fiscal")
+
+	fc := fiscalController{fiscal: options.Fiscal}
+
+	fiscalGroup.Use(auth.AuthMiddleware(options.UserRepo, options.AdminRepo))
+	fiscalGroup.Use(auth.RoleMiddleware(3, options.UserRepo, options.AdminRepo))
+	fiscalGroup.GET("", jsonHelper.MakeHttpHandler(fc.getByStatus))
+	fiscalGroup.GET("/payment", jsonHelper.MakeHttpHandler(fc.getByReference))
+	fiscalGroup.POST("/:id/retry", jsonHelper.MakeHttpHandler(fc.retry))
+}
+
+func (fc *fiscalController) getByStatus(c *gin.Context) error {
+	status := c.DefaultQuery("status", models.FISCAL_FAILED)
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			return jsonHelper.DefaultHttpErrors["BadRequest"]
+		}
+	}
+	documents, err := fc.fiscal.GetByStatus(c, status, limit)
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	c.JSON(200, gin.H{"documents": documents})
+	return nil
+}
+
+func (fc *fiscalController) getByReference(c *gin.Context) error {
+	document, err := fc.fiscal.GetByReference(c, c.Query("reference"))
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return jsonHelper.ApiError{
+			Err:    "Payment has no fiscal check",
+			Status: 404,
+		}
+	}
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	c.JSON(200, gin.H{"fiscal": document})
+	return nil
+}
+
+func (fc *fiscalController) retry(c *gin.Context) error {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	document, err := fc.fiscal.Retry(c, id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return jsonHelper.ApiError{
+			Err:    "No such fiscal check",
+			Status: 404,
+		}
+	}
+	if errors.Is(err, fiscal.ErrNotFailed) {
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 409,
+		}
+	}
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	c.JSON(200, gin.H{"fiscal": document})
+	return nil
+}
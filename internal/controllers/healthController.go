@@ -0,0 +1,22 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"palyvoua/internal/api/health"
+)
+
+// SetupHealthRoutes serves the liveness probe at /healthz and the readiness probe at /readyz.
+// Liveness only tells that the process answers, readiness checks the dependencies too.
+func SetupHealthRoutes(r *gin.Engine, healthService health.HealthService) {
+	r.GET("/healthz", func(c *gin.Context) {
+		c.JSON(200, gin.H{"status": health.STATUS_UP})
+	})
+	r.GET("/readyz", func(c *gin.Context) {
+		report := healthService.Ready(c)
+		status := 200
+		if report.Status != health.STATUS_UP {
+			status = 503
+		}
+		c.JSON(status, report)
+	})
+}
@@ -0,0 +1,24 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"palyvoua/tools/metrics"
+)
+
+type MetricsRoutesOptions struct {
+	// Token is the bearer token scrapers send, the endpoint is open when it is empty
+	Token string
+}
+
+// SetupMetricsRoutes serves the Prometheus metrics at /metrics
+func SetupMetricsRoutes(r *gin.Engine, options *MetricsRoutesOptions) {
+	handler := metrics.Handler()
+	r.GET("/metrics", func(c *gin.Context) {
+		if options.Token != "" && subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), []byte("Bearer "+options.Token)) != 1 {
+			c.AbortWithStatus(401)
+			return
+		}
+		handler(c)
+	})
+}
@@ -0,0 +1,371 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/auth"
+	"palyvoua/tools/jsonHelper"
+	"time"
+)
+
+type mfaController struct {
+	userRepo repository.UserRepo
+	adminRepo adminRepo
+	loginLimiter auth.LoginLimiter
+	sessionRepo repository.SessionRepo
+	issuer string
+}
+
+func SetupMFARoutes(r *gin.Engine, options *AuthRoutesOptions) {
+	ur, ar := options.UserRepo, options.AdminRepo
+	mc := mfaController{userRepo: ur, adminRepo: ar, loginLimiter: options.LoginLimiter, sessionRepo: options.SessionRepo, issuer: options.MFAIssuer}
+
+	// second login step, authorised by the challenge token returned from /auth/login.
+	// A user who has to enroll first also needs the enrollment token an admin handed them, the password alone isn't enough.
+	challengeGroup := r.Group("/auth/mfa")
+	challengeGroup.POST("/verify", jsonHelper.MakeHttpHandler(mc.verifyChallenge))
+	challengeGroup.POST("/enrollment/totp", jsonHelper.MakeHttpHandler(mc.enrollWithToken))
+	challengeGroup.POST("/enrollment/confirm", jsonHelper.MakeHttpHandler(mc.confirmWithToken))
+
+	mfaGroup := r.Group("/mfa")
+	mfaGroup.Use(auth.AuthMiddleware(ur, ar))
+	mfaGroup.GET("/status", jsonHelper.MakeHttpHandler(mc.getStatus))
+	mfaGroup.POST("/totp/enroll", jsonHelper.MakeHttpHandler(mc.enroll))
+	mfaGroup.POST("/totp/confirm", jsonHelper.MakeHttpHandler(mc.confirm))
+	mfaGroup.DELETE("/totp", jsonHelper.MakeHttpHandler(mc.disable))
+	mfaGroup.POST("/recoveryCodes", jsonHelper.MakeHttpHandler(mc.regenerateRecoveryCodes))
+}
+
+type MFAChallengeRequest struct {
+	MFAToken string `json:"mfaToken"`
+	Code string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+type MFAEnrollmentRequest struct {
+	MFAToken string `json:"mfaToken"`
+	EnrollmentToken string `json:"enrollmentToken"`
+	Code string `json:"code"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+func (mc *mfaController) userFromChallenge(c *gin.Context, mfaToken string) (models.User, error) {
+	email, err := auth.ValidateMFAChallenge(mfaToken)
+	if err != nil {
+		return models.User{}, jsonHelper.ApiError{
+			Err:    "Invalid or expired MFA token",
+			Status: 401,
+		}
+	}
+	user, err := mc.userRepo.GetUserByEmail(c, email)
+	if err != nil {
+		return models.User{}, jsonHelper.ApiError{
+			Err:    "Invalid or expired MFA token",
+			Status: 401,
+		}
+	}
+	return user, nil
+}
+
+// userFromEnrollment needs both the challenge of a password login and an unexpired enrollment token of the same user
+func (mc *mfaController) userFromEnrollment(c *gin.Context, body *MFAEnrollmentRequest) (models.User, error) {
+	user, err := mc.userFromChallenge(c, body.MFAToken)
+	if err != nil {
+		return models.User{}, err
+	}
+	hash := auth.HashOpaqueToken(body.EnrollmentToken)
+	if body.EnrollmentToken == "" || user.MFA.EnrollmentTokenHash == "" ||
+		subtle.ConstantTimeCompare([]byte(hash), []byte(user.MFA.EnrollmentTokenHash)) != 1 ||
+		user.MFA.EnrollmentExpiresAt < int(time.Now().Unix()) {
+		return models.User{}, jsonHelper.ApiError{
+			Err:    "Invalid or expired enrollment token",
+			Status: 403,
+		}
+	}
+	return user, nil
+}
+
+func (mc *mfaController) userFromAuthBody(c *gin.Context) (models.User, error) {
+	authBodyField, exists := c.Get("authBody")
+	if !exists {
+		return models.User{}, jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	authBody, ok := authBodyField.(auth.AuthBody)
+	if !ok {
+		return models.User{}, jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	return *authBody.GetUser(), nil
+}
+
+// checkTOTP verifies the code and records its step, so the same code can't be replayed
+func checkTOTP(user *models.User, secret string, code string) bool {
+	step, ok := auth.MatchTOTPCode(secret, code, time.Now())
+	if !ok || step <= user.MFA.LastTOTPStep {
+		return false
+	}
+	user.MFA.LastTOTPStep = step
+	return true
+}
+
+func (mc *mfaController) verifyChallenge(c *gin.Context) error {
+	var body MFAChallengeRequest
+	if err := c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	user, err := mc.userFromChallenge(c, body.MFAToken)
+	if err != nil {
+		return err
+	}
+	if !user.MFA.TOTPEnabled {
+		return jsonHelper.ApiError{
+			Err:    "Two-factor authentication is not set up",
+			Status: 400,
+		}
+	}
+	if err = checkLoginAllowed(c, mc.loginLimiter, user.Email); err != nil {
+		return err
+	}
+
+	var verified bool
+	if body.RecoveryCode != "" {
+		user.MFA.RecoveryCodes, verified = auth.ConsumeRecoveryCode(user.MFA.RecoveryCodes, body.RecoveryCode)
+	} else {
+		verified = checkTOTP(&user, user.MFA.TOTPSecret, body.Code)
+	}
+	if !verified {
+		if err = mc.loginLimiter.RegisterFailure(user.Email, c.ClientIP()); err != nil {
+			return jsonHelper.DefaultHttpErrors["InternalServerError"]
+		}
+		return jsonHelper.ApiError{
+			Err:    "Invalid code",
+			Status: 403,
+		}
+	}
+	if err = mc.loginLimiter.RegisterSuccess(user.Email, c.ClientIP()); err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	if err = mc.userRepo.UpdateMFASettings(c, user.ID, user.MFA); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error saving MFA settings",
+			Status: 500,
+		}
+	}
+
+	tokens, err := startSession(c, mc.sessionRepo, &user, true)
+	if err != nil {
+		return err
+	}
+	c.JSON(200, gin.H{
+		"accessToken":            tokens.AccessToken,
+		"refreshToken":           tokens.RefreshToken,
+		"remainingRecoveryCodes": len(user.MFA.RecoveryCodes),
+	})
+	return nil
+}
+
+func (mc *mfaController) startEnrollment(c *gin.Context, user *models.User) error {
+	if user.MFA.TOTPEnabled {
+		return jsonHelper.ApiError{
+			Err:    "Two-factor authentication is already enabled",
+			Status: 409,
+		}
+	}
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	user.MFA.PendingTOTPSecret = secret
+	if err = mc.userRepo.UpdateMFASettings(c, user.ID, user.MFA); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error saving MFA settings",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{
+		"secret":          secret,
+		"provisioningUri": auth.TOTPProvisioningURI(mc.issuer, secret, user.Email),
+	})
+	return nil
+}
+
+// finishEnrollment activates the pending secret and returns the plain recovery codes
+func (mc *mfaController) finishEnrollment(c *gin.Context, user *models.User, code string) ([]string, error) {
+	if user.MFA.PendingTOTPSecret == "" {
+		return nil, jsonHelper.ApiError{
+			Err:    "No pending enrollment",
+			Status: 400,
+		}
+	}
+	if !checkTOTP(user, user.MFA.PendingTOTPSecret, code) {
+		return nil, jsonHelper.ApiError{
+			Err:    "Invalid code",
+			Status: 403,
+		}
+	}
+	recoveryCodes, hashedCodes, err := auth.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	user.MFA.TOTPEnabled = true
+	user.MFA.TOTPSecret = user.MFA.PendingTOTPSecret
+	user.MFA.PendingTOTPSecret = ""
+	user.MFA.RecoveryCodes = hashedCodes
+	user.MFA.EnrollmentTokenHash = ""
+	user.MFA.EnrollmentExpiresAt = 0
+	if err = mc.userRepo.UpdateMFASettings(c, user.ID, user.MFA); err != nil {
+		return nil, jsonHelper.ApiError{
+			Err:    "Error saving MFA settings",
+			Status: 500,
+		}
+	}
+	return recoveryCodes, nil
+}
+
+func (mc *mfaController) enrollWithToken(c *gin.Context) error {
+	var body MFAEnrollmentRequest
+	if err := c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	user, err := mc.userFromEnrollment(c, &body)
+	if err != nil {
+		return err
+	}
+	return mc.startEnrollment(c, &user)
+}
+
+func (mc *mfaController) confirmWithToken(c *gin.Context) error {
+	var body MFAEnrollmentRequest
+	if err := c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	user, err := mc.userFromEnrollment(c, &body)
+	if err != nil {
+		return err
+	}
+	recoveryCodes, err := mc.finishEnrollment(c, &user, body.Code)
+	if err != nil {
+		return err
+	}
+	tokens, err := startSession(c, mc.sessionRepo, &user, true)
+	if err != nil {
+		return err
+	}
+	c.JSON(200, gin.H{
+		"accessToken":   tokens.AccessToken,
+		"refreshToken":  tokens.RefreshToken,
+		"recoveryCodes": recoveryCodes,
+	})
+	return nil
+}
+
+func (mc *mfaController) getStatus(c *gin.Context) error {
+	user, err := mc.userFromAuthBody(c)
+	if err != nil {
+		return err
+	}
+	role, err := mc.adminRepo.GetRoleByID(c, user.Role)
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	c.JSON(200, gin.H{
+		"totpEnabled":            user.MFA.TOTPEnabled,
+		"required":               role.RequireMFA,
+		"remainingRecoveryCodes": len(user.MFA.RecoveryCodes),
+	})
+	return nil
+}
+
+func (mc *mfaController) enroll(c *gin.Context) error {
+	user, err := mc.userFromAuthBody(c)
+	if err != nil {
+		return err
+	}
+	return mc.startEnrollment(c, &user)
+}
+
+func (mc *mfaController) confirm(c *gin.Context) error {
+	var body TOTPCodeRequest
+	if err := c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	user, err := mc.userFromAuthBody(c)
+	if err != nil {
+		return err
+	}
+	recoveryCodes, err := mc.finishEnrollment(c, &user, body.Code)
+	if err != nil {
+		return err
+	}
+	c.JSON(200, gin.H{"recoveryCodes": recoveryCodes})
+	return nil
+}
+
+func (mc *mfaController) disable(c *gin.Context) error {
+	var body TOTPCodeRequest
+	if err := c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	user, err := mc.userFromAuthBody(c)
+	if err != nil {
+		return err
+	}
+	role, err := mc.adminRepo.GetRoleByID(c, user.Role)
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	if role.RequireMFA {
+		return jsonHelper.ApiError{
+			Err:    "Two-factor authentication is required for your role",
+			Status: 403,
+		}
+	}
+	if !user.MFA.TOTPEnabled || !checkTOTP(&user, user.MFA.TOTPSecret, body.Code) {
+		return jsonHelper.ApiError{
+			Err:    "Invalid code",
+			Status: 403,
+		}
+	}
+	if err = mc.userRepo.UpdateMFASettings(c, user.ID, models.MFASettings{}); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error saving MFA settings",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{})
+	return nil
+}
+
+func (mc *mfaController) regenerateRecoveryCodes(c *gin.Context) error {
+	var body TOTPCodeRequest
+	if err := c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	user, err := mc.userFromAuthBody(c)
+	if err != nil {
+		return err
+	}
+	if !user.MFA.TOTPEnabled || !checkTOTP(&user, user.MFA.TOTPSecret, body.Code) {
+		return jsonHelper.ApiError{
+			Err:    "Invalid code",
+			Status: 403,
+		}
+	}
+	recoveryCodes, hashedCodes, err := auth.GenerateRecoveryCodes()
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	user.MFA.RecoveryCodes = hashedCodes
+	if err = mc.userRepo.UpdateMFASettings(c, user.ID, user.MFA); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error saving MFA settings",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{"recoveryCodes": recoveryCodes})
+	return nil
+}
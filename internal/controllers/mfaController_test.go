@@ -0,0 +1,160 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"palyvoua/internal/models"
+	"palyvoua/tools/auth"
+	"testing"
+	"time"
+)
+
+// totpNow computes the code an authenticator app shows for secret right now
+func totpNow(t *testing.T, secret string) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(time.Now().Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func TestMFAEnrollment(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	auth.UseTokens(auth.TokenOptions{Secret: []byte("test"), AccessExpiration: time.Minute, RefreshExpiration: time.Hour})
+	role := models.Role{ID: uuid.New(), Name: "ROLE_ADMIN", AuthorityLevel: 3, RequireMFA: true}
+	password, err := bcrypt.GenerateFromPassword([]byte("guessed"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const enrollmentToken = "handed-out-by-an-admin"
+
+	tests := []struct {
+		name string
+		// enrollment is what the admin issued, nothing when nil
+		enrollment *models.MFASettings
+		token string
+		wantStatus int
+	}{
+		{
+			name:       "password alone",
+			wantStatus: 403,
+		},
+		{
+			name:       "no token sent",
+			enrollment: &models.MFASettings{EnrollmentTokenHash: auth.HashOpaqueToken(enrollmentToken), EnrollmentExpiresAt: int(time.Now().Add(time.Hour).Unix())},
+			wantStatus: 403,
+		},
+		{
+			name:       "wrong token",
+			enrollment: &models.MFASettings{EnrollmentTokenHash: auth.HashOpaqueToken(enrollmentToken), EnrollmentExpiresAt: int(time.Now().Add(time.Hour).Unix())},
+			token:      "guessed",
+			wantStatus: 403,
+		},
+		{
+			name:       "expired token",
+			enrollment: &models.MFASettings{EnrollmentTokenHash: auth.HashOpaqueToken(enrollmentToken), EnrollmentExpiresAt: int(time.Now().Add(-time.Minute).Unix())},
+			token:      enrollmentToken,
+			wantStatus: 403,
+		},
+		{
+			name:       "issued token",
+			enrollment: &models.MFASettings{EnrollmentTokenHash: auth.HashOpaqueToken(enrollmentToken), EnrollmentExpiresAt: int(time.Now().Add(time.Hour).Unix())},
+			token:      enrollmentToken,
+			wantStatus: 200,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admin := models.User{ID: uuid.New(), Email: "admin", Password: string(password), Role: role.ID}
+			if tt.enrollment != nil {
+				admin.MFA = *tt.enrollment
+			}
+			userRepo := &memoryUserRepo{users: map[string]*models.User{admin.Email: &admin}}
+			options := &AuthRoutesOptions{
+				UserRepo:     userRepo,
+				AdminRepo:    &memoryAdminRepo{role: role},
+				LoginLimiter: auth.NewLoginLimiter(auth.NewMemoryAttemptStore(), auth.DefaultLoginLimiterOptions()),
+				SessionRepo:  &memorySessionRepo{},
+			}
+			r := gin.New()
+			SetupAuthRoutes(r, options)
+			SetupMFARoutes(r, options)
+
+			var login struct {
+				MFAToken string `json:"mfaToken"`
+				EnrollmentRequired bool `json:"enrollmentRequired"`
+			}
+			if status := post(t, r, "/auth/login", LoginRequest{Email: "admin", Password: "guessed"}, &login); status != 200 || !login.EnrollmentRequired {
+				t.Fatalf("login status = %d, %+v, want an enrollment challenge", status, login)
+			}
+			var enrollment struct {
+				Secret string `json:"secret"`
+			}
+			request := MFAEnrollmentRequest{MFAToken: login.MFAToken, EnrollmentToken: tt.token}
+			status := post(t, r, "/auth/mfa/enrollment/totp", request, &enrollment)
+			if status != tt.wantStatus {
+				t.Fatalf("enroll status = %d, want %d", status, tt.wantStatus)
+			}
+			if status != 200 {
+				if userRepo.users["admin"].MFA.PendingTOTPSecret != "" {
+					t.Fatal("enrollment started without a valid token")
+				}
+				return
+			}
+
+			var confirmed struct {
+				AccessToken string `json:"accessToken"`
+			}
+			request.Code = totpNow(t, enrollment.Secret)
+			if status = post(t, r, "/auth/mfa/enrollment/confirm", request, &confirmed); status != 200 {
+				t.Fatalf("confirm status = %d", status)
+			}
+			if !auth.HasMFAClaim(confirmed.AccessToken) {
+				t.Fatal("token after enrollment is not MFA verified")
+			}
+			mfa := userRepo.users["admin"].MFA
+			if !mfa.TOTPEnabled || mfa.EnrollmentTokenHash != "" {
+				t.Fatalf("mfa = %+v, want enabled with the enrollment token used up", mfa)
+			}
+			// the token is spent, it can't start another enrollment
+			if status = post(t, r, "/auth/mfa/enrollment/totp", request, &enrollment); status != 403 {
+				t.Fatalf("enrolling again status = %d, want 403", status)
+			}
+		})
+	}
+}
+
+func post(t *testing.T, r *gin.Engine, target string, request interface{}, response interface{}) int {
+	t.Helper()
+	body, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	httpRequest := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	httpRequest.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, httpRequest)
+	if w.Code == 200 {
+		if err := json.Unmarshal(w.Body.Bytes(), response); err != nil {
+			t.Fatalf("decoding %s: %v", w.Body, err)
+		}
+	}
+	return w.Code
+}
@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"palyvoua/internal/api/notification"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/auth"
+	"palyvoua/tools/jsonHelper"
+	"palyvoua/tools/logging"
+	"slices"
+)
+
+const MAX_PUSH_TOKENS = 10
+
+type notificationController struct {
+	userRepo repository.UserRepo
+}
+
+type NotificationRoutesOptions struct {
+	UserRepo repository.UserRepo
+	AdminRepo repository.AdminRepo
+}
+
+// SetupNotificationRoutes lets users pick their channels and register the devices push goes to
+func SetupNotificationRoutes(r *gin.Engine, options *NotificationRoutesOptions) {
+	notificationGroup := r.Group("/notification")
+
+	nc := notificationController{userRepo: options.UserRepo}
+
+	notificationGroup.Use(auth.AuthMiddleware(options.UserRepo, options.AdminRepo))
+	notificationGroup.GET("/preferences", jsonHelper.MakeHttpHandler(nc.getPreferences))
+	notificationGroup.PUT("/preferences", jsonHelper.MakeHttpHandler(nc.updatePreferences))
+	notificationGroup.POST("/pushToken", jsonHelper.MakeHttpHandler(nc.addPushToken))
+	notificationGroup.DELETE("/pushToken", jsonHelper.MakeHttpHandler(nc.removePushToken))
+}
+
+// notify queues a notice, the request it came from already succeeded so a failure is only logged
+func notify(c context.Context, notifications notification.NotificationService, notice notification.TicketNotice) {
+	if notifications == nil {
+		return
+	}
+	if err := notifications.NotifyTickets(c, notice); err != nil {
+		slog.ErrorContext(c, "queueing notification failed", "key", notice.Key, logging.Err(err))
+	}
+}
+
+func (nc *notificationController) getPreferences(c *gin.Context) error {
+	user, err := authUser(c)
+	if err != nil {
+		return err
+	}
+	c.JSON(200, gin.H{"preferences": user.Notifications, "pushTokens": len(user.Notifications.PushTokens)})
+	return nil
+}
+
+type UpdateNotificationPreferencesRequest struct {
+	DisabledChannels []string `json:"disabledChannels"`
+}
+
+func (nc *notificationController) updatePreferences(c *gin.Context) error {
+	user, err := authUser(c)
+	if err != nil {
+		return err
+	}
+	var body UpdateNotificationPreferencesRequest
+	if err = c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	preferences := user.Notifications
+	preferences.DisabledChannels = []string{}
+	for _, channel := range body.DisabledChannels {
+		if !notification.HasChannel(channel) {
+			return jsonHelper.ApiError{
+				Err:    "Unknown channel " + channel,
+				Status: 400,
+			}
+		}
+		if !slices.Contains(preferences.DisabledChannels, channel) {
+			preferences.DisabledChannels = append(preferences.DisabledChannels, channel)
+		}
+	}
+	if err = nc.userRepo.UpdateNotificationPreferences(c, user.ID, preferences); err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	c.JSON(200, gin.H{"preferences": preferences})
+	return nil
+}
+
+type PushTokenRequest struct {
+	Token string `json:"token"`
+}
+
+func (nc *notificationController) addPushToken(c *gin.Context) error {
+	user, err := authUser(c)
+	if err != nil {
+		return err
+	}
+	var body PushTokenRequest
+	if err = c.Bind(&body); err != nil || body.Token == "" {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	preferences := user.Notifications
+	if !slices.Contains(preferences.PushTokens, body.Token) {
+		preferences.PushTokens = append(preferences.PushTokens, body.Token)
+	}
+	// the oldest devices go first
+	if len(preferences.PushTokens) > MAX_PUSH_TOKENS {
+		preferences.PushTokens = preferences.PushTokens[len(preferences.PushTokens)-MAX_PUSH_TOKENS:]
+	}
+	if err = nc.userRepo.UpdateNotificationPreferences(c, user.ID, preferences); err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	c.JSON(200, gin.H{})
+	return nil
+}
+
+func (nc *notificationController) removePushToken(c *gin.Context) error {
+	user, err := authUser(c)
+	if err != nil {
+		return err
+	}
+	var body PushTokenRequest
+	if err = c.Bind(&body); err != nil || body.Token == "" {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	preferences := user.Notifications
+	preferences.PushTokens = slices.DeleteFunc(slices.Clone(preferences.PushTokens), func(token string) bool {
+		return token == body.Token
+	})
+	if err = nc.userRepo.UpdateNotificationPreferences(c, user.ID, preferences); err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	c.JSON(200, gin.H{})
+	return nil
+}
+
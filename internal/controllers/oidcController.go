@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+	"palyvoua/internal/api/oidc"
+	"palyvoua/internal/models"
+	"palyvoua/tools/jsonHelper"
+	"slices"
+	"strings"
+	"time"
+)
+
+type oidcController struct {
+	authController
+	oidcService oidc.OIDCService
+}
+
+func SetupOIDCRoutes(r *gin.Engine, options *AuthRoutesOptions) {
+	oc := oidcController{
+		authController: authController{
+			AuthRepo:       options.UserRepo,
+			adminRepo:      options.AdminRepo,
+			paymentService: options.Ps,
+			loginLimiter:   options.LoginLimiter,
+			sessionRepo:    options.SessionRepo,
+		},
+		oidcService: options.OIDCService,
+	}
+
+	oidcGroup := r.Group("/auth/oidc")
+
+	oidcGroup.GET("/providers", jsonHelper.MakeHttpHandler(oc.providers))
+	oidcGroup.GET("/:provider/start", jsonHelper.MakeHttpHandler(oc.start))
+	// apple answers with a form post, google with a redirect
+	oidcGroup.GET("/:provider/callback", jsonHelper.MakeHttpHandler(oc.callback))
+	oidcGroup.POST("/:provider/callback", jsonHelper.MakeHttpHandler(oc.callback))
+}
+
+func (oc *oidcController) providers(c *gin.Context) error {
+	c.JSON(200, gin.H{"providers": oc.oidcService.Providers()})
+	return nil
+}
+
+func (oc *oidcController) start(c *gin.Context) error {
+	provider := c.Param("provider")
+	if !slices.Contains(oc.oidcService.Providers(), provider) {
+		return jsonHelper.ApiError{
+			Err:    "Unknown provider",
+			Status: 404,
+		}
+	}
+	url, err := oc.oidcService.AuthCodeURL(c, provider)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error contacting provider",
+			Status: 502,
+		}
+	}
+	c.JSON(200, gin.H{"url": url})
+	return nil
+}
+
+// appleUser is sent by apple next to the code, only on the first sign in
+type appleUser struct {
+	Name struct {
+		FirstName string `json:"firstName"`
+		LastName string `json:"lastName"`
+	} `json:"name"`
+}
+
+func (oc *oidcController) callback(c *gin.Context) error {
+	provider := c.Param("provider")
+	if providerError := c.Request.FormValue("error"); providerError != "" {
+		return jsonHelper.ApiError{
+			Err:    "Sign in was cancelled: " + providerError,
+			Status: 400,
+		}
+	}
+	code := c.Request.FormValue("code")
+	state := c.Request.FormValue("state")
+	if code == "" || state == "" {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	identity, err := oc.oidcService.Exchange(c, provider, code, state)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Sign in failed",
+			Status: 401,
+		}
+	}
+	if identity.Name == "" {
+		var user appleUser
+		if json.Unmarshal([]byte(c.Request.FormValue("user")), &user) == nil {
+			identity.Name = strings.TrimSpace(user.Name.FirstName + " " + user.Name.LastName)
+		}
+	}
+
+	user, err := oc.resolveUser(c, identity)
+	if err != nil {
+		return err
+	}
+	if user.Deletion.DeletedAt != 0 {
+		return invalidCredentialsError
+	}
+	return oc.completeLogin(c, user)
+}
+
+// resolveUser finds the user linked to the identity, links it by verified email or creates a new user
+func (oc *oidcController) resolveUser(c *gin.Context, identity *oidc.Identity) (*models.User, error) {
+	user, err := oc.AuthRepo.GetByIdentity(c, identity.Provider, identity.Subject)
+	if err == nil {
+		return &user, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	if identity.Email == "" {
+		return nil, jsonHelper.ApiError{
+			Err:    "Provider did not share an email",
+			Status: 400,
+		}
+	}
+	// an unverified email could belong to someone else, an account made or linked with it would be handed to them
+	if !identity.EmailVerified {
+		return nil, jsonHelper.ApiError{
+			Err:    "Provider has not verified your email",
+			Status: 403,
+		}
+	}
+
+	link := models.ExternalIdentity{
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+		LinkedAt: int(time.Now().Unix()),
+	}
+	user, err = oc.AuthRepo.GetUserByEmail(c, identity.Email)
+	if err == nil {
+		if err = oc.AuthRepo.AddIdentity(c, user.ID, link); err != nil {
+			return nil, jsonHelper.ApiError{
+				Err:    "Error linking account",
+				Status: 500,
+			}
+		}
+		return &user, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	return oc.createUser(c, identity, link)
+}
+
+func (oc *oidcController) createUser(c *gin.Context, identity *oidc.Identity, link models.ExternalIdentity) (*models.User, error) {
+	role, err := oc.adminRepo.GetRoleByName(c, "ROLE_USER")
+	if err != nil {
+		return nil, jsonHelper.ApiError{
+			Err:    "No role found",
+			Status: 404,
+		}
+	}
+	userID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	// no password, the user signs in through the provider
+	newUser := models.User{
+		ID:          userID,
+		Email:       identity.Email,
+		Role:        role.ID,
+		UserProfile: models.UserProfile{Name: identity.Name},
+		Identities:  []models.ExternalIdentity{link},
+	}
+	if err = oc.AuthRepo.SaveUser(c, &newUser); err != nil {
+		return nil, jsonHelper.ApiError{
+			Err:    "Error creating user",
+			Status: 500,
+		}
+	}
+
+	customerID, err := oc.paymentService.CreateCustomer(newUser.Email)
+	if err != nil {
+		return nil, jsonHelper.ApiError{
+			Err:    "Error creating payment profile",
+			Status: 502,
+		}
+	}
+	if err = oc.AuthRepo.UpdateCustomerIDByEmail(c, newUser.Email, customerID); err != nil {
+		return nil, jsonHelper.ApiError{
+			Err:    "Error creating payment profile",
+			Status: 500,
+		}
+	}
+	newUser.CustomerID = customerID
+	return &newUser, nil
+}
@@ -0,0 +1,257 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"palyvoua/internal/api/oidc"
+	"palyvoua/internal/api/oidc/oidctest"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/auth"
+	"testing"
+	"time"
+)
+
+// memoryUserRepo keeps the users the sign-in routes look up, link, create and enroll, other methods are not used by them
+type memoryUserRepo struct {
+	repository.UserRepo
+	users map[string]*models.User
+}
+
+func (m *memoryUserRepo) GetByIdentity(c context.Context, provider string, subject string) (models.User, error) {
+	for _, user := range m.users {
+		for _, identity := range user.Identities {
+			if identity.Provider == provider && identity.Subject == subject {
+				return *user, nil
+			}
+		}
+	}
+	return models.User{}, mongo.ErrNoDocuments
+}
+
+func (m *memoryUserRepo) GetUserByEmail(c context.Context, email string) (models.User, error) {
+	if user, ok := m.users[email]; ok {
+		return *user, nil
+	}
+	return models.User{}, mongo.ErrNoDocuments
+}
+
+func (m *memoryUserRepo) AddIdentity(c context.Context, userID uuid.UUID, identity models.ExternalIdentity) error {
+	for _, user := range m.users {
+		if user.ID == userID {
+			user.Identities = append(user.Identities, identity)
+		}
+	}
+	return nil
+}
+
+func (m *memoryUserRepo) SaveUser(c context.Context, user *models.User) error {
+	saved := *user
+	m.users[user.Email] = &saved
+	return nil
+}
+
+func (m *memoryUserRepo) GetByID(c context.Context, id uuid.UUID) (models.User, error) {
+	for _, user := range m.users {
+		if user.ID == id {
+			return *user, nil
+		}
+	}
+	return models.User{}, mongo.ErrNoDocuments
+}
+
+func (m *memoryUserRepo) UpdateMFASettings(c context.Context, userID uuid.UUID, settings models.MFASettings) error {
+	for _, user := range m.users {
+		if user.ID == userID {
+			user.MFA = settings
+		}
+	}
+	return nil
+}
+
+func (m *memoryUserRepo) UpdateCustomerIDByEmail(c context.Context, email string, cid string) error {
+	m.users[email].CustomerID = cid
+	return nil
+}
+
+type memoryAdminRepo struct {
+	repository.AdminRepo
+	role models.Role
+}
+
+func (m *memoryAdminRepo) GetRoleByName(c context.Context, name string) (models.Role, error) {
+	return m.role, nil
+}
+
+func (m *memoryAdminRepo) GetRoleByID(c context.Context, id uuid.UUID) (models.Role, error) {
+	return m.role, nil
+}
+
+type memorySessionRepo struct {
+	repository.SessionRepo
+	sessions []models.Session
+}
+
+func (m *memorySessionRepo) Save(c context.Context, session *models.Session) error {
+	m.sessions = append(m.sessions, *session)
+	return nil
+}
+
+type customerPaymentService struct {
+	paymentService
+}
+
+func (customerPaymentService) CreateCustomer(email string) (string, error) {
+	return "cus_" + email, nil
+}
+
+func TestOIDCCallback(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	auth.UseTokens(auth.TokenOptions{Secret: []byte("test"), AccessExpiration: time.Minute, RefreshExpiration: time.Hour})
+	role := models.Role{ID: uuid.New(), Name: "ROLE_USER"}
+	existing := models.User{ID: uuid.New(), Email: "known@example.com", Role: role.ID}
+	linked := models.User{
+		ID:         uuid.New(),
+		Email:      "linked@example.com",
+		Role:       role.ID,
+		Identities: []models.ExternalIdentity{{Provider: "mock", Subject: "linked-sub"}},
+	}
+
+	tests := []struct {
+		name string
+		claims oidctest.Claims
+		status int
+		// check looks at the users after the callback, by email
+		check func(t *testing.T, users map[string]*models.User)
+	}{
+		{
+			name:   "linked identity signs in",
+			claims: oidctest.Claims{Subject: "linked-sub", Email: "changed@example.com"},
+			status: 200,
+			check: func(t *testing.T, users map[string]*models.User) {
+				if len(users) != 2 {
+					t.Fatalf("got %d users, want no new user", len(users))
+				}
+			},
+		},
+		{
+			name:   "verified email links the existing user",
+			claims: oidctest.Claims{Subject: "new-sub", Email: "known@example.com", EmailVerified: true},
+			status: 200,
+			check: func(t *testing.T, users map[string]*models.User) {
+				identities := users["known@example.com"].Identities
+				if len(identities) != 1 || identities[0].Provider != "mock" || identities[0].Subject != "new-sub" {
+					t.Fatalf("identities = %+v, want the mock identity linked", identities)
+				}
+			},
+		},
+		{
+			name:   "unverified email does not link the existing user",
+			claims: oidctest.Claims{Subject: "new-sub", Email: "known@example.com"},
+			status: 403,
+			check: func(t *testing.T, users map[string]*models.User) {
+				if identities := users["known@example.com"].Identities; len(identities) != 0 {
+					t.Fatalf("identities = %+v, want none linked", identities)
+				}
+			},
+		},
+		{
+			name:   "verified email creates a user",
+			claims: oidctest.Claims{Subject: "new-sub", Email: "new@example.com", EmailVerified: true, Name: "New"},
+			status: 200,
+			check: func(t *testing.T, users map[string]*models.User) {
+				user, ok := users["new@example.com"]
+				if !ok {
+					t.Fatal("no user created")
+				}
+				if user.Role != role.ID || user.Name != "New" || user.CustomerID != "cus_new@example.com" || user.Password != "" {
+					t.Fatalf("created %+v", user)
+				}
+				if len(user.Identities) != 1 || user.Identities[0].Subject != "new-sub" {
+					t.Fatalf("identities = %+v, want the mock identity", user.Identities)
+				}
+			},
+		},
+		{
+			name:   "unverified email creates no user",
+			claims: oidctest.Claims{Subject: "new-sub", Email: "new@example.com"},
+			status: 403,
+			check: func(t *testing.T, users map[string]*models.User) {
+				if _, ok := users["new@example.com"]; ok {
+					t.Fatal("user created for an unverified email")
+				}
+			},
+		},
+		{
+			name:   "no email",
+			claims: oidctest.Claims{Subject: "new-sub", EmailVerified: true},
+			status: 400,
+			check: func(t *testing.T, users map[string]*models.User) {
+				if len(users) != 2 {
+					t.Fatalf("got %d users, want no new user", len(users))
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := oidctest.NewIssuer(t)
+			existingCopy, linkedCopy := existing, linked
+			userRepo := &memoryUserRepo{users: map[string]*models.User{
+				existing.Email: &existingCopy,
+				linked.Email:   &linkedCopy,
+			}}
+			sessionRepo := &memorySessionRepo{}
+			r := gin.New()
+			SetupOIDCRoutes(r, &AuthRoutesOptions{
+				UserRepo:    userRepo,
+				AdminRepo:   &memoryAdminRepo{role: role},
+				Ps:          customerPaymentService{},
+				SessionRepo: sessionRepo,
+				OIDCService: oidc.NewOIDCService([]oidc.ProviderConfig{
+					{Name: "mock", Issuer: issuer.URL, ClientID: "palyvo", ClientSecret: "secret", RedirectURL: "http://localhost/callback"},
+				}, oidc.NewMemoryStateStore()),
+			})
+
+			var start struct {
+				URL string `json:"url"`
+			}
+			if status := serve(t, r, "/auth/oidc/mock/start", &start); status != 200 {
+				t.Fatalf("start status = %d", status)
+			}
+			code, state, err := issuer.Authorize(start.URL, tt.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var tokens struct {
+				AccessToken string `json:"accessToken"`
+			}
+			status := serve(t, r, "/auth/oidc/mock/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), &tokens)
+			if status != tt.status {
+				t.Fatalf("callback status = %d, want %d", status, tt.status)
+			}
+			if status == 200 && (tokens.AccessToken == "" || len(sessionRepo.sessions) != 1) {
+				t.Fatalf("signed in without a token or a session")
+			}
+			tt.check(t, userRepo.users)
+		})
+	}
+}
+
+func serve(t *testing.T, r *gin.Engine, target string, body interface{}) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code == 200 {
+		if err := json.Unmarshal(w.Body.Bytes(), body); err != nil {
+			t.Fatalf("decoding %s: %v", w.Body, err)
+		}
+	}
+	return w.Code
+}
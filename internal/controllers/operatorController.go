@@ -1,12 +1,17 @@
 package controllers
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"palyvoua/internal/api/events"
+	"palyvoua/internal/api/notification"
+	"palyvoua/internal/api/webhook"
 	"palyvoua/internal/models"
 	"palyvoua/internal/repository"
 	"palyvoua/tools/auth"
 	"palyvoua/tools/jsonHelper"
+	"palyvoua/tools/metrics"
 )
 
 //type operatorControllerOptions func(*operatorController)
@@ -15,14 +20,19 @@ type operatorController struct {
 	authRepo repository.UserRepo
 	adminRepo adminRepo
 	ticketRepo repository.TicketRepo
+	productTicketRepo repository.ProductTicketRepo
+	notifications notification.NotificationService
+	events events.Broker
+	webhooks webhook.WebhookService
 }
 
-func SetupOperatorRoutes(r *gin.Engine , authRepo repository.UserRepo, adminRepo adminRepo, tr repository.TicketRepo) {
+func SetupOperatorRoutes(r *gin.Engine , authRepo repository.UserRepo, adminRepo adminRepo, tr repository.TicketRepo, ptr repository.ProductTicketRepo, notifications notification.NotificationService, broker events.Broker, webhooks webhook.WebhookService) {
 	operatorGroup := r.Group("/operator")
 
-	oc := operatorController{authRepo: authRepo, adminRepo: adminRepo, ticketRepo: tr}
+	oc := operatorController{authRepo: authRepo, adminRepo: adminRepo, ticketRepo: tr, productTicketRepo: ptr, notifications: notifications, events: broker, webhooks: webhooks}
 
 
+	operatorGroup.Use(auth.RequireScope(models.SCOPE_TICKETS_REDEEM))
 	operatorGroup.Use(auth.AuthMiddleware(oc.authRepo, adminRepo))
 	operatorGroup.Use(auth.RoleMiddleware(2, oc.authRepo, oc.adminRepo))
 	operatorGroup.POST("/submitTicket", jsonHelper.MakeHttpHandler(oc.submitTicket))
@@ -31,6 +41,10 @@ func SetupOperatorRoutes(r *gin.Engine , authRepo repository.UserRepo, adminRepo
 
 type SubmitTicketRequest struct {
 	TicketID string `json:"ticketId"`
+	// Liters redeems part of the ticket, the whole ticket is used when it is 0
+	Liters int `json:"liters"`
+	// Station is where the ticket is redeemed, a key bound to a station redeems at that one
+	Station string `json:"station"`
 }
 
 func (oc *operatorController) submitTicket(c *gin.Context) error {
@@ -47,7 +61,7 @@ func (oc *operatorController) submitTicket(c *gin.Context) error {
 	//	return jsonHelper.DefaultHttpErrors["BadRequest"]
 	//}
 
-	ticket, err := oc.ticketRepo.GetByID(uuid.MustParse(body.TicketID))
+	ticket, err := oc.ticketRepo.GetByID(c, uuid.MustParse(body.TicketID))
 	if err != nil {
 		return jsonHelper.ApiError{
 			Err:    err.Error(),
@@ -62,14 +76,108 @@ func (oc *operatorController) submitTicket(c *gin.Context) error {
 		}
 	}
 
-	err = oc.ticketRepo.UpdateStatus(ticket.ID, models.USED)
+	if err = oc.checkAPIKeySeller(c, &ticket); err != nil {
+		return err
+	}
+	station, err := apiKeyStation(c, body.Station)
+	if err != nil {
+		return err
+	}
+
+	if body.Liters < 0 || body.Liters > ticket.Amount {
+		return jsonHelper.ApiError{
+			Err:    "Ticket doesn't hold that many liters",
+			Status: 400,
+		}
+	}
+	if body.Liters > 0 && body.Liters < ticket.Amount {
+		used, err := oc.ticketRepo.UsePart(c, ticket.ID, body.Liters, station)
+		if err != nil {
+			return jsonHelper.ApiError{
+				Err:    "Error changing ticket's status",
+				Status: 500,
+			}
+		}
+		if !used {
+			return jsonHelper.ApiError{
+				Err:    "Ticket can't be used",
+				Status: 409,
+			}
+		}
+		ticket.Amount -= body.Liters
+		ticket.Used += body.Liters
+		ticket.Station = station
+		metrics.CountTickets(c, metrics.TICKETS_REDEEMED, ticket)
+		events.PublishTickets(oc.events, models.TICKET_PARTIALLY_USED, ticket)
+		publishToSeller(c, oc.webhooks, models.WEBHOOK_TICKET_REDEEMED, fmt.Sprintf("redeemed:%s:%d", ticket.ID, ticket.Used), &ticket, body.Liters)
+		c.JSON(200, gin.H{"amount": ticket.Amount})
+		return nil
+	}
+
+	used, err := oc.ticketRepo.Use(c, ticket.ID, station)
 	if err != nil {
 		return jsonHelper.ApiError{
 			Err:    "Error changing ticket's status",
-			Status: 0,
+			Status: 500,
 		}
 	}
+	if !used {
+		return jsonHelper.ApiError{
+			Err:    "Ticket can't be used",
+			Status: 409,
+		}
+	}
+	ticket.Status = models.USED
+	ticket.Station = station
+	metrics.CountTickets(c, metrics.TICKETS_REDEEMED, ticket)
+	events.PublishTickets(oc.events, models.TICKET_USED, ticket)
+	publishToSeller(c, oc.webhooks, models.WEBHOOK_TICKET_REDEEMED, "redeemed:"+ticket.ID.String(), &ticket, ticket.Amount)
+	notify(c, oc.notifications, notification.TicketNotice{
+		Event:   models.NOTIFY_TICKET_REDEEMED,
+		Key:     "redeemed:" + ticket.ID.String(),
+		Tickets: []models.Ticket{ticket},
+	})
 
 	c.JSON(200, gin.H{})
 	return nil
 }
+
+// checkAPIKeySeller stops a terminal key bound to one seller from redeeming another seller's tickets
+func (oc *operatorController) checkAPIKeySeller(c *gin.Context, ticket *models.Ticket) error {
+	authBodyField, _ := c.Get("authBody")
+	authBody, ok := authBodyField.(auth.AuthBody)
+	if !ok || authBody.GetAPIKey() == nil || authBody.GetAPIKey().Seller == "" {
+		return nil
+	}
+	productTicket, err := oc.productTicketRepo.GetByID(c, ticket.ProductTicketID)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error receiving product ticket",
+			Status: 500,
+		}
+	}
+	if productTicket.Seller != authBody.GetAPIKey().Seller {
+		return jsonHelper.ApiError{
+			Err:    "Ticket belongs to another seller",
+			Status: 403,
+		}
+	}
+	return nil
+}
+
+// apiKeyStation is the station a ticket is redeemed at, a terminal key bound to a station can't redeem at another one
+func apiKeyStation(c *gin.Context, requested string) (string, error) {
+	authBodyField, _ := c.Get("authBody")
+	authBody, ok := authBodyField.(auth.AuthBody)
+	if !ok || authBody.GetAPIKey() == nil || authBody.GetAPIKey().Station == "" {
+		return requested, nil
+	}
+	station := authBody.GetAPIKey().Station
+	if requested != "" && requested != station {
+		return "", jsonHelper.ApiError{
+			Err:    "API key is bound to another station",
+			Status: 403,
+		}
+	}
+	return station, nil
+}
@@ -0,0 +1,390 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"palyvoua/internal/api/organization"
+	"palyvoua/internal/api/payment"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/auth"
+	"palyvoua/tools/jsonHelper"
+	"strconv"
+)
+
+type organizationController struct {
+	organizations organization.OrganizationService
+	paymentService payment.PaymentService
+	productTicketRepo repository.ProductTicketRepo
+	providers payment.ProviderSelector
+	returnURLs payment.ReturnURLResolver
+}
+
+type OrganizationRoutesOptions struct {
+	UserRepo repository.UserRepo
+	AdminRepo repository.AdminRepo
+	Organizations organization.OrganizationService
+	PaymentService payment.PaymentService
+	ProductTicketRepo repository.ProductTicketRepo
+	Providers payment.ProviderSelector
+	ReturnURLs payment.ReturnURLResolver
+}
+
+func SetupOrganizationRoutes(r *gin.Engine, options *OrganizationRoutesOptions) {
+	organizationGroup := r.Group("/organization")
+
+	oc := organizationController{
+		organizations:     options.Organizations,
+		paymentService:    options.PaymentService,
+		productTicketRepo: options.ProductTicketRepo,
+		providers:         options.Providers,
+		returnURLs:        options.ReturnURLs,
+	}
+
+	organizationGroup.Use(auth.AuthMiddleware(options.UserRepo, options.AdminRepo))
+	organizationGroup.GET("", jsonHelper.MakeHttpHandler(oc.getMemberships))
+	organizationGroup.POST("", jsonHelper.MakeHttpHandler(oc.createOrganization))
+	organizationGroup.GET("/:id", jsonHelper.MakeHttpHandler(oc.getOrganization))
+
+	// the rest is for the organization's managers, authorize checks the membership
+	organizationGroup.POST("/:id/members", jsonHelper.MakeHttpHandler(oc.addMember))
+	organizationGroup.DELETE("/:id/members/:userId", jsonHelper.MakeHttpHandler(oc.removeMember))
+	organizationGroup.PUT("/:id/members/:userId/limits", jsonHelper.MakeHttpHandler(oc.setLimits))
+	organizationGroup.POST("/:id/setupIntent", jsonHelper.MakeHttpHandler(oc.createSetupIntent))
+	organizationGroup.GET("/:id/paymentMethods", jsonHelper.MakeHttpHandler(oc.getPaymentMethods))
+	organizationGroup.POST("/:id/checkout", jsonHelper.MakeHttpHandler(oc.createCheckoutSession))
+	organizationGroup.GET("/:id/tickets", jsonHelper.MakeHttpHandler(oc.getTickets))
+	organizationGroup.POST("/:id/allocate", jsonHelper.MakeHttpHandler(oc.allocate))
+	organizationGroup.GET("/:id/report", jsonHelper.MakeHttpHandler(oc.getReport))
+}
+
+func organizationError(err error) error {
+	var rejected organization.RejectedError
+	var overLimit organization.LimitError
+	switch {
+	case errors.Is(err, organization.ErrNotMember), errors.Is(err, organization.ErrNotManager):
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 403,
+		}
+	case errors.As(err, &overLimit):
+		return jsonHelper.ApiError{
+			Err:    overLimit.Error(),
+			Status: 409,
+		}
+	case errors.As(err, &rejected):
+		return jsonHelper.ApiError{
+			Err:    rejected.Error(),
+			Status: 400,
+		}
+	}
+	return jsonHelper.DefaultHttpErrors["InternalServerError"]
+}
+
+// authorize reads the organization id param and checks the caller's membership
+func (oc *organizationController) authorize(c *gin.Context, managerOnly bool) (uuid.UUID, *models.OrganizationMember, error) {
+	authBodyField, exists := c.Get("authBody")
+	if !exists {
+		return uuid.Nil, nil, jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	authBody, ok := authBodyField.(auth.AuthBody)
+	if !ok {
+		return uuid.Nil, nil, jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	organizationID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return uuid.Nil, nil, jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	member, err := oc.organizations.Authorize(c, organizationID, authBody.GetUser().ID, managerOnly)
+	if err != nil {
+		return uuid.Nil, nil, organizationError(err)
+	}
+	return organizationID, member, nil
+}
+
+func (oc *organizationController) getMemberships(c *gin.Context) error {
+	user, err := authUser(c)
+	if err != nil {
+		return err
+	}
+	memberships, err := oc.organizations.Memberships(c, user.ID)
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	c.JSON(200, gin.H{"memberships": memberships})
+	return nil
+}
+
+type CreateOrganizationRequest struct {
+	Name string `json:"name"`
+}
+
+func (oc *organizationController) createOrganization(c *gin.Context) error {
+	user, err := authUser(c)
+	if err != nil {
+		return err
+	}
+	var body CreateOrganizationRequest
+	if err = c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	created, err := oc.organizations.Create(c, body.Name, user)
+	if err != nil {
+		return organizationError(err)
+	}
+	c.JSON(200, gin.H{"organization": created})
+	return nil
+}
+
+func (oc *organizationController) getOrganization(c *gin.Context) error {
+	organizationID, member, err := oc.authorize(c, false)
+	if err != nil {
+		return err
+	}
+	found, err := oc.organizations.GetByID(c, organizationID)
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	// drivers see their own membership and limits, managers the whole fleet
+	members := []models.OrganizationMember{*member}
+	if member.Role == models.ORG_MANAGER {
+		if members, err = oc.organizations.Members(c, organizationID); err != nil {
+			return jsonHelper.DefaultHttpErrors["InternalServerError"]
+		}
+	}
+	c.JSON(200, gin.H{"organization": found, "members": members})
+	return nil
+}
+
+type AddMemberRequest struct {
+	Email string `json:"email"`
+	Role string `json:"role"`
+}
+
+func (oc *organizationController) addMember(c *gin.Context) error {
+	organizationID, _, err := oc.authorize(c, true)
+	if err != nil {
+		return err
+	}
+	var body AddMemberRequest
+	if err = c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	member, err := oc.organizations.AddMember(c, organizationID, body.Email, body.Role)
+	if err != nil {
+		return organizationError(err)
+	}
+	c.JSON(200, gin.H{"member": member})
+	return nil
+}
+
+func (oc *organizationController) removeMember(c *gin.Context) error {
+	organizationID, _, err := oc.authorize(c, true)
+	if err != nil {
+		return err
+	}
+	userID, err := uuid.Parse(c.Param("userId"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	if err = oc.organizations.RemoveMember(c, organizationID, userID); err != nil {
+		if errors.Is(err, organization.ErrNotMember) {
+			return jsonHelper.ApiError{
+				Err:    "No such member",
+				Status: 404,
+			}
+		}
+		return organizationError(err)
+	}
+	c.JSON(200, gin.H{})
+	return nil
+}
+
+type SetLimitsRequest struct {
+	Limits []models.DriverLimit `json:"limits"`
+}
+
+func (oc *organizationController) setLimits(c *gin.Context) error {
+	organizationID, _, err := oc.authorize(c, true)
+	if err != nil {
+		return err
+	}
+	userID, err := uuid.Parse(c.Param("userId"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	var body SetLimitsRequest
+	if err = c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	if err = oc.organizations.SetLimits(c, organizationID, userID, body.Limits); err != nil {
+		if errors.Is(err, organization.ErrNotMember) {
+			return jsonHelper.ApiError{
+				Err:    "No such member",
+				Status: 404,
+			}
+		}
+		return organizationError(err)
+	}
+	c.JSON(200, gin.H{})
+	return nil
+}
+
+func (oc *organizationController) createSetupIntent(c *gin.Context) error {
+	organizationID, _, err := oc.authorize(c, true)
+	if err != nil {
+		return err
+	}
+	found, err := oc.organizations.GetByID(c, organizationID)
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	si, err := oc.paymentService.CreateSetupIntent(found.CustomerID)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{
+		"setupClientSecret": si.ClientSecret,
+		"customerID":        found.CustomerID,
+	})
+	return nil
+}
+
+func (oc *organizationController) getPaymentMethods(c *gin.Context) error {
+	organizationID, _, err := oc.authorize(c, true)
+	if err != nil {
+		return err
+	}
+	found, err := oc.organizations.GetByID(c, organizationID)
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	paymentMethods, err := oc.paymentService.ListPaymentMethods(found.CustomerID)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error getting payment methods",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{"paymentMethods": paymentMethods})
+	return nil
+}
+
+type OrganizationCheckoutRequest struct {
+	ProductList []payment.ProductDto `json:"productList"`
+	Provider string `json:"provider"`
+	Client string `json:"client"`
+	Platform string `json:"platform"`
+}
+
+// createCheckoutSession buys tickets for the organization, the webhook issues them to the organization
+func (oc *organizationController) createCheckoutSession(c *gin.Context) error {
+	organizationID, _, err := oc.authorize(c, true)
+	if err != nil {
+		return err
+	}
+	var body OrganizationCheckoutRequest
+	if err = c.Bind(&body); err != nil || len(body.ProductList) == 0 {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	found, err := oc.organizations.GetByID(c, organizationID)
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	productTicket, err := oc.productTicketRepo.GetByStripeProductID(c, body.ProductList[0].ProductStripeID)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "No such product",
+			Status: 404,
+		}
+	}
+	providerName, provider, err := oc.providers.Select(body.Provider, productTicket.Seller)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 400,
+		}
+	}
+	returnURLs, err := oc.returnURLs.Resolve(body.Client, body.Platform)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 400,
+		}
+	}
+	sess, err := provider.CreateCheckoutSession(c, body.ProductList, found.CustomerID, returnURLs, nil)
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	c.JSON(200, gin.H{"sessionId": sess.ID, "url": sess.URL, "provider": providerName})
+	return nil
+}
+
+func (oc *organizationController) getTickets(c *gin.Context) error {
+	organizationID, _, err := oc.authorize(c, true)
+	if err != nil {
+		return err
+	}
+	tickets, err := oc.organizations.Tickets(c, organizationID)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error getting tickets",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{"tickets": tickets})
+	return nil
+}
+
+type AllocateRequest struct {
+	TicketID uuid.UUID `json:"ticketId"`
+	DriverID uuid.UUID `json:"driverId"`
+	// Liters splits the ticket, 0 hands over all of it
+	Liters int `json:"liters"`
+}
+
+func (oc *organizationController) allocate(c *gin.Context) error {
+	organizationID, manager, err := oc.authorize(c, true)
+	if err != nil {
+		return err
+	}
+	var body AllocateRequest
+	if err = c.Bind(&body); err != nil || body.TicketID == uuid.Nil || body.DriverID == uuid.Nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	allocation, err := oc.organizations.Allocate(c, organizationID, manager.UserID, body.TicketID, body.DriverID, body.Liters)
+	if err != nil {
+		return organizationError(err)
+	}
+	c.JSON(200, gin.H{"allocation": allocation})
+	return nil
+}
+
+// getReport sums purchases and allocations over [from, to), both unix seconds and optional
+func (oc *organizationController) getReport(c *gin.Context) error {
+	organizationID, _, err := oc.authorize(c, true)
+	if err != nil {
+		return err
+	}
+	from, to := 0, 0
+	if value := c.Query("from"); value != "" {
+		if from, err = strconv.Atoi(value); err != nil {
+			return jsonHelper.DefaultHttpErrors["BadRequest"]
+		}
+	}
+	if value := c.Query("to"); value != "" {
+		if to, err = strconv.Atoi(value); err != nil {
+			return jsonHelper.DefaultHttpErrors["BadRequest"]
+		}
+	}
+	report, err := oc.organizations.Report(c, organizationID, from, to)
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	c.JSON(200, gin.H{"report": report})
+	return nil
+}
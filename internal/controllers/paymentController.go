@@ -2,45 +2,79 @@ package controllers
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"github.com/stripe/stripe-go/v75"
-	"github.com/stripe/stripe-go/v75/checkout/session"
-	"github.com/stripe/stripe-go/v75/paymentmethod"
-	"github.com/stripe/stripe-go/v75/webhook"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io"
-	"os"
+	"log/slog"
+	"net/http"
+	"palyvoua/internal/api/events"
+	"palyvoua/internal/api/fiscal"
+	"palyvoua/internal/api/notification"
+	"palyvoua/internal/api/organization"
 	"palyvoua/internal/api/payment"
+	"palyvoua/internal/api/promotion"
+	"palyvoua/internal/api/receipt"
+	"palyvoua/internal/api/wallet"
+	"palyvoua/internal/api/webhook"
+	"palyvoua/internal/mapper"
 	"palyvoua/internal/models"
 	"palyvoua/internal/repository"
 	"palyvoua/tools/auth"
 	"palyvoua/tools/jsonHelper"
-	"strconv"
+	"palyvoua/tools/logging"
+	"palyvoua/tools/metrics"
+	"palyvoua/tools/tracing"
+	"strings"
 	"sync"
 	"time"
 )
 
+// DEFAULT_WEBHOOK_PROVIDER labels the callbacks of the payment service every checkout used to go through
+const DEFAULT_WEBHOOK_PROVIDER = "default"
+
 type paymentController struct {
 	userRepo repository.UserRepo
 	paymentService
 	ticketRepo repository.TicketRepo
 	productRepo repository.ProductRepo
 	productTicketRepo repository.ProductTicketRepo
+	providers payment.ProviderSelector
+	checkouts repository.CheckoutRepo
+	returnURLs payment.ReturnURLResolver
+	ticketMapper mapper.TicketMapper
+	promotions promotion.PromotionService
+	wallet wallet.WalletService
+	organizations organization.OrganizationService
+	receipts receipt.ReceiptService
+	fiscal fiscal.FiscalService
+	notifications notification.NotificationService
+	events events.Broker
+	webhooks webhook.WebhookService
+	ticketExpiration time.Duration
 }
 
 type paymentService interface {
 	SetDefaultPaymentMethod(customerID string, paymentMethodID string) error
 	CreateCustomer(email string) (string, error)
 	GetDefaultPaymentMethod(customerID string) (string, error)
+	ListPaymentMethods(customerID string) ([]payment.PaymentMethod, error)
 	DeletePaymentMethodByIDAndCustomerID(paymentMethodID string, customerID string) error
-	ChargeCustomer(customerID string, amount int) (string, error)
-	CreateSetupIntent(cid string) (*stripe.SetupIntent, error)
-	GetCustomerByID(cid string) (*stripe.Customer, error)
-	SaveProduct(product *models.ProductTicket) (*stripe.Product, error)
-	CreateCheckoutSession(productList []payment.ProductDto, customerID string) (*stripe.CheckoutSession, error)
+	ChargeCustomer(c context.Context, customerID string, amount int) (string, error)
+	CreateSetupIntent(cid string) (*payment.SetupIntent, error)
+	GetCustomerByID(cid string) (*payment.Customer, error)
+	SaveProduct(product *models.ProductTicket) (*payment.Product, error)
+	CreateCheckoutSession(c context.Context, productList []payment.ProductDto, customerID string, returnURLs payment.ReturnURLs, discount *payment.Discount) (*payment.CheckoutSession, error)
+	CreateTopUpSession(c context.Context, customerID string, amount int, currency string, returnURLs payment.ReturnURLs) (*payment.CheckoutSession, error)
+	GetCheckoutSession(c context.Context, sessionID string) (*payment.CheckoutSession, error)
 	DeleteProductByID(productID string) error
+	UpdateCustomer(customerID string, details payment.CustomerDetails) error
+	DeleteCustomer(customerID string) error
+	ParseWebhook(c context.Context, payload []byte, header http.Header) (*payment.Event, error)
 }
 
 type PaymentRouterOptions struct {
@@ -50,12 +84,29 @@ type PaymentRouterOptions struct {
 	Pr repository.ProductRepo
 	Ptr repository.ProductTicketRepo
 	AdminRepo repository.AdminRepo
+	Providers payment.ProviderSelector
+	// Checkouts are the sessions of the providers that keep them with us, the default provider keeps its own
+	Checkouts repository.CheckoutRepo
+	ReturnURLs payment.ReturnURLResolver
+	TicketMapper mapper.TicketMapper
+	Promotions promotion.PromotionService
+	Wallet wallet.WalletService
+	Organizations organization.OrganizationService
+	Receipts receipt.ReceiptService
+	// Fiscal is nil when fiscalization is off
+	Fiscal fiscal.FiscalService
+	Notifications notification.NotificationService
+	Events events.Broker
+	Webhooks webhook.WebhookService
+	// TicketExpiration is how long a bought ticket can be used
+	TicketExpiration time.Duration
 }
 
 func SetupPaymentRoutes(r *gin.Engine, options *PaymentRouterOptions) {	paymentGroup := r.Group("/payment")
-	pc := paymentController{userRepo: options.UserRepository, paymentService: options.Ps, ticketRepo: options.Tr, productRepo: options.Pr, productTicketRepo: options.Ptr}
+	pc := paymentController{userRepo: options.UserRepository, paymentService: options.Ps, ticketRepo: options.Tr, productRepo: options.Pr, productTicketRepo: options.Ptr, providers: options.Providers, checkouts: options.Checkouts, returnURLs: options.ReturnURLs, ticketMapper: options.TicketMapper, promotions: options.Promotions, wallet: options.Wallet, organizations: options.Organizations, receipts: options.Receipts, fiscal: options.Fiscal, notifications: options.Notifications, events: options.Events, webhooks: options.Webhooks, ticketExpiration: options.TicketExpiration}
 
 	paymentGroup.POST("/webhook", jsonHelper.MakeHttpHandler(pc.webhookHandler))
+	paymentGroup.POST("/webhook/:provider", jsonHelper.MakeHttpHandler(pc.providerWebhookHandler))
 
 	paymentGroup.Use(auth.AuthMiddleware(options.UserRepository, options.AdminRepo))
 	paymentGroup.POST("/method/setDefault", jsonHelper.MakeHttpHandler(pc.setDefaultPaymentMethod))
@@ -66,63 +117,77 @@ func SetupPaymentRoutes(r *gin.Engine, options *PaymentRouterOptions) {	paymentG
 	//paymentGroup.POST("/buy/amount", jsonHelper.MakeHttpHandler(pc.buyAmount))
 	paymentGroup.POST("/setupIntent/create",jsonHelper.MakeHttpHandler(pc.createSetupIntent))
 	paymentGroup.POST("/checkout/create",jsonHelper.MakeHttpHandler(pc.createCheckoutSession))
+	paymentGroup.GET("/checkout/:sessionId", jsonHelper.MakeHttpHandler(pc.getCheckoutSession))
 }
 
-func (sc *paymentController) processProductID(c context.Context, wg *sync.WaitGroup, errorCh chan error, productID string, user *models.User, sess *stripe.CheckoutSession) {
+func (sc *paymentController) processProductID(c context.Context, wg *sync.WaitGroup, errorCh chan error, item payment.LineItem, user *models.User, organizationID uuid.UUID, sess *payment.CheckoutSession) {
 	defer wg.Done()
 
-	expirationTerm, err := strconv.Atoi(os.Getenv("TICKET_EXPIRATION"))
+	c, span := tracing.Tracer.Start(c, "payment.issueTicket", trace.WithAttributes(attribute.String("payment.product_id", item.ProductID)))
+	defer span.End()
+
+	slog.DebugContext(c, "issuing tickets for line item", "product_id", item.ProductID, "quantity", item.Quantity)
+	productTicket,err := sc.productTicketRepo.GetByStripeProductID(c, item.ProductID)
 	if err != nil {
+		tracing.Fail(span, err)
 		errorCh <- err
 		return
 	}
-	fmt.Println(productID)
-	productTicket,err := sc.productTicketRepo.GetByStripeProductID(c, productID)
+	// the price may have changed between the checkout and this webhook, the line item knows what was paid
+	priceVersionID := productTicket.PriceVersionID
+	if paidVersionID, err := uuid.Parse(item.PriceVersionID); err == nil {
+		priceVersionID = paidVersionID
+	}
+	_, err = issueTicket(c, sc.ticketRepo, sc.productRepo, &productTicket, sc.ticketExpiration, user.ID, organizationID, sess.PaymentID, sess.ID, priceVersionID)
 	if err != nil {
+		tracing.Fail(span, err)
 		errorCh <- err
 		return
 	}
+
+	return
+
+}
+
+// issueTicket creates a paid ticket and takes its liters out of the stock,
+// a ticket bought by an organization has no user until it is allocated
+func issueTicket(c context.Context, ticketRepo repository.TicketRepo, productRepo repository.ProductRepo, productTicket *models.ProductTicket, expiration time.Duration, userID uuid.UUID, organizationID uuid.UUID, paymentID string, checkoutSessionID string, priceVersionID uuid.UUID) (*models.Ticket, error) {
 	ticketID, _ := uuid.NewRandom()
 	ticket := models.Ticket{
 		CreatedAt: int(time.Now().Unix()),
-		ExpiresAt: int(time.Now().Add(time.Hour * 24 * time.Duration(expirationTerm)).Unix()),
+		ExpiresAt: int(time.Now().Add(expiration).Unix()),
 		ID: ticketID,
-		UserId: user.ID,
+		UserId: userID,
 		Status: models.NOT_ACTIVATED,
 		ProductTicketID: productTicket.ID,
 		Amount: productTicket.Amount,
+		CheckoutSessionID: checkoutSessionID,
+		PriceVersionID: priceVersionID,
+		OrganizationID: organizationID,
 	}
 	ticket.SetSecret("Huy")
 
-	err = sc.ticketRepo.Create(c,ticket)
+	err := ticketRepo.Create(c,ticket)
 	if err != nil {
-		errorCh <- err
-		return
+		return nil, err
 	}
 
-	err = sc.ticketRepo.UpdatePaymentID(c,ticketID, sess.PaymentIntent.ID)
+	err = ticketRepo.UpdatePaymentID(c,ticketID, paymentID)
 	if err != nil {
-		errorCh <- err
-		return
+		return nil, err
 	}
+	ticket.PaymentID = paymentID
+	ticket.Status = models.ACTIVATED
 
-	err = sc.productRepo.DecreaseProductAmount(c, productTicket.ProductID, productTicket.Amount)
+	err = productRepo.DecreaseProductAmount(c, productTicket.ProductID, productTicket.Amount)
 	if err != nil {
-		errorCh <- err
-		return
+		return nil, err
 	}
-
-	return
-
+	return &ticket, nil
 }
 
-func (sc *paymentController) processProductDto(c context.Context, wg *sync.WaitGroup, errorCh chan error, dto *payment.ProductDto, user *models.User, sess *stripe.CheckoutSession) {
+func (sc *paymentController) processProductDto(c context.Context, wg *sync.WaitGroup, errorCh chan error, dto *payment.ProductDto, user *models.User, sess *payment.CheckoutSession) {
 	defer wg.Done()
-	expirationTerm, err := strconv.Atoi(os.Getenv("TICKET_EXPIRATION"))
-	if err != nil {
-		errorCh <- err
-		return
-	}
 
 	productTicket,err := sc.productTicketRepo.GetByStripeProductID(c, dto.ProductStripeID)
 	if err != nil {
@@ -132,11 +197,13 @@ func (sc *paymentController) processProductDto(c context.Context, wg *sync.WaitG
 	ticketID, _ := uuid.NewRandom()
 	ticket := models.Ticket{
 		CreatedAt: int(time.Now().Unix()),
-		ExpiresAt: int(time.Now().Add(time.Hour * 24 * time.Duration(expirationTerm)).Unix()),
+		ExpiresAt: int(time.Now().Add(sc.ticketExpiration).Unix()),
 		ID: ticketID,
 		UserId: user.ID,
 		Status: models.NOT_ACTIVATED,
 		ProductTicketID: productTicket.ID,
+		CheckoutSessionID: sess.ID,
+		PriceVersionID: productTicket.PriceVersionID,
 	}
 	ticket.SetSecret("Huy")
 
@@ -146,7 +213,7 @@ func (sc *paymentController) processProductDto(c context.Context, wg *sync.WaitG
 		return
 	}
 
-	err = sc.ticketRepo.UpdatePaymentID(c,ticketID, sess.PaymentIntent.ID)
+	err = sc.ticketRepo.UpdatePaymentID(c,ticketID, sess.PaymentID)
 	if err != nil {
 		errorCh <- err
 		return
@@ -169,65 +236,120 @@ func (sc *paymentController) webhookHandler(c *gin.Context) error {
 			Status: 400,
 		}
 	}
-	event, err := webhook.ConstructEventWithOptions(requestBody, c.GetHeader("Stripe-Signature"), os.Getenv("WEBHOOK_SECRET_STRIPE"), webhook.ConstructEventOptions{IgnoreAPIVersionMismatch: true})
+	event, err := sc.paymentService.ParseWebhook(c, requestBody, c.Request.Header)
 	if err != nil {
+		metrics.CountPaymentWebhook(DEFAULT_WEBHOOK_PROVIDER, "", metrics.WEBHOOK_REJECTED)
 		return jsonHelper.ApiError{
 			Err:    err.Error(),
 			Status: 400,
 		}
 	}
+	return sc.handleCountedEvent(c, DEFAULT_WEBHOOK_PROVIDER, event)
+}
 
+// providerWebhookHandler takes the callbacks of the providers selectable per seller or checkout
+func (sc *paymentController) providerWebhookHandler(c *gin.Context) error {
+	provider, ok := sc.providers.Get(c.Param("provider"))
+	if !ok {
+		return jsonHelper.ApiError{
+			Err:    "Unknown payment provider",
+			Status: 404,
+		}
+	}
+	requestBody, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 400,
+		}
+	}
+	event, err := provider.ParseWebhook(c, requestBody, c.Request.Header)
+	if err != nil {
+		metrics.CountPaymentWebhook(c.Param("provider"), "", metrics.WEBHOOK_REJECTED)
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 400,
+		}
+	}
+	return sc.handleCountedEvent(c, c.Param("provider"), event)
+}
+
+// handleCountedEvent handles event in a span of its own and counts the result, a failed callback is retried by the provider
+func (sc *paymentController) handleCountedEvent(c *gin.Context, provider string, event *payment.Event) error {
+	spanContext, span := tracing.Tracer.Start(c.Request.Context(), "payment.webhook "+event.Type, trace.WithAttributes(
+		attribute.String("payment.provider", provider),
+		attribute.String("payment.event_id", event.ID),
+	))
+	c.Request = c.Request.WithContext(spanContext)
+	err := sc.handleEvent(c, event)
+	tracing.End(span, &err)
+	result := metrics.WEBHOOK_PROCESSED
+	if err != nil {
+		result = metrics.WEBHOOK_FAILED
+	}
+	metrics.CountPaymentWebhook(provider, event.Type, result)
+	return err
+}
+
+// errAlreadyIssued ends the ticket transaction of a checkout whose tickets an earlier delivery issued
+var errAlreadyIssued = errors.New("tickets already issued")
+
+func (sc *paymentController) handleEvent(c *gin.Context, event *payment.Event) error {
 	switch event.Type {
-	case "checkout.session.async_payment_succeeded":
+	case payment.EVENT_CHECKOUT_COMPLETED:
+		sess := event.CheckoutSession
 
-	case "checkout.session.completed":
-		var checkoutSession stripe.CheckoutSession
-		err:=json.Unmarshal(event.Data.Raw, &checkoutSession)
+		// fleet accounts pay with their own customer, their tickets belong to the organization
+		var organizationID uuid.UUID
+		user,err:=sc.userRepo.GetByCustomerID(c, sess.CustomerID)
+		buyer := user.Email
 		if err != nil {
-			return jsonHelper.ApiError{
-				Err:    err.Error(),
-				Status: 500,
+			organization, orgErr := sc.organizations.GetByCustomerID(c, sess.CustomerID)
+			if orgErr != nil {
+				slog.ErrorContext(c, "checkout customer is neither a user nor an organization", "session_id", sess.ID, "customer_id", sess.CustomerID, logging.Err(orgErr))
+				return jsonHelper.ApiError{
+					Err:    err.Error(),
+					Status: 500,
+				}
 			}
+			organizationID = organization.ID
+			buyer = organization.Name
 		}
-
-		var param ="line_items"
-		sess, err := session.Get(event.Data.Object["id"].(string), &stripe.CheckoutSessionParams{
-			Expand: []*string{&param},
-		})
-
-		user,err:=sc.userRepo.GetByCustomerID(checkoutSession.Customer.ID)
-		if err != nil {
-			fmt.Println("error tyt")
-			return jsonHelper.ApiError{
-				Err:    err.Error(),
-				Status: 500,
+		if sess.Purpose == payment.CHECKOUT_PURPOSE_TOP_UP {
+			if organizationID != uuid.Nil {
+				return jsonHelper.ApiError{
+					Err:    "organizations have no wallet",
+					Status: 500,
+				}
 			}
+			return sc.creditTopUp(c, &user, sess)
 		}
 
 		err = sc.ticketRepo.WithTransaction(c, func(c context.Context) error {
-			var productDtoList []*payment.ProductDto
-			wg := sync.WaitGroup{}
-
-			var productIDList []string
+			// stripe redelivers events too, the tickets of a checkout are issued once
+			existing, err := sc.ticketRepo.GetByCheckoutSessionID(c, user.ID, sess.ID)
+			if err != nil {
+				return err
+			}
+			if len(existing) > 0 {
+				return errAlreadyIssued
+			}
 
-			errorCh := make(chan error, len(sess.LineItems.Data))
+			wg := sync.WaitGroup{}
 
-			for _, stripeProduct := range sess.LineItems.Data {
-				var dto = payment.ProductDto{
-					ProductStripeID: stripeProduct.Price.Product.ID,
-					Amount:          int(stripeProduct.Quantity),
-				}
+			var itemList []payment.LineItem
 
-				for i := 0;i < int(stripeProduct.Quantity); i++ {
-					productIDList = append(productIDList, stripeProduct.Price.Product.ID)
+			for _, item := range sess.LineItems {
+				for i := 0;i < item.Quantity; i++ {
+					itemList = append(itemList, item)
 				}
-
-				productDtoList = append(productDtoList, &dto)
 			}
 
-			for _, productID := range productIDList {
+			errorCh := make(chan error, len(itemList))
+
+			for _, item := range itemList {
 				wg.Add(1)
-				go sc.processProductID(c, &wg, errorCh, productID, &user, sess)
+				go sc.processProductID(c, &wg, errorCh, item, &user, organizationID, sess)
 			}
 
 			wg.Wait()
@@ -238,8 +360,24 @@ func (sc *paymentController) webhookHandler(c *gin.Context) error {
 				}
 			}
 
-			return nil
+			// the receipt is part of the payment, a failure rolls the tickets back for the provider to retry
+			issued, err := sc.receipts.IssueForCheckout(c, user.ID, organizationID, buyer, sess)
+			if err != nil {
+				return err
+			}
+			if sc.fiscal != nil {
+				if _, err = sc.fiscal.Enqueue(c, issued, models.FISCAL_PAYMENT_CARD); err != nil {
+					return err
+				}
+			}
+			if organizationID != uuid.Nil {
+				return nil
+			}
+			return sc.redeemPromotion(c, &user, sess)
 		})
+		if errors.Is(err, errAlreadyIssued) {
+			return nil
+		}
 
 		if err != nil {
 			return jsonHelper.ApiError{
@@ -249,13 +387,107 @@ func (sc *paymentController) webhookHandler(c *gin.Context) error {
 			}
 		}
 
+		sc.announceIssued(c, user.ID, sess.ID)
 
+	case payment.EVENT_CHECKOUT_FAILED:
+		if event.CheckoutSession == nil {
+			return nil
+		}
+		if err := sc.promotions.Release(c, event.CheckoutSession.ID); err != nil {
+			return jsonHelper.DefaultHttpErrors["InternalServerError"]
+		}
+	}
+	return nil
+}
+
+// announceIssued tells the buyer about the tickets of a paid checkout, the payment stands even when it fails.
+// Tickets of an organization have no user and are only counted.
+func (sc *paymentController) announceIssued(c context.Context, userID uuid.UUID, sessionID string) {
+	tickets, err := sc.ticketRepo.GetByCheckoutSessionID(c, userID, sessionID)
+	if err != nil {
+		slog.ErrorContext(c, "loading tickets of checkout failed", "session_id", sessionID, logging.Err(err))
+		return
+	}
+	metrics.CountTickets(c, metrics.TICKETS_CREATED, tickets...)
+	if userID == uuid.Nil {
+		return
+	}
+	events.PublishTickets(sc.events, models.TICKET_CREATED, tickets...)
+	events.PublishTickets(sc.events, models.TICKET_ACTIVATED, tickets...)
+	for i := range tickets {
+		publishToSeller(c, sc.webhooks, models.WEBHOOK_TICKET_PURCHASED, "purchased:"+tickets[i].ID.String(), &tickets[i], tickets[i].Amount)
+	}
+	notify(c, sc.notifications, notification.TicketNotice{
+		Event:   models.NOTIFY_TICKET_ISSUED,
+		Key:     "issued:" + sessionID,
+		Tickets: tickets,
+	})
+}
+
+// creditTopUp puts a paid top up on the wallet, a redelivered event is credited once
+func (sc *paymentController) creditTopUp(c context.Context, user *models.User, sess *payment.CheckoutSession) error {
+	if !strings.EqualFold(sess.Currency, sc.wallet.Currency()) {
+		return jsonHelper.ApiError{
+			Err:    fmt.Sprintf("top up in %s for a wallet in %s", sess.Currency, sc.wallet.Currency()),
+			Status: 500,
+		}
+	}
+	_, err := sc.wallet.TopUp(c, user.ID, sess.AmountTotal, sess.ID)
+	if err != nil && !errors.Is(err, wallet.ErrAlreadyPosted) {
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 500,
+		}
+	}
+	return nil
+}
+
+func (sc *paymentController) quotePromotion(c context.Context, code string, user *models.User, productList []payment.ProductDto) (*promotion.Quote, error) {
+	var lines []promotion.QuoteLine
+	for _, p := range productList {
+		productTicket, err := sc.productTicketRepo.GetByStripeProductID(c, p.ProductStripeID)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, promotion.QuoteLine{ProductTicket: productTicket, Quantity: p.Amount})
+	}
+	return sc.promotions.Quote(c, code, user, lines)
+}
+
+// redeemPromotion counts the checkout's promotion and hands out its bonus liters, in the ticket transaction
+func (sc *paymentController) redeemPromotion(c context.Context, user *models.User, sess *payment.CheckoutSession) error {
+	redemption, err := sc.promotions.Complete(c, sess.ID)
+	if err != nil || redemption == nil || redemption.BonusLiters == 0 {
+		return err
+	}
+	tickets, err := sc.ticketRepo.GetByCheckoutSessionID(c, user.ID, sess.ID)
+	if err != nil {
+		return err
+	}
+	for _, ticket := range tickets {
+		if ticket.ProductTicketID != redemption.BonusProductTicketID {
+			continue
+		}
+		if err = sc.ticketRepo.AddAmount(c, ticket.ID, redemption.BonusLiters); err != nil {
+			return err
+		}
+		productTicket, err := sc.productTicketRepo.GetByID(c, ticket.ProductTicketID)
+		if err != nil {
+			return err
+		}
+		return sc.productRepo.DecreaseProductAmount(c, productTicket.ProductID, redemption.BonusLiters)
 	}
 	return nil
 }
 
 type CreateCheckoutSessionRequest struct {
 	ProductList []payment.ProductDto `json:"productList" bson:"productList"`
+	// Provider overrides the seller's payment provider, empty keeps it
+	Provider string `json:"provider" bson:"provider"`
+	// Client and Platform pick the return urls, a web page or an app deep link
+	Client string `json:"client" bson:"client"`
+	Platform string `json:"platform" bson:"platform"`
+	PromoCode string `json:"promoCode" bson:"promoCode"`
 }
 
 func (sc *paymentController) createCheckoutSession(c *gin.Context) error {
@@ -277,17 +509,158 @@ func (sc *paymentController) createCheckoutSession(c *gin.Context) error {
 	}
 
 
-	sess,err := sc.paymentService.CreateCheckoutSession(body.ProductList, authBody.GetUser().CustomerID)
+	if len(body.ProductList) == 0 {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	// the provider is the seller's, a cart of several sellers would charge one seller's tickets through another's
+	seller := ""
+	for i, product := range body.ProductList {
+		productTicket, err := sc.productTicketRepo.GetByStripeProductID(c, product.ProductStripeID)
+		if err != nil {
+			return jsonHelper.ApiError{
+				Err:    "No such product",
+				Status: 404,
+			}
+		}
+		if i > 0 && productTicket.Seller != seller {
+			return jsonHelper.ApiError{
+				Err:    "All products of a checkout must be from one seller",
+				Status: 400,
+			}
+		}
+		seller = productTicket.Seller
+	}
+	providerName, provider, err := sc.providers.Select(body.Provider, seller)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 400,
+		}
+	}
+
+	returnURLs, err := sc.returnURLs.Resolve(body.Client, body.Platform)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 400,
+		}
+	}
+
+	var quote *promotion.Quote
+	var discount *payment.Discount
+	if body.PromoCode != "" {
+		quote, err = sc.quotePromotion(c, body.PromoCode, authBody.GetUser(), body.ProductList)
+		if err != nil {
+			return promotionError(err)
+		}
+		if quote.Discount > 0 {
+			discount = &payment.Discount{Amount: quote.Discount, Currency: quote.Currency, Name: quote.Promotion.Code}
+		}
+	}
+
+	sess,err := provider.CreateCheckoutSession(c, body.ProductList, authBody.GetUser().CustomerID, returnURLs, discount)
 	if err != nil {
 		return jsonHelper.ApiError{
 			Err:    "Internal server error",
 			Status: 500,
 		}
 	}
-	c.JSON(200, gin.H{"sessionId":sess.ID})
+	if quote != nil {
+		// the code may have been used up since it was quoted, the session is then left unpaid
+		if err = sc.promotions.Reserve(c, quote, authBody.GetUser().ID, sess.ID); err != nil {
+			return promotionError(err)
+		}
+	}
+	c.JSON(200, gin.H{"sessionId":sess.ID, "url": sess.URL, "provider": providerName, "promotion": quote})
 	return nil
 }
 
+// getCheckoutSession is polled by the return page until the webhook has created the tickets
+func (sc *paymentController) getCheckoutSession(c *gin.Context) error {
+	authBodyField, exists := c.Get("authBody")
+	if !exists {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	authBody, ok := authBodyField.(auth.AuthBody)
+	if !ok {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	user := authBody.GetUser()
+
+	providerName, provider, err := sc.sessionProvider(c, c.Param("sessionId"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	sess, err := provider.GetCheckoutSession(c, c.Param("sessionId"))
+	// someone else's session is reported like a missing one
+	if err != nil || sess.CustomerID != user.CustomerID {
+		return jsonHelper.ApiError{
+			Err:    "Checkout session not found",
+			Status: 404,
+		}
+	}
+	// a top up buys no tickets, its status is the payment's
+	if sess.Purpose == payment.CHECKOUT_PURPOSE_TOP_UP {
+		c.JSON(200, gin.H{
+			"sessionId": sess.ID,
+			"provider":  providerName,
+			"purpose":   sess.Purpose,
+			"status":    sess.Status,
+			"tickets":   []interface{}{},
+		})
+		return nil
+	}
+
+	tickets, err := sc.ticketRepo.GetByCheckoutSessionID(c, user.ID, sess.ID)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error getting tickets",
+			Status: 500,
+		}
+	}
+	ticketDtos := []interface{}{}
+	for i := range tickets {
+		fullDto, err := sc.ticketMapper.ModelToFullDto(c, &tickets[i])
+		if err != nil {
+			return jsonHelper.ApiError{
+				Err:    "Error mapping tickets",
+				Status: 500,
+			}
+		}
+		ticketDtos = append(ticketDtos, fullDto)
+	}
+
+	status := sess.Status
+	// the provider may report the payment before our webhook has run
+	if status == models.CHECKOUT_COMPLETED && len(tickets) == 0 {
+		status = models.CHECKOUT_PENDING
+	}
+	c.JSON(200, gin.H{
+		"sessionId": sess.ID,
+		"provider":  providerName,
+		"purpose":   sess.Purpose,
+		"status":    status,
+		"tickets":   ticketDtos,
+	})
+	return nil
+}
+
+// sessionProvider finds who took the payment of a session, a session we don't keep belongs to the default provider
+func (sc *paymentController) sessionProvider(c context.Context, sessionID string) (string, payment.CheckoutProvider, error) {
+	checkout, err := sc.checkouts.GetByID(c, sessionID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return sc.providers.Select("", "")
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	provider, ok := sc.providers.Get(checkout.Provider)
+	if !ok {
+		return "", nil, fmt.Errorf("payment provider %q is not available", checkout.Provider)
+	}
+	return checkout.Provider, provider, nil
+}
+
 type CreateSetupIntentRequest struct{}
 
 func (sc *paymentController) createSetupIntent(c *gin.Context) error {
@@ -366,13 +739,6 @@ func (pc *paymentController) buyAmount(c *gin.Context) error {
 		}
 	}
 
-	expirationTerm, err := strconv.Atoi(os.Getenv("TICKET_EXPIRATION"))
-	if err != nil {
-		return jsonHelper.ApiError{
-			Err:    "Internal server error",
-			Status: 500,
-		}
-	}
 	err = pc.ticketRepo.WithTransaction(c, func(c context.Context) error {
 		product,err := pc.productRepo.GetProduct(c, uuid.MustParse(body.ProductID))
 		if err != nil {
@@ -385,7 +751,7 @@ func (pc *paymentController) buyAmount(c *gin.Context) error {
 		ticketID, _ := uuid.NewRandom()
 		ticket := models.Ticket{
 			CreatedAt: int(time.Now().Unix()),
-			ExpiresAt: int(time.Now().Add(time.Hour * 24 * time.Duration(expirationTerm)).Unix()),
+			ExpiresAt: int(time.Now().Add(pc.ticketExpiration).Unix()),
 			ID: ticketID,
 			UserId: user.ID,
 			Status: models.NOT_ACTIVATED,
@@ -401,7 +767,7 @@ func (pc *paymentController) buyAmount(c *gin.Context) error {
 			}
 		}
 
-		pmID, err := pc.paymentService.ChargeCustomer(user.CustomerID, body.Amount*product.Amount)
+		pmID, err := pc.paymentService.ChargeCustomer(c, user.CustomerID, body.Amount*product.Amount)
 		if err != nil {
 
 			return jsonHelper.ApiError{
@@ -485,16 +851,12 @@ func (pc *paymentController) paymentMethodsHandler(c *gin.Context) error {
 			Status: 500,
 		}
 	}
-	var paymentMethods []stripe.PaymentMethod
-
-	params := &stripe.PaymentMethodListParams{
-		Customer: stripe.String(user.CustomerID),
-		Type:     stripe.String("card"),
-	}
-	i := paymentmethod.List(params)
-	for i.Next() {
-		pm := i.PaymentMethod()
-		paymentMethods = append(paymentMethods, *pm)
+	paymentMethods, err := pc.paymentService.ListPaymentMethods(user.CustomerID)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error getting payment methods",
+			Status: 500,
+		}
 	}
 
 	c.JSON(200, gin.H{"paymentMethods": paymentMethods})
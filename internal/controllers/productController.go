@@ -1,14 +1,14 @@
 package controllers
 
 import (
-	"context"
-	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"log/slog"
 	"palyvoua/internal/models"
 	"palyvoua/internal/repository"
 	"palyvoua/tools/auth"
 	"palyvoua/tools/jsonHelper"
+	"palyvoua/tools/logging"
 )
 
 type productController struct {
@@ -67,7 +67,7 @@ func (pc *productController) getByFuelType(c *gin.Context) error {
 	var products []models.Product
 	var err error
 
-	products, err = pc.productRepo.GetByFuelType(context.Background(), fuelTypeField)
+	products, err = pc.productRepo.GetByFuelType(c,  fuelTypeField)
 	if err != nil {
 		return jsonHelper.ApiError{
 			Err:    "Error occurred while receiving product",
@@ -85,7 +85,7 @@ func (pc *productController) getBySeller(c *gin.Context) error {
 	var products []models.Product
 	var err error
 
-	products, err = pc.productRepo.GetBySeller(context.Background(), fuelTypeField)
+	products, err = pc.productRepo.GetBySeller(c,  fuelTypeField)
 	if err != nil {
 		return jsonHelper.ApiError{
 			Err:    "Error occurred while receiving product",
@@ -104,7 +104,7 @@ func (pc *productController) getProductByID(c *gin.Context) error {
 		return jsonHelper.DefaultHttpErrors["BadRequest"]
 	}
 
-	product, err := pc.productRepo.GetProduct(context.Background(), productID)
+	product, err := pc.productRepo.GetProduct(c,  productID)
 	if err != nil {
 		return jsonHelper.DefaultHttpErrors["InternalServerError"]
 	}
@@ -125,9 +125,9 @@ func (pc *productController) getAllProducts(c *gin.Context) error {
 
 	var err error
 
-	products, err := pc.productRepo.GetAllProducts(context.Background())
+	products, err := pc.productRepo.GetAllProducts(c)
 	if err != nil {
-		fmt.Println(err.Error())
+		slog.ErrorContext(c, "listing products failed", logging.Err(err))
 		return jsonHelper.ApiError{
 			Err:    "No products",
 			Status: 500,
@@ -138,10 +138,8 @@ func (pc *productController) getAllProducts(c *gin.Context) error {
 }
 
 func (pc *productController) createProduct(c *gin.Context) error {
-	fmt.Println("at least came here")
 	var body CreateProductRequest
 	if err := c.Bind(&body);err!=nil{
-		fmt.Println(err)
 		return jsonHelper.DefaultHttpErrors["BadRequest"]
 	}
 	productID,err := uuid.NewRandom()
@@ -160,10 +158,9 @@ func (pc *productController) createProduct(c *gin.Context) error {
 		Seller: body.Seller,
 		FuelType: body.FuelType,
 	}
-	err = pc.productRepo.SaveProduct(context.Background(), &p)
+	err = pc.productRepo.SaveProduct(c,  &p)
 	if err != nil {
-		fmt.Println("error")
-		fmt.Println(err.Error())
+		slog.ErrorContext(c, "saving product failed", logging.Err(err))
 		return jsonHelper.ApiError{
 			Err:    "Internal server error",
 			Status: 500,
@@ -196,7 +193,7 @@ func (pc *productController) updateProductAmount(c *gin.Context) error {
 	if err != nil {
 		return jsonHelper.DefaultHttpErrors["BadRequest"]
 	}
-	err = pc.productRepo.UpdateProductAmount(context.Background(), pid , body.Amount)
+	err = pc.productRepo.UpdateProductAmount(c,  pid , body.Amount)
 	if err != nil {
 		return jsonHelper.ApiError{
 			Err:    "Error updating product amount",
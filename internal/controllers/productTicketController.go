@@ -2,9 +2,11 @@ package controllers
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"log/slog"
+	"palyvoua/internal/api/pricing"
 	"palyvoua/internal/models"
 	"palyvoua/internal/repository"
 	"palyvoua/tools"
@@ -15,12 +17,13 @@ import (
 type productTicketController struct {
 	paymentService paymentService
 	productTicketRepo repository.ProductTicketRepo
+	priceService pricing.PriceService
 }
 
-func SetupProductTicketRoutes(r *gin.Engine, adminRepo adminRepo, ur repository.UserRepo, productTicketRepo repository.ProductTicketRepo, ps paymentService) {
+func SetupProductTicketRoutes(r *gin.Engine, adminRepo adminRepo, ur repository.UserRepo, productTicketRepo repository.ProductTicketRepo, ps paymentService, priceService pricing.PriceService) {
 	productTicketGroup := r.Group("/productTicket")
 
-	ptc := productTicketController{productTicketRepo: productTicketRepo, paymentService: ps}
+	ptc := productTicketController{productTicketRepo: productTicketRepo, paymentService: ps, priceService: priceService}
 
 	productTicketGroup.Use(auth.AuthMiddleware(ur, adminRepo))
 
@@ -33,6 +36,9 @@ func SetupProductTicketRoutes(r *gin.Engine, adminRepo adminRepo, ur repository.
 	productTicketGroup.POST("/create", jsonHelper.MakeHttpHandler(ptc.createProductTicket))
 	productTicketGroup.DELETE("", jsonHelper.MakeHttpHandler(ptc.deleteProductTicket))
 	productTicketGroup.PUT("", jsonHelper.MakeHttpHandler(ptc.updateProductTicket))
+	productTicketGroup.GET("/prices", jsonHelper.MakeHttpHandler(ptc.getPriceHistory))
+	productTicketGroup.POST("/prices", jsonHelper.MakeHttpHandler(ptc.schedulePriceChange))
+	productTicketGroup.DELETE("/prices", jsonHelper.MakeHttpHandler(ptc.cancelPriceChange))
 
 }
 
@@ -55,7 +61,7 @@ func (ptc *productTicketController) getByParams(c *gin.Context) error {
 		params.FuelType = &fuelType
 	}
 
-	ptList, err := ptc.productTicketRepo.FindByParams(context.Background(), &params)
+	ptList, err := ptc.productTicketRepo.FindByParams(c,  &params)
 
 	if err !=nil {
 		return jsonHelper.ApiError{
@@ -106,25 +112,36 @@ func (ptc *productTicketController) updateProductTicket(c *gin.Context) error {
 		return jsonHelper.DefaultHttpErrors["BadRequest"]
 	}
 
-	originalProductTicket, err := ptc.productTicketRepo.GetByID(context.Background(),productTicketID)
+	originalProductTicket, err := ptc.productTicketRepo.GetByID(c, productTicketID)
 
+	// the price is only changed through a new version, so the history stays complete
 	newProductTicket := models.ProductTicket{
 		ID:        originalProductTicket.ID,
 		ProductID: body.ProductID,
 		Amount:    body.Amount,
 		Title:     body.Title,
-		Price:     body.Price,
-		Currency:  body.Currency,
+		Price:     originalProductTicket.Price,
+		Currency:  originalProductTicket.Currency,
 		StripeID:  originalProductTicket.StripeID,
+		PriceVersionID: originalProductTicket.PriceVersionID,
 	}
 
-	err = ptc.productTicketRepo.UpdateProductTicket(context.Background(),originalProductTicket.ID, &newProductTicket)
+	err = ptc.productTicketRepo.UpdateProductTicket(c, originalProductTicket.ID, &newProductTicket)
 	if err!=nil {
 		return jsonHelper.ApiError{
 			Err:    "Error updating product ticket",
 			Status: 500,
 		}
 	}
+	if body.Price != originalProductTicket.Price || body.Currency != originalProductTicket.Currency {
+		_, err = ptc.priceService.ChangePrice(c, originalProductTicket.ID, body.Price, body.Currency, 0)
+		if err != nil {
+			return jsonHelper.ApiError{
+				Err:    "Error changing product ticket price: " + err.Error(),
+				Status: 500,
+			}
+		}
+	}
 	c.JSON(200,gin.H{})
 	return nil
 }
@@ -194,7 +211,15 @@ func (ptc *productTicketController) createProductTicket(c *gin.Context) error {
 		FuelType: body.FuelType,
 	}
 
-	err = ptc.productTicketRepo.SaveProductTicket(context.Background(),&productTicket)
+	err = ptc.priceService.StartHistory(c, &productTicket)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error saving product ticket price",
+			Status: 500,
+		}
+	}
+
+	err = ptc.productTicketRepo.SaveProductTicket(c, &productTicket)
 	if err != nil {
 		return jsonHelper.ApiError{
 			Err:    "Error saving product ticket",
@@ -209,8 +234,15 @@ func (ptc *productTicketController) createProductTicket(c *gin.Context) error {
 			Status: 500,
 		}
 	}
-	fmt.Println(stripeProduct.ID)
-	updatedProductTicket, err := ptc.productTicketRepo.UpdateStripeProductID(context.Background(),productTicketID, stripeProduct.ID)
+	slog.DebugContext(c, "product ticket saved to stripe", "product_ticket_id", productTicket.ID, "stripe_product_id", stripeProduct.ID)
+	err = ptc.priceService.LinkProviderPrice(c, productTicket.PriceVersionID, stripeProduct.PriceID)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error updating product ticket price",
+			Status: 500,
+		}
+	}
+	updatedProductTicket, err := ptc.productTicketRepo.UpdateStripeProductID(c, productTicketID, stripeProduct.ID)
 	if err != nil {
 		return jsonHelper.ApiError{
 			Err:    "Error updating product ticket",
@@ -221,10 +253,78 @@ func (ptc *productTicketController) createProductTicket(c *gin.Context) error {
 	return nil
 }
 
+func (ptc *productTicketController) getPriceHistory(c *gin.Context) error {
+	productTicketID, err := uuid.Parse(c.Query("productTicketId"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	versions, err := ptc.priceService.History(c, productTicketID)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error getting price history",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{"prices": versions})
+	return nil
+}
+
+type SchedulePriceChangeRequest struct {
+	ProductTicketID uuid.UUID `json:"productTicketId"`
+	Price int `json:"price"`
+	Currency string `json:"currency"`
+	// EffectiveFrom is a unix time, 0 or a past time changes the price right away
+	EffectiveFrom int `json:"effectiveFrom"`
+}
+
+func (ptc *productTicketController) schedulePriceChange(c *gin.Context) error {
+	var body SchedulePriceChangeRequest
+	if err := c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	if body.Price <= 0 || body.Currency == "" {
+		return jsonHelper.ApiError{
+			Err:    "Price and currency are required",
+			Status: 400,
+		}
+	}
+	version, err := ptc.priceService.ChangePrice(c, body.ProductTicketID, body.Price, body.Currency, body.EffectiveFrom)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error changing product ticket price: " + err.Error(),
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{"price": version})
+	return nil
+}
+
+func (ptc *productTicketController) cancelPriceChange(c *gin.Context) error {
+	versionID, err := uuid.Parse(c.Query("priceVersionId"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	err = ptc.priceService.CancelScheduled(c, versionID)
+	if errors.Is(err, pricing.ErrNotScheduled) {
+		return jsonHelper.ApiError{
+			Err:    "No scheduled price change with this id",
+			Status: 404,
+		}
+	}
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error cancelling price change",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{})
+	return nil
+}
+
 func (ptc *productTicketController) getAllProductTickets(c *gin.Context) error {
 	var productTickets []models.ProductTicket
 	var err error
-	productTickets, err = ptc.productTicketRepo.GetAllProductTickets(context.Background())
+	productTickets, err = ptc.productTicketRepo.GetAllProductTickets(c)
 	if err != nil {
 		return jsonHelper.ApiError{
 			Err:    "Couldn't receive all product tickets",
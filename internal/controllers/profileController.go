@@ -0,0 +1,321 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"net/mail"
+	mailer "palyvoua/internal/api/mail"
+	"palyvoua/internal/api/payment"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/auth"
+	"palyvoua/tools/jsonHelper"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	minPasswordLength = 8
+	emailChangeExpirationHours = 24
+)
+
+var phonePattern = regexp.MustCompile(`^\+?[0-9]{9,15}$`)
+
+type profileController struct {
+	userRepo repository.UserRepo
+	sessionRepo repository.SessionRepo
+	paymentService paymentService
+	mailer mailer.Mailer
+}
+
+type ProfileRoutesOptions struct {
+	UserRepo repository.UserRepo
+	AdminRepo repository.AdminRepo
+	SessionRepo repository.SessionRepo
+	Ps paymentService
+	Mailer mailer.Mailer
+}
+
+func SetupProfileRoutes(r *gin.Engine, options *ProfileRoutesOptions) {
+	meGroup := r.Group("/me")
+
+	pc := profileController{
+		userRepo:       options.UserRepo,
+		sessionRepo:    options.SessionRepo,
+		paymentService: options.Ps,
+		mailer:         options.Mailer,
+	}
+
+	meGroup.Use(auth.AuthMiddleware(options.UserRepo, options.AdminRepo))
+	meGroup.GET("", jsonHelper.MakeHttpHandler(pc.getMe))
+	meGroup.PATCH("", jsonHelper.MakeHttpHandler(pc.updateMe))
+	meGroup.POST("/password", jsonHelper.MakeHttpHandler(pc.changePassword))
+	meGroup.POST("/email", jsonHelper.MakeHttpHandler(pc.requestEmailChange))
+	meGroup.POST("/email/verify", jsonHelper.MakeHttpHandler(pc.verifyEmailChange))
+}
+
+func (pc *profileController) currentUser(c *gin.Context) (models.User, error) {
+	authBodyField, exists := c.Get("authBody")
+	if !exists {
+		return models.User{}, jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	authBody, ok := authBodyField.(auth.AuthBody)
+	if !ok {
+		return models.User{}, jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	return *authBody.GetUser(), nil
+}
+
+func (pc *profileController) getMe(c *gin.Context) error {
+	user, err := pc.currentUser(c)
+	if err != nil {
+		return err
+	}
+	c.JSON(200, gin.H{"user": user, "pendingEmail": user.EmailChange.PendingEmail})
+	return nil
+}
+
+// UpdateProfileRequest only changes the fields that are present
+type UpdateProfileRequest struct {
+	Name *string `json:"name"`
+	Phone *string `json:"phone"`
+	PreferredLanguage *string `json:"preferredLanguage"`
+	MarketingConsent *bool `json:"marketingConsent"`
+	DefaultFuelType *string `json:"defaultFuelType"`
+}
+
+func (pc *profileController) updateMe(c *gin.Context) error {
+	var body UpdateProfileRequest
+	if err := c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	user, err := pc.currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	profile := user.UserProfile
+	if body.Name != nil {
+		profile.Name = strings.TrimSpace(*body.Name)
+	}
+	if body.Phone != nil {
+		phone := strings.ReplaceAll(strings.TrimSpace(*body.Phone), " ", "")
+		if phone != "" && !phonePattern.MatchString(phone) {
+			return jsonHelper.ApiError{
+				Err:    "Invalid phone number",
+				Status: 400,
+			}
+		}
+		profile.Phone = phone
+	}
+	if body.PreferredLanguage != nil {
+		if *body.PreferredLanguage != models.LANGUAGE_UK && *body.PreferredLanguage != models.LANGUAGE_EN {
+			return jsonHelper.ApiError{
+				Err:    "Unsupported language",
+				Status: 400,
+			}
+		}
+		profile.PreferredLanguage = *body.PreferredLanguage
+	}
+	if body.MarketingConsent != nil {
+		profile.MarketingConsent = *body.MarketingConsent
+	}
+	if body.DefaultFuelType != nil {
+		profile.DefaultFuelType = strings.TrimSpace(*body.DefaultFuelType)
+	}
+
+	// the payment provider goes first, a failed sync must not leave the two records apart
+	if err = pc.syncCustomer(user.CustomerID, user.Email, profile); err != nil {
+		return err
+	}
+	if err = pc.userRepo.UpdateProfile(c, user.ID, profile); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error updating profile",
+			Status: 500,
+		}
+	}
+	user.UserProfile = profile
+	c.JSON(200, gin.H{"user": user})
+	return nil
+}
+
+func (pc *profileController) syncCustomer(customerID string, email string, profile models.UserProfile) error {
+	if customerID == "" {
+		return nil
+	}
+	err := pc.paymentService.UpdateCustomer(customerID, payment.CustomerDetails{
+		Email:             email,
+		Name:              profile.Name,
+		Phone:             profile.Phone,
+		PreferredLanguage: profile.PreferredLanguage,
+	})
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error updating payment profile",
+			Status: 502,
+		}
+	}
+	return nil
+}
+
+// ChangePasswordRequest also sets the first password of a user who signed up through a provider,
+// who confirms it with TOTPCode or a recent sign in instead
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	TOTPCode string `json:"totpCode"`
+	NewPassword string `json:"newPassword"`
+}
+
+func (pc *profileController) changePassword(c *gin.Context) error {
+	var body ChangePasswordRequest
+	if err := c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	user, err := pc.currentUser(c)
+	if err != nil {
+		return err
+	}
+	if err = reauthenticate(c, pc.userRepo, pc.sessionRepo, &user, body.CurrentPassword, body.TOTPCode); err != nil {
+		return err
+	}
+	if len(body.NewPassword) < minPasswordLength {
+		return jsonHelper.ApiError{
+			Err:    fmt.Sprintf("Password must be at least %d characters long", minPasswordLength),
+			Status: 400,
+		}
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(body.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	if err = pc.userRepo.UpdatePassword(c, user.ID, string(hashedPassword)); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error updating password",
+			Status: 500,
+		}
+	}
+	// every other device has to log in again with the new password
+	currentSessionID := auth.GetSessionID(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+	if err = pc.sessionRepo.RevokeAllExcept(c, user.ID, currentSessionID, int(time.Now().Unix())); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error revoking sessions",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{})
+	return nil
+}
+
+type ChangeEmailRequest struct {
+	NewEmail string `json:"newEmail"`
+	CurrentPassword string `json:"currentPassword"`
+	TOTPCode string `json:"totpCode"`
+}
+
+func (pc *profileController) requestEmailChange(c *gin.Context) error {
+	var body ChangeEmailRequest
+	if err := c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	user, err := pc.currentUser(c)
+	if err != nil {
+		return err
+	}
+	if err = reauthenticate(c, pc.userRepo, pc.sessionRepo, &user, body.CurrentPassword, body.TOTPCode); err != nil {
+		return err
+	}
+	newEmail := strings.TrimSpace(body.NewEmail)
+	if _, err = mail.ParseAddress(newEmail); err != nil || newEmail == user.Email {
+		return jsonHelper.ApiError{
+			Err:    "Invalid email",
+			Status: 400,
+		}
+	}
+	if _, err = pc.userRepo.GetUserByEmail(c, newEmail); err == nil {
+		return jsonHelper.ApiError{
+			Err:    "Email is already in use",
+			Status: 409,
+		}
+	}
+
+	token, tokenHash, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	change := models.EmailChange{
+		PendingEmail: newEmail,
+		TokenHash:    tokenHash,
+		ExpiresAt:    int(time.Now().Add(emailChangeExpirationHours * time.Hour).Unix()),
+	}
+	if err = pc.userRepo.UpdateEmailChange(c, user.ID, change); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error saving email change",
+			Status: 500,
+		}
+	}
+	err = pc.mailer.Send(newEmail, "Confirm your new email", "Your confirmation code: "+token)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error sending confirmation email",
+			Status: 502,
+		}
+	}
+	c.JSON(200, gin.H{"pendingEmail": newEmail})
+	return nil
+}
+
+type VerifyEmailChangeRequest struct {
+	Token string `json:"token"`
+}
+
+func (pc *profileController) verifyEmailChange(c *gin.Context) error {
+	var body VerifyEmailChangeRequest
+	if err := c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	user, err := pc.currentUser(c)
+	if err != nil {
+		return err
+	}
+	change := user.EmailChange
+	if change.PendingEmail == "" || change.TokenHash != auth.HashOpaqueToken(body.Token) || change.ExpiresAt < int(time.Now().Unix()) {
+		return jsonHelper.ApiError{
+			Err:    "Invalid or expired confirmation code",
+			Status: 400,
+		}
+	}
+	if _, err = pc.userRepo.GetUserByEmail(c, change.PendingEmail); err == nil {
+		return jsonHelper.ApiError{
+			Err:    "Email is already in use",
+			Status: 409,
+		}
+	}
+	if err = pc.syncCustomer(user.CustomerID, change.PendingEmail, user.UserProfile); err != nil {
+		return err
+	}
+	if err = pc.userRepo.UpdateEmail(c, user.ID, change.PendingEmail); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error updating email",
+			Status: 500,
+		}
+	}
+
+	// tokens carry the email, so the current device gets new ones for the same session
+	// and every other device has to log in again with the new email
+	accessToken := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if err = pc.sessionRepo.RevokeAllExcept(c, user.ID, auth.GetSessionID(accessToken), int(time.Now().Unix())); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error revoking sessions",
+			Status: 500,
+		}
+	}
+	user.Email = change.PendingEmail
+	tokens := auth.GenerateTokens(tokenBody(&user, auth.HasMFAClaim(accessToken), auth.GetSessionID(accessToken)), c)
+	c.JSON(200, gin.H{
+		"accessToken":  tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+	})
+	return nil
+}
@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"palyvoua/internal/api/payment"
+	"palyvoua/internal/api/promotion"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/auth"
+	"palyvoua/tools/jsonHelper"
+)
+
+type promotionController struct {
+	promotions promotion.PromotionService
+	productTicketRepo repository.ProductTicketRepo
+}
+
+type PromotionRoutesOptions struct {
+	UserRepo repository.UserRepo
+	AdminRepo repository.AdminRepo
+	Promotions promotion.PromotionService
+	ProductTicketRepo repository.ProductTicketRepo
+}
+
+func SetupPromotionRoutes(r *gin.Engine, options *PromotionRoutesOptions) {
+	promotionGroup := r.Group("/promotion")
+
+	pc := promotionController{
+		promotions:        options.Promotions,
+		productTicketRepo: options.ProductTicketRepo,
+	}
+
+	promotionGroup.Use(auth.AuthMiddleware(options.UserRepo, options.AdminRepo))
+	promotionGroup.POST("/validate", jsonHelper.MakeHttpHandler(pc.validatePromoCode))
+
+	promotionGroup.Use(auth.RoleMiddleware(3, options.UserRepo, options.AdminRepo))
+	promotionGroup.GET("", jsonHelper.MakeHttpHandler(pc.getAllPromotions))
+	promotionGroup.POST("", jsonHelper.MakeHttpHandler(pc.createPromotion))
+	promotionGroup.PUT("/:id/active", jsonHelper.MakeHttpHandler(pc.setPromotionActive))
+}
+
+func promotionError(err error) error {
+	var rejected promotion.RejectedError
+	if errors.As(err, &rejected) {
+		return jsonHelper.ApiError{
+			Err:    rejected.Error(),
+			Status: 400,
+		}
+	}
+	return jsonHelper.DefaultHttpErrors["InternalServerError"]
+}
+
+type ValidatePromoCodeRequest struct {
+	PromoCode string `json:"promoCode"`
+	ProductList []payment.ProductDto `json:"productList"`
+}
+
+// validatePromoCode shows what a code gives on a cart before the checkout is started
+func (pc *promotionController) validatePromoCode(c *gin.Context) error {
+	authBodyField, exists := c.Get("authBody")
+	if !exists {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	authBody, ok := authBodyField.(auth.AuthBody)
+	if !ok {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	var body ValidatePromoCodeRequest
+	if err := c.Bind(&body); err != nil || body.PromoCode == "" {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+
+	var lines []promotion.QuoteLine
+	for _, p := range body.ProductList {
+		productTicket, err := pc.productTicketRepo.GetByStripeProductID(c, p.ProductStripeID)
+		if err != nil {
+			return jsonHelper.ApiError{
+				Err:    "No such product",
+				Status: 404,
+			}
+		}
+		lines = append(lines, promotion.QuoteLine{ProductTicket: productTicket, Quantity: p.Amount})
+	}
+	quote, err := pc.promotions.Quote(c, body.PromoCode, authBody.GetUser(), lines)
+	if err != nil {
+		return promotionError(err)
+	}
+	c.JSON(200, gin.H{"promotion": quote})
+	return nil
+}
+
+func (pc *promotionController) getAllPromotions(c *gin.Context) error {
+	promotions, err := pc.promotions.GetAll(c)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error getting promotions",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{"promotions": promotions})
+	return nil
+}
+
+type CreatePromotionRequest struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Value int `json:"value"`
+	Currency string `json:"currency"`
+	StartsAt int `json:"startsAt"`
+	EndsAt int `json:"endsAt"`
+	MaxRedemptions int `json:"maxRedemptions"`
+	MaxRedemptionsPerUser int `json:"maxRedemptionsPerUser"`
+	FirstPurchaseOnly bool `json:"firstPurchaseOnly"`
+	FuelTypes []string `json:"fuelTypes"`
+	Sellers []string `json:"sellers"`
+}
+
+func (pc *promotionController) createPromotion(c *gin.Context) error {
+	var body CreatePromotionRequest
+	if err := c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	p := models.Promotion{
+		Code:                  body.Code,
+		Name:                  body.Name,
+		Type:                  body.Type,
+		Value:                 body.Value,
+		Currency:              body.Currency,
+		StartsAt:              body.StartsAt,
+		EndsAt:                body.EndsAt,
+		MaxRedemptions:        body.MaxRedemptions,
+		MaxRedemptionsPerUser: body.MaxRedemptionsPerUser,
+		FirstPurchaseOnly:     body.FirstPurchaseOnly,
+		FuelTypes:             body.FuelTypes,
+		Sellers:               body.Sellers,
+	}
+	if err := pc.promotions.Create(c, &p); err != nil {
+		return promotionError(err)
+	}
+	c.JSON(200, gin.H{"promotion": p})
+	return nil
+}
+
+type SetPromotionActiveRequest struct {
+	Active bool `json:"active"`
+}
+
+func (pc *promotionController) setPromotionActive(c *gin.Context) error {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	var body SetPromotionActiveRequest
+	if err = c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	if err = pc.promotions.SetActive(c, id, body.Active); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error updating promotion",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{})
+	return nil
+}
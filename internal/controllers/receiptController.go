@@ -0,0 +1,181 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+	"palyvoua/internal/api/fiscal"
+	"palyvoua/internal/api/receipt"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/auth"
+	"palyvoua/tools/jsonHelper"
+)
+
+type receiptController struct {
+	receipts receipt.ReceiptService
+	organizations organizationAuthorizer
+	fiscal fiscal.FiscalService
+}
+
+// organizationAuthorizer lets managers at the receipts of their organization
+type organizationAuthorizer interface {
+	Authorize(c context.Context, organizationID uuid.UUID, userID uuid.UUID, managerOnly bool) (*models.OrganizationMember, error)
+}
+
+type ReceiptRoutesOptions struct {
+	UserRepo repository.UserRepo
+	AdminRepo repository.AdminRepo
+	Receipts receipt.ReceiptService
+	Organizations organizationAuthorizer
+	Fiscal fiscal.FiscalService
+}
+
+func SetupReceiptRoutes(r *gin.Engine, options *ReceiptRoutesOptions) {
+	receiptGroup := r.Group("/receipt")
+
+	rc := receiptController{
+		receipts:      options.Receipts,
+		organizations: options.Organizations,
+		fiscal:        options.Fiscal,
+	}
+
+	receiptGroup.Use(auth.AuthMiddleware(options.UserRepo, options.AdminRepo))
+	receiptGroup.GET("", jsonHelper.MakeHttpHandler(rc.getAll))
+	receiptGroup.GET("/:id", jsonHelper.MakeHttpHandler(rc.getByID))
+	receiptGroup.GET("/:id/pdf", jsonHelper.MakeHttpHandler(rc.download))
+	receiptGroup.GET("/:id/fiscal", jsonHelper.MakeHttpHandler(rc.getFiscalStatus))
+
+	receiptGroup.Use(auth.RoleMiddleware(3, options.UserRepo, options.AdminRepo))
+	receiptGroup.POST("/:id/regenerate", jsonHelper.MakeHttpHandler(rc.regenerate))
+}
+
+// getAll lists the caller's receipts, or an organization's for its managers
+func (rc *receiptController) getAll(c *gin.Context) error {
+	user, err := authUser(c)
+	if err != nil {
+		return err
+	}
+	organizationID := uuid.Nil
+	if value := c.Query("organizationId"); value != "" {
+		if organizationID, err = uuid.Parse(value); err != nil {
+			return jsonHelper.DefaultHttpErrors["BadRequest"]
+		}
+		if _, err = rc.organizations.Authorize(c, organizationID, user.ID, true); err != nil {
+			return organizationError(err)
+		}
+	}
+	receipts, err := rc.receipts.List(c, user.ID, organizationID)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error getting receipts",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{"receipts": receipts})
+	return nil
+}
+
+// find returns the receipt when the caller bought it, manages its organization or is an admin
+func (rc *receiptController) find(c *gin.Context) (*models.Receipt, error) {
+	authBodyField, exists := c.Get("authBody")
+	if !exists {
+		return nil, jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	authBody, ok := authBodyField.(auth.AuthBody)
+	if !ok {
+		return nil, jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return nil, jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	notFound := jsonHelper.ApiError{
+		Err:    "No such receipt",
+		Status: 404,
+	}
+	found, err := rc.receipts.Get(c, id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, notFound
+	}
+	if err != nil {
+		return nil, jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	userID := authBody.GetUser().ID
+	if authBody.GetRole().AuthorityLevel >= 3 || (found.OrganizationID == uuid.Nil && found.UserID == userID) {
+		return &found, nil
+	}
+	if found.OrganizationID != uuid.Nil {
+		if _, err = rc.organizations.Authorize(c, found.OrganizationID, userID, true); err == nil {
+			return &found, nil
+		}
+	}
+	// someone else's receipt is reported like a missing one
+	return nil, notFound
+}
+
+func (rc *receiptController) getByID(c *gin.Context) error {
+	found, err := rc.find(c)
+	if err != nil {
+		return err
+	}
+	c.JSON(200, gin.H{"receipt": found})
+	return nil
+}
+
+func (rc *receiptController) download(c *gin.Context) error {
+	found, err := rc.find(c)
+	if err != nil {
+		return err
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+found.Number+`.pdf"`)
+	c.Data(200, "application/pdf", found.PDF)
+	return nil
+}
+
+// getFiscalStatus shows where the fiscal check of the receipt's payment is
+func (rc *receiptController) getFiscalStatus(c *gin.Context) error {
+	found, err := rc.find(c)
+	if err != nil {
+		return err
+	}
+	if rc.fiscal == nil {
+		return jsonHelper.ApiError{
+			Err:    "Fiscalization is not enabled",
+			Status: 404,
+		}
+	}
+	document, err := rc.fiscal.GetByReference(c, found.Reference)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return jsonHelper.ApiError{
+			Err:    "Payment has no fiscal check",
+			Status: 404,
+		}
+	}
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	c.JSON(200, gin.H{"fiscal": document})
+	return nil
+}
+
+func (rc *receiptController) regenerate(c *gin.Context) error {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	regenerated, err := rc.receipts.Regenerate(c, id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return jsonHelper.ApiError{
+			Err:    "No such receipt",
+			Status: 404,
+		}
+	}
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	c.JSON(200, gin.H{"receipt": regenerated})
+	return nil
+}
@@ -0,0 +1,150 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/auth"
+	"palyvoua/tools/jsonHelper"
+	"strings"
+	"time"
+)
+
+const (
+	deviceNameHeader = "X-Device-Name"
+	// reauthWindow is how long after signing in through a provider a user without a password may make sensitive changes
+	reauthWindow = 10 * time.Minute
+)
+
+type sessionController struct {
+	sessionRepo repository.SessionRepo
+}
+
+func SetupSessionRoutes(r *gin.Engine, ur repository.UserRepo, ar adminRepo, sr repository.SessionRepo) {
+	sessionGroup := r.Group("/session")
+
+	sc := sessionController{sessionRepo: sr}
+
+	sessionGroup.Use(auth.AuthMiddleware(ur, ar))
+	sessionGroup.GET("", jsonHelper.MakeHttpHandler(sc.getAll))
+	sessionGroup.DELETE("/:id", jsonHelper.MakeHttpHandler(sc.revoke))
+}
+
+// startSession registers the device the user logs in from and issues tokens bound to it
+func startSession(c *gin.Context, sessionRepo repository.SessionRepo, user *models.User, mfaVerified bool) (auth.Tokens, error) {
+	sessionID, err := uuid.NewRandom()
+	if err != nil {
+		return auth.Tokens{}, jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	now := int(time.Now().Unix())
+	deviceName := c.GetHeader(deviceNameHeader)
+	if deviceName == "" {
+		deviceName = c.Request.UserAgent()
+	}
+	session := models.Session{
+		ID:         sessionID,
+		UserID:     user.ID,
+		DeviceName: deviceName,
+		IP:         c.ClientIP(),
+		UserAgent:  c.Request.UserAgent(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+	if err = sessionRepo.Save(c, &session); err != nil {
+		return auth.Tokens{}, jsonHelper.ApiError{
+			Err:    "Error creating session",
+			Status: 500,
+		}
+	}
+	return auth.GenerateTokens(tokenBody(user, mfaVerified, sessionID), c), nil
+}
+
+// reauthenticate makes the user prove who they are again before a sensitive change. Users with a password give it,
+// users who only sign in through a provider give a TOTP code or must have signed in within reauthWindow.
+func reauthenticate(c *gin.Context, userRepo repository.UserRepo, sessionRepo repository.SessionRepo, user *models.User, password string, totpCode string) error {
+	if user.Password != "" {
+		if err := auth.ComparePasswords(password, user.Password); err != nil {
+			return jsonHelper.ApiError{
+				Err:    "Current password is incorrect",
+				Status: 403,
+			}
+		}
+		return nil
+	}
+	if totpCode != "" && user.MFA.TOTPEnabled {
+		if !checkTOTP(user, user.MFA.TOTPSecret, totpCode) {
+			return jsonHelper.ApiError{
+				Err:    "Invalid code",
+				Status: 403,
+			}
+		}
+		if err := userRepo.UpdateMFASettings(c, user.ID, user.MFA); err != nil {
+			return jsonHelper.ApiError{
+				Err:    "Error saving MFA settings",
+				Status: 500,
+			}
+		}
+		return nil
+	}
+	sessionID := auth.GetSessionID(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+	session, err := sessionRepo.GetByID(c, sessionID)
+	if err != nil || time.Since(time.Unix(int64(session.CreatedAt), 0)) > reauthWindow {
+		return jsonHelper.ApiError{
+			Err:    "Sign in again to confirm it's you",
+			Status: 403,
+		}
+	}
+	return nil
+}
+
+func (sc *sessionController) getAll(c *gin.Context) error {
+	authBodyField, exists := c.Get("authBody")
+	if !exists {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	authBody, ok := authBodyField.(auth.AuthBody)
+	if !ok {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	sessions, err := sc.sessionRepo.GetActiveByUserID(c, authBody.GetUser().ID)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error getting sessions",
+			Status: 500,
+		}
+	}
+	currentSessionID := auth.GetSessionID(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+	c.JSON(200, gin.H{"sessions": sessions, "currentSessionId": currentSessionID})
+	return nil
+}
+
+func (sc *sessionController) revoke(c *gin.Context) error {
+	authBodyField, exists := c.Get("authBody")
+	if !exists {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	authBody, ok := authBodyField.(auth.AuthBody)
+	if !ok {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	sessionID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	session, err := sc.sessionRepo.GetByID(c, sessionID)
+	if err != nil || session.UserID != authBody.GetUser().ID {
+		return jsonHelper.ApiError{
+			Err:    "No such session",
+			Status: 404,
+		}
+	}
+	if err = sc.sessionRepo.Revoke(c, sessionID, int(time.Now().Unix())); err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Error revoking session",
+			Status: 500,
+		}
+	}
+	c.JSON(200, gin.H{})
+	return nil
+}
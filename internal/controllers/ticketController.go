@@ -4,20 +4,36 @@ import (
 	"context"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"io"
+	"log/slog"
+	"net/http"
+	"palyvoua/internal/api/events"
 	"palyvoua/internal/dto"
 	"palyvoua/internal/mapper"
 	"palyvoua/internal/models"
 	"palyvoua/internal/repository"
 	"palyvoua/tools/auth"
 	"palyvoua/tools/jsonHelper"
+	"palyvoua/tools/logging"
 	"sync"
+	"time"
 )
 
+// EVENTS_HEARTBEAT keeps idle event streams from being closed by proxies
+const EVENTS_HEARTBEAT = 20 * time.Second
+
 type ticketController struct {
 	ticketRepo repository.TicketRepo
 	userRepo repository.UserRepo
 	adminRepo adminRepo
 	ticketMapper mapper.TicketMapper
+	organizations ticketAccess
+	events events.Broker
+}
+
+// ticketAccess knows who besides the holder may see a ticket
+type ticketAccess interface {
+	CanAccessTicket(c context.Context, userID uuid.UUID, ticket *models.Ticket) (bool, error)
 }
 
 //type ticketControllerOptions func(*ticketController)
@@ -33,17 +49,21 @@ type TicketRoutesOptions struct {
 	TicketRepo repository.TicketRepo
 	AdminRepo repository.AdminRepo
 	TicketMapper mapper.TicketMapper
+	Organizations ticketAccess
+	Events events.Broker
 }
 
 
 func SetupTicketRoutes(r *gin.Engine, options *TicketRoutesOptions) {
 	ticketGroup := r.Group("/ticket")
 
-	tc := ticketController{userRepo: options.UserRepo, ticketRepo: options.TicketRepo, adminRepo: options.AdminRepo, ticketMapper: options.TicketMapper}
+	tc := ticketController{userRepo: options.UserRepo, ticketRepo: options.TicketRepo, adminRepo: options.AdminRepo, ticketMapper: options.TicketMapper, organizations: options.Organizations, events: options.Events}
 
+	ticketGroup.Use(auth.RequireScope(models.SCOPE_TICKETS_READ))
 	ticketGroup.Use(auth.AuthMiddleware(options.UserRepo, options.AdminRepo))
 	ticketGroup.Use(auth.RoleMiddleware(0, options.UserRepo, tc.adminRepo))
 	ticketGroup.GET("/", jsonHelper.MakeHttpHandler(tc.getAll))
+	ticketGroup.GET("/events", jsonHelper.MakeHttpHandler(tc.streamEvents))
 	ticketGroup.GET("/:id", jsonHelper.MakeHttpHandler(tc.getByID))
 }
 
@@ -113,6 +133,45 @@ func (tc *ticketController) getAll(c *gin.Context) error {
 	return nil
 }
 
+// streamEvents sends what happens to the user's tickets as server-sent events until the client goes away
+func (tc *ticketController) streamEvents(c *gin.Context) error {
+	user, err := authUser(c)
+	if err != nil {
+		return err
+	}
+	stream, unsubscribe := tc.events.Subscribe(user.ID)
+	defer unsubscribe()
+	heartbeat := time.NewTicker(EVENTS_HEARTBEAT)
+	defer heartbeat.Stop()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	// the server's write timeout is meant for ordinary responses, a stream lasts as long as the client stays
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		slog.WarnContext(c, "lifting the write deadline of the event stream failed", logging.Err(err))
+	}
+	c.Status(200)
+	c.Writer.Flush()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case event, ok := <-stream:
+			if !ok {
+				return false
+			}
+			c.SSEvent(event.Type, event)
+			return true
+		case <-heartbeat.C:
+			_, err := io.WriteString(w, ": ping\n\n")
+			return err == nil
+		}
+	})
+	return nil
+}
+
 func (tc *ticketController) getByID(c *gin.Context) error {
 	authBodyField, exists := c.Get("authBody")
 	if !exists {
@@ -127,14 +186,18 @@ func (tc *ticketController) getByID(c *gin.Context) error {
 
 	ticketToReceive := c.Param("id")
 
-	ticket, err := tc.ticketRepo.GetByID(uuid.MustParse(ticketToReceive))
+	ticket, err := tc.ticketRepo.GetByID(c, uuid.MustParse(ticketToReceive))
 	if err != nil {
 		return jsonHelper.ApiError{
 			Err:    "Error receiving ticket with given id",
 			Status: 500,
 		}
 	}
-	if ticket.UserId.String() != authBody.GetUser().ID.String() && authBody.GetRole().AuthorityLevel < 2 {
+	canAccess, err := tc.organizations.CanAccessTicket(c, authBody.GetUser().ID, &ticket)
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	if !canAccess && authBody.GetRole().AuthorityLevel < 2 {
 		return jsonHelper.ApiError{
 			Err:    "You have no authority to retrieve this source",
 			Status: 403,
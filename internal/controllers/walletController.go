@@ -0,0 +1,384 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"palyvoua/internal/api/events"
+	"palyvoua/internal/api/fiscal"
+	"palyvoua/internal/api/notification"
+	"palyvoua/internal/api/payment"
+	"palyvoua/internal/api/receipt"
+	"palyvoua/internal/api/wallet"
+	"palyvoua/internal/api/webhook"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/auth"
+	"palyvoua/tools/jsonHelper"
+	"palyvoua/tools/metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_STATEMENT_LIMIT = 50
+	MAX_STATEMENT_LIMIT = 200
+)
+
+type walletController struct {
+	wallet wallet.WalletService
+	ticketRepo repository.TicketRepo
+	productRepo repository.ProductRepo
+	productTicketRepo repository.ProductTicketRepo
+	priceVersionRepo repository.PriceVersionRepo
+	providers payment.ProviderSelector
+	returnURLs payment.ReturnURLResolver
+	receipts receipt.ReceiptService
+	fiscal fiscal.FiscalService
+	notifications notification.NotificationService
+	events events.Broker
+	webhooks webhook.WebhookService
+	maxTopUp int
+	ticketExpiration time.Duration
+}
+
+type WalletRoutesOptions struct {
+	UserRepo repository.UserRepo
+	AdminRepo repository.AdminRepo
+	Wallet wallet.WalletService
+	TicketRepo repository.TicketRepo
+	ProductRepo repository.ProductRepo
+	ProductTicketRepo repository.ProductTicketRepo
+	PriceVersionRepo repository.PriceVersionRepo
+	Providers payment.ProviderSelector
+	ReturnURLs payment.ReturnURLResolver
+	Receipts receipt.ReceiptService
+	Fiscal fiscal.FiscalService
+	Notifications notification.NotificationService
+	Events events.Broker
+	Webhooks webhook.WebhookService
+	// MaxTopUp is the largest top-up in minor units
+	MaxTopUp int
+	TicketExpiration time.Duration
+}
+
+func SetupWalletRoutes(r *gin.Engine, options *WalletRoutesOptions) {
+	walletGroup := r.Group("/wallet")
+
+	wc := walletController{
+		wallet:            options.Wallet,
+		ticketRepo:        options.TicketRepo,
+		productRepo:       options.ProductRepo,
+		productTicketRepo: options.ProductTicketRepo,
+		priceVersionRepo:  options.PriceVersionRepo,
+		providers:         options.Providers,
+		returnURLs:        options.ReturnURLs,
+		receipts:          options.Receipts,
+		fiscal:            options.Fiscal,
+		notifications:     options.Notifications,
+		events:            options.Events,
+		webhooks:          options.Webhooks,
+		maxTopUp:          options.MaxTopUp,
+		ticketExpiration:  options.TicketExpiration,
+	}
+
+	walletGroup.Use(auth.AuthMiddleware(options.UserRepo, options.AdminRepo))
+	walletGroup.GET("", jsonHelper.MakeHttpHandler(wc.getBalance))
+	walletGroup.GET("/statement", jsonHelper.MakeHttpHandler(wc.getStatement))
+	walletGroup.POST("/topUp", jsonHelper.MakeHttpHandler(wc.topUp))
+	walletGroup.POST("/purchase", jsonHelper.MakeHttpHandler(wc.purchase))
+
+	walletGroup.Use(auth.RoleMiddleware(3, options.UserRepo, options.AdminRepo))
+	walletGroup.POST("/refund", jsonHelper.MakeHttpHandler(wc.refund))
+}
+
+// authUser is the user the request was authenticated as
+func authUser(c *gin.Context) (*models.User, error) {
+	authBodyField, exists := c.Get("authBody")
+	if !exists {
+		return nil, jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	authBody, ok := authBodyField.(auth.AuthBody)
+	if !ok {
+		return nil, jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	return authBody.GetUser(), nil
+}
+
+func (wc *walletController) getBalance(c *gin.Context) error {
+	user, err := authUser(c)
+	if err != nil {
+		return err
+	}
+	balance, err := wc.wallet.Balance(c, user.ID)
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	c.JSON(200, gin.H{"balance": balance, "currency": wc.wallet.Currency()})
+	return nil
+}
+
+// getStatement pages back in time, before is the createdAt of the last line already shown
+func (wc *walletController) getStatement(c *gin.Context) error {
+	user, err := authUser(c)
+	if err != nil {
+		return err
+	}
+	before, limit := 0, DEFAULT_STATEMENT_LIMIT
+	if value := c.Query("before"); value != "" {
+		if before, err = strconv.Atoi(value); err != nil {
+			return jsonHelper.DefaultHttpErrors["BadRequest"]
+		}
+	}
+	if value := c.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			return jsonHelper.DefaultHttpErrors["BadRequest"]
+		}
+	}
+	lines, err := wc.wallet.Statement(c, user.ID, before, min(limit, MAX_STATEMENT_LIMIT))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	c.JSON(200, gin.H{"statement": lines, "currency": wc.wallet.Currency()})
+	return nil
+}
+
+type TopUpRequest struct {
+	// Amount in minor units of the wallet currency
+	Amount int `json:"amount"`
+	Provider string `json:"provider"`
+	Client string `json:"client"`
+	Platform string `json:"platform"`
+}
+
+// topUp starts a checkout, the wallet is credited by the payment webhook
+func (wc *walletController) topUp(c *gin.Context) error {
+	user, err := authUser(c)
+	if err != nil {
+		return err
+	}
+	var body TopUpRequest
+	if err = c.Bind(&body); err != nil || body.Amount <= 0 {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	if body.Amount > wc.maxTopUp {
+		return jsonHelper.ApiError{
+			Err:    "Top up is over the limit of " + strconv.Itoa(wc.maxTopUp),
+			Status: 400,
+		}
+	}
+	providerName, provider, err := wc.providers.Select(body.Provider, "")
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 400,
+		}
+	}
+	returnURLs, err := wc.returnURLs.Resolve(body.Client, body.Platform)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 400,
+		}
+	}
+	sess, err := provider.CreateTopUpSession(c, user.CustomerID, body.Amount, wc.wallet.Currency(), returnURLs)
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	c.JSON(200, gin.H{"sessionId": sess.ID, "url": sess.URL, "provider": providerName})
+	return nil
+}
+
+type WalletPurchaseRequest struct {
+	ProductList []payment.ProductDto `json:"productList"`
+}
+
+// purchase pays tickets from the balance, the tickets are issued in the same transaction as the debit
+func (wc *walletController) purchase(c *gin.Context) error {
+	user, err := authUser(c)
+	if err != nil {
+		return err
+	}
+	var body WalletPurchaseRequest
+	if err = c.Bind(&body); err != nil || len(body.ProductList) == 0 {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+
+	type purchaseLine struct {
+		productTicket models.ProductTicket
+		quantity int
+	}
+	var lines []purchaseLine
+	total := 0
+	for _, p := range body.ProductList {
+		if p.Amount <= 0 {
+			return jsonHelper.DefaultHttpErrors["BadRequest"]
+		}
+		productTicket, err := wc.productTicketRepo.GetByStripeProductID(c, p.ProductStripeID)
+		if err != nil {
+			return jsonHelper.ApiError{
+				Err:    "No such product",
+				Status: 404,
+			}
+		}
+		if !strings.EqualFold(productTicket.Currency, wc.wallet.Currency()) {
+			return jsonHelper.ApiError{
+				Err:    "Product is not sold in the wallet currency",
+				Status: 400,
+			}
+		}
+		lines = append(lines, purchaseLine{productTicket: productTicket, quantity: p.Amount})
+		total += productTicket.Price * p.Amount
+	}
+
+	var tickets []models.Ticket
+	transaction, err := wc.wallet.Purchase(c, user.ID, total, uuid.NewString(), func(ctx context.Context, transaction *models.LedgerTransaction) error {
+		// a retried transaction starts over
+		tickets = nil
+		for _, line := range lines {
+			for i := 0; i < line.quantity; i++ {
+				ticket, err := issueTicket(ctx, wc.ticketRepo, wc.productRepo, &line.productTicket, wc.ticketExpiration, user.ID, uuid.Nil, "wallet:"+transaction.ID.String(), "", line.productTicket.PriceVersionID)
+				if err != nil {
+					return err
+				}
+				tickets = append(tickets, *ticket)
+			}
+		}
+		request := receipt.Request{
+			UserID:    user.ID,
+			Buyer:     user.Email,
+			Reference: "wallet:" + transaction.ID.String(),
+			Currency:  wc.wallet.Currency(),
+			Total:     total,
+		}
+		for _, line := range lines {
+			request.Items = append(request.Items, receipt.Item{ProductTicket: line.productTicket, Quantity: line.quantity, UnitPrice: line.productTicket.Price})
+		}
+		issued, err := wc.receipts.Issue(ctx, request)
+		if err != nil || wc.fiscal == nil {
+			return err
+		}
+		_, err = wc.fiscal.Enqueue(ctx, issued, models.FISCAL_PAYMENT_WALLET)
+		return err
+	})
+	if errors.Is(err, repository.ErrInsufficientBalance) {
+		return jsonHelper.ApiError{
+			Err:    "Insufficient balance",
+			Status: 402,
+		}
+	}
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	metrics.CountTickets(c, metrics.TICKETS_CREATED, tickets...)
+	events.PublishTickets(wc.events, models.TICKET_CREATED, tickets...)
+	events.PublishTickets(wc.events, models.TICKET_ACTIVATED, tickets...)
+	for i := range tickets {
+		publishToSeller(c, wc.webhooks, models.WEBHOOK_TICKET_PURCHASED, "purchased:"+tickets[i].ID.String(), &tickets[i], tickets[i].Amount)
+	}
+	notify(c, wc.notifications, notification.TicketNotice{
+		Event:   models.NOTIFY_TICKET_ISSUED,
+		Key:     "issued:wallet:" + transaction.ID.String(),
+		Tickets: tickets,
+	})
+	c.JSON(200, gin.H{"transaction": transaction, "tickets": tickets})
+	return nil
+}
+
+type WalletRefundRequest struct {
+	TicketID uuid.UUID `json:"ticketId"`
+	// Amount defaults to the price the ticket was bought at, it can't be more
+	Amount int `json:"amount"`
+}
+
+var errNotRefundable = jsonHelper.ApiError{
+	Err:    "Ticket can't be refunded",
+	Status: 409,
+}
+
+// refund pays an unused ticket back to its owner's wallet, a ticket is refunded once
+func (wc *walletController) refund(c *gin.Context) error {
+	var body WalletRefundRequest
+	if err := c.Bind(&body); err != nil || body.TicketID == uuid.Nil || body.Amount < 0 {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	ticket, err := wc.ticketRepo.GetByID(c, body.TicketID)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "No such ticket",
+			Status: 404,
+		}
+	}
+	// organization tickets not handed to a driver have no wallet to go back to
+	if ticket.PaymentID == "" || ticket.UserId == uuid.Nil || ticket.Status == models.USED || ticket.Status == models.REFUNDED {
+		return errNotRefundable
+	}
+	if body.Amount == 0 && ticket.Used > 0 {
+		return jsonHelper.ApiError{
+			Err:    "Ticket was partly used, pass an amount",
+			Status: 400,
+		}
+	}
+	// the price bounds what is paid back, so it has to be known in the wallet currency
+	priceVersion, err := wc.priceVersionRepo.GetByID(c, ticket.PriceVersionID)
+	if err != nil {
+		return jsonHelper.ApiError{
+			Err:    "Ticket price is unknown, it can't be refunded to the wallet",
+			Status: 400,
+		}
+	}
+	if !strings.EqualFold(priceVersion.Currency, wc.wallet.Currency()) {
+		return jsonHelper.ApiError{
+			Err:    "Ticket was not paid in the wallet currency",
+			Status: 400,
+		}
+	}
+	amount := body.Amount
+	if amount == 0 {
+		amount = priceVersion.Price
+	}
+	if amount > priceVersion.Price {
+		return jsonHelper.ApiError{
+			Err:    "Refund can't be more than the ticket's price",
+			Status: 400,
+		}
+	}
+
+	// the ticket is marked with the credit, a ticket used in the meantime rolls the credit back
+	transaction, err := wc.wallet.Refund(c, ticket.UserId, amount, ticket.ID.String(), func(c context.Context, transaction *models.LedgerTransaction) error {
+		refunded, err := wc.ticketRepo.Refund(c, ticket.ID)
+		if err != nil {
+			return err
+		}
+		if !refunded {
+			return errNotRefundable
+		}
+		return nil
+	})
+	if errors.Is(err, wallet.ErrAlreadyPosted) {
+		return jsonHelper.ApiError{
+			Err:    "Ticket was already refunded",
+			Status: 409,
+		}
+	}
+	if errors.Is(err, errNotRefundable) {
+		return errNotRefundable
+	}
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["InternalServerError"]
+	}
+	ticket.Status = models.REFUNDED
+	events.PublishTickets(wc.events, models.TICKET_REFUNDED, ticket)
+	publishToSeller(c, wc.webhooks, models.WEBHOOK_TICKET_REFUNDED, "refunded:"+ticket.ID.String(), &ticket, ticket.Amount)
+	notify(c, wc.notifications, notification.TicketNotice{
+		Event:    models.NOTIFY_TICKET_REFUNDED,
+		Key:      "refunded:" + ticket.ID.String(),
+		Tickets:  []models.Ticket{ticket},
+		Amount:   amount,
+		Currency: wc.wallet.Currency(),
+	})
+	c.JSON(200, gin.H{"transaction": transaction})
+	return nil
+}
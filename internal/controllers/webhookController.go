@@ -0,0 +1,284 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"log/slog"
+	"palyvoua/internal/api/webhook"
+	"palyvoua/internal/models"
+	"palyvoua/internal/repository"
+	"palyvoua/tools/auth"
+	"palyvoua/tools/jsonHelper"
+	"palyvoua/tools/logging"
+	"strconv"
+)
+
+const (
+	DEFAULT_DELIVERY_LIMIT = 50
+	MAX_DELIVERY_LIMIT = 200
+)
+
+type webhookController struct {
+	webhooks webhook.WebhookService
+}
+
+type WebhookRoutesOptions struct {
+	UserRepo repository.UserRepo
+	AdminRepo repository.AdminRepo
+	Webhooks webhook.WebhookService
+}
+
+// SetupWebhookRoutes lets sellers register the endpoints their systems are told about ticket events on.
+// A seller's API key manages its own endpoints, admins name the seller with ?seller=.
+func SetupWebhookRoutes(r *gin.Engine, options *WebhookRoutesOptions) {
+	webhookGroup := r.Group("/webhooks")
+
+	wc := webhookController{webhooks: options.Webhooks}
+
+	webhookGroup.Use(auth.RequireScope(models.SCOPE_WEBHOOKS_MANAGE))
+	webhookGroup.Use(auth.AuthMiddleware(options.UserRepo, options.AdminRepo))
+	webhookGroup.Use(auth.RoleMiddleware(2, options.UserRepo, options.AdminRepo))
+	webhookGroup.GET("/events", jsonHelper.MakeHttpHandler(wc.getEventTypes))
+	webhookGroup.GET("/endpoints", jsonHelper.MakeHttpHandler(wc.getEndpoints))
+	webhookGroup.POST("/endpoints", jsonHelper.MakeHttpHandler(wc.register))
+	webhookGroup.PUT("/endpoints/:id", jsonHelper.MakeHttpHandler(wc.updateEndpoint))
+	webhookGroup.DELETE("/endpoints/:id", jsonHelper.MakeHttpHandler(wc.deleteEndpoint))
+	webhookGroup.POST("/endpoints/:id/rotateSecret", jsonHelper.MakeHttpHandler(wc.rotateSecret))
+	webhookGroup.POST("/endpoints/:id/ping", jsonHelper.MakeHttpHandler(wc.ping))
+	webhookGroup.GET("/deliveries", jsonHelper.MakeHttpHandler(wc.getDeliveries))
+	webhookGroup.GET("/deliveries/:id", jsonHelper.MakeHttpHandler(wc.getDelivery))
+	webhookGroup.POST("/deliveries/:id/redeliver", jsonHelper.MakeHttpHandler(wc.redeliver))
+}
+
+// publishToSeller queues a ticket event for the seller's endpoints, like notify it only logs a failure
+func publishToSeller(c context.Context, webhooks webhook.WebhookService, event string, key string, ticket *models.Ticket, liters int) {
+	if webhooks == nil {
+		return
+	}
+	if err := webhooks.PublishTicket(c, event, key, ticket, liters); err != nil {
+		slog.ErrorContext(c, "queueing webhook failed", "key", key, logging.Err(err))
+	}
+}
+
+func webhookError(err error) error {
+	var rejected webhook.RejectedError
+	switch {
+	case errors.Is(err, webhook.ErrNotFound):
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 404,
+		}
+	case errors.Is(err, webhook.ErrNotDead):
+		return jsonHelper.ApiError{
+			Err:    err.Error(),
+			Status: 409,
+		}
+	case errors.As(err, &rejected):
+		return jsonHelper.ApiError{
+			Err:    rejected.Error(),
+			Status: 400,
+		}
+	}
+	return jsonHelper.DefaultHttpErrors["InternalServerError"]
+}
+
+// seller is the seller the request manages, a key bound to a seller can't manage another one
+func (wc *webhookController) seller(c *gin.Context) (string, error) {
+	authBodyField, exists := c.Get("authBody")
+	if !exists {
+		return "", jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	authBody, ok := authBodyField.(auth.AuthBody)
+	if !ok {
+		return "", jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	requested := c.Query("seller")
+	if apiKey := authBody.GetAPIKey(); apiKey != nil && apiKey.Seller != "" {
+		if requested != "" && requested != apiKey.Seller {
+			return "", jsonHelper.ApiError{
+				Err:    "API key belongs to another seller",
+				Status: 403,
+			}
+		}
+		return apiKey.Seller, nil
+	}
+	if requested == "" || c.GetInt("authorityLevel") < 3 {
+		return "", jsonHelper.ApiError{
+			Err:    "Use an API key of the seller or pass the seller as an admin",
+			Status: 403,
+		}
+	}
+	return requested, nil
+}
+
+func (wc *webhookController) getEventTypes(c *gin.Context) error {
+	c.JSON(200, gin.H{"events": models.WebhookEventTypes})
+	return nil
+}
+
+func (wc *webhookController) getEndpoints(c *gin.Context) error {
+	seller, err := wc.seller(c)
+	if err != nil {
+		return err
+	}
+	endpoints, err := wc.webhooks.GetEndpoints(c, seller)
+	if err != nil {
+		return webhookError(err)
+	}
+	c.JSON(200, gin.H{"endpoints": endpoints})
+	return nil
+}
+
+type WebhookEndpointRequest struct {
+	URL string `json:"url"`
+	Events []string `json:"events"`
+	// Active is only read on updates, new endpoints start active
+	Active *bool `json:"active"`
+}
+
+func (wc *webhookController) register(c *gin.Context) error {
+	seller, err := wc.seller(c)
+	if err != nil {
+		return err
+	}
+	var body WebhookEndpointRequest
+	if err = c.Bind(&body); err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	endpoint, secret, err := wc.webhooks.Register(c, seller, body.URL, body.Events)
+	if err != nil {
+		return webhookError(err)
+	}
+	c.JSON(200, gin.H{"endpoint": endpoint, "secret": secret})
+	return nil
+}
+
+func (wc *webhookController) updateEndpoint(c *gin.Context) error {
+	seller, err := wc.seller(c)
+	if err != nil {
+		return err
+	}
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	var body WebhookEndpointRequest
+	if err = c.Bind(&body); err != nil || body.Active == nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	endpoint, err := wc.webhooks.UpdateEndpoint(c, seller, id, body.URL, body.Events, *body.Active)
+	if err != nil {
+		return webhookError(err)
+	}
+	c.JSON(200, gin.H{"endpoint": endpoint})
+	return nil
+}
+
+func (wc *webhookController) deleteEndpoint(c *gin.Context) error {
+	seller, err := wc.seller(c)
+	if err != nil {
+		return err
+	}
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	if err = wc.webhooks.DeleteEndpoint(c, seller, id); err != nil {
+		return webhookError(err)
+	}
+	c.JSON(200, gin.H{})
+	return nil
+}
+
+func (wc *webhookController) rotateSecret(c *gin.Context) error {
+	seller, err := wc.seller(c)
+	if err != nil {
+		return err
+	}
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	secret, err := wc.webhooks.RotateSecret(c, seller, id)
+	if err != nil {
+		return webhookError(err)
+	}
+	c.JSON(200, gin.H{"secret": secret})
+	return nil
+}
+
+func (wc *webhookController) ping(c *gin.Context) error {
+	seller, err := wc.seller(c)
+	if err != nil {
+		return err
+	}
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	delivery, err := wc.webhooks.Ping(c, seller, id)
+	if err != nil {
+		return webhookError(err)
+	}
+	c.JSON(200, gin.H{"delivery": delivery})
+	return nil
+}
+
+func (wc *webhookController) getDeliveries(c *gin.Context) error {
+	seller, err := wc.seller(c)
+	if err != nil {
+		return err
+	}
+	endpointID := uuid.Nil
+	if param := c.Query("endpointId"); param != "" {
+		if endpointID, err = uuid.Parse(param); err != nil {
+			return jsonHelper.DefaultHttpErrors["BadRequest"]
+		}
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(DEFAULT_DELIVERY_LIMIT)))
+	if err != nil || limit <= 0 {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	deliveries, err := wc.webhooks.GetDeliveries(c, seller, endpointID, c.Query("status"), min(limit, MAX_DELIVERY_LIMIT))
+	if err != nil {
+		return webhookError(err)
+	}
+	c.JSON(200, gin.H{"deliveries": deliveries})
+	return nil
+}
+
+func (wc *webhookController) getDelivery(c *gin.Context) error {
+	seller, err := wc.seller(c)
+	if err != nil {
+		return err
+	}
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	delivery, err := wc.webhooks.GetDelivery(c, seller, id)
+	if err != nil {
+		return webhookError(err)
+	}
+	c.JSON(200, gin.H{"delivery": delivery})
+	return nil
+}
+
+func (wc *webhookController) redeliver(c *gin.Context) error {
+	seller, err := wc.seller(c)
+	if err != nil {
+		return err
+	}
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		return jsonHelper.DefaultHttpErrors["BadRequest"]
+	}
+	delivery, err := wc.webhooks.Redeliver(c, seller, id)
+	if err != nil {
+		return webhookError(err)
+	}
+	c.JSON(200, gin.H{"delivery": delivery})
+	return nil
+}
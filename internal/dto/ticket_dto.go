@@ -7,8 +7,11 @@ type TicketDto struct {
 	UserId *string `json:"userId" bson:"userId"`
 	Status *string `json:"status" bson:"status"`
 	Amount *int `json:"amount" bson:"amount"`
+	Used *int `json:"used" bson:"used"`
 	PaymentID *string `json:"paymentId" bson:"paymentId"`
 	ProductTicketId *string `json:"productTicketId" bson:"productTicketId"`
+	OrganizationID *string `json:"organizationId,omitempty" bson:"organizationId"`
+	DriverID *string `json:"driverId,omitempty" bson:"driverId"`
 }
 
 type ProductTicketDto struct {
@@ -2,6 +2,7 @@ package mapper
 
 import (
 	"context"
+	"github.com/google/uuid"
 	"palyvoua/internal/dto"
 	"palyvoua/internal/models"
 	"palyvoua/internal/repository"
@@ -37,6 +38,7 @@ func (d *defaultTicketMapper) TicketToDto(model *models.Ticket) (*dto.TicketDto,
 	createdAt := model.CreatedAt
 	expiresAt := model.ExpiresAt
 	amount := model.Amount
+	used := model.Used
 	ticketDto := dto.TicketDto{
 		CreatedAt:       &createdAt,
 		ExpiresAt:       &expiresAt,
@@ -44,9 +46,14 @@ func (d *defaultTicketMapper) TicketToDto(model *models.Ticket) (*dto.TicketDto,
 		UserId:          stringPtr(model.UserId.String()),
 		Status:          stringPtr(model.Status),
 		Amount:          &amount,
+		Used:            &used,
 		PaymentID:       stringPtr(model.PaymentID),
 		ProductTicketId: stringPtr(model.ProductTicketID.String()),
 	}
+	if model.OrganizationID != uuid.Nil {
+		ticketDto.OrganizationID = stringPtr(model.OrganizationID.String())
+		ticketDto.DriverID = stringPtr(model.DriverID.String())
+	}
 	return &ticketDto,nil
 }
 
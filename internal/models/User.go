@@ -2,10 +2,62 @@ package models
 
 import "github.com/google/uuid"
 
+const (
+	LANGUAGE_UK = "uk"
+	LANGUAGE_EN = "en"
+)
+
 type User struct {
 	Email string `json:"email" bson:"email"`
-	Password string `bson:"password"`
+	Password string `json:"-" bson:"password"`
 	ID uuid.UUID `bson:"_id" json:"id"`
 	CustomerID string `json:"customerId" bson:"customerId"`
 	Role uuid.UUID `json:"role" bson:"role"`
+	MFA MFASettings `json:"mfa" bson:"mfa"`
+	UserProfile `bson:",inline"`
+	EmailChange EmailChange `json:"-" bson:"emailChange"`
+	Deletion AccountDeletion `json:"deletion" bson:"deletion"`
+	Identities []ExternalIdentity `json:"identities" bson:"identities"`
+	Notifications NotificationPreferences `json:"notifications" bson:"notifications"`
+}
+
+// ExternalIdentity links the user to an account at an OpenID Connect provider
+type ExternalIdentity struct {
+	Provider string `json:"provider" bson:"provider"`
+	Subject string `json:"-" bson:"subject"`
+	LinkedAt int `json:"linkedAt" bson:"linkedAt"`
+}
+
+// AccountDeletion tracks a requested deletion through its grace period
+type AccountDeletion struct {
+	RequestedAt int `json:"requestedAt" bson:"requestedAt"`
+	ScheduledAt int `json:"scheduledAt" bson:"scheduledAt"`
+	DeletedAt int `json:"deletedAt" bson:"deletedAt"`
+}
+
+// UserProfile is the part of the user the user can edit themselves
+type UserProfile struct {
+	Name string `json:"name" bson:"name"`
+	Phone string `json:"phone" bson:"phone"`
+	PreferredLanguage string `json:"preferredLanguage" bson:"preferredLanguage"`
+	MarketingConsent bool `json:"marketingConsent" bson:"marketingConsent"`
+	DefaultFuelType string `json:"defaultFuelType" bson:"defaultFuelType"`
+}
+
+// EmailChange holds a requested email until the user proves they own it
+type EmailChange struct {
+	PendingEmail string `bson:"pendingEmail"`
+	TokenHash string `bson:"tokenHash"`
+	ExpiresAt int `bson:"expiresAt"`
+}
+
+type MFASettings struct {
+	TOTPEnabled bool `json:"totpEnabled" bson:"totpEnabled"`
+	TOTPSecret string `json:"-" bson:"totpSecret"`
+	PendingTOTPSecret string `json:"-" bson:"pendingTotpSecret"`
+	LastTOTPStep int64 `json:"-" bson:"lastTotpStep"`
+	RecoveryCodes []string `json:"-" bson:"recoveryCodes"`
+	// EnrollmentTokenHash is set by an admin, its token lets a user whose role requires MFA enroll before they can sign in
+	EnrollmentTokenHash string `json:"-" bson:"enrollmentTokenHash"`
+	EnrollmentExpiresAt int `json:"-" bson:"enrollmentExpiresAt"`
 }
@@ -0,0 +1,41 @@
+package models
+
+import "github.com/google/uuid"
+
+const (
+	SCOPE_TICKETS_READ = "tickets:read"
+	SCOPE_TICKETS_REDEEM = "tickets:redeem"
+	// SCOPE_WEBHOOKS_MANAGE lets a seller's system manage its webhook endpoints
+	SCOPE_WEBHOOKS_MANAGE = "webhooks:manage"
+)
+
+var APIKeyScopes = []string{SCOPE_TICKETS_READ, SCOPE_TICKETS_REDEEM, SCOPE_WEBHOOKS_MANAGE}
+
+// APIKey lets a station terminal or a partner system act as UserID without a JWT, bound to Seller and Station when they are set.
+// Only the sha256 of the key is stored, the plain key is shown once when issued.
+type APIKey struct {
+	ID uuid.UUID `json:"id" bson:"_id"`
+	Name string `json:"name" bson:"name"`
+	Prefix string `json:"prefix" bson:"prefix"`
+	Hash string `json:"-" bson:"hash"`
+	UserID uuid.UUID `json:"userId" bson:"userId"`
+	Seller string `json:"seller" bson:"seller"`
+	// Station is the one station a terminal key redeems tickets at
+	Station string `json:"station" bson:"station"`
+	Scopes []string `json:"scopes" bson:"scopes"`
+	AllowedIPs []string `json:"allowedIps" bson:"allowedIps"`
+	CreatedBy uuid.UUID `json:"createdBy" bson:"createdBy"`
+	CreatedAt int `json:"createdAt" bson:"createdAt"`
+	ExpiresAt int `json:"expiresAt" bson:"expiresAt"`
+	RevokedAt int `json:"revokedAt" bson:"revokedAt"`
+	LastUsedAt int `json:"lastUsedAt" bson:"lastUsedAt"`
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package models
+
+const (
+	CHECKOUT_PENDING = "PENDING"
+	CHECKOUT_COMPLETED = "COMPLETED"
+	CHECKOUT_FAILED = "FAILED"
+	CHECKOUT_EXPIRED = "EXPIRED"
+)
+
+// Checkout is a payment started with a provider that only calls back with our order reference,
+// the callback is matched against it to know who paid for what
+type Checkout struct {
+	ID string `json:"id" bson:"_id"`
+	Provider string `json:"provider" bson:"provider"`
+	// Purpose is one of the payment.CHECKOUT_PURPOSE_ constants
+	Purpose string `json:"purpose" bson:"purpose"`
+	CustomerID string `json:"customerId" bson:"customerId"`
+	Seller string `json:"seller" bson:"seller"`
+	LineItems []CheckoutLineItem `json:"lineItems" bson:"lineItems"`
+	// Total in minor units, with the discount already taken off
+	Total int `json:"total" bson:"total"`
+	Discount int `json:"discount" bson:"discount"`
+	Currency string `json:"currency" bson:"currency"`
+	Status string `json:"status" bson:"status"`
+	PaymentID string `json:"paymentId" bson:"paymentId"`
+	CreatedAt int `json:"createdAt" bson:"createdAt"`
+	UpdatedAt int `json:"updatedAt" bson:"updatedAt"`
+}
+
+type CheckoutLineItem struct {
+	ProductID string `json:"productId" bson:"productId"`
+	Title string `json:"title" bson:"title"`
+	Quantity int `json:"quantity" bson:"quantity"`
+	UnitPrice int `json:"unitPrice" bson:"unitPrice"`
+	PriceVersionID string `json:"priceVersionId" bson:"priceVersionId"`
+}
@@ -0,0 +1,52 @@
+package models
+
+import "github.com/google/uuid"
+
+const (
+	// FISCAL_PENDING documents wait for their first submission
+	FISCAL_PENDING = "PENDING"
+	// FISCAL_OFFLINE documents were numbered locally during an outage and still have to be delivered
+	FISCAL_OFFLINE = "OFFLINE"
+	FISCAL_DONE = "DONE"
+	// FISCAL_FAILED documents were rejected by the provider and need an admin
+	FISCAL_FAILED = "FAILED"
+
+	FISCAL_PAYMENT_CARD = "CARD"
+	FISCAL_PAYMENT_WALLET = "WALLET"
+)
+
+// FiscalDocument is the fiscal check of one payment, submitted to the tax service through a PRRO
+type FiscalDocument struct {
+	ID uuid.UUID `json:"id" bson:"_id"`
+	// Reference is the payment, the same as on its receipt
+	Reference string `json:"reference" bson:"reference"`
+	ReceiptID uuid.UUID `json:"receiptId" bson:"receiptId"`
+	CashRegisterID string `json:"cashRegisterId" bson:"cashRegisterId"`
+	PaymentType string `json:"paymentType" bson:"paymentType"`
+	Currency string `json:"currency" bson:"currency"`
+	Lines []FiscalLine `json:"lines" bson:"lines"`
+	Total int `json:"total" bson:"total"`
+	Status string `json:"status" bson:"status"`
+	FiscalNumber string `json:"fiscalNumber" bson:"fiscalNumber"`
+	// OfflineNumber is given by us while the tax service is unreachable, it stays on the check once delivered
+	OfflineNumber string `json:"offlineNumber" bson:"offlineNumber"`
+	// QR is the check verification link printed as a QR code
+	QR string `json:"qr" bson:"qr"`
+	Attempts int `json:"attempts" bson:"attempts"`
+	LastError string `json:"lastError" bson:"lastError"`
+	NextAttemptAt int `json:"nextAttemptAt" bson:"nextAttemptAt"`
+	CreatedAt int `json:"createdAt" bson:"createdAt"`
+	FiscalizedAt int `json:"fiscalizedAt" bson:"fiscalizedAt"`
+}
+
+type FiscalLine struct {
+	Code string `json:"code" bson:"code"`
+	Name string `json:"name" bson:"name"`
+	Quantity int `json:"quantity" bson:"quantity"`
+	UnitPrice int `json:"unitPrice" bson:"unitPrice"`
+	Discount int `json:"discount" bson:"discount"`
+	// Amount is what the line was paid, VAT included
+	Amount int `json:"amount" bson:"amount"`
+	VATRate int `json:"vatRate" bson:"vatRate"`
+	VAT int `json:"vat" bson:"vat"`
+}
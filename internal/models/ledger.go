@@ -0,0 +1,48 @@
+package models
+
+import "github.com/google/uuid"
+
+const (
+	// LEDGER_WALLET is a customer's prepaid balance, it never goes below zero
+	LEDGER_WALLET = "WALLET"
+	// LEDGER_CLEARING holds what the payment providers collected for top ups, it runs negative
+	LEDGER_CLEARING = "CLEARING"
+	// LEDGER_REVENUE is what was earned by selling tickets from wallets
+	LEDGER_REVENUE = "REVENUE"
+
+	LEDGER_TOP_UP = "TOP_UP"
+	LEDGER_PURCHASE = "PURCHASE"
+	LEDGER_REFUND = "REFUND"
+)
+
+// LedgerAccount keeps the running balance of its entries, so it can be checked and changed in one update
+type LedgerAccount struct {
+	ID string `json:"id" bson:"_id"`
+	Kind string `json:"kind" bson:"kind"`
+	// UserID is set on wallets only
+	UserID uuid.UUID `json:"userId" bson:"userId"`
+	Currency string `json:"currency" bson:"currency"`
+	// Balance in minor units
+	Balance int `json:"balance" bson:"balance"`
+	UpdatedAt int `json:"updatedAt" bson:"updatedAt"`
+}
+
+type LedgerEntry struct {
+	AccountID string `json:"accountId" bson:"accountId"`
+	// Amount is positive when the account is credited and negative when it is debited
+	Amount int `json:"amount" bson:"amount"`
+	BalanceAfter int `json:"balanceAfter" bson:"balanceAfter"`
+}
+
+// LedgerTransaction moves money between accounts, its entries always add up to zero
+type LedgerTransaction struct {
+	ID uuid.UUID `json:"id" bson:"_id"`
+	Kind string `json:"kind" bson:"kind"`
+	// IdempotencyKey makes a retried posting, a redelivered webhook say, a no-op
+	IdempotencyKey string `json:"-" bson:"idempotencyKey"`
+	// Reference is the checkout session or ticket the money moved for
+	Reference string `json:"reference" bson:"reference"`
+	Currency string `json:"currency" bson:"currency"`
+	Entries []LedgerEntry `json:"entries" bson:"entries"`
+	CreatedAt int `json:"createdAt" bson:"createdAt"`
+}
@@ -0,0 +1,46 @@
+package models
+
+import "github.com/google/uuid"
+
+const (
+	CHANNEL_EMAIL = "email"
+	CHANNEL_SMS = "sms"
+	CHANNEL_PUSH = "push"
+
+	NOTIFY_TICKET_ISSUED = "ticket_issued"
+	NOTIFY_TICKET_EXPIRING = "ticket_expiring"
+	NOTIFY_TICKET_REDEEMED = "ticket_redeemed"
+	NOTIFY_TICKET_REFUNDED = "ticket_refunded"
+
+	NOTIFICATION_PENDING = "PENDING"
+	NOTIFICATION_SENT = "SENT"
+	NOTIFICATION_FAILED = "FAILED"
+)
+
+// NotificationPreferences are kept on the user, every channel is on unless disabled
+type NotificationPreferences struct {
+	DisabledChannels []string `json:"disabledChannels" bson:"disabledChannels"`
+	// PushTokens are the devices the user signed in to the app on
+	PushTokens []string `json:"-" bson:"pushTokens"`
+}
+
+// Notification is one rendered message to one recipient, queued until it is delivered
+type Notification struct {
+	ID uuid.UUID `json:"id" bson:"_id"`
+	UserID uuid.UUID `json:"userId" bson:"userId"`
+	Event string `json:"event" bson:"event"`
+	// Key makes an event notify once, the expiry reminder of a ticket is only sent one time
+	Key string `json:"key" bson:"key"`
+	Channel string `json:"channel" bson:"channel"`
+	// Recipient is an email address, a phone number or a push token
+	Recipient string `json:"recipient" bson:"recipient"`
+	Language string `json:"language" bson:"language"`
+	Subject string `json:"subject" bson:"subject"`
+	Body string `json:"body" bson:"body"`
+	Status string `json:"status" bson:"status"`
+	Attempts int `json:"attempts" bson:"attempts"`
+	LastError string `json:"lastError" bson:"lastError"`
+	NextAttemptAt int `json:"nextAttemptAt" bson:"nextAttemptAt"`
+	CreatedAt int `json:"createdAt" bson:"createdAt"`
+	SentAt int `json:"sentAt" bson:"sentAt"`
+}
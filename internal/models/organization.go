@@ -0,0 +1,51 @@
+package models
+
+import "github.com/google/uuid"
+
+const (
+	// ORG_MANAGER buys for the organization, manages its members and hands out tickets
+	ORG_MANAGER = "manager"
+	// ORG_DRIVER only uses the tickets allocated to them
+	ORG_DRIVER = "driver"
+)
+
+// Organization is a fleet account, it owns the payment method and the tickets it buys
+type Organization struct {
+	ID uuid.UUID `json:"id" bson:"_id"`
+	Name string `json:"name" bson:"name"`
+	// CustomerID is the organization's own customer at the payment provider
+	CustomerID string `json:"-" bson:"customerId"`
+	CreatedAt int `json:"createdAt" bson:"createdAt"`
+}
+
+type OrganizationMember struct {
+	ID uuid.UUID `json:"id" bson:"_id"`
+	OrganizationID uuid.UUID `json:"organizationId" bson:"organizationId"`
+	UserID uuid.UUID `json:"userId" bson:"userId"`
+	Role string `json:"role" bson:"role"`
+	// Limits cap what managers may allocate to a driver
+	Limits []DriverLimit `json:"limits" bson:"limits"`
+	CreatedAt int `json:"createdAt" bson:"createdAt"`
+}
+
+// DriverLimit caps the liters allocated to a driver per day and per month, 0 leaves that period unlimited
+type DriverLimit struct {
+	// FuelType limits one fuel, empty limits all fuels together
+	FuelType string `json:"fuelType" bson:"fuelType"`
+	DailyLiters int `json:"dailyLiters" bson:"dailyLiters"`
+	MonthlyLiters int `json:"monthlyLiters" bson:"monthlyLiters"`
+}
+
+// Allocation records liters a manager handed to a driver
+type Allocation struct {
+	ID uuid.UUID `json:"id" bson:"_id"`
+	OrganizationID uuid.UUID `json:"organizationId" bson:"organizationId"`
+	DriverID uuid.UUID `json:"driverId" bson:"driverId"`
+	ManagerID uuid.UUID `json:"managerId" bson:"managerId"`
+	// SourceTicketID is the organization's ticket the liters came from, TicketID the driver's
+	SourceTicketID uuid.UUID `json:"sourceTicketId" bson:"sourceTicketId"`
+	TicketID uuid.UUID `json:"ticketId" bson:"ticketId"`
+	FuelType string `json:"fuelType" bson:"fuelType"`
+	Liters int `json:"liters" bson:"liters"`
+	CreatedAt int `json:"createdAt" bson:"createdAt"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import "github.com/google/uuid"
+
+// PriceVersion is one price of a product ticket. Versions are never edited, a price change adds a new one
+// that takes over at EffectiveFrom.
+type PriceVersion struct {
+	ID uuid.UUID `json:"id" bson:"_id"`
+	ProductTicketID uuid.UUID `json:"productTicketId" bson:"productTicketId"`
+	// Version counts up from 1 per product ticket
+	Version int `json:"version" bson:"version"`
+	// Price in minor units
+	Price int `json:"price" bson:"price"`
+	Currency string `json:"currency" bson:"currency"`
+	EffectiveFrom int `json:"effectiveFrom" bson:"effectiveFrom"`
+	// AppliedAt is 0 while the version is scheduled
+	AppliedAt int `json:"appliedAt" bson:"appliedAt"`
+	// StripePriceID is empty for the versions made from prices that existed before versioning
+	StripePriceID string `json:"stripePriceId" bson:"stripePriceId"`
+	CreatedAt int `json:"createdAt" bson:"createdAt"`
+}
@@ -22,4 +22,6 @@ type ProductTicket struct {
 	StripeID string `bson:"stripeProductId" json:"stripeProductId"`
 	Seller string `json:"seller" bson:"seller"`
 	FuelType string `json:"fuelType" bson:"fuelType"`
+	// PriceVersionID is the version Price and Currency were taken from
+	PriceVersionID uuid.UUID `json:"priceVersionId" bson:"priceVersionId"`
 }
\ No newline at end of file
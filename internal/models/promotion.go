@@ -0,0 +1,61 @@
+package models
+
+import "github.com/google/uuid"
+
+const (
+	// PROMOTION_PERCENT takes Value percent off the eligible items
+	PROMOTION_PERCENT = "PERCENT"
+	// PROMOTION_FIXED takes Value minor units of Currency off the eligible items
+	PROMOTION_FIXED = "FIXED"
+	// PROMOTION_BONUS_LITERS adds Value liters to a bought ticket, the price stays the same
+	PROMOTION_BONUS_LITERS = "BONUS_LITERS"
+
+	REDEMPTION_PENDING = "PENDING"
+	REDEMPTION_REDEEMED = "REDEEMED"
+	REDEMPTION_RELEASED = "RELEASED"
+)
+
+type Promotion struct {
+	ID uuid.UUID `json:"id" bson:"_id"`
+	// Code is what customers type, stored upper case
+	Code string `json:"code" bson:"code"`
+	Name string `json:"name" bson:"name"`
+	Type string `json:"type" bson:"type"`
+	Value int `json:"value" bson:"value"`
+	Currency string `json:"currency" bson:"currency"`
+	// StartsAt and EndsAt bound the validity window, 0 leaves that side open
+	StartsAt int `json:"startsAt" bson:"startsAt"`
+	EndsAt int `json:"endsAt" bson:"endsAt"`
+	// MaxRedemptions and MaxRedemptionsPerUser are unlimited when 0
+	MaxRedemptions int `json:"maxRedemptions" bson:"maxRedemptions"`
+	MaxRedemptionsPerUser int `json:"maxRedemptionsPerUser" bson:"maxRedemptionsPerUser"`
+	FirstPurchaseOnly bool `json:"firstPurchaseOnly" bson:"firstPurchaseOnly"`
+	// FuelTypes and Sellers limit the eligible product tickets, empty allows all
+	FuelTypes []string `json:"fuelTypes" bson:"fuelTypes"`
+	Sellers []string `json:"sellers" bson:"sellers"`
+	Redemptions int `json:"redemptions" bson:"redemptions"`
+	// Reserved counts the pending redemptions, they hold a place under MaxRedemptions until paid or released
+	Reserved int `json:"reserved" bson:"reserved"`
+	Active bool `json:"active" bson:"active"`
+	CreatedAt int `json:"createdAt" bson:"createdAt"`
+}
+
+// PromotionRedemption is a promotion used on a checkout, it counts once the checkout is paid
+type PromotionRedemption struct {
+	ID uuid.UUID `json:"id" bson:"_id"`
+	PromotionID uuid.UUID `json:"promotionId" bson:"promotionId"`
+	Code string `json:"code" bson:"code"`
+	UserID uuid.UUID `json:"userId" bson:"userId"`
+	CheckoutSessionID string `json:"checkoutSessionId" bson:"checkoutSessionId"`
+	// Discount in minor units of Currency
+	Discount int `json:"discount" bson:"discount"`
+	Currency string `json:"currency" bson:"currency"`
+	BonusLiters int `json:"bonusLiters" bson:"bonusLiters"`
+	// BonusProductTicketID is the product ticket whose ticket gets the bonus liters
+	BonusProductTicketID uuid.UUID `json:"bonusProductTicketId" bson:"bonusProductTicketId"`
+	Status string `json:"status" bson:"status"`
+	CreatedAt int `json:"createdAt" bson:"createdAt"`
+	// ExpiresAt is when a pending redemption is released, its checkout can no longer be paid by then
+	ExpiresAt int `json:"expiresAt" bson:"expiresAt"`
+	RedeemedAt int `json:"redeemedAt" bson:"redeemedAt"`
+}
@@ -0,0 +1,61 @@
+package models
+
+import "github.com/google/uuid"
+
+// Receipt is the accounting document of one payment, its Number runs without gaps per year
+type Receipt struct {
+	ID uuid.UUID `json:"id" bson:"_id"`
+	Number string `json:"number" bson:"number"`
+	UserID uuid.UUID `json:"userId" bson:"userId"`
+	OrganizationID uuid.UUID `json:"organizationId" bson:"organizationId"`
+	Buyer string `json:"buyer" bson:"buyer"`
+	// Reference is the payment the receipt is for, a provider payment id or a wallet transaction
+	Reference string `json:"reference" bson:"reference"`
+	CheckoutSessionID string `json:"checkoutSessionId" bson:"checkoutSessionId"`
+	Currency string `json:"currency" bson:"currency"`
+	Lines []ReceiptLine `json:"lines" bson:"lines"`
+	Sellers []SellerDetails `json:"sellers" bson:"sellers"`
+	VAT []VATLine `json:"vat" bson:"vat"`
+	Discount int `json:"discount" bson:"discount"`
+	// Total is what was paid, in minor units of Currency
+	Total int `json:"total" bson:"total"`
+	IssuedAt int `json:"issuedAt" bson:"issuedAt"`
+	RegeneratedAt int `json:"regeneratedAt" bson:"regeneratedAt"`
+	PDF []byte `json:"-" bson:"pdf"`
+}
+
+type ReceiptLine struct {
+	ProductTicketID uuid.UUID `json:"productTicketId" bson:"productTicketId"`
+	Title string `json:"title" bson:"title"`
+	Seller string `json:"seller" bson:"seller"`
+	FuelType string `json:"fuelType" bson:"fuelType"`
+	Quantity int `json:"quantity" bson:"quantity"`
+	// Liters per ticket
+	Liters int `json:"liters" bson:"liters"`
+	// UnitPrice and Gross include VAT, Discount is this line's share of the receipt discount
+	UnitPrice int `json:"unitPrice" bson:"unitPrice"`
+	Discount int `json:"discount" bson:"discount"`
+	Gross int `json:"gross" bson:"gross"`
+	VATRate int `json:"vatRate" bson:"vatRate"`
+	VAT int `json:"vat" bson:"vat"`
+}
+
+// VATLine sums the lines taxed at one rate, Net + VAT = Gross
+type VATLine struct {
+	Rate int `json:"rate" bson:"rate"`
+	Net int `json:"net" bson:"net"`
+	VAT int `json:"vat" bson:"vat"`
+	Gross int `json:"gross" bson:"gross"`
+}
+
+type SellerDetails struct {
+	Seller string `json:"seller" bson:"seller"`
+	Name string `json:"name" bson:"name"`
+	Address string `json:"address" bson:"address"`
+	// TaxID is the EDRPOU or individual tax number
+	TaxID string `json:"taxId" bson:"taxId"`
+	VATNumber string `json:"vatNumber" bson:"vatNumber"`
+	IBAN string `json:"iban" bson:"iban"`
+	// VATRate in percent, 0 for sellers that don't pay VAT
+	VATRate int `json:"vatRate" bson:"vatRate"`
+}
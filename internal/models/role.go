@@ -6,6 +6,7 @@ type Role struct {
 	ID uuid.UUID `json:"id" bson:"_id"`
 	Name string `json:"name" bson:"name"`
 	AuthorityLevel int `json:"authorityLevel" bson:"authorityLevel"`
+	RequireMFA bool `json:"requireMfa" bson:"requireMfa"`
 }
 
 type RoleFactory struct {
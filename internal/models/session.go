@@ -0,0 +1,15 @@
+package models
+
+import "github.com/google/uuid"
+
+// Session is one login of a user on a device. Access and refresh tokens carry its id in the "sid" claim.
+type Session struct {
+	ID uuid.UUID `json:"id" bson:"_id"`
+	UserID uuid.UUID `json:"userId" bson:"userId"`
+	DeviceName string `json:"deviceName" bson:"deviceName"`
+	IP string `json:"ip" bson:"ip"`
+	UserAgent string `json:"userAgent" bson:"userAgent"`
+	CreatedAt int `json:"createdAt" bson:"createdAt"`
+	LastSeenAt int `json:"lastSeenAt" bson:"lastSeenAt"`
+	RevokedAt int `json:"revokedAt" bson:"revokedAt"`
+}
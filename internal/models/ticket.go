@@ -6,6 +6,17 @@ const (
 	ACTIVATED = "ACTIVATED"
 	NOT_ACTIVATED = "NOT_ACTIVATED"
 	USED = "USED"
+	// REFUNDED tickets were paid back to the wallet and can't be used
+	REFUNDED = "REFUNDED"
+	// EXPIRED tickets were not used before ExpiresAt
+	EXPIRED = "EXPIRED"
+
+	TICKET_CREATED = "created"
+	TICKET_ACTIVATED = "activated"
+	TICKET_PARTIALLY_USED = "partially_used"
+	TICKET_USED = "used"
+	TICKET_EXPIRED = "expired"
+	TICKET_REFUNDED = "refunded"
 )
 
 type Ticket struct {
@@ -15,9 +26,31 @@ type Ticket struct {
 	secret string `bson:"secret"`
 	UserId uuid.UUID `bson:"userId" json:"userId"`
 	Status string `json:"status" bson:"status"`
+	// Amount is what is left on the ticket, Used what partial redemptions took off it
 	Amount int `json:"amount" bson:"amount"`
+	Used int `json:"used" bson:"used"`
 	PaymentID string `json:"paymentId" bson:"paymentId"`
 	ProductTicketID uuid.UUID `bson:"productTicketId" json:"productTicketId"`
+	CheckoutSessionID string `json:"checkoutSessionId" bson:"checkoutSessionId"`
+	// PriceVersionID is the price the ticket was bought at
+	PriceVersionID uuid.UUID `json:"priceVersionId" bson:"priceVersionId"`
+	// OrganizationID is set on tickets bought by a fleet account, DriverID once one was allocated to a driver
+	OrganizationID uuid.UUID `json:"organizationId" bson:"organizationId"`
+	DriverID uuid.UUID `json:"driverId" bson:"driverId"`
+	// Station is where the ticket was last redeemed
+	Station string `json:"station" bson:"station"`
+}
+
+// TicketEvent tells the holder of a ticket what happened to it
+type TicketEvent struct {
+	ID uuid.UUID `json:"id"`
+	Type string `json:"type"`
+	UserID uuid.UUID `json:"-"`
+	TicketID uuid.UUID `json:"ticketId"`
+	Status string `json:"status"`
+	Amount int `json:"amount"`
+	Used int `json:"used"`
+	At int `json:"at"`
 }
 
 func (t *Ticket) GetSecret() string {
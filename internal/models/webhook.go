@@ -0,0 +1,56 @@
+package models
+
+import "github.com/google/uuid"
+
+const (
+	WEBHOOK_TICKET_PURCHASED = "ticket.purchased"
+	WEBHOOK_TICKET_REDEEMED = "ticket.redeemed"
+	WEBHOOK_TICKET_REFUNDED = "ticket.refunded"
+	// WEBHOOK_PING is only sent by the test ping, endpoints can't subscribe to it
+	WEBHOOK_PING = "ping"
+
+	DELIVERY_PENDING = "PENDING"
+	DELIVERY_DELIVERED = "DELIVERED"
+	// DELIVERY_DEAD deliveries ran out of attempts and wait for a manual redelivery
+	DELIVERY_DEAD = "DEAD"
+)
+
+var WebhookEventTypes = []string{WEBHOOK_TICKET_PURCHASED, WEBHOOK_TICKET_REDEEMED, WEBHOOK_TICKET_REFUNDED}
+
+// WebhookEndpoint is a URL of a seller's system that is told about the events it subscribed to
+type WebhookEndpoint struct {
+	ID uuid.UUID `json:"id" bson:"_id"`
+	Seller string `json:"seller" bson:"seller"`
+	URL string `json:"url" bson:"url"`
+	// Secret signs the deliveries, it is shown once when the endpoint is created or the secret rotated
+	Secret string `json:"-" bson:"secret"`
+	Events []string `json:"events" bson:"events"`
+	Active bool `json:"active" bson:"active"`
+	CreatedAt int `json:"createdAt" bson:"createdAt"`
+	UpdatedAt int `json:"updatedAt" bson:"updatedAt"`
+}
+
+// WebhookDelivery is one event queued for one endpoint
+type WebhookDelivery struct {
+	ID uuid.UUID `json:"id" bson:"_id"`
+	EndpointID uuid.UUID `json:"endpointId" bson:"endpointId"`
+	Seller string `json:"seller" bson:"seller"`
+	Event string `json:"event" bson:"event"`
+	// IdempotencyKey is the same for every attempt and redelivery of an event, receivers dedupe on it
+	IdempotencyKey string `json:"idempotencyKey" bson:"idempotencyKey"`
+	Payload string `json:"payload" bson:"payload"`
+	Status string `json:"status" bson:"status"`
+	// Tries counts the attempts since the delivery was queued, a redelivery starts over while Attempts keeps the log
+	Tries int `json:"tries" bson:"tries"`
+	Attempts []WebhookAttempt `json:"attempts" bson:"attempts"`
+	NextAttemptAt int `json:"nextAttemptAt" bson:"nextAttemptAt"`
+	CreatedAt int `json:"createdAt" bson:"createdAt"`
+	DeliveredAt int `json:"deliveredAt" bson:"deliveredAt"`
+}
+
+type WebhookAttempt struct {
+	At int `json:"at" bson:"at"`
+	StatusCode int `json:"statusCode" bson:"statusCode"`
+	Error string `json:"error" bson:"error"`
+	DurationMs int `json:"durationMs" bson:"durationMs"`
+}
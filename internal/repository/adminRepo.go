@@ -9,11 +9,12 @@ import (
 )
 
 type AdminRepo interface {
-	GetAllRoles() ([]models.Role, error)
-	SaveRole(role models.Role) error
-	DeleteRoleByID(roleID uuid.UUID) error
-	GetRoleByID(uuid2 uuid.UUID) (models.Role, error)
-	GetRoleByName(string) (models.Role, error)
+	GetAllRoles(c context.Context) ([]models.Role, error)
+	SaveRole(c context.Context, role models.Role) error
+	DeleteRoleByID(c context.Context, roleID uuid.UUID) error
+	GetRoleByID(c context.Context, uuid2 uuid.UUID) (models.Role, error)
+	GetRoleByName(c context.Context, name string) (models.Role, error)
+	UpdateRoleMFAPolicy(c context.Context, roleID uuid.UUID, required bool) error
 }
 
 func NewAdminRepo() AdminRepo {
@@ -24,22 +25,21 @@ type defaultAdminRepo struct {
 
 }
 
-func (d *defaultAdminRepo) GetRoleByName(name string) (models.Role, error) {
+func (d *defaultAdminRepo) GetRoleByName(c context.Context, name string) (models.Role, error) {
 	var role models.Role
 	roleCollection := tools.DB.Collection("roles")
-	err := roleCollection.FindOne(context.TODO(), bson.M{"name":name}).Decode(&role)
+	err := roleCollection.FindOne(c, bson.M{"name":name}).Decode(&role)
 	if err != nil {
 		return models.Role{}, err
 	}
 	return role, nil
 }
 
-func (d *defaultAdminRepo) GetAllRoles() ([]models.Role, error) {
+func (d *defaultAdminRepo) GetAllRoles(c context.Context) ([]models.Role, error) {
 	var roles []models.Role
 	roleCollection := tools.DB.Collection("roles")
-	ctx := context.Background()
-	cursor, err := roleCollection.Find(ctx, bson.M{})
-	defer cursor.Close(ctx)
+	cursor, err := roleCollection.Find(c, bson.M{})
+	defer cursor.Close(c)
 	if err != nil {
 		return nil, err
 	}
@@ -47,7 +47,7 @@ func (d *defaultAdminRepo) GetAllRoles() ([]models.Role, error) {
 		return nil, cursor.Err()
 	}
 
-	for cursor.Next(ctx) {
+	for cursor.Next(c) {
 		var role models.Role
 		if err := cursor.Decode(&role);err!=nil {
 			return nil, err
@@ -58,24 +58,30 @@ func (d *defaultAdminRepo) GetAllRoles() ([]models.Role, error) {
 
 }
 
-func (d *defaultAdminRepo) SaveRole(role models.Role) error {
+func (d *defaultAdminRepo) SaveRole(c context.Context, role models.Role) error {
 	roleCollection := tools.DB.Collection("roles")
-	_, err := roleCollection.InsertOne(context.TODO(), role)
+	_, err := roleCollection.InsertOne(c, role)
 	return err
 }
 
-func (d *defaultAdminRepo) DeleteRoleByID(roleID uuid.UUID) error {
+func (d *defaultAdminRepo) DeleteRoleByID(c context.Context, roleID uuid.UUID) error {
 	roleCollection := tools.DB.Collection("roles")
-	_,err := roleCollection.DeleteOne(context.TODO(), bson.M{"_id":roleID})
+	_,err := roleCollection.DeleteOne(c, bson.M{"_id":roleID})
 	return err
 }
 
-func (d *defaultAdminRepo) GetRoleByID(uuid2 uuid.UUID) (models.Role, error) {
+func (d *defaultAdminRepo) GetRoleByID(c context.Context, uuid2 uuid.UUID) (models.Role, error) {
 	var role models.Role
 	roleCollection := tools.DB.Collection("roles")
-	err := roleCollection.FindOne(context.TODO(), bson.M{"_id":uuid2}).Decode(&role)
+	err := roleCollection.FindOne(c, bson.M{"_id":uuid2}).Decode(&role)
 	if err != nil {
 		return models.Role{}, err
 	}
 	return role, nil
 }
+
+func (d *defaultAdminRepo) UpdateRoleMFAPolicy(c context.Context, roleID uuid.UUID, required bool) error {
+	roleCollection := tools.DB.Collection("roles")
+	_, err := roleCollection.UpdateByID(c, roleID, bson.M{"$set": bson.M{"requireMfa": required}})
+	return err
+}
@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"palyvoua/internal/models"
+	"palyvoua/tools"
+)
+
+type APIKeyRepo interface {
+	Save(c context.Context, key *models.APIKey) error
+	GetByHash(c context.Context, hash string) (models.APIKey, error)
+	GetAll(c context.Context) ([]models.APIKey, error)
+	Revoke(c context.Context, id uuid.UUID, revokedAt int) error
+	UpdateLastUsed(c context.Context, id uuid.UUID, lastUsedAt int) error
+}
+
+func NewAPIKeyRepo() APIKeyRepo {
+	repo := defaultAPIKeyRepo{}
+	repo.localCollection = tools.DB.Collection("apiKeys")
+	return &repo
+}
+
+type defaultAPIKeyRepo struct {
+	localCollection *mongo.Collection
+}
+
+func (d *defaultAPIKeyRepo) Save(c context.Context, key *models.APIKey) error {
+	_, err := d.localCollection.InsertOne(c, *key)
+	return err
+}
+
+func (d *defaultAPIKeyRepo) GetByHash(c context.Context, hash string) (models.APIKey, error) {
+	var key models.APIKey
+	err := d.localCollection.FindOne(c, bson.M{"hash": hash}).Decode(&key)
+	if err != nil {
+		return models.APIKey{}, err
+	}
+	return key, nil
+}
+
+func (d *defaultAPIKeyRepo) GetAll(c context.Context) ([]models.APIKey, error) {
+	var keys []models.APIKey
+	cursor, err := d.localCollection.Find(c, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+	for cursor.Next(c) {
+		var key models.APIKey
+		if err = cursor.Decode(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, cursor.Err()
+}
+
+func (d *defaultAPIKeyRepo) Revoke(c context.Context, id uuid.UUID, revokedAt int) error {
+	res, err := d.localCollection.UpdateByID(c, id, bson.M{"$set": bson.M{"revokedAt": revokedAt}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+func (d *defaultAPIKeyRepo) UpdateLastUsed(c context.Context, id uuid.UUID, lastUsedAt int) error {
+	_, err := d.localCollection.UpdateByID(c, id, bson.M{"$set": bson.M{"lastUsedAt": lastUsedAt}})
+	return err
+}
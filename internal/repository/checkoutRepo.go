@@ -0,0 +1,52 @@
+package repository
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"palyvoua/internal/models"
+	"palyvoua/tools"
+)
+
+type CheckoutRepo interface {
+	Save(c context.Context, checkout *models.Checkout) error
+	GetByID(c context.Context, id string) (models.Checkout, error)
+	// UpdateStatus settles a pending checkout, false when it was settled before
+	UpdateStatus(c context.Context, id string, status string, paymentID string, updatedAt int) (bool, error)
+}
+
+func NewCheckoutRepo() CheckoutRepo {
+	repo := defaultCheckoutRepo{}
+	repo.localCollection = tools.DB.Collection("checkouts")
+	return &repo
+}
+
+type defaultCheckoutRepo struct {
+	localCollection *mongo.Collection
+}
+
+func (d *defaultCheckoutRepo) Save(c context.Context, checkout *models.Checkout) error {
+	_, err := d.localCollection.InsertOne(c, *checkout)
+	return err
+}
+
+func (d *defaultCheckoutRepo) GetByID(c context.Context, id string) (models.Checkout, error) {
+	var checkout models.Checkout
+	err := d.localCollection.FindOne(c, bson.M{"_id": id}).Decode(&checkout)
+	if err != nil {
+		return models.Checkout{}, err
+	}
+	return checkout, nil
+}
+
+func (d *defaultCheckoutRepo) UpdateStatus(c context.Context, id string, status string, paymentID string, updatedAt int) (bool, error) {
+	res, err := d.localCollection.UpdateOne(c, bson.M{"_id": id, "status": models.CHECKOUT_PENDING}, bson.M{"$set": bson.M{
+		"status":    status,
+		"paymentId": paymentID,
+		"updatedAt": updatedAt,
+	}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
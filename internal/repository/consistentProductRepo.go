@@ -6,6 +6,7 @@ import (
 	"github.com/google/uuid"
 	"palyvoua/internal/models"
 	"palyvoua/tools"
+	"palyvoua/tools/metrics"
 )
 
 func NewConsistentProductRepo() ProductRepo {
@@ -22,24 +23,26 @@ func (cpr *consistentProductRepo) SetProductTicketRepo(repo ProductTicketRepo) {
 
 func (cpr *consistentProductRepo) UpdateProductStripeID(c context.Context, pID uuid.UUID, newStripeID string) error {
 	var err error
-	stmt, err := tools.RelationalDB.Prepare("update products set stripe_id = $1 where id = $2")
+	defer metrics.ObserveQuery(metrics.DB_POSTGRES, &err)()
+	stmt, err := tools.RelationalDB.PrepareContext(c, "update products set stripe_id = $1 where id = $2")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
-	_,err = stmt.Exec(newStripeID, pID)
+	_,err = stmt.ExecContext(c, newStripeID, pID)
 	return err
 }
 
 func (cpr *consistentProductRepo) GetByFuelType(c context.Context, fuelType string) ([]models.Product, error) {
 	var products []models.Product
 	var err error
-	stmt, err := tools.RelationalDB.Prepare("select * from products where fuel_type = $1")
+	defer metrics.ObserveQuery(metrics.DB_POSTGRES, &err)()
+	stmt, err := tools.RelationalDB.PrepareContext(c, "select * from products where fuel_type = $1")
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
-	rows,err := stmt.Query(fuelType)
+	rows,err := stmt.QueryContext(c, fuelType)
 	if err != nil {
 		return nil, err
 	}
@@ -61,12 +64,13 @@ func (cpr *consistentProductRepo) GetByFuelType(c context.Context, fuelType stri
 func (cpr *consistentProductRepo) GetBySeller(c context.Context, seller string) ([]models.Product, error) {
 	var products []models.Product
 	var err error
-	stmt, err := tools.RelationalDB.Prepare("select * from products where seller = $1")
+	defer metrics.ObserveQuery(metrics.DB_POSTGRES, &err)()
+	stmt, err := tools.RelationalDB.PrepareContext(c, "select * from products where seller = $1")
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
-	rows,err := stmt.Query(seller)
+	rows,err := stmt.QueryContext(c, seller)
 	if err != nil {
 		return nil, err
 	}
@@ -88,12 +92,13 @@ func (cpr *consistentProductRepo) GetBySeller(c context.Context, seller string)
 func (cpr *consistentProductRepo) GetBySellerAndFuelType(c context.Context, seller string, fuelType string) ([]models.Product, error) {
 	var products []models.Product
 	var err error
-	stmt, err := tools.RelationalDB.Prepare("select * from products where seller = $1 and fuel_type = $2")
+	defer metrics.ObserveQuery(metrics.DB_POSTGRES, &err)()
+	stmt, err := tools.RelationalDB.PrepareContext(c, "select * from products where seller = $1 and fuel_type = $2")
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
-	rows,err := stmt.Query(seller, fuelType)
+	rows,err := stmt.QueryContext(c, seller, fuelType)
 	if err != nil {
 		return nil, err
 	}
@@ -115,12 +120,13 @@ func (cpr *consistentProductRepo) GetBySellerAndFuelType(c context.Context, sell
 func (cpr *consistentProductRepo) GetAllProducts(c context.Context) ([]models.Product, error) {
 	var products []models.Product
 	var err error
-	stmt, err := tools.RelationalDB.Prepare("select * from products")
+	defer metrics.ObserveQuery(metrics.DB_POSTGRES, &err)()
+	stmt, err := tools.RelationalDB.PrepareContext(c, "select * from products")
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
-	rows,err := stmt.Query()
+	rows,err := stmt.QueryContext(c)
 	if err != nil {
 		return nil, err
 	}
@@ -141,24 +147,26 @@ func (cpr *consistentProductRepo) GetAllProducts(c context.Context) ([]models.Pr
 
 func (cpr *consistentProductRepo) UpdateProductAmount(c context.Context, pid uuid.UUID, amount int) error {
 	var err error
-	stmt, err := tools.RelationalDB.Prepare("update products set amount = $1 where id = $2")
+	defer metrics.ObserveQuery(metrics.DB_POSTGRES, &err)()
+	stmt, err := tools.RelationalDB.PrepareContext(c, "update products set amount = $1 where id = $2")
 	if err != nil {
 		return err
 	}
-	err = stmt.QueryRow(amount, pid.String()).Err()
+	err = stmt.QueryRowContext(c, amount, pid.String()).Err()
 	return err
 }
 
 func (cpr *consistentProductRepo) DeleteProduct(c context.Context, pid uuid.UUID) error {
 	var err error
+	defer metrics.ObserveQuery(metrics.DB_POSTGRES, &err)()
 	tx, err := tools.RelationalDB.BeginTx(c, &sql.TxOptions{Isolation: sql.LevelSerializable})
 
-	stmt, err := tx.Prepare("delete from products where id = $1")
+	stmt, err := tx.PrepareContext(c, "delete from products where id = $1")
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
-	err = stmt.QueryRow(pid.String()).Err()
+	err = stmt.QueryRowContext(c, pid.String()).Err()
 	if err !=nil {
 		tx.Rollback()
 		return err
@@ -174,19 +182,21 @@ func (cpr *consistentProductRepo) DeleteProduct(c context.Context, pid uuid.UUID
 
 func (cpr *consistentProductRepo) DecreaseProductAmount(c context.Context, pid uuid.UUID, amount int) error {
 	//TODO implement me
+	var err error
+	defer metrics.ObserveQuery(metrics.DB_POSTGRES, &err)()
 
 	tx, err := tools.RelationalDB.BeginTx(c, &sql.TxOptions{Isolation: sql.LevelSerializable})
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
-	getProductStmt, err := tx.Prepare("SELECT id, amount, title from products where id = $1")
+	getProductStmt, err := tx.PrepareContext(c, "SELECT id, amount, title from products where id = $1")
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 	p := models.Product{}
-	err = getProductStmt.QueryRow(pid.String()).Scan(&p.ID, &p.Amount, &p.Title)
+	err = getProductStmt.QueryRowContext(c, pid.String()).Scan(&p.ID, &p.Amount, &p.Title)
 	if err != nil {
 		tx.Rollback()
 		return err
@@ -194,12 +204,12 @@ func (cpr *consistentProductRepo) DecreaseProductAmount(c context.Context, pid u
 
 	newAmount := p.Amount - amount
 
-	updateProductStmt, err := tx.Prepare("UPDATE products SET amount = $1 WHERE id = $2")
+	updateProductStmt, err := tx.PrepareContext(c, "UPDATE products SET amount = $1 WHERE id = $2")
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
-	_, err = updateProductStmt.Exec(newAmount, p.ID)
+	_, err = updateProductStmt.ExecContext(c, newAmount, p.ID)
 
 	err = tx.Commit()
 	if err != nil {
@@ -211,13 +221,14 @@ func (cpr *consistentProductRepo) DecreaseProductAmount(c context.Context, pid u
 
 func (cpr *consistentProductRepo) GetProduct(c context.Context, pid uuid.UUID) (models.Product, error) {
 	var err error
+	defer metrics.ObserveQuery(metrics.DB_POSTGRES, &err)()
 	p := models.Product{}
-	stmt, err := tools.RelationalDB.Prepare("select id, amount, title, currency,price, seller, fuel_type from products where id = $1")
+	stmt, err := tools.RelationalDB.PrepareContext(c, "select id, amount, title, currency,price, seller, fuel_type from products where id = $1")
 	if err != nil {
 		return models.Product{}, err
 	}
 	var stringID string
-	err = stmt.QueryRow(pid.String()).Scan(&stringID, &p.Amount, &p.Title, &p.Currency, &p.Price, &p.Seller, &p.FuelType)
+	err = stmt.QueryRowContext(c, pid.String()).Scan(&stringID, &p.Amount, &p.Title, &p.Currency, &p.Price, &p.Seller, &p.FuelType)
 	if err != nil {
 		return models.Product{}, err
 	}
@@ -230,11 +241,12 @@ func (cpr *consistentProductRepo) GetProduct(c context.Context, pid uuid.UUID) (
 
 func (cpr *consistentProductRepo) SaveProduct(c context.Context, p *models.Product) error {
 	var err error
-	stmt, err := tools.RelationalDB.Prepare("insert into products (amount, id, title, price, currency, seller, fuel_type) values ($1, $2, $3, $4, $5, $6, $7)")
+	defer metrics.ObserveQuery(metrics.DB_POSTGRES, &err)()
+	stmt, err := tools.RelationalDB.PrepareContext(c, "insert into products (amount, id, title, price, currency, seller, fuel_type) values ($1, $2, $3, $4, $5, $6, $7)")
 	if err != nil {
 		return err
 	}
-	err = stmt.QueryRow(p.Amount, p.ID.String(), p.Title, p.Price, p.Currency, p.Seller, p.FuelType).Err()
+	err = stmt.QueryRowContext(c, p.Amount, p.ID.String(), p.Title, p.Price, p.Currency, p.Seller, p.FuelType).Err()
 	return err
 }
 
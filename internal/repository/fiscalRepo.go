@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"palyvoua/internal/models"
+	"palyvoua/tools"
+)
+
+type FiscalRepo interface {
+	Save(c context.Context, document *models.FiscalDocument) error
+	GetByID(c context.Context, id uuid.UUID) (models.FiscalDocument, error)
+	GetByReference(c context.Context, reference string) (models.FiscalDocument, error)
+	GetByStatus(c context.Context, status string, limit int) ([]models.FiscalDocument, error)
+	// ClaimDue takes pending and offline documents whose next attempt is due, oldest first,
+	// and moves their next attempt to until so no other instance picks them up meanwhile
+	ClaimDue(c context.Context, now int, until int, limit int) ([]models.FiscalDocument, error)
+	Update(c context.Context, document *models.FiscalDocument) error
+}
+
+func NewFiscalRepo() FiscalRepo {
+	repo := defaultFiscalRepo{}
+	repo.localCollection = tools.DB.Collection("fiscalDocuments")
+	return &repo
+}
+
+type defaultFiscalRepo struct {
+	localCollection *mongo.Collection
+}
+
+func (d *defaultFiscalRepo) Save(c context.Context, document *models.FiscalDocument) error {
+	_, err := d.localCollection.InsertOne(c, *document)
+	return err
+}
+
+func (d *defaultFiscalRepo) GetByID(c context.Context, id uuid.UUID) (models.FiscalDocument, error) {
+	var document models.FiscalDocument
+	err := d.localCollection.FindOne(c, bson.M{"_id": id}).Decode(&document)
+	if err != nil {
+		return models.FiscalDocument{}, err
+	}
+	return document, nil
+}
+
+func (d *defaultFiscalRepo) GetByReference(c context.Context, reference string) (models.FiscalDocument, error) {
+	var document models.FiscalDocument
+	err := d.localCollection.FindOne(c, bson.M{"reference": reference}).Decode(&document)
+	if err != nil {
+		return models.FiscalDocument{}, err
+	}
+	return document, nil
+}
+
+func (d *defaultFiscalRepo) find(c context.Context, filter bson.M, limit int) ([]models.FiscalDocument, error) {
+	documents := []models.FiscalDocument{}
+	cursor, err := d.localCollection.Find(c, filter, options.Find().SetSort(bson.M{"createdAt": 1}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+	if err = cursor.All(c, &documents); err != nil {
+		return nil, err
+	}
+	return documents, nil
+}
+
+func (d *defaultFiscalRepo) GetByStatus(c context.Context, status string, limit int) ([]models.FiscalDocument, error) {
+	return d.find(c, bson.M{"status": status}, limit)
+}
+
+func (d *defaultFiscalRepo) ClaimDue(c context.Context, now int, until int, limit int) ([]models.FiscalDocument, error) {
+	documents := []models.FiscalDocument{}
+	filter := bson.M{
+		"status":        bson.M{"$in": bson.A{models.FISCAL_PENDING, models.FISCAL_OFFLINE}},
+		"nextAttemptAt": bson.M{"$lte": now},
+	}
+	update := bson.M{"$set": bson.M{"nextAttemptAt": until}}
+	claimOptions := options.FindOneAndUpdate().SetSort(bson.M{"createdAt": 1}).SetReturnDocument(options.After)
+	for len(documents) < limit {
+		var document models.FiscalDocument
+		err := d.localCollection.FindOneAndUpdate(c, filter, update, claimOptions).Decode(&document)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			break
+		}
+		if err != nil {
+			return documents, err
+		}
+		documents = append(documents, document)
+	}
+	return documents, nil
+}
+
+func (d *defaultFiscalRepo) Update(c context.Context, document *models.FiscalDocument) error {
+	_, err := d.localCollection.ReplaceOne(c, bson.M{"_id": document.ID}, *document)
+	return err
+}
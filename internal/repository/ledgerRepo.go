@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"palyvoua/internal/models"
+	"palyvoua/tools"
+)
+
+// ErrInsufficientBalance is returned when a debit would take an account below zero
+var ErrInsufficientBalance = errors.New("insufficient balance")
+
+type LedgerRepo interface {
+	GetAccount(c context.Context, id string) (models.LedgerAccount, error)
+	// ApplyEntry changes the balance of an account and returns the new one, creating the account on first
+	// use. Unless allowNegative is set a debit larger than the balance fails with ErrInsufficientBalance,
+	// checked and applied in one update so concurrent debits can't overdraw.
+	ApplyEntry(c context.Context, account models.LedgerAccount, amount int, allowNegative bool, now int) (int, error)
+	SaveTransaction(c context.Context, transaction *models.LedgerTransaction) error
+	GetTransactionByKey(c context.Context, idempotencyKey string) (models.LedgerTransaction, error)
+	// GetByAccountID returns the transactions of an account, newest first, created before the given time when it isn't 0
+	GetByAccountID(c context.Context, accountID string, before int, limit int) ([]models.LedgerTransaction, error)
+}
+
+func NewLedgerRepo() LedgerRepo {
+	repo := defaultLedgerRepo{}
+	repo.localCollection = tools.DB.Collection("ledgerTransactions")
+	repo.accountCollection = tools.DB.Collection("ledgerAccounts")
+	return &repo
+}
+
+type defaultLedgerRepo struct {
+	localCollection *mongo.Collection
+	accountCollection *mongo.Collection
+}
+
+func (d *defaultLedgerRepo) GetAccount(c context.Context, id string) (models.LedgerAccount, error) {
+	var account models.LedgerAccount
+	err := d.accountCollection.FindOne(c, bson.M{"_id": id}).Decode(&account)
+	if err != nil {
+		return models.LedgerAccount{}, err
+	}
+	return account, nil
+}
+
+func (d *defaultLedgerRepo) ApplyEntry(c context.Context, account models.LedgerAccount, amount int, allowNegative bool, now int) (int, error) {
+	filter := bson.M{"_id": account.ID}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if amount < 0 && !allowNegative {
+		// an account that doesn't exist yet has nothing to debit, so no upsert here
+		filter["balance"] = bson.M{"$gte": -amount}
+	} else {
+		opts.SetUpsert(true)
+	}
+	update := bson.M{
+		"$inc": bson.M{"balance": amount},
+		"$set": bson.M{"updatedAt": now},
+		"$setOnInsert": bson.M{
+			"kind":     account.Kind,
+			"userId":   account.UserID,
+			"currency": account.Currency,
+		},
+	}
+	var updated models.LedgerAccount
+	err := d.accountCollection.FindOneAndUpdate(c, filter, update, opts).Decode(&updated)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, ErrInsufficientBalance
+	}
+	if err != nil {
+		return 0, err
+	}
+	return updated.Balance, nil
+}
+
+func (d *defaultLedgerRepo) SaveTransaction(c context.Context, transaction *models.LedgerTransaction) error {
+	_, err := d.localCollection.InsertOne(c, *transaction)
+	return err
+}
+
+func (d *defaultLedgerRepo) GetTransactionByKey(c context.Context, idempotencyKey string) (models.LedgerTransaction, error) {
+	var transaction models.LedgerTransaction
+	err := d.localCollection.FindOne(c, bson.M{"idempotencyKey": idempotencyKey}).Decode(&transaction)
+	if err != nil {
+		return models.LedgerTransaction{}, err
+	}
+	return transaction, nil
+}
+
+func (d *defaultLedgerRepo) GetByAccountID(c context.Context, accountID string, before int, limit int) ([]models.LedgerTransaction, error) {
+	transactions := []models.LedgerTransaction{}
+	filter := bson.M{"entries.accountId": accountID}
+	if before != 0 {
+		filter["createdAt"] = bson.M{"$lt": before}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(int64(limit))
+	cursor, err := d.localCollection.Find(c, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+	if err = cursor.All(c, &transactions); err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
+
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"palyvoua/internal/models"
+	"palyvoua/tools"
+)
+
+type NotificationRepo interface {
+	SaveAll(c context.Context, notifications []models.Notification) error
+	ExistsByKey(c context.Context, key string) (bool, error)
+	// GetDue returns pending notifications whose attempt is due, oldest first
+	GetDue(c context.Context, now int, limit int) ([]models.Notification, error)
+	Update(c context.Context, notification *models.Notification) error
+}
+
+func NewNotificationRepo() NotificationRepo {
+	repo := defaultNotificationRepo{}
+	repo.localCollection = tools.DB.Collection("notifications")
+	return &repo
+}
+
+type defaultNotificationRepo struct {
+	localCollection *mongo.Collection
+}
+
+func (d *defaultNotificationRepo) SaveAll(c context.Context, notifications []models.Notification) error {
+	if len(notifications) == 0 {
+		return nil
+	}
+	documents := make([]interface{}, len(notifications))
+	for i := range notifications {
+		documents[i] = notifications[i]
+	}
+	_, err := d.localCollection.InsertMany(c, documents)
+	return err
+}
+
+func (d *defaultNotificationRepo) ExistsByKey(c context.Context, key string) (bool, error) {
+	count, err := d.localCollection.CountDocuments(c, bson.M{"key": key}, options.Count().SetLimit(1))
+	return count > 0, err
+}
+
+func (d *defaultNotificationRepo) GetDue(c context.Context, now int, limit int) ([]models.Notification, error) {
+	notifications := []models.Notification{}
+	filter := bson.M{"status": models.NOTIFICATION_PENDING, "nextAttemptAt": bson.M{"$lte": now}}
+	cursor, err := d.localCollection.Find(c, filter, options.Find().SetSort(bson.M{"createdAt": 1}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+	if err = cursor.All(c, &notifications); err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
+
+func (d *defaultNotificationRepo) Update(c context.Context, notification *models.Notification) error {
+	_, err := d.localCollection.ReplaceOne(c, bson.M{"_id": notification.ID}, *notification)
+	return err
+}
@@ -0,0 +1,161 @@
+package repository
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"palyvoua/internal/models"
+	"palyvoua/tools"
+)
+
+type OrganizationRepo interface {
+	Save(c context.Context, organization *models.Organization) error
+	GetByID(c context.Context, id uuid.UUID) (models.Organization, error)
+	GetByCustomerID(c context.Context, customerID string) (models.Organization, error)
+	SaveMember(c context.Context, member *models.OrganizationMember) error
+	GetMember(c context.Context, organizationID uuid.UUID, userID uuid.UUID) (models.OrganizationMember, error)
+	GetMembers(c context.Context, organizationID uuid.UUID) ([]models.OrganizationMember, error)
+	GetMembershipsByUserID(c context.Context, userID uuid.UUID) ([]models.OrganizationMember, error)
+	DeleteMember(c context.Context, organizationID uuid.UUID, userID uuid.UUID) error
+	UpdateLimits(c context.Context, memberID uuid.UUID, limits []models.DriverLimit) error
+	// LockMember writes to the member so concurrent transactions on the same driver conflict
+	LockMember(c context.Context, memberID uuid.UUID) error
+	SaveAllocation(c context.Context, allocation *models.Allocation) error
+	// SumAllocated adds up the liters given to a driver since a time, an empty fuelType counts every fuel
+	SumAllocated(c context.Context, organizationID uuid.UUID, driverID uuid.UUID, fuelType string, since int) (int, error)
+	// GetAllocations returns the allocations made in [from, to), to 0 leaves the end open
+	GetAllocations(c context.Context, organizationID uuid.UUID, from int, to int) ([]models.Allocation, error)
+}
+
+func NewOrganizationRepo() OrganizationRepo {
+	repo := defaultOrganizationRepo{}
+	repo.localCollection = tools.DB.Collection("organizations")
+	repo.memberCollection = tools.DB.Collection("organizationMembers")
+	repo.allocationCollection = tools.DB.Collection("allocations")
+	return &repo
+}
+
+type defaultOrganizationRepo struct {
+	localCollection *mongo.Collection
+	memberCollection *mongo.Collection
+	allocationCollection *mongo.Collection
+}
+
+func (d *defaultOrganizationRepo) Save(c context.Context, organization *models.Organization) error {
+	_, err := d.localCollection.InsertOne(c, *organization)
+	return err
+}
+
+func (d *defaultOrganizationRepo) GetByID(c context.Context, id uuid.UUID) (models.Organization, error) {
+	var organization models.Organization
+	err := d.localCollection.FindOne(c, bson.M{"_id": id}).Decode(&organization)
+	if err != nil {
+		return models.Organization{}, err
+	}
+	return organization, nil
+}
+
+func (d *defaultOrganizationRepo) GetByCustomerID(c context.Context, customerID string) (models.Organization, error) {
+	var organization models.Organization
+	err := d.localCollection.FindOne(c, bson.M{"customerId": customerID}).Decode(&organization)
+	if err != nil {
+		return models.Organization{}, err
+	}
+	return organization, nil
+}
+
+func (d *defaultOrganizationRepo) SaveMember(c context.Context, member *models.OrganizationMember) error {
+	_, err := d.memberCollection.InsertOne(c, *member)
+	return err
+}
+
+func (d *defaultOrganizationRepo) GetMember(c context.Context, organizationID uuid.UUID, userID uuid.UUID) (models.OrganizationMember, error) {
+	var member models.OrganizationMember
+	err := d.memberCollection.FindOne(c, bson.M{"organizationId": organizationID, "userId": userID}).Decode(&member)
+	if err != nil {
+		return models.OrganizationMember{}, err
+	}
+	return member, nil
+}
+
+func (d *defaultOrganizationRepo) findMembers(c context.Context, filter bson.M) ([]models.OrganizationMember, error) {
+	members := []models.OrganizationMember{}
+	cursor, err := d.memberCollection.Find(c, filter, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+	if err = cursor.All(c, &members); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (d *defaultOrganizationRepo) GetMembers(c context.Context, organizationID uuid.UUID) ([]models.OrganizationMember, error) {
+	return d.findMembers(c, bson.M{"organizationId": organizationID})
+}
+
+func (d *defaultOrganizationRepo) GetMembershipsByUserID(c context.Context, userID uuid.UUID) ([]models.OrganizationMember, error) {
+	return d.findMembers(c, bson.M{"userId": userID})
+}
+
+func (d *defaultOrganizationRepo) DeleteMember(c context.Context, organizationID uuid.UUID, userID uuid.UUID) error {
+	_, err := d.memberCollection.DeleteOne(c, bson.M{"organizationId": organizationID, "userId": userID})
+	return err
+}
+
+func (d *defaultOrganizationRepo) UpdateLimits(c context.Context, memberID uuid.UUID, limits []models.DriverLimit) error {
+	_, err := d.memberCollection.UpdateByID(c, memberID, bson.M{"$set": bson.M{"limits": limits}})
+	return err
+}
+
+func (d *defaultOrganizationRepo) LockMember(c context.Context, memberID uuid.UUID) error {
+	_, err := d.memberCollection.UpdateByID(c, memberID, bson.M{"$inc": bson.M{"allocations": 1}})
+	return err
+}
+
+func (d *defaultOrganizationRepo) SaveAllocation(c context.Context, allocation *models.Allocation) error {
+	_, err := d.allocationCollection.InsertOne(c, *allocation)
+	return err
+}
+
+func (d *defaultOrganizationRepo) SumAllocated(c context.Context, organizationID uuid.UUID, driverID uuid.UUID, fuelType string, since int) (int, error) {
+	match := bson.M{"organizationId": organizationID, "driverId": driverID, "createdAt": bson.M{"$gte": since}}
+	if fuelType != "" {
+		match["fuelType"] = fuelType
+	}
+	cursor, err := d.allocationCollection.Aggregate(c, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "liters": bson.M{"$sum": "$liters"}}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(c)
+	var res []struct {
+		Liters int `bson:"liters"`
+	}
+	if err = cursor.All(c, &res); err != nil || len(res) == 0 {
+		return 0, err
+	}
+	return res[0].Liters, nil
+}
+
+func (d *defaultOrganizationRepo) GetAllocations(c context.Context, organizationID uuid.UUID, from int, to int) ([]models.Allocation, error) {
+	allocations := []models.Allocation{}
+	createdAt := bson.M{"$gte": from}
+	if to != 0 {
+		createdAt["$lt"] = to
+	}
+	cursor, err := d.allocationCollection.Find(c, bson.M{"organizationId": organizationID, "createdAt": createdAt}, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+	if err = cursor.All(c, &allocations); err != nil {
+		return nil, err
+	}
+	return allocations, nil
+}
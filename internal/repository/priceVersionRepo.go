@@ -0,0 +1,87 @@
+package repository
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"palyvoua/internal/models"
+	"palyvoua/tools"
+)
+
+type PriceVersionRepo interface {
+	Save(c context.Context, version *models.PriceVersion) error
+	GetByID(c context.Context, id uuid.UUID) (models.PriceVersion, error)
+	// GetByProductTicketID returns the history, oldest version first
+	GetByProductTicketID(c context.Context, productTicketID uuid.UUID) ([]models.PriceVersion, error)
+	// GetDue returns the scheduled versions whose time has come, oldest first
+	GetDue(c context.Context, now int) ([]models.PriceVersion, error)
+	MarkApplied(c context.Context, id uuid.UUID, appliedAt int) error
+	UpdateStripePriceID(c context.Context, id uuid.UUID, stripePriceID string) error
+	// DeleteScheduled removes a version that hasn't been applied yet, false when there was none
+	DeleteScheduled(c context.Context, id uuid.UUID) (bool, error)
+}
+
+func NewPriceVersionRepo() PriceVersionRepo {
+	repo := defaultPriceVersionRepo{}
+	repo.localCollection = tools.DB.Collection("priceVersions")
+	return &repo
+}
+
+type defaultPriceVersionRepo struct {
+	localCollection *mongo.Collection
+}
+
+func (d *defaultPriceVersionRepo) Save(c context.Context, version *models.PriceVersion) error {
+	_, err := d.localCollection.InsertOne(c, *version)
+	return err
+}
+
+func (d *defaultPriceVersionRepo) GetByID(c context.Context, id uuid.UUID) (models.PriceVersion, error) {
+	var version models.PriceVersion
+	err := d.localCollection.FindOne(c, bson.M{"_id": id}).Decode(&version)
+	if err != nil {
+		return models.PriceVersion{}, err
+	}
+	return version, nil
+}
+
+func (d *defaultPriceVersionRepo) find(c context.Context, filter bson.M) ([]models.PriceVersion, error) {
+	versions := []models.PriceVersion{}
+	cursor, err := d.localCollection.Find(c, filter, options.Find().SetSort(bson.D{{Key: "effectiveFrom", Value: 1}, {Key: "version", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+	if err = cursor.All(c, &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (d *defaultPriceVersionRepo) GetByProductTicketID(c context.Context, productTicketID uuid.UUID) ([]models.PriceVersion, error) {
+	return d.find(c, bson.M{"productTicketId": productTicketID})
+}
+
+func (d *defaultPriceVersionRepo) GetDue(c context.Context, now int) ([]models.PriceVersion, error) {
+	return d.find(c, bson.M{"appliedAt": 0, "effectiveFrom": bson.M{"$lte": now}})
+}
+
+func (d *defaultPriceVersionRepo) MarkApplied(c context.Context, id uuid.UUID, appliedAt int) error {
+	_, err := d.localCollection.UpdateByID(c, id, bson.M{"$set": bson.M{"appliedAt": appliedAt}})
+	return err
+}
+
+func (d *defaultPriceVersionRepo) UpdateStripePriceID(c context.Context, id uuid.UUID, stripePriceID string) error {
+	_, err := d.localCollection.UpdateByID(c, id, bson.M{"$set": bson.M{"stripePriceId": stripePriceID}})
+	return err
+}
+
+func (d *defaultPriceVersionRepo) DeleteScheduled(c context.Context, id uuid.UUID) (bool, error) {
+	res, err := d.localCollection.DeleteOne(c, bson.M{"_id": id, "appliedAt": 0})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
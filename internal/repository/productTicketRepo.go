@@ -2,10 +2,10 @@ package repository
 
 import (
 	"context"
-	"fmt"
 	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"log/slog"
 	"palyvoua/internal/models"
 	"palyvoua/tools"
 )
@@ -25,6 +25,7 @@ type ProductTicketRepo interface {
 	UpdateStripeProductID(c context.Context,prID uuid.UUID, stripeProductID string) (models.ProductTicket,error)
 	DeleteProductTicket(c context.Context,id uuid.UUID) error
 	UpdateProductTicket(c context.Context,id uuid.UUID, ticket *models.ProductTicket) error
+	UpdatePrice(c context.Context, id uuid.UUID, price int, currency string, priceVersionID uuid.UUID) error
 	GetByStripeProductID(context.Context,string) (models.ProductTicket, error)
 	FindManyByProductID(ctx context.Context, productID uuid.UUID) ([]*models.ProductTicket, error)
 	DeleteManyByProductID(ctx context.Context, productID uuid.UUID) error
@@ -193,12 +194,20 @@ func (d *defaultProductTicketRepo) UpdateProductTicket(c context.Context, id uui
 
 }
 
+func (d *defaultProductTicketRepo) UpdatePrice(c context.Context, id uuid.UUID, price int, currency string, priceVersionID uuid.UUID) error {
+	_, err := d.localCollection.UpdateByID(c, id, bson.M{"$set": bson.M{
+		"price":          price,
+		"currency":       currency,
+		"priceVersionId": priceVersionID,
+	}})
+	return err
+}
+
 func (d *defaultProductTicketRepo) GetByStripeProductID(ctx context.Context, s string) (models.ProductTicket, error) {
 	var pt models.ProductTicket
 	var err error
 	productTicketCollection := tools.DB.Collection("productTickets")
-	fmt.Println("searching by this stripe id")
-	fmt.Println(s)
+	slog.DebugContext(ctx, "finding product ticket by stripe product", "stripe_product_id", s)
 	res := productTicketCollection.FindOne(ctx, bson.M{"stripeProductId":s})
 	if res.Err() != nil {
 		return models.ProductTicket{}, res.Err()
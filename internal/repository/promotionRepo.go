@@ -0,0 +1,211 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"palyvoua/internal/models"
+	"palyvoua/tools"
+)
+
+type PromotionRepo interface {
+	Save(c context.Context, promotion *models.Promotion) error
+	GetAll(c context.Context) ([]models.Promotion, error)
+	GetByID(c context.Context, id uuid.UUID) (models.Promotion, error)
+	GetByCode(c context.Context, code string) (models.Promotion, error)
+	SetActive(c context.Context, id uuid.UUID, active bool) error
+	WithTransaction(c context.Context, fn func(c context.Context) error) error
+	// Reserve saves a pending redemption and holds its place under the promotion's MaxRedemptions, false when
+	// no place is left. Run it in a transaction, the promotion it writes keeps reservations from passing each other.
+	Reserve(c context.Context, redemption *models.PromotionRedemption) (bool, error)
+	GetRedemptionBySessionID(c context.Context, sessionID string) (models.PromotionRedemption, error)
+	// CountUsedByUser counts the user's redemptions that are paid or still held by a checkout
+	CountUsedByUser(c context.Context, promotionID uuid.UUID, userID uuid.UUID) (int, error)
+	// Redeem turns a pending or released redemption into a counted one, false when it already was.
+	// Run it in a transaction so the redemption and the promotion's count change together.
+	Redeem(c context.Context, redemption *models.PromotionRedemption, redeemedAt int) (bool, error)
+	// ReleaseBySessionID drops the pending redemption of a checkout that wasn't paid
+	ReleaseBySessionID(c context.Context, sessionID string) error
+	// ReleaseExpired drops the pending redemptions that expired before now, it returns how many
+	ReleaseExpired(c context.Context, now int) (int, error)
+}
+
+func NewPromotionRepo() PromotionRepo {
+	repo := defaultPromotionRepo{}
+	repo.localCollection = tools.DB.Collection("promotions")
+	repo.redemptionCollection = tools.DB.Collection("promotionRedemptions")
+	return &repo
+}
+
+type defaultPromotionRepo struct {
+	localCollection *mongo.Collection
+	redemptionCollection *mongo.Collection
+}
+
+func (d *defaultPromotionRepo) Save(c context.Context, promotion *models.Promotion) error {
+	_, err := d.localCollection.InsertOne(c, *promotion)
+	return err
+}
+
+func (d *defaultPromotionRepo) GetAll(c context.Context) ([]models.Promotion, error) {
+	promotions := []models.Promotion{}
+	cursor, err := d.localCollection.Find(c, bson.M{}, options.Find().SetSort(bson.M{"createdAt": -1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+	if err = cursor.All(c, &promotions); err != nil {
+		return nil, err
+	}
+	return promotions, nil
+}
+
+func (d *defaultPromotionRepo) GetByID(c context.Context, id uuid.UUID) (models.Promotion, error) {
+	var promotion models.Promotion
+	err := d.localCollection.FindOne(c, bson.M{"_id": id}).Decode(&promotion)
+	if err != nil {
+		return models.Promotion{}, err
+	}
+	return promotion, nil
+}
+
+func (d *defaultPromotionRepo) GetByCode(c context.Context, code string) (models.Promotion, error) {
+	var promotion models.Promotion
+	err := d.localCollection.FindOne(c, bson.M{"code": code}).Decode(&promotion)
+	if err != nil {
+		return models.Promotion{}, err
+	}
+	return promotion, nil
+}
+
+func (d *defaultPromotionRepo) SetActive(c context.Context, id uuid.UUID, active bool) error {
+	_, err := d.localCollection.UpdateByID(c, id, bson.M{"$set": bson.M{"active": active}})
+	return err
+}
+
+func (d *defaultPromotionRepo) WithTransaction(c context.Context, fn func(c context.Context) error) error {
+	sess, err := tools.DB.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(c)
+	_, err = sess.WithTransaction(c, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// placeLeft matches a promotion whose paid and reserved redemptions are under its limit, promotions
+// stored before reservations were counted have no reserved field
+var placeLeft = bson.M{"$or": bson.A{
+	bson.M{"$lte": bson.A{"$maxRedemptions", 0}},
+	bson.M{"$lt": bson.A{bson.M{"$add": bson.A{"$redemptions", bson.M{"$ifNull": bson.A{"$reserved", 0}}}}, "$maxRedemptions"}},
+}}
+
+// unreserve gives back the place of a pending redemption. Ones reserved before they were counted
+// would take reserved below 0, it stops there.
+var unreserve = bson.M{"$max": bson.A{0, bson.M{"$subtract": bson.A{bson.M{"$ifNull": bson.A{"$reserved", 0}}, 1}}}}
+
+func (d *defaultPromotionRepo) Reserve(c context.Context, redemption *models.PromotionRedemption) (bool, error) {
+	res, err := d.localCollection.UpdateOne(c, bson.M{"_id": redemption.PromotionID, "$expr": placeLeft}, bson.M{"$inc": bson.M{"reserved": 1}})
+	if err != nil {
+		return false, err
+	}
+	if res.ModifiedCount == 0 {
+		return false, nil
+	}
+	if _, err = d.redemptionCollection.InsertOne(c, *redemption); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *defaultPromotionRepo) GetRedemptionBySessionID(c context.Context, sessionID string) (models.PromotionRedemption, error) {
+	var redemption models.PromotionRedemption
+	err := d.redemptionCollection.FindOne(c, bson.M{"checkoutSessionId": sessionID}).Decode(&redemption)
+	if err != nil {
+		return models.PromotionRedemption{}, err
+	}
+	return redemption, nil
+}
+
+func (d *defaultPromotionRepo) CountUsedByUser(c context.Context, promotionID uuid.UUID, userID uuid.UUID) (int, error) {
+	count, err := d.redemptionCollection.CountDocuments(c, bson.M{
+		"promotionId": promotionID,
+		"userId":      userID,
+		"status":      bson.M{"$in": bson.A{models.REDEMPTION_PENDING, models.REDEMPTION_REDEEMED}},
+	})
+	return int(count), err
+}
+
+func (d *defaultPromotionRepo) Redeem(c context.Context, redemption *models.PromotionRedemption, redeemedAt int) (bool, error) {
+	var before models.PromotionRedemption
+	err := d.redemptionCollection.FindOneAndUpdate(c, bson.M{
+		"_id":    redemption.ID,
+		"status": bson.M{"$in": bson.A{models.REDEMPTION_PENDING, models.REDEMPTION_RELEASED}},
+	}, bson.M{"$set": bson.M{
+		"status":     models.REDEMPTION_REDEEMED,
+		"redeemedAt": redeemedAt,
+	}}).Decode(&before)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	update := bson.M{"redemptions": bson.M{"$add": bson.A{"$redemptions", 1}}}
+	// a released redemption gave its place back already
+	if before.Status == models.REDEMPTION_PENDING {
+		update["reserved"] = unreserve
+	}
+	_, err = d.localCollection.UpdateByID(c, redemption.PromotionID, bson.A{bson.M{"$set": update}})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *defaultPromotionRepo) ReleaseBySessionID(c context.Context, sessionID string) error {
+	return d.release(c, bson.M{"checkoutSessionId": sessionID, "status": models.REDEMPTION_PENDING})
+}
+
+// release marks the pending redemption matched by filter released and gives its place back
+func (d *defaultPromotionRepo) release(c context.Context, filter bson.M) error {
+	var released models.PromotionRedemption
+	err := d.redemptionCollection.FindOneAndUpdate(c, filter, bson.M{"$set": bson.M{
+		"status": models.REDEMPTION_RELEASED,
+	}}).Decode(&released)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = d.localCollection.UpdateByID(c, released.PromotionID, bson.A{bson.M{"$set": bson.M{"reserved": unreserve}}})
+	return err
+}
+
+func (d *defaultPromotionRepo) ReleaseExpired(c context.Context, now int) (int, error) {
+	cursor, err := d.redemptionCollection.Find(c, bson.M{
+		"status":    models.REDEMPTION_PENDING,
+		"expiresAt": bson.M{"$gt": 0, "$lt": now},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(c)
+	expired := []models.PromotionRedemption{}
+	if err = cursor.All(c, &expired); err != nil {
+		return 0, err
+	}
+	// released one by one, a checkout paid in the meantime keeps its redemption
+	for _, redemption := range expired {
+		if err = d.release(c, bson.M{"_id": redemption.ID, "status": models.REDEMPTION_PENDING}); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"palyvoua/internal/models"
+	"palyvoua/tools"
+)
+
+type ReceiptRepo interface {
+	Save(c context.Context, receipt *models.Receipt) error
+	GetByID(c context.Context, id uuid.UUID) (models.Receipt, error)
+	GetByReference(c context.Context, reference string) (models.Receipt, error)
+	// GetByOwner lists the receipts of a user, or of an organization when organizationID is set, without their PDF
+	GetByOwner(c context.Context, userID uuid.UUID, organizationID uuid.UUID) ([]models.Receipt, error)
+	UpdateDocument(c context.Context, id uuid.UUID, sellers []models.SellerDetails, pdf []byte, regeneratedAt int) error
+	// NextSequence counts up the named sequence, in a transaction an aborted receipt gives its number back
+	NextSequence(c context.Context, name string) (int, error)
+}
+
+func NewReceiptRepo() ReceiptRepo {
+	repo := defaultReceiptRepo{}
+	repo.localCollection = tools.DB.Collection("receipts")
+	repo.counterCollection = tools.DB.Collection("counters")
+	return &repo
+}
+
+type defaultReceiptRepo struct {
+	localCollection *mongo.Collection
+	counterCollection *mongo.Collection
+}
+
+func (d *defaultReceiptRepo) Save(c context.Context, receipt *models.Receipt) error {
+	_, err := d.localCollection.InsertOne(c, *receipt)
+	return err
+}
+
+func (d *defaultReceiptRepo) GetByID(c context.Context, id uuid.UUID) (models.Receipt, error) {
+	var receipt models.Receipt
+	err := d.localCollection.FindOne(c, bson.M{"_id": id}).Decode(&receipt)
+	if err != nil {
+		return models.Receipt{}, err
+	}
+	return receipt, nil
+}
+
+func (d *defaultReceiptRepo) GetByReference(c context.Context, reference string) (models.Receipt, error) {
+	var receipt models.Receipt
+	err := d.localCollection.FindOne(c, bson.M{"reference": reference}).Decode(&receipt)
+	if err != nil {
+		return models.Receipt{}, err
+	}
+	return receipt, nil
+}
+
+func (d *defaultReceiptRepo) GetByOwner(c context.Context, userID uuid.UUID, organizationID uuid.UUID) ([]models.Receipt, error) {
+	receipts := []models.Receipt{}
+	filter := bson.M{"userId": userID}
+	if organizationID != uuid.Nil {
+		filter = bson.M{"organizationId": organizationID}
+	}
+	findOptions := options.Find().SetSort(bson.M{"issuedAt": -1}).SetProjection(bson.M{"pdf": 0})
+	cursor, err := d.localCollection.Find(c, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+	if err = cursor.All(c, &receipts); err != nil {
+		return nil, err
+	}
+	return receipts, nil
+}
+
+func (d *defaultReceiptRepo) UpdateDocument(c context.Context, id uuid.UUID, sellers []models.SellerDetails, pdf []byte, regeneratedAt int) error {
+	_, err := d.localCollection.UpdateByID(c, id, bson.M{"$set": bson.M{"sellers": sellers, "pdf": pdf, "regeneratedAt": regeneratedAt}})
+	return err
+}
+
+func (d *defaultReceiptRepo) NextSequence(c context.Context, name string) (int, error) {
+	var counter struct {
+		Value int `bson:"value"`
+	}
+	err := d.counterCollection.FindOneAndUpdate(c,
+		bson.M{"_id": name},
+		bson.M{"$inc": bson.M{"value": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+	return counter.Value, nil
+}
@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"palyvoua/internal/models"
+	"palyvoua/tools"
+)
+
+type SessionRepo interface {
+	Save(c context.Context, session *models.Session) error
+	GetByID(c context.Context, id uuid.UUID) (models.Session, error)
+	GetActiveByUserID(c context.Context, userID uuid.UUID) ([]models.Session, error)
+	GetAllByUserID(c context.Context, userID uuid.UUID) ([]models.Session, error)
+	DeleteAllByUserID(c context.Context, userID uuid.UUID) error
+	Revoke(c context.Context, id uuid.UUID, revokedAt int) error
+	RevokeAllExcept(c context.Context, userID uuid.UUID, keep uuid.UUID, revokedAt int) error
+	Touch(c context.Context, id uuid.UUID, lastSeenAt int, ip string) error
+}
+
+func NewSessionRepo() SessionRepo {
+	repo := defaultSessionRepo{}
+	repo.localCollection = tools.DB.Collection("sessions")
+	return &repo
+}
+
+type defaultSessionRepo struct {
+	localCollection *mongo.Collection
+}
+
+func (d *defaultSessionRepo) Save(c context.Context, session *models.Session) error {
+	_, err := d.localCollection.InsertOne(c, *session)
+	return err
+}
+
+func (d *defaultSessionRepo) GetByID(c context.Context, id uuid.UUID) (models.Session, error) {
+	var session models.Session
+	err := d.localCollection.FindOne(c, bson.M{"_id": id}).Decode(&session)
+	if err != nil {
+		return models.Session{}, err
+	}
+	return session, nil
+}
+
+func (d *defaultSessionRepo) GetActiveByUserID(c context.Context, userID uuid.UUID) ([]models.Session, error) {
+	return d.find(c, bson.M{"userId": userID, "revokedAt": 0})
+}
+
+func (d *defaultSessionRepo) GetAllByUserID(c context.Context, userID uuid.UUID) ([]models.Session, error) {
+	return d.find(c, bson.M{"userId": userID})
+}
+
+func (d *defaultSessionRepo) DeleteAllByUserID(c context.Context, userID uuid.UUID) error {
+	_, err := d.localCollection.DeleteMany(c, bson.M{"userId": userID})
+	return err
+}
+
+func (d *defaultSessionRepo) find(c context.Context, filter bson.M) ([]models.Session, error) {
+	var sessions []models.Session
+	opts := options.Find().SetSort(bson.M{"lastSeenAt": -1})
+	cursor, err := d.localCollection.Find(c, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+	for cursor.Next(c) {
+		var session models.Session
+		if err = cursor.Decode(&session); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, cursor.Err()
+}
+
+func (d *defaultSessionRepo) Revoke(c context.Context, id uuid.UUID, revokedAt int) error {
+	_, err := d.localCollection.UpdateByID(c, id, bson.M{"$set": bson.M{"revokedAt": revokedAt}})
+	return err
+}
+
+func (d *defaultSessionRepo) RevokeAllExcept(c context.Context, userID uuid.UUID, keep uuid.UUID, revokedAt int) error {
+	filter := bson.M{"userId": userID, "revokedAt": 0, "_id": bson.M{"$ne": keep}}
+	_, err := d.localCollection.UpdateMany(c, filter, bson.M{"$set": bson.M{"revokedAt": revokedAt}})
+	return err
+}
+
+func (d *defaultSessionRepo) Touch(c context.Context, id uuid.UUID, lastSeenAt int, ip string) error {
+	_, err := d.localCollection.UpdateByID(c, id, bson.M{"$set": bson.M{"lastSeenAt": lastSeenAt, "ip": ip}})
+	return err
+}
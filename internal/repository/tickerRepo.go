@@ -13,14 +13,32 @@ type CreateTicketTransactionFn func(c context.Context) error
 
 type TicketRepo interface {
 	Create(context.Context, models.Ticket) error
-	GetByID(id uuid.UUID) (models.Ticket, error)
-	DeleteByID(id uuid.UUID) error
+	GetByID(c context.Context, id uuid.UUID) (models.Ticket, error)
+	DeleteByID(c context.Context, id uuid.UUID) error
 	WithTransaction(c context.Context, fn CreateTicketTransactionFn) error
 
-	GetAll() ([]models.Ticket, error)
+	GetAll(c context.Context) ([]models.Ticket, error)
 	GetAllTicketsByUserID(c context.Context,userID uuid.UUID) ([]models.Ticket, error)
-	UpdateStatus(uuid.UUID, string) error
+	UpdateStatus(c context.Context, id uuid.UUID, status string) error
 	UpdatePaymentID(context.Context,uuid.UUID,string) error
+	DeleteUnpaidByUserID(c context.Context, userID uuid.UUID) error
+	GetByCheckoutSessionID(c context.Context, userID uuid.UUID, sessionID string) ([]models.Ticket, error)
+	AddAmount(c context.Context, id uuid.UUID, amount int) error
+	GetByOrganizationID(c context.Context, organizationID uuid.UUID) ([]models.Ticket, error)
+	// AssignDriver hands a whole unallocated organization ticket to a driver, false when it isn't available
+	AssignDriver(c context.Context, id uuid.UUID, driverID uuid.UUID) (bool, error)
+	// TakeAmount takes liters off an unallocated organization ticket, false when it doesn't hold enough
+	TakeAmount(c context.Context, id uuid.UUID, amount int) (bool, error)
+	// GetExpiring returns the unused tickets of users that expire in [from, to)
+	GetExpiring(c context.Context, from int, to int) ([]models.Ticket, error)
+	// Use redeems a whole activated ticket at station, false when it is no longer activated
+	Use(c context.Context, id uuid.UUID, station string) (bool, error)
+	// UsePart takes liters off an activated ticket holding more than that at station, false when it can't
+	UsePart(c context.Context, id uuid.UUID, amount int, station string) (bool, error)
+	// Expire marks the activated tickets that expired before now, it returns the ones it marked
+	Expire(c context.Context, now int) ([]models.Ticket, error)
+	// Refund marks a ticket refunded, false when it was used or refunded before
+	Refund(c context.Context, id uuid.UUID) (bool, error)
 }
 
 func NewTickerRepo() TicketRepo {
@@ -38,19 +56,24 @@ func (d *defaultTicketRepo) UpdatePaymentID(c context.Context,u uuid.UUID, s str
 	return nil
 }
 
-func (d *defaultTicketRepo) GetAll() ([]models.Ticket, error) {
+func (d *defaultTicketRepo) AddAmount(c context.Context, id uuid.UUID, amount int) error {
+	ticketCollection := tools.DB.Collection("tickets")
+	_, err := ticketCollection.UpdateByID(c, id, bson.M{"$inc": bson.M{"amount": amount}})
+	return err
+}
+
+func (d *defaultTicketRepo) GetAll(c context.Context) ([]models.Ticket, error) {
 	var tickets []models.Ticket
-	ctx := context.Background()
 	ticketCollection := tools.DB.Collection("tickets")
-	cursor, err := ticketCollection.Find(ctx, bson.M{})
-	defer cursor.Close(ctx)
+	cursor, err := ticketCollection.Find(c, bson.M{})
+	defer cursor.Close(c)
 	if err != nil {
 		return nil, err
 	}
 	if cursor.Err() !=nil {
 		return nil, cursor.Err()
 	}
-	for cursor.Next(ctx) {
+	for cursor.Next(c) {
 		var ticket models.Ticket
 		if err:=cursor.Decode(&ticket);err!=nil {
 			return nil, err
@@ -83,9 +106,9 @@ func (d *defaultTicketRepo) GetAllTicketsByUserID(c context.Context,userID uuid.
 	return tickets, nil
 }
 
-func (d *defaultTicketRepo) UpdateStatus(u uuid.UUID, s string) error {
+func (d *defaultTicketRepo) UpdateStatus(c context.Context, u uuid.UUID, s string) error {
 	ticketCollection := tools.DB.Collection("tickets")
-	_,err := ticketCollection.UpdateByID(context.TODO(), u, bson.M{"$set":bson.M{"status":s}})
+	_,err := ticketCollection.UpdateByID(c, u, bson.M{"$set":bson.M{"status":s}})
 	return err
 }
 
@@ -95,19 +118,19 @@ func (d *defaultTicketRepo) Create(c context.Context, ticket models.Ticket) erro
 	return err
 }
 
-func (d *defaultTicketRepo) GetByID(id uuid.UUID) (models.Ticket, error) {
+func (d *defaultTicketRepo) GetByID(c context.Context, id uuid.UUID) (models.Ticket, error) {
 	var ticket models.Ticket
 	ticketCollection := tools.DB.Collection("tickets")
-	err := ticketCollection.FindOne(context.TODO(), bson.M{"_id":id}).Decode(&ticket)
+	err := ticketCollection.FindOne(c, bson.M{"_id":id}).Decode(&ticket)
 	if err != nil {
 		return models.Ticket{}, err
 	}
 	return ticket, nil
 }
 
-func (d *defaultTicketRepo) DeleteByID(id uuid.UUID) error {
+func (d *defaultTicketRepo) DeleteByID(c context.Context, id uuid.UUID) error {
 	ticketCollection := tools.DB.Collection("tickets")
-	_,err := ticketCollection.DeleteOne(context.TODO(), bson.M{"_id":id})
+	_,err := ticketCollection.DeleteOne(c, bson.M{"_id":id})
 	return err
 }
 
@@ -128,4 +151,142 @@ func (d *defaultTicketRepo) WithTransaction(c context.Context, fn CreateTicketTr
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// DeleteUnpaidByUserID removes the tickets that never got a payment, paid ones are financial records
+func (d *defaultTicketRepo) DeleteUnpaidByUserID(c context.Context, userID uuid.UUID) error {
+	ticketCollection := tools.DB.Collection("tickets")
+	_, err := ticketCollection.DeleteMany(c, bson.M{"userId": userID, "paymentId": bson.M{"$in": bson.A{"", nil}}})
+	return err
+}
+
+func (d *defaultTicketRepo) GetByCheckoutSessionID(c context.Context, userID uuid.UUID, sessionID string) ([]models.Ticket, error) {
+	tickets := []models.Ticket{}
+	ticketCollection := tools.DB.Collection("tickets")
+	cursor, err := ticketCollection.Find(c, bson.M{"userId": userID, "checkoutSessionId": sessionID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+	for cursor.Next(c) {
+		var ticket models.Ticket
+		if err = cursor.Decode(&ticket); err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, ticket)
+	}
+	return tickets, cursor.Err()
+}
+
+func (d *defaultTicketRepo) GetByOrganizationID(c context.Context, organizationID uuid.UUID) ([]models.Ticket, error) {
+	tickets := []models.Ticket{}
+	ticketCollection := tools.DB.Collection("tickets")
+	cursor, err := ticketCollection.Find(c, bson.M{"organizationId": organizationID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+	if err = cursor.All(c, &tickets); err != nil {
+		return nil, err
+	}
+	return tickets, nil
+}
+
+// unallocated matches an organization ticket still held by the organization
+func unallocated(id uuid.UUID) bson.M {
+	return bson.M{"_id": id, "status": models.ACTIVATED, "driverId": uuid.Nil, "organizationId": bson.M{"$ne": uuid.Nil}}
+}
+
+func (d *defaultTicketRepo) AssignDriver(c context.Context, id uuid.UUID, driverID uuid.UUID) (bool, error) {
+	ticketCollection := tools.DB.Collection("tickets")
+	res, err := ticketCollection.UpdateOne(c, unallocated(id), bson.M{"$set": bson.M{"userId": driverID, "driverId": driverID}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+func (d *defaultTicketRepo) TakeAmount(c context.Context, id uuid.UUID, amount int) (bool, error) {
+	ticketCollection := tools.DB.Collection("tickets")
+	filter := unallocated(id)
+	filter["amount"] = bson.M{"$gt": amount}
+	res, err := ticketCollection.UpdateOne(c, filter, bson.M{"$inc": bson.M{"amount": -amount}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+func (d *defaultTicketRepo) GetExpiring(c context.Context, from int, to int) ([]models.Ticket, error) {
+	tickets := []models.Ticket{}
+	ticketCollection := tools.DB.Collection("tickets")
+	filter := bson.M{
+		"status":    models.ACTIVATED,
+		"userId":    bson.M{"$ne": uuid.Nil},
+		"expiresAt": bson.M{"$gte": from, "$lt": to},
+	}
+	cursor, err := ticketCollection.Find(c, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+	if err = cursor.All(c, &tickets); err != nil {
+		return nil, err
+	}
+	return tickets, nil
+}
+
+func (d *defaultTicketRepo) Use(c context.Context, id uuid.UUID, station string) (bool, error) {
+	ticketCollection := tools.DB.Collection("tickets")
+	res, err := ticketCollection.UpdateOne(c, bson.M{"_id": id, "status": models.ACTIVATED}, bson.M{"$set": bson.M{"status": models.USED, "station": station}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+func (d *defaultTicketRepo) Refund(c context.Context, id uuid.UUID) (bool, error) {
+	ticketCollection := tools.DB.Collection("tickets")
+	filter := bson.M{"_id": id, "status": bson.M{"$nin": bson.A{models.USED, models.REFUNDED}}}
+	res, err := ticketCollection.UpdateOne(c, filter, bson.M{"$set": bson.M{"status": models.REFUNDED}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+func (d *defaultTicketRepo) UsePart(c context.Context, id uuid.UUID, amount int, station string) (bool, error) {
+	ticketCollection := tools.DB.Collection("tickets")
+	filter := bson.M{"_id": id, "status": models.ACTIVATED, "amount": bson.M{"$gt": amount}}
+	res, err := ticketCollection.UpdateOne(c, filter, bson.M{"$inc": bson.M{"amount": -amount, "used": amount}, "$set": bson.M{"station": station}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+func (d *defaultTicketRepo) Expire(c context.Context, now int) ([]models.Ticket, error) {
+	tickets := []models.Ticket{}
+	ticketCollection := tools.DB.Collection("tickets")
+	cursor, err := ticketCollection.Find(c, bson.M{"status": models.ACTIVATED, "expiresAt": bson.M{"$lt": now}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+	if err = cursor.All(c, &tickets); err != nil {
+		return nil, err
+	}
+	expired := []models.Ticket{}
+	for _, ticket := range tickets {
+		// a ticket used since it was read stays used
+		res, err := ticketCollection.UpdateOne(c, bson.M{"_id": ticket.ID, "status": models.ACTIVATED}, bson.M{"$set": bson.M{"status": models.EXPIRED}})
+		if err != nil {
+			return expired, err
+		}
+		if res.ModifiedCount == 1 {
+			ticket.Status = models.EXPIRED
+			expired = append(expired, ticket)
+		}
+	}
+	return expired, nil
+}
@@ -2,17 +2,33 @@ package repository
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log/slog"
 	"palyvoua/internal/models"
 	"palyvoua/tools"
+	"palyvoua/tools/logging"
 )
 
 type UserRepo interface {
-	SaveUser(*models.User) error
+	SaveUser(c context.Context, user *models.User) error
 	GetUserByEmail(ctx context.Context,email string) (models.User, error)
-	UpdateCustomerIDByEmail(email string, cid string) error
-	GetByCustomerID(cID string) (models.User,error)
+	GetByID(c context.Context, id uuid.UUID) (models.User, error)
+	UpdateCustomerIDByEmail(c context.Context, email string, cid string) error
+	GetByCustomerID(c context.Context, cID string) (models.User,error)
+	UpdateMFASettings(c context.Context, userID uuid.UUID, settings models.MFASettings) error
+	UpdateProfile(c context.Context, userID uuid.UUID, profile models.UserProfile) error
+	UpdatePassword(c context.Context, userID uuid.UUID, passwordHash string) error
+	UpdateEmailChange(c context.Context, userID uuid.UUID, change models.EmailChange) error
+	UpdateEmail(c context.Context, userID uuid.UUID, email string) error
+	UpdateDeletion(c context.Context, userID uuid.UUID, deletion models.AccountDeletion) error
+	GetDueForDeletion(c context.Context, now int) ([]models.User, error)
+	Anonymize(c context.Context, userID uuid.UUID, deletedAt int) error
+	GetByIdentity(c context.Context, provider string, subject string) (models.User, error)
+	AddIdentity(c context.Context, userID uuid.UUID, identity models.ExternalIdentity) error
+	UpdateNotificationPreferences(c context.Context, userID uuid.UUID, preferences models.NotificationPreferences) error
 }
 
 func NewUserRepo() UserRepo {
@@ -23,37 +39,157 @@ type defaultUserRepo struct {
 
 }
 
-func (d *defaultUserRepo) GetByCustomerID(cID string) (models.User,error) {
+func (d *defaultUserRepo) GetByCustomerID(c context.Context, cID string) (models.User,error) {
 	var user models.User
 	var err error
 	userCollection := tools.DB.Collection("users")
-	res :=userCollection.FindOne(context.Background(), bson.M{"customerId":cID})
+	res :=userCollection.FindOne(c, bson.M{"customerId":cID})
 	if err = res.Err();err!=nil {
-		fmt.Println(err)
+		// organizations are customers too, not finding a user is expected for their payments
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			slog.ErrorContext(c, "finding user by customer failed", "customer_id", cID, logging.Err(err))
+		}
 		return models.User{}, err
 	}
 	if err = res.Decode(&user);err!=nil {
-		fmt.Println(err)
+		slog.ErrorContext(c, "decoding user failed", "customer_id", cID, logging.Err(err))
 		return models.User{}, err
 	}
 	return user,nil
 }
 
-func (d *defaultUserRepo) SaveUser(user *models.User) error {
+func (d *defaultUserRepo) SaveUser(c context.Context, user *models.User) error {
 	userCollection := tools.DB.Collection("users")
-	_, err := userCollection.InsertOne(context.TODO(), *user)
+	_, err := userCollection.InsertOne(c, *user)
 	return err
 }
 
 func (d *defaultUserRepo) GetUserByEmail(ctx context.Context,email string) (models.User, error) {
 	var user models.User
 	userCollection := tools.DB.Collection("users")
-	err := userCollection.FindOne(context.TODO(), bson.M{"email":email}).Decode(&user)
+	err := userCollection.FindOne(ctx, bson.M{"email":email}).Decode(&user)
 	return user,err
 }
 
-func (d *defaultUserRepo) UpdateCustomerIDByEmail(email string, cid string) error {
+func (d *defaultUserRepo) GetByID(c context.Context, id uuid.UUID) (models.User, error) {
+	var user models.User
+	userCollection := tools.DB.Collection("users")
+	err := userCollection.FindOne(c, bson.M{"_id": id}).Decode(&user)
+	return user, err
+}
+
+func (d *defaultUserRepo) UpdateCustomerIDByEmail(c context.Context, email string, cid string) error {
+	userCollection := tools.DB.Collection("users")
+	_, err := userCollection.UpdateOne(c, bson.M{"email": email}, bson.M{"$set": bson.M{"customerId": cid}})
+	return err
+}
+
+func (d *defaultUserRepo) UpdateMFASettings(c context.Context, userID uuid.UUID, settings models.MFASettings) error {
+	userCollection := tools.DB.Collection("users")
+	_, err := userCollection.UpdateByID(c, userID, bson.M{"$set": bson.M{"mfa": settings}})
+	return err
+}
+
+func (d *defaultUserRepo) UpdateProfile(c context.Context, userID uuid.UUID, profile models.UserProfile) error {
+	userCollection := tools.DB.Collection("users")
+	_, err := userCollection.UpdateByID(c, userID, bson.M{"$set": bson.M{
+		"name":              profile.Name,
+		"phone":             profile.Phone,
+		"preferredLanguage": profile.PreferredLanguage,
+		"marketingConsent":  profile.MarketingConsent,
+		"defaultFuelType":   profile.DefaultFuelType,
+	}})
+	return err
+}
+
+func (d *defaultUserRepo) UpdatePassword(c context.Context, userID uuid.UUID, passwordHash string) error {
+	userCollection := tools.DB.Collection("users")
+	_, err := userCollection.UpdateByID(c, userID, bson.M{"$set": bson.M{"password": passwordHash}})
+	return err
+}
+
+func (d *defaultUserRepo) UpdateEmailChange(c context.Context, userID uuid.UUID, change models.EmailChange) error {
+	userCollection := tools.DB.Collection("users")
+	_, err := userCollection.UpdateByID(c, userID, bson.M{"$set": bson.M{"emailChange": change}})
+	return err
+}
+
+// UpdateEmail swaps in the verified email and clears the pending change
+func (d *defaultUserRepo) UpdateEmail(c context.Context, userID uuid.UUID, email string) error {
+	userCollection := tools.DB.Collection("users")
+	_, err := userCollection.UpdateByID(c, userID, bson.M{"$set": bson.M{
+		"email":       email,
+		"emailChange": models.EmailChange{},
+	}})
+	return err
+}
+
+func (d *defaultUserRepo) UpdateDeletion(c context.Context, userID uuid.UUID, deletion models.AccountDeletion) error {
+	userCollection := tools.DB.Collection("users")
+	_, err := userCollection.UpdateByID(c, userID, bson.M{"$set": bson.M{"deletion": deletion}})
+	return err
+}
+
+func (d *defaultUserRepo) GetDueForDeletion(c context.Context, now int) ([]models.User, error) {
+	var users []models.User
+	userCollection := tools.DB.Collection("users")
+	filter := bson.M{
+		"deletion.scheduledAt": bson.M{"$gt": 0, "$lte": now},
+		"deletion.deletedAt":   0,
+	}
+	cursor, err := userCollection.Find(c, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+	for cursor.Next(c) {
+		var user models.User
+		if err = cursor.Decode(&user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, cursor.Err()
+}
+
+// Anonymize wipes everything that identifies the user but keeps the document,
+// so tickets and payments still point at an existing id
+func (d *defaultUserRepo) Anonymize(c context.Context, userID uuid.UUID, deletedAt int) error {
+	userCollection := tools.DB.Collection("users")
+	_, err := userCollection.UpdateByID(c, userID, bson.M{"$set": bson.M{
+		"email":                "deleted-" + userID.String() + "@deleted.invalid",
+		"password":             "",
+		"customerId":           "",
+		"mfa":                  models.MFASettings{},
+		"name":                 "",
+		"phone":                "",
+		"preferredLanguage":    "",
+		"marketingConsent":     false,
+		"defaultFuelType":      "",
+		"emailChange":          models.EmailChange{},
+		"identities":           []models.ExternalIdentity{},
+		"notifications":        models.NotificationPreferences{},
+		"deletion.deletedAt":   deletedAt,
+	}})
+	return err
+}
+
+func (d *defaultUserRepo) GetByIdentity(c context.Context, provider string, subject string) (models.User, error) {
+	var user models.User
+	userCollection := tools.DB.Collection("users")
+	filter := bson.M{"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}}}
+	err := userCollection.FindOne(c, filter).Decode(&user)
+	return user, err
+}
+
+func (d *defaultUserRepo) AddIdentity(c context.Context, userID uuid.UUID, identity models.ExternalIdentity) error {
+	userCollection := tools.DB.Collection("users")
+	_, err := userCollection.UpdateByID(c, userID, bson.M{"$push": bson.M{"identities": identity}})
+	return err
+}
+
+func (d *defaultUserRepo) UpdateNotificationPreferences(c context.Context, userID uuid.UUID, preferences models.NotificationPreferences) error {
 	userCollection := tools.DB.Collection("users")
-	_, err := userCollection.UpdateOne(context.TODO(), bson.M{"email": email}, bson.M{"$set": bson.M{"customerId": cid}})
+	_, err := userCollection.UpdateByID(c, userID, bson.M{"$set": bson.M{"notifications": preferences}})
 	return err
 }
@@ -0,0 +1,134 @@
+package repository
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"palyvoua/internal/models"
+	"palyvoua/tools"
+)
+
+type WebhookRepo interface {
+	SaveEndpoint(c context.Context, endpoint *models.WebhookEndpoint) error
+	GetEndpoint(c context.Context, id uuid.UUID) (models.WebhookEndpoint, error)
+	GetEndpointsBySeller(c context.Context, seller string) ([]models.WebhookEndpoint, error)
+	// GetSubscribed returns the active endpoints of a seller subscribed to event
+	GetSubscribed(c context.Context, seller string, event string) ([]models.WebhookEndpoint, error)
+	UpdateEndpoint(c context.Context, endpoint *models.WebhookEndpoint) error
+	DeleteEndpoint(c context.Context, id uuid.UUID) error
+
+	SaveDelivery(c context.Context, delivery *models.WebhookDelivery) error
+	GetDelivery(c context.Context, id uuid.UUID) (models.WebhookDelivery, error)
+	ExistsDelivery(c context.Context, endpointID uuid.UUID, idempotencyKey string) (bool, error)
+	// GetDeliveries lists the deliveries of a seller newest first, endpointID and status narrow it when set
+	GetDeliveries(c context.Context, seller string, endpointID uuid.UUID, status string, limit int) ([]models.WebhookDelivery, error)
+	// GetDueDeliveries returns pending deliveries whose attempt is due, oldest first
+	GetDueDeliveries(c context.Context, now int, limit int) ([]models.WebhookDelivery, error)
+	UpdateDelivery(c context.Context, delivery *models.WebhookDelivery) error
+}
+
+func NewWebhookRepo() WebhookRepo {
+	repo := defaultWebhookRepo{}
+	repo.localCollection = tools.DB.Collection("webhookEndpoints")
+	repo.deliveryCollection = tools.DB.Collection("webhookDeliveries")
+	return &repo
+}
+
+type defaultWebhookRepo struct {
+	localCollection *mongo.Collection
+	deliveryCollection *mongo.Collection
+}
+
+func (d *defaultWebhookRepo) SaveEndpoint(c context.Context, endpoint *models.WebhookEndpoint) error {
+	_, err := d.localCollection.InsertOne(c, *endpoint)
+	return err
+}
+
+func (d *defaultWebhookRepo) GetEndpoint(c context.Context, id uuid.UUID) (models.WebhookEndpoint, error) {
+	var endpoint models.WebhookEndpoint
+	err := d.localCollection.FindOne(c, bson.M{"_id": id}).Decode(&endpoint)
+	return endpoint, err
+}
+
+func (d *defaultWebhookRepo) findEndpoints(c context.Context, filter bson.M) ([]models.WebhookEndpoint, error) {
+	endpoints := []models.WebhookEndpoint{}
+	cursor, err := d.localCollection.Find(c, filter, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+	if err = cursor.All(c, &endpoints); err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+func (d *defaultWebhookRepo) GetEndpointsBySeller(c context.Context, seller string) ([]models.WebhookEndpoint, error) {
+	return d.findEndpoints(c, bson.M{"seller": seller})
+}
+
+func (d *defaultWebhookRepo) GetSubscribed(c context.Context, seller string, event string) ([]models.WebhookEndpoint, error) {
+	return d.findEndpoints(c, bson.M{"seller": seller, "active": true, "events": event})
+}
+
+func (d *defaultWebhookRepo) UpdateEndpoint(c context.Context, endpoint *models.WebhookEndpoint) error {
+	_, err := d.localCollection.ReplaceOne(c, bson.M{"_id": endpoint.ID}, *endpoint)
+	return err
+}
+
+func (d *defaultWebhookRepo) DeleteEndpoint(c context.Context, id uuid.UUID) error {
+	_, err := d.localCollection.DeleteOne(c, bson.M{"_id": id})
+	return err
+}
+
+func (d *defaultWebhookRepo) SaveDelivery(c context.Context, delivery *models.WebhookDelivery) error {
+	_, err := d.deliveryCollection.InsertOne(c, *delivery)
+	return err
+}
+
+func (d *defaultWebhookRepo) GetDelivery(c context.Context, id uuid.UUID) (models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	err := d.deliveryCollection.FindOne(c, bson.M{"_id": id}).Decode(&delivery)
+	return delivery, err
+}
+
+func (d *defaultWebhookRepo) ExistsDelivery(c context.Context, endpointID uuid.UUID, idempotencyKey string) (bool, error) {
+	count, err := d.deliveryCollection.CountDocuments(c, bson.M{"endpointId": endpointID, "idempotencyKey": idempotencyKey}, options.Count().SetLimit(1))
+	return count > 0, err
+}
+
+func (d *defaultWebhookRepo) findDeliveries(c context.Context, filter bson.M, opts *options.FindOptions) ([]models.WebhookDelivery, error) {
+	deliveries := []models.WebhookDelivery{}
+	cursor, err := d.deliveryCollection.Find(c, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(c)
+	if err = cursor.All(c, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (d *defaultWebhookRepo) GetDeliveries(c context.Context, seller string, endpointID uuid.UUID, status string, limit int) ([]models.WebhookDelivery, error) {
+	filter := bson.M{"seller": seller}
+	if endpointID != uuid.Nil {
+		filter["endpointId"] = endpointID
+	}
+	if status != "" {
+		filter["status"] = status
+	}
+	return d.findDeliveries(c, filter, options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(int64(limit)))
+}
+
+func (d *defaultWebhookRepo) GetDueDeliveries(c context.Context, now int, limit int) ([]models.WebhookDelivery, error) {
+	filter := bson.M{"status": models.DELIVERY_PENDING, "nextAttemptAt": bson.M{"$lte": now}}
+	return d.findDeliveries(c, filter, options.Find().SetSort(bson.M{"createdAt": 1}).SetLimit(int64(limit)))
+}
+
+func (d *defaultWebhookRepo) UpdateDelivery(c context.Context, delivery *models.WebhookDelivery) error {
+	_, err := d.deliveryCollection.ReplaceOne(c, bson.M{"_id": delivery.ID}, *delivery)
+	return err
+}
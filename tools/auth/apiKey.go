@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"net"
+	"palyvoua/internal/models"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeyPrefix = "plv_"
+	apiKeyHeader = "X-API-Key"
+	requiredScopeKey = "requiredScope"
+	// last-used time is only written when it is older than this, to spare a write per request
+	apiKeyLastUsedResolution = 60
+)
+
+type apiKeyRepo interface {
+	GetByHash(c context.Context, hash string) (models.APIKey, error)
+	UpdateLastUsed(c context.Context, id uuid.UUID, lastUsedAt int) error
+}
+
+var apiKeys apiKeyRepo
+
+// UseAPIKeys makes AuthMiddleware accept API keys looked up in repo
+func UseAPIKeys(repo apiKeyRepo) {
+	apiKeys = repo
+}
+
+// GenerateAPIKey returns the plain key to hand out once, its display prefix and the hash to store
+func GenerateAPIKey() (string, string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", "", err
+	}
+	plain := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	return plain, plain[:len(apiKeyPrefix)+8], HashAPIKey(plain), nil
+}
+
+func HashAPIKey(key string) string {
+	return HashOpaqueToken(key)
+}
+
+// RequireScope marks a route group as reachable with an API key carrying scope.
+// It has to run before AuthMiddleware, groups without it refuse API keys.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(requiredScopeKey, scope)
+		c.Next()
+	}
+}
+
+// apiKeyFromRequest reads the key from X-API-Key or an "Authorization: ApiKey ..." header
+func apiKeyFromRequest(c *gin.Context) string {
+	if key := c.GetHeader(apiKeyHeader); key != "" {
+		return key
+	}
+	authHeader := c.GetHeader("Authorization")
+	if strings.HasPrefix(authHeader, "ApiKey ") {
+		return strings.TrimPrefix(authHeader, "ApiKey ")
+	}
+	return ""
+}
+
+func validateAPIKey(c *gin.Context, plain string) (*models.APIKey, error) {
+	if apiKeys == nil {
+		return nil, fmt.Errorf("API keys are not enabled")
+	}
+	key, err := apiKeys.GetByHash(c, HashAPIKey(plain))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid API key")
+	}
+	now := int(time.Now().Unix())
+	if key.RevokedAt != 0 {
+		return nil, fmt.Errorf("API key has been revoked")
+	}
+	if key.ExpiresAt != 0 && key.ExpiresAt < now {
+		return nil, fmt.Errorf("API key has expired")
+	}
+	if !ipAllowed(c.ClientIP(), key.AllowedIPs) {
+		return nil, fmt.Errorf("API key is not allowed from this address")
+	}
+	scope, _ := c.Get(requiredScopeKey)
+	requiredScope, _ := scope.(string)
+	if requiredScope == "" {
+		return nil, fmt.Errorf("API keys are not accepted for this resource")
+	}
+	if !key.HasScope(requiredScope) {
+		return nil, fmt.Errorf("API key is missing the %s scope", requiredScope)
+	}
+	if now-key.LastUsedAt > apiKeyLastUsedResolution {
+		if err = apiKeys.UpdateLastUsed(c, key.ID, now); err == nil {
+			key.LastUsedAt = now
+		}
+	}
+	return &key, nil
+}
+
+// ipAllowed accepts plain addresses and CIDR ranges, an empty list allows everything
+func ipAllowed(clientIP string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, entry := range allowed {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if allowedIP := net.ParseIP(entry); allowedIP != nil && allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateIPAllowlist checks the entries an admin submits when issuing a key
+func ValidateIPAllowlist(allowed []string) error {
+	for _, entry := range allowed {
+		if _, _, err := net.ParseCIDR(entry); err == nil {
+			continue
+		}
+		if net.ParseIP(entry) == nil {
+			return fmt.Errorf("invalid address %q", entry)
+		}
+	}
+	return nil
+}
@@ -2,20 +2,22 @@ package auth
 
 import (
 	"context"
-	"fmt"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
-	"palyvoua/internal/models"
 	repository "palyvoua/internal/repository"
 )
 
-func UserExists(email string) bool {
+func UserExists(c context.Context, email string) bool {
 	//var count int64
 	//utils.DB.Model(&models.User{}).Where("email = ?", email).Count(&count)
 	userRepo := repository.NewUserRepo()
-	user, _ := userRepo.GetUserByEmail(context.Background(),email)
-	fmt.Println(user)
-	isEmpty := user == models.User{}
+	user, _ := userRepo.GetUserByEmail(c, email)
+	isEmpty := user.ID == uuid.Nil
 	if isEmpty {
 		return false
 	}
@@ -38,3 +40,18 @@ func GenerateTokens(body map[string]interface{}, c *gin.Context) (Tokens) {
 func ComparePasswords(plainPassword string, hashedPassword string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(plainPassword))
 }
+
+// GenerateOpaqueToken returns a random url-safe token and the sha256 hash to store instead of it
+func GenerateOpaqueToken() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	return token, HashOpaqueToken(token), nil
+}
+
+func HashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
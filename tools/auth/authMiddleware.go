@@ -2,17 +2,19 @@ package auth
 
 import (
 	"context"
-	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"log/slog"
 	"palyvoua/internal/models"
 	"palyvoua/internal/repository"
+	"palyvoua/tools/logging"
 	"strings"
 )
 
 type AuthBody struct {
 	user *models.User
 	role *models.Role
+	apiKey *models.APIKey
 }
 
 func (ab *AuthBody) setUser(u *models.User) error {
@@ -33,8 +35,17 @@ func (ab *AuthBody) GetRole() *models.Role {
 	return ab.role
 }
 
+// GetAPIKey returns the key the request was authenticated with, nil for JWT requests
+func (ab *AuthBody) GetAPIKey() *models.APIKey {
+	return ab.apiKey
+}
+
 func AuthMiddleware(userRepo repository.UserRepo, roleRepo roleRepo) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if plainKey := apiKeyFromRequest(c); plainKey != "" {
+			apiKeyAuth(c, plainKey, userRepo, roleRepo)
+			return
+		}
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
 			c.JSON(401, gin.H{"error": "Unauthorized"})
@@ -43,11 +54,16 @@ func AuthMiddleware(userRepo repository.UserRepo, roleRepo roleRepo) gin.Handler
 		}
 		accessToken := authHeader[7:]
 		if _, err := Validate(accessToken); err != nil {
-			fmt.Println("auth 2")
+			slog.DebugContext(c, "invalid access token", logging.Err(err))
 			c.JSON(401, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
 		}
+		if err := CheckSession(c, accessToken); err != nil {
+			c.JSON(401, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		}
 		userEmail, err := GetSubject(accessToken)
 		if err != nil {
 
@@ -56,21 +72,26 @@ func AuthMiddleware(userRepo repository.UserRepo, roleRepo roleRepo) gin.Handler
 			return
 		}
 
-		user, err := userRepo.GetUserByEmail(context.Background(), userEmail)
+		// a token outliving its user, or the email it was issued for, is no longer valid
+		user, err := userRepo.GetUserByEmail(c, userEmail)
 		if err != nil {
 
-			c.JSON(404, gin.H{"error": "No such user"})
+			c.JSON(401, gin.H{"error": "No such user"})
 			c.Abort()
 			return
 		}
-		fmt.Println(user.Role)
-		role, err := roleRepo.GetRoleByID(user.Role)
+		role, err := roleRepo.GetRoleByID(c, user.Role)
 		if err != nil {
 
 			c.JSON(403, gin.H{"error": "You have no authority for this (FORBIDDEN)"})
 			c.Abort()
 			return
 		}
+		if role.RequireMFA && !HasMFAClaim(accessToken) {
+			c.JSON(403, gin.H{"error": "Two-factor authentication required"})
+			c.Abort()
+			return
+		}
 
 		authBody := AuthBody{}
 		err = authBody.setUser(&user)
@@ -92,12 +113,35 @@ func AuthMiddleware(userRepo repository.UserRepo, roleRepo roleRepo) gin.Handler
 	}
 }
 
+func apiKeyAuth(c *gin.Context, plainKey string, userRepo repository.UserRepo, roleRepo roleRepo) {
+	key, err := validateAPIKey(c, plainKey)
+	if err != nil {
+		c.JSON(401, gin.H{"error": err.Error()})
+		c.Abort()
+		return
+	}
+	user, err := userRepo.GetByID(c, key.UserID)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "API key owner no longer exists"})
+		c.Abort()
+		return
+	}
+	role, err := roleRepo.GetRoleByID(c, user.Role)
+	if err != nil {
+		c.JSON(403, gin.H{"error": "You have no authority for this (FORBIDDEN)"})
+		c.Abort()
+		return
+	}
+	c.Set("authBody", AuthBody{user: &user, role: &role, apiKey: key})
+	c.Next()
+}
+
 type userRepo interface {
 	GetUserByEmail(ctx context.Context, email string) (models.User, error)
 }
 
 type roleRepo interface {
-	GetRoleByID(uuid.UUID) (models.Role, error)
+	GetRoleByID(c context.Context, id uuid.UUID) (models.Role, error)
 }
 
 func RoleMiddleware(requiredAuthorityLevel int, userRepo repository.UserRepo, roleRepo roleRepo) gin.HandlerFunc {
@@ -122,7 +166,7 @@ func RoleMiddleware(requiredAuthorityLevel int, userRepo repository.UserRepo, ro
 			return
 		}
 
-		user, err := userRepo.GetUserByEmail(context.Background(), authBody.user.Email)
+		user, err := userRepo.GetUserByEmail(c, authBody.user.Email)
 		if err != nil {
 			c.Set("authorized", false)
 			c.Set("authorityLevel", -1)
@@ -130,7 +174,7 @@ func RoleMiddleware(requiredAuthorityLevel int, userRepo repository.UserRepo, ro
 			c.Abort()
 			return
 		}
-		role, err := roleRepo.GetRoleByID(user.Role)
+		role, err := roleRepo.GetRoleByID(c, user.Role)
 		if role.AuthorityLevel < requiredAuthorityLevel {
 			c.Set("authorized", false)
 			c.Set("authorityLevel", -1)
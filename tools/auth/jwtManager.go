@@ -3,8 +3,6 @@ package auth
 import (
 	"fmt"
 	"github.com/golang-jwt/jwt/v4"
-	"os"
-	"palyvoua/tools"
 	"time"
 )
 
@@ -20,6 +18,20 @@ type Tokens struct {
 	RefreshToken string
 }
 
+type TokenOptions struct {
+	// Secret signs and verifies every token
+	Secret []byte
+	AccessExpiration time.Duration
+	RefreshExpiration time.Duration
+}
+
+var tokenOptions TokenOptions
+
+// UseTokens sets how tokens are signed and how long they last, it is called once before serving
+func UseTokens(options TokenOptions) {
+	tokenOptions = options
+}
+
 func createToken(body map[string]interface{}, expirationTime time.Time, secretKey []byte) (string, error) {
 	token := jwt.New(jwt.SigningMethodHS256)
 	claims := token.Claims.(jwt.MapClaims)
@@ -36,21 +48,77 @@ func createToken(body map[string]interface{}, expirationTime time.Time, secretKe
 
 func CreateAccessToken(body map[string]interface{}) (string, error) {
 
-	expirationTime := tools.GetEnvInt("refreshExpirationTimeDays", 30)
-	expirationTimeUnix := time.Now().Add(time.Duration(expirationTime) * time.Hour)
+	expirationTimeUnix := time.Now().Add(tokenOptions.AccessExpiration)
 
-	return createToken(body, expirationTimeUnix, []byte(os.Getenv("secretKey")))
+	return createToken(body, expirationTimeUnix, tokenOptions.Secret)
 }
 func CreateRefreshToken(body map[string]interface{}) (string, error) {
-	expirationTime := tools.GetEnvInt("refreshExpirationTimeDays", 30)
-	expirationTimeUnix := time.Now().Add(time.Duration(expirationTime) * 24 * time.Hour)
-	return createToken(body,expirationTimeUnix, []byte(os.Getenv("secretKey")))
+	expirationTimeUnix := time.Now().Add(tokenOptions.RefreshExpiration)
+	return createToken(body,expirationTimeUnix, tokenOptions.Secret)
+}
+
+const (
+	purposeClaim = "purpose"
+	mfaChallengePurpose = "mfa_challenge"
+	// MFAClaim marks access and refresh tokens issued after a second factor was checked
+	MFAClaim = "mfa"
+	mfaChallengeExpirationMinutes = 5
+	// MFAEnrollmentExpiration is how long an admin-issued enrollment token can be used
+	MFAEnrollmentExpiration = 72 * time.Hour
+)
+
+// CreateMFAChallengeToken issues the short-lived token handed out between the password and the TOTP step.
+// It is rejected by Validate, so it can't be used as an access or refresh token.
+func CreateMFAChallengeToken(email string) (string, error) {
+	expirationTime := time.Now().Add(mfaChallengeExpirationMinutes * time.Minute)
+	return createToken(map[string]interface{}{
+		"email":      email,
+		purposeClaim: mfaChallengePurpose,
+	}, expirationTime, tokenOptions.Secret)
+}
+
+func ValidateMFAChallenge(tokenString string) (string, error) {
+	token, err := parse(tokenString)
+	if err != nil {
+		return "", err
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if purpose, _ := claims[purposeClaim].(string); purpose != mfaChallengePurpose {
+		return "", fmt.Errorf("Not an MFA challenge token")
+	}
+	email, ok := claims["email"].(string)
+	if !ok {
+		return "", fmt.Errorf("Invalid token")
+	}
+	return email, nil
+}
+
+// HasMFAClaim reports whether the token was issued after a successful second factor
+func HasMFAClaim(tokenString string) bool {
+	token, err := parse(tokenString)
+	if err != nil {
+		return false
+	}
+	verified, _ := token.Claims.(jwt.MapClaims)[MFAClaim].(bool)
+	return verified
+}
+
+func parse(tokenString string) (*jwt.Token, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return tokenOptions.Secret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := token.Claims.(jwt.MapClaims); !ok || !token.Valid {
+		return nil, fmt.Errorf("Invalid token")
+	}
+	return token, nil
 }
 
 func Validate(tokenString string) (*jwt.Token, error) {
-	secretKey := os.Getenv("secretKey")
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secretKey), nil
+		return tokenOptions.Secret, nil
 	})
 	if err!=nil {
 		return nil,err
@@ -61,13 +129,15 @@ func Validate(tokenString string) (*jwt.Token, error) {
 	if token.Claims.(jwt.MapClaims)["exp"].(float64)<float64(time.Now().Unix()) {
 		return nil, fmt.Errorf("Expired token is being used")
 	}
+	if _, ok := token.Claims.(jwt.MapClaims)[purposeClaim]; ok {
+		return nil, fmt.Errorf("Invalid token")
+	}
 	return token, nil
 }
 
 func GetSubject(tokenString string) (string, error)  {
-	secretKey := os.Getenv("secretKey")
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secretKey), nil
+		return tokenOptions.Secret, nil
 	})
 	if err!=nil {
 		return "" ,err
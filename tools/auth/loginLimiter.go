@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AttemptState is what the limiter remembers about one account or ip
+type AttemptState struct {
+	Failures int
+	LastFailure time.Time
+	LockedUntil time.Time
+	// Pending attempts passed Check and are not settled yet, they count as failures until they are
+	Pending int
+	LastPending time.Time
+}
+
+// pendingExpiration forgets attempts that were never settled, a request that died half way doesn't block forever
+const pendingExpiration = time.Minute
+
+// AttemptStore keeps failed login attempts. The in-memory store is enough for a single node,
+// a shared store (redis, mongo) is needed once the api runs on several instances.
+type AttemptStore interface {
+	Get(key string) (AttemptState, error)
+	Save(key string, state AttemptState) error
+	Delete(key string) error
+}
+
+type LoginLimiter interface {
+	// Check returns how long the caller has to wait before the next attempt, zero when allowed.
+	// An allowed attempt is reserved, so parallel attempts can't all pass before the first one fails,
+	// and has to be settled with RegisterFailure or RegisterSuccess.
+	Check(email string, ip string) (time.Duration, error)
+	RegisterFailure(email string, ip string) error
+	RegisterSuccess(email string, ip string) error
+	Unlock(email string) error
+}
+
+type LoginLimiterOptions struct {
+	// failures allowed before the backoff kicks in
+	FreeAttempts int
+	BaseDelay time.Duration
+	MaxDelay time.Duration
+	AccountLockoutThreshold int
+	IPLockoutThreshold int
+	LockoutDuration time.Duration
+	// failures older than this are forgotten
+	ResetAfter time.Duration
+}
+
+func DefaultLoginLimiterOptions() LoginLimiterOptions {
+	return LoginLimiterOptions{
+		FreeAttempts:            3,
+		BaseDelay:               time.Second,
+		MaxDelay:                5 * time.Minute,
+		AccountLockoutThreshold: 10,
+		IPLockoutThreshold:      50,
+		LockoutDuration:         30 * time.Minute,
+		ResetAfter:              24 * time.Hour,
+	}
+}
+
+func NewLoginLimiter(store AttemptStore, options LoginLimiterOptions) LoginLimiter {
+	return &defaultLoginLimiter{store: store, options: options, now: time.Now}
+}
+
+type defaultLoginLimiter struct {
+	// serialises read-modify-write on the store, Check included
+	mu sync.Mutex
+	store AttemptStore
+	options LoginLimiterOptions
+	now func() time.Time
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func (l *defaultLoginLimiter) Check(email string, ip string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keys := []string{accountKey(email), ipKey(ip)}
+	states := make([]AttemptState, len(keys))
+	var wait time.Duration
+	for i, key := range keys {
+		state, err := l.get(key)
+		if err != nil {
+			return 0, err
+		}
+		states[i] = state
+		if w := l.waitFor(state); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+	now := l.now()
+	for i, key := range keys {
+		states[i].Pending++
+		states[i].LastPending = now
+		if err := l.store.Save(key, states[i]); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+// get reads the state of key with its expired pending attempts dropped
+func (l *defaultLoginLimiter) get(key string) (AttemptState, error) {
+	state, err := l.store.Get(key)
+	if err != nil {
+		return state, err
+	}
+	if state.Pending > 0 && l.now().Sub(state.LastPending) > pendingExpiration {
+		state.Pending = 0
+	}
+	return state, nil
+}
+
+// waitFor counts pending attempts as failures made when they were reserved
+func (l *defaultLoginLimiter) waitFor(state AttemptState) time.Duration {
+	now := l.now()
+	if state.LockedUntil.After(now) {
+		return state.LockedUntil.Sub(now)
+	}
+	failures := state.Failures + state.Pending
+	if failures < l.options.FreeAttempts {
+		return 0
+	}
+	exponent := float64(failures - l.options.FreeAttempts)
+	delay := time.Duration(float64(l.options.BaseDelay) * math.Pow(2, exponent))
+	if delay > l.options.MaxDelay || delay <= 0 {
+		delay = l.options.MaxDelay
+	}
+	last := state.LastFailure
+	if state.Pending > 0 && state.LastPending.After(last) {
+		last = state.LastPending
+	}
+	if next := last.Add(delay); next.After(now) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+func (l *defaultLoginLimiter) RegisterFailure(email string, ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.registerFailure(accountKey(email), l.options.AccountLockoutThreshold); err != nil {
+		return err
+	}
+	return l.registerFailure(ipKey(ip), l.options.IPLockoutThreshold)
+}
+
+func (l *defaultLoginLimiter) registerFailure(key string, lockoutThreshold int) error {
+	now := l.now()
+	state, err := l.get(key)
+	if err != nil {
+		return err
+	}
+	state.Pending = max(state.Pending-1, 0)
+	if !state.LastFailure.IsZero() && now.Sub(state.LastFailure) > l.options.ResetAfter {
+		state.Failures = 0
+		state.LockedUntil = time.Time{}
+	}
+	state.Failures++
+	state.LastFailure = now
+	if lockoutThreshold > 0 && state.Failures >= lockoutThreshold {
+		state.LockedUntil = now.Add(l.options.LockoutDuration)
+		state.Failures = 0
+	}
+	return l.store.Save(key, state)
+}
+
+func (l *defaultLoginLimiter) RegisterSuccess(email string, ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.store.Delete(accountKey(email)); err != nil {
+		return err
+	}
+	// the ip keeps its history, one valid account must not clear a credential stuffing run
+	state, err := l.get(ipKey(ip))
+	if err != nil || state.Pending == 0 {
+		return err
+	}
+	state.Pending--
+	return l.store.Save(ipKey(ip), state)
+}
+
+func (l *defaultLoginLimiter) Unlock(email string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.store.Delete(accountKey(email))
+}
+
+const memoryStorePruneSize = 10000
+
+func NewMemoryAttemptStore() AttemptStore {
+	return &memoryAttemptStore{entries: map[string]AttemptState{}}
+}
+
+type memoryAttemptStore struct {
+	mu sync.Mutex
+	entries map[string]AttemptState
+}
+
+// prune drops entries that are neither locked, failed recently nor pending, so the map can't grow forever
+func (m *memoryAttemptStore) prune(now time.Time) {
+	for key, state := range m.entries {
+		if state.LockedUntil.Before(now) && now.Sub(state.LastFailure) > 24*time.Hour && now.Sub(state.LastPending) > pendingExpiration {
+			delete(m.entries, key)
+		}
+	}
+}
+
+func (m *memoryAttemptStore) Get(key string) (AttemptState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.entries[key], nil
+}
+
+func (m *memoryAttemptStore) Save(key string, state AttemptState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.entries) >= memoryStorePruneSize {
+		m.prune(time.Now())
+	}
+	m.entries[key] = state
+	return nil
+}
+
+func (m *memoryAttemptStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
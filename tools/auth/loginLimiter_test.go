@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(now *time.Time) *defaultLoginLimiter {
+	options := DefaultLoginLimiterOptions()
+	limiter := NewLoginLimiter(NewMemoryAttemptStore(), options).(*defaultLoginLimiter)
+	limiter.now = func() time.Time { return *now }
+	return limiter
+}
+
+func TestLoginLimiterParallelAttempts(t *testing.T) {
+	now := time.Now()
+	limiter := newTestLimiter(&now)
+
+	// every attempt passes Check before any of them has failed
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, err := limiter.Check("admin", "10.0.0.1")
+			if err != nil {
+				t.Error(err)
+			}
+			if wait == 0 {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := allowed.Load(); got != int32(limiter.options.FreeAttempts) {
+		t.Fatalf("%d parallel attempts allowed, want the %d free ones", got, limiter.options.FreeAttempts)
+	}
+}
+
+func TestLoginLimiterSettlesReservations(t *testing.T) {
+	now := time.Now()
+	limiter := newTestLimiter(&now)
+	free := limiter.options.FreeAttempts
+
+	for i := 0; i < free; i++ {
+		if wait, _ := limiter.Check("admin", "10.0.0.1"); wait != 0 {
+			t.Fatalf("attempt %d waits %s", i+1, wait)
+		}
+	}
+	if wait, _ := limiter.Check("admin", "10.0.0.2"); wait == 0 {
+		t.Fatal("attempt beyond the free ones allowed while they are pending")
+	}
+	// the pending attempts succeed, the account is free again
+	for i := 0; i < free; i++ {
+		if err := limiter.RegisterSuccess("admin", "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wait, _ := limiter.Check("admin", "10.0.0.2"); wait != 0 {
+		t.Fatalf("attempt after successes waits %s", wait)
+	}
+	if err := limiter.RegisterFailure("admin", "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// an attempt that is never settled stops counting after a while
+	for i := 0; i < free; i++ {
+		limiter.Check("other", "10.0.0.3")
+	}
+	if wait, _ := limiter.Check("other", "10.0.0.4"); wait == 0 {
+		t.Fatal("attempt allowed while the free ones are pending")
+	}
+	now = now.Add(pendingExpiration + time.Second)
+	if wait, _ := limiter.Check("other", "10.0.0.4"); wait != 0 {
+		t.Fatalf("attempt waits %s after the pending ones expired", wait)
+	}
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"palyvoua/internal/models"
+	"time"
+)
+
+const (
+	// SessionClaim holds the id of the session a token was issued for
+	SessionClaim = "sid"
+	sessionLastSeenResolution = 60
+)
+
+type sessionRepo interface {
+	GetByID(c context.Context, id uuid.UUID) (models.Session, error)
+	Touch(c context.Context, id uuid.UUID, lastSeenAt int, ip string) error
+}
+
+var sessions sessionRepo
+
+// UseSessions makes AuthMiddleware reject tokens whose session was revoked
+func UseSessions(repo sessionRepo) {
+	sessions = repo
+}
+
+// GetSessionID returns the session of a token, uuid.Nil for invalid tokens and those issued before sessions existed
+func GetSessionID(tokenString string) uuid.UUID {
+	token, err := parse(tokenString)
+	if err != nil {
+		return uuid.Nil
+	}
+	sid, _ := token.Claims.(jwt.MapClaims)[SessionClaim].(string)
+	id, err := uuid.Parse(sid)
+	if err != nil {
+		return uuid.Nil
+	}
+	return id
+}
+
+// CheckSession fails when the session behind the token was revoked, and records activity on it.
+// Tokens from before sessions existed are refused, they could never be revoked.
+func CheckSession(c *gin.Context, tokenString string) error {
+	if sessions == nil {
+		return nil
+	}
+	sid := GetSessionID(tokenString)
+	if sid == uuid.Nil {
+		return fmt.Errorf("Token has no session, log in again")
+	}
+	session, err := sessions.GetByID(c, sid)
+	if err != nil {
+		return fmt.Errorf("Unknown session")
+	}
+	if session.RevokedAt != 0 {
+		return fmt.Errorf("Session has been revoked")
+	}
+	now := int(time.Now().Unix())
+	if now-session.LastSeenAt > sessionLastSeenResolution {
+		_ = sessions.Touch(c, sid, now, c.ClientIP())
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package caller
+
+import (
+	"runtime"
+	"strings"
+	"unicode"
+)
+
+const repositoryPackage = "palyvoua/internal/repository."
+
+// Repository finds the innermost repository method on the stack,
+// "palyvoua/internal/repository.(*defaultUserRepo).GetByID.func1" is userRepo and GetByID
+func Repository() (string, string, bool) {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		if name, found := strings.CutPrefix(frame.Function, repositoryPackage); found {
+			parts := strings.Split(name, ".")
+			if len(parts) >= 2 && strings.HasPrefix(parts[0], "(*") {
+				return repositoryName(strings.Trim(parts[0], "(*)")), parts[1], true
+			}
+		}
+		if !more {
+			return "", "", false
+		}
+	}
+}
+
+// repositoryName drops the default prefix the implementations share, defaultTicketRepo is ticketRepo
+func repositoryName(typeName string) string {
+	name, found := strings.CutPrefix(typeName, "default")
+	if !found || name == "" {
+		return typeName
+	}
+	runes := []rune(name)
+	runes[0] = unicode.ToLower(runes[0])
+	return string(runes)
+}
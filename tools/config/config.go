@@ -0,0 +1,282 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	PAYMENT_PROVIDER_STRIPE = "stripe"
+	// PAYMENT_PROVIDER_FAKE takes no real payments, it is meant for development and tests
+	PAYMENT_PROVIDER_FAKE = "fake"
+
+	OIDC_PROVIDER_GOOGLE = "google"
+	OIDC_PROVIDER_APPLE = "apple"
+)
+
+// Config is everything the api is configured with. Fields are read from the variable in their env tag,
+// a unit tag lets a plain number stand for that many units of a duration.
+type Config struct {
+	Server Server
+	Log Log
+	Tracing Tracing
+	Metrics Metrics
+	Health Health
+	DB DB
+	Auth Auth
+	OIDC OIDC
+	Payment Payment
+	Tickets Tickets
+	Wallet Wallet
+	Catalog Catalog
+	Receipt Receipt
+	Fiscal Fiscal
+	Webhook Webhook
+	Notification Notification
+	Account Account
+	SeedDB bool `env:"SEED_DB" usage:"fill the database with sample data on start"`
+}
+
+type Server struct {
+	Port string `env:"PORT" default:"8080"`
+	ReadHeaderTimeout time.Duration `env:"HTTP_READ_HEADER_TIMEOUT_SECONDS" default:"5" unit:"second"`
+	ReadTimeout time.Duration `env:"HTTP_READ_TIMEOUT_SECONDS" default:"30" unit:"second"`
+	WriteTimeout time.Duration `env:"HTTP_WRITE_TIMEOUT_SECONDS" default:"60" unit:"second"`
+	IdleTimeout time.Duration `env:"HTTP_IDLE_TIMEOUT_SECONDS" default:"120" unit:"second"`
+	ShutdownDrain time.Duration `env:"SHUTDOWN_DRAIN_SECONDS" default:"0" unit:"second" usage:"how long /readyz fails before the server stops accepting connections"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT_SECONDS" default:"30" unit:"second" usage:"how long requests and background jobs get to finish on shutdown"`
+}
+
+type Log struct {
+	Level string `env:"LOG_LEVEL" default:"info"`
+	Format string `env:"LOG_FORMAT" default:"text" usage:"text or json"`
+}
+
+type Tracing struct {
+	Exporter string `env:"OTEL_TRACES_EXPORTER" default:"none" usage:"none, stdout or otlp"`
+	ServiceName string `env:"OTEL_SERVICE_NAME" default:"palyvo-api"`
+	SampleRatio float64 `env:"OTEL_TRACES_SAMPLER_ARG" default:"1" usage:"share of new traces kept, from 0 to 1"`
+}
+
+type Metrics struct {
+	Token Secret `env:"METRICS_TOKEN" usage:"bearer token scrapers send, /metrics is open without it"`
+}
+
+type Health struct {
+	Timeout time.Duration `env:"HEALTH_TIMEOUT_SECONDS" default:"3" unit:"second"`
+	PaymentCache time.Duration `env:"HEALTH_PAYMENT_CACHE_SECONDS" default:"30" unit:"second" usage:"how long a check of the payment provider is reused"`
+}
+
+type DB struct {
+	ConnectTimeout time.Duration `env:"DB_CONNECT_TIMEOUT_SECONDS" default:"10" unit:"second"`
+	// MongoURL may carry credentials
+	MongoURL Secret `env:"DB_URL" required:"true"`
+	Postgres Postgres
+}
+
+type Postgres struct {
+	Host string `env:"POSTGRES_HOST" required:"true"`
+	Port int `env:"POSTGRES_PORT" default:"5432"`
+	User string `env:"POSTGRES_USER" required:"true"`
+	Password Secret `env:"POSTGRES_PASSWORD"`
+	Name string `env:"POSTGRES_DB_NAME" required:"true"`
+	SSLMode string `env:"POSTGRES_SSLMODE" default:"disable"`
+}
+
+type Auth struct {
+	// TokenSecret signs the access and refresh tokens
+	TokenSecret Secret `env:"secretKey" required:"true"`
+	RefreshExpiration time.Duration `env:"refreshExpirationTimeDays" default:"30" unit:"day"`
+	LoginFreeAttempts int `env:"LOGIN_FREE_ATTEMPTS" default:"3"`
+	LoginAccountLockoutThreshold int `env:"LOGIN_ACCOUNT_LOCKOUT_THRESHOLD" default:"10"`
+	LoginIPLockoutThreshold int `env:"LOGIN_IP_LOCKOUT_THRESHOLD" default:"50"`
+	LoginLockout time.Duration `env:"LOGIN_LOCKOUT_MINUTES" default:"30" unit:"minute"`
+	MFAIssuer string `env:"MFA_ISSUER" default:"Palyvo" usage:"name authenticator apps show next to the account"`
+}
+
+// OIDC signs users in with the providers listed in Providers, each needs its client
+type OIDC struct {
+	Providers string `env:"OIDC_PROVIDERS" usage:"comma separated, google and apple"`
+	Google OIDCGoogle
+	Apple OIDCApple
+}
+
+type OIDCGoogle struct {
+	Issuer string `env:"OIDC_GOOGLE_ISSUER" default:"https://accounts.google.com"`
+	ClientID string `env:"OIDC_GOOGLE_CLIENT_ID"`
+	ClientSecret Secret `env:"OIDC_GOOGLE_CLIENT_SECRET"`
+	RedirectURL string `env:"OIDC_GOOGLE_REDIRECT_URL"`
+}
+
+// OIDCApple takes a static ClientSecret or the key a short-lived one is signed with
+type OIDCApple struct {
+	Issuer string `env:"OIDC_APPLE_ISSUER" default:"https://appleid.apple.com"`
+	ClientID string `env:"OIDC_APPLE_CLIENT_ID"`
+	ClientSecret Secret `env:"OIDC_APPLE_CLIENT_SECRET"`
+	RedirectURL string `env:"OIDC_APPLE_REDIRECT_URL"`
+	TeamID string `env:"OIDC_APPLE_TEAM_ID"`
+	KeyID string `env:"OIDC_APPLE_KEY_ID"`
+	PrivateKey Secret `env:"OIDC_APPLE_PRIVATE_KEY" usage:"PEM of the sign in with apple key"`
+}
+
+// ProviderNames splits Providers, names are lower case
+func (o *OIDC) ProviderNames() []string {
+	var names []string
+	for _, name := range strings.Split(o.Providers, ",") {
+		if name = strings.TrimSpace(strings.ToLower(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+type Payment struct {
+	Provider string `env:"PAYMENT_PROVIDER" default:"stripe" usage:"stripe or fake"`
+	StripeSecretKey Secret `env:"STRIPE_SECRET_KEY"`
+	StripeWebhookSecret Secret `env:"WEBHOOK_SECRET_STRIPE"`
+	// FakeWebhookURL is left empty to have the fake provider call this api's own /payment/webhook
+	FakeWebhookURL string `env:"FAKE_PAYMENT_WEBHOOK_URL"`
+	FakeWebhookSecret Secret `env:"FAKE_PAYMENT_WEBHOOK_SECRET" default:"fake"`
+	SellerProviders string `env:"PAYMENT_SELLER_PROVIDERS" usage:"checkout provider of a seller's tickets, like wog:liqpay,okko:monobank"`
+	ReturnURLs string `env:"CHECKOUT_RETURN_URLS" usage:"json object of success and cancel urls keyed by platform or client/platform"`
+	LiqPay LiqPay
+	Monobank Monobank
+}
+
+// LiqPay is offered at checkout once both keys are set
+type LiqPay struct {
+	PublicKey string `env:"LIQPAY_PUBLIC_KEY"`
+	PrivateKey Secret `env:"LIQPAY_PRIVATE_KEY"`
+	CallbackURL string `env:"LIQPAY_CALLBACK_URL" usage:"this api's /payment/webhook/liqpay"`
+	Sandbox bool `env:"LIQPAY_SANDBOX"`
+}
+
+// Monobank is offered at checkout once Token is set
+type Monobank struct {
+	Token Secret `env:"MONOBANK_TOKEN"`
+	BaseURL string `env:"MONOBANK_BASE_URL" default:"https://api.monobank.ua"`
+	WebhookURL string `env:"MONOBANK_WEBHOOK_URL" usage:"this api's /payment/webhook/monobank"`
+	PublicKey string `env:"MONOBANK_PUBLIC_KEY" usage:"verifies webhooks, fetched from monobank when empty"`
+}
+
+type Tickets struct {
+	Expiration time.Duration `env:"TICKET_EXPIRATION" required:"true" unit:"day" usage:"how long a bought ticket can be used"`
+}
+
+type Wallet struct {
+	Currency string `env:"WALLET_CURRENCY" default:"UAH"`
+	MaxTopUp int `env:"WALLET_MAX_TOP_UP" default:"1000000" usage:"largest top-up in minor units"`
+}
+
+type Catalog struct {
+	ReconcileInterval time.Duration `env:"CATALOG_RECONCILE_INTERVAL_MINUTES" default:"0" unit:"minute" usage:"0 turns the reconciler off"`
+	ReconcileRepair bool `env:"CATALOG_RECONCILE_REPAIR"`
+}
+
+type Receipt struct {
+	Issuer string `env:"RECEIPT_ISSUER" default:"Palyvo" usage:"printed at the top of every receipt"`
+	NumberPrefix string `env:"RECEIPT_NUMBER_PREFIX" default:"PV"`
+	DefaultVATRate int `env:"RECEIPT_DEFAULT_VAT_RATE" default:"20" usage:"percent, for sellers without details"`
+	Sellers string `env:"RECEIPT_SELLERS" usage:"json object of seller details keyed by seller"`
+}
+
+// MaxAttempts of 0 leave the limits to the services' own defaults
+type Fiscal struct {
+	Provider string `env:"FISCAL_PROVIDER" usage:"empty turns fiscalization off"`
+	CashRegisterID string `env:"FISCAL_CASH_REGISTER_ID"`
+	MaxAttempts int `env:"FISCAL_MAX_ATTEMPTS"`
+	Interval time.Duration `env:"FISCAL_INTERVAL_SECONDS" default:"10" unit:"second"`
+}
+
+type Webhook struct {
+	MaxAttempts int `env:"WEBHOOK_MAX_ATTEMPTS"`
+	AllowHTTP bool `env:"WEBHOOK_ALLOW_HTTP"`
+	AllowPrivateNetworks bool `env:"WEBHOOK_ALLOW_PRIVATE_NETWORKS" usage:"deliver to loopback and private addresses, for local development"`
+	Interval time.Duration `env:"WEBHOOK_INTERVAL_SECONDS" default:"10" unit:"second"`
+}
+
+type Notification struct {
+	ExpiryNotice time.Duration `env:"NOTIFY_EXPIRY_HOURS" default:"48" unit:"hour"`
+	MaxAttempts int `env:"NOTIFY_MAX_ATTEMPTS"`
+	Interval time.Duration `env:"NOTIFY_INTERVAL_SECONDS" default:"30" unit:"second"`
+	// SinkDir takes the SMS and push messages, there is no gateway for them yet
+	SinkDir string `env:"NOTIFICATION_SINK_DIR" usage:"directory sms and push messages are written to, the log when empty"`
+}
+
+type Account struct {
+	DeletionGrace time.Duration `env:"ACCOUNT_DELETION_GRACE_DAYS" default:"30" unit:"day"`
+}
+
+// validate checks what the tags can't say, required values are checked while loading
+func (c *Config) validate() error {
+	var errs []error
+	positive := func(key string, d time.Duration) {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be greater than 0", key))
+		}
+	}
+	notNegative := func(key string, d time.Duration) {
+		if d < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", key))
+		}
+	}
+
+	switch c.Payment.Provider {
+	case PAYMENT_PROVIDER_STRIPE:
+		if c.Payment.StripeSecretKey == "" {
+			errs = append(errs, errors.New("STRIPE_SECRET_KEY is required with the stripe payment provider"))
+		}
+		if c.Payment.StripeWebhookSecret == "" {
+			errs = append(errs, errors.New("WEBHOOK_SECRET_STRIPE is required with the stripe payment provider"))
+		}
+	case PAYMENT_PROVIDER_FAKE:
+	default:
+		errs = append(errs, fmt.Errorf("PAYMENT_PROVIDER: unknown provider %q", c.Payment.Provider))
+	}
+	if c.Payment.LiqPay.PublicKey != "" && c.Payment.LiqPay.PrivateKey == "" {
+		errs = append(errs, errors.New("LIQPAY_PRIVATE_KEY is required with LIQPAY_PUBLIC_KEY"))
+	}
+	for _, name := range c.OIDC.ProviderNames() {
+		switch name {
+		case OIDC_PROVIDER_GOOGLE:
+			if c.OIDC.Google.ClientID == "" || c.OIDC.Google.ClientSecret == "" || c.OIDC.Google.RedirectURL == "" {
+				errs = append(errs, errors.New("OIDC_GOOGLE_CLIENT_ID, OIDC_GOOGLE_CLIENT_SECRET and OIDC_GOOGLE_REDIRECT_URL are required with the google provider"))
+			}
+		case OIDC_PROVIDER_APPLE:
+			apple := c.OIDC.Apple
+			if apple.ClientID == "" || apple.RedirectURL == "" {
+				errs = append(errs, errors.New("OIDC_APPLE_CLIENT_ID and OIDC_APPLE_REDIRECT_URL are required with the apple provider"))
+			}
+			if apple.ClientSecret == "" && (apple.TeamID == "" || apple.KeyID == "" || apple.PrivateKey == "") {
+				errs = append(errs, errors.New("the apple provider needs OIDC_APPLE_CLIENT_SECRET or OIDC_APPLE_TEAM_ID, OIDC_APPLE_KEY_ID and OIDC_APPLE_PRIVATE_KEY"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("OIDC_PROVIDERS: unknown provider %q", name))
+		}
+	}
+	if c.Receipt.DefaultVATRate < 0 {
+		errs = append(errs, errors.New("RECEIPT_DEFAULT_VAT_RATE must not be negative"))
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG must be between 0 and 1"))
+	}
+
+	positive("TICKET_EXPIRATION", c.Tickets.Expiration)
+	positive("refreshExpirationTimeDays", c.Auth.RefreshExpiration)
+	positive("DB_CONNECT_TIMEOUT_SECONDS", c.DB.ConnectTimeout)
+	positive("HEALTH_TIMEOUT_SECONDS", c.Health.Timeout)
+	// the jobs tick at these intervals, a ticker can't tick every 0s
+	positive("FISCAL_INTERVAL_SECONDS", c.Fiscal.Interval)
+	positive("WEBHOOK_INTERVAL_SECONDS", c.Webhook.Interval)
+	positive("NOTIFY_INTERVAL_SECONDS", c.Notification.Interval)
+	notNegative("CATALOG_RECONCILE_INTERVAL_MINUTES", c.Catalog.ReconcileInterval)
+	notNegative("HTTP_READ_HEADER_TIMEOUT_SECONDS", c.Server.ReadHeaderTimeout)
+	notNegative("HTTP_READ_TIMEOUT_SECONDS", c.Server.ReadTimeout)
+	notNegative("HTTP_WRITE_TIMEOUT_SECONDS", c.Server.WriteTimeout)
+	notNegative("HTTP_IDLE_TIMEOUT_SECONDS", c.Server.IdleTimeout)
+	notNegative("SHUTDOWN_DRAIN_SECONDS", c.Server.ShutdownDrain)
+	positive("SHUTDOWN_TIMEOUT_SECONDS", c.Server.ShutdownTimeout)
+	return errors.Join(errs...)
+}
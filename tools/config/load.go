@@ -0,0 +1,243 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/joho/godotenv"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DEFAULT_FILE is read when it exists, a file named with -config or CONFIG_FILE has to exist
+const DEFAULT_FILE = ".env"
+
+var units = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+}
+
+// Load reads the config from, by increasing precedence, the defaults, the env file, the environment and the flags in args.
+// Every field gets a flag named after its variable, DB_URL is set with -db-url.
+//
+// The flags are added to flagSet, which parses args. With -print-config the redacted config is printed and the process exits.
+func Load(flagSet *flag.FlagSet, args []string) (*Config, error) {
+	config := &Config{}
+	fields := fieldsOf(reflect.ValueOf(config).Elem())
+
+	file := flagSet.String("config", "", "env file to read, "+DEFAULT_FILE+" by default")
+	printConfig := flagSet.Bool("print-config", false, "print the config with its secrets redacted and exit")
+	flagged := map[string]string{}
+	for _, f := range fields {
+		key := f.key
+		flagSet.Func(flagName(key), f.usage(), func(value string) error {
+			flagged[key] = value
+			return nil
+		})
+	}
+	if err := flagSet.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := loadFile(*file); err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, f := range fields {
+		value, ok := flagged[f.key]
+		if !ok {
+			value = os.Getenv(f.key)
+		}
+		if value == "" {
+			value = f.defaultValue
+		}
+		if value == "" {
+			if f.required {
+				errs = append(errs, fmt.Errorf("%s is required", f.key))
+			}
+			continue
+		}
+		if err := f.set(value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		errs = append(errs, config.validate())
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	if *printConfig {
+		config.Dump(os.Stdout)
+		os.Exit(0)
+	}
+	return config, nil
+}
+
+func loadFile(name string) error {
+	if name == "" {
+		name = os.Getenv("CONFIG_FILE")
+	}
+	if name != "" {
+		return godotenv.Load(name)
+	}
+	// running without an env file is normal once the variables come from the environment
+	if err := godotenv.Load(DEFAULT_FILE); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Dump writes the config as KEY=value lines that could be read back, secrets are redacted
+func (c *Config) Dump(w io.Writer) {
+	for _, f := range fieldsOf(reflect.ValueOf(c).Elem()) {
+		fmt.Fprintf(w, "%s=%s\n", f.key, f.String())
+	}
+}
+
+// LogValue keeps secrets redacted when the config is logged
+func (c *Config) LogValue() slog.Value {
+	fields := fieldsOf(reflect.ValueOf(c).Elem())
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, f := range fields {
+		attrs = append(attrs, slog.String(f.key, f.String()))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+type field struct {
+	key string
+	defaultValue string
+	required bool
+	unit time.Duration
+	description string
+	value reflect.Value
+}
+
+func fieldsOf(v reflect.Value) []field {
+	var fields []field
+	for i := 0; i < v.NumField(); i++ {
+		structField := v.Type().Field(i)
+		key, ok := structField.Tag.Lookup("env")
+		if !ok {
+			if structField.Type.Kind() == reflect.Struct {
+				fields = append(fields, fieldsOf(v.Field(i))...)
+			}
+			continue
+		}
+		f := field{
+			key:          key,
+			defaultValue: structField.Tag.Get("default"),
+			required:     structField.Tag.Get("required") == "true",
+			description:  structField.Tag.Get("usage"),
+			value:        v.Field(i),
+		}
+		if unit := structField.Tag.Get("unit"); unit != "" {
+			f.unit = units[unit]
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// set parses value into the field. Errors quote the value, secrets are strings and never fail to parse.
+func (f *field) set(value string) error {
+	switch f.value.Interface().(type) {
+	case time.Duration:
+		// a bare number counts in the unit of the field, anything else is a duration like 90s
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil && f.unit != 0 {
+			f.value.SetInt(n * int64(f.unit))
+			return nil
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s: %q is neither a number nor a duration", f.key, value)
+		}
+		f.value.SetInt(int64(d))
+		return nil
+	}
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a whole number", f.key, value)
+		}
+		f.value.SetInt(int64(n))
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a number", f.key, value)
+		}
+		f.value.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not true or false", f.key, value)
+		}
+		f.value.SetBool(b)
+	default:
+		return fmt.Errorf("%s: fields of type %s are not supported", f.key, f.value.Type())
+	}
+	return nil
+}
+
+func (f *field) String() string {
+	if stringer, ok := f.value.Interface().(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	return fmt.Sprint(f.value.Interface())
+}
+
+func (f *field) usage() string {
+	usage := "sets " + f.key
+	if f.description != "" {
+		usage += ", " + f.description
+	}
+	if f.unit != 0 {
+		usage += " (" + unitName(f.unit) + "s or a duration like 90s)"
+	}
+	if f.required {
+		usage += " (required)"
+	}
+	if f.defaultValue != "" {
+		usage += " (default " + f.defaultValue + ")"
+	}
+	return usage
+}
+
+func unitName(unit time.Duration) string {
+	for name, d := range units {
+		if d == unit {
+			return name
+		}
+	}
+	return unit.String()
+}
+
+// flagName turns the variable of a field into a flag, DB_URL into db-url and secretKey into secret-key
+func flagName(key string) string {
+	if strings.ToUpper(key) == key {
+		return strings.ReplaceAll(strings.ToLower(key), "_", "-")
+	}
+	var name strings.Builder
+	for i, r := range key {
+		if unicode.IsUpper(r) && i > 0 {
+			name.WriteByte('-')
+		}
+		name.WriteRune(unicode.ToLower(r))
+	}
+	return name.String()
+}
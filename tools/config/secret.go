@@ -0,0 +1,34 @@
+package config
+
+import (
+	"log/slog"
+	"palyvoua/tools/logging"
+)
+
+// Secret is a value that must not show up in logs or dumps, however it is printed.
+// Value hands out the real thing to the code that needs it.
+type Secret string
+
+func (s Secret) Value() string {
+	return string(s)
+}
+
+// String redacts the secret, an unset one stays empty so a dump still tells whether it was given
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return logging.REDACTED
+}
+
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
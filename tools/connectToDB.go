@@ -7,39 +7,53 @@ import (
 	_ "github.com/lib/pq"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"log"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"log/slog"
 	"os"
+	"palyvoua/tools/config"
+	"palyvoua/tools/logging"
+	"palyvoua/tools/metrics"
+	"palyvoua/tools/tracing"
 )
 
 var DB *mongo.Database
 
-func ConnectToDb() {
+// ConnectToDb connects to mongo and pings it within ConnectTimeout, the driver connects lazily and would only fail on the first query
+func ConnectToDb(dbConfig config.DB) {
 
-	mongoUri := os.Getenv("DB_URL")
-	mongoOptions := options.Client().ApplyURI(mongoUri)
+	mongoOptions := options.Client().ApplyURI(dbConfig.MongoURL.Value()).SetMonitor(tracing.MongoMonitor(metrics.MongoMonitor()))
 	client, err := mongo.Connect(context.TODO(), mongoOptions)
 	if err != nil {
-		log.Println("Error while connecting to database at /utils/connectToDb.go")
-		log.Fatal(err)
+		slog.Error("connecting to mongo failed", logging.Err(err))
+		os.Exit(1)
 	}
 	DB = client.Database("palyvo-db")
-	fmt.Errorf(DB.Name())
+	c, cancel := context.WithTimeout(context.Background(), dbConfig.ConnectTimeout)
+	defer cancel()
+	if err = PingMongo(c); err != nil {
+		slog.Error("pinging mongo failed", logging.Err(err))
+		os.Exit(1)
+	}
+	slog.Info("connected to mongo", "database", DB.Name())
 }
 
 var RelationalDB *sql.DB
-func ConnectToPostgres() {
+func ConnectToPostgres(dbConfig config.DB) {
 	var err error
-	username := os.Getenv("POSTGRES_USER")
-	password := os.Getenv("POSTGRES_PASSWORD")
-	dbname := os.Getenv("POSTGRES_DB_NAME")
-	host := os.Getenv("POSTGRES_HOST")
+	postgres := dbConfig.Postgres
 
-	connStr := fmt.Sprintf("host=%s port=5432 user=%s password=%s dbname=%s sslmode=disable", host, username, password, dbname)
+	connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s", postgres.Host, postgres.Port, postgres.User, postgres.Password.Value(), postgres.Name, postgres.SSLMode)
 
-	db, err := sql.Open("postgres", connStr)
+	db, err := tracing.OpenSQL("postgres", connStr, "postgresql")
 	if err != nil {
-		log.Printf("Error while connecting to PostgreSQL: %v", err)
-		log.Fatal(err)
+		slog.Error("connecting to postgres failed", logging.Err(err))
+		os.Exit(1)
+	}
+	c, cancel := context.WithTimeout(context.Background(), dbConfig.ConnectTimeout)
+	defer cancel()
+	if err = db.PingContext(c); err != nil {
+		slog.Error("pinging postgres failed", logging.Err(err))
+		os.Exit(1)
 	}
 
 	createTableSQL := `CREATE TABLE IF NOT EXISTS products (
@@ -52,16 +66,34 @@ func ConnectToPostgres() {
 		fuel_type TEXT
 	);`
 
-	_, err = db.Exec(createTableSQL)
+	_, err = db.ExecContext(c, createTableSQL)
 	if err != nil {
-		log.Printf("Error creating table: %v", err)
-		log.Fatal(err)
+		slog.Error("creating the products table failed", logging.Err(err))
+		os.Exit(1)
 	}
 
 	RelationalDB = db
 }
 
 
+// PingMongo checks that the primary answers, writes go nowhere else
+func PingMongo(c context.Context) error {
+	return DB.Client().Ping(c, readpref.Primary())
+}
+
+func PingPostgres(c context.Context) error {
+	return RelationalDB.PingContext(c)
+}
+
+// DisconnectDbs closes the connections of both databases once the server is done with them
+func DisconnectDbs(c context.Context) {
+	if err := DB.Client().Disconnect(c); err != nil {
+		slog.WarnContext(c, "disconnecting from mongo failed", logging.Err(err))
+	}
+	if err := RelationalDB.Close(); err != nil {
+		slog.WarnContext(c, "disconnecting from postgres failed", logging.Err(err))
+	}
+}
 
 func InitSQL() {
 
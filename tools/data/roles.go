@@ -5,8 +5,11 @@ import (
 	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
 	"golang.org/x/crypto/bcrypt"
+	"log/slog"
 	"palyvoua/internal/models"
 	"palyvoua/tools"
+	"palyvoua/tools/auth"
+	"time"
 )
 
 func (s *defaultDBSeeder) createDefaultRoles() error {
@@ -24,11 +27,13 @@ func (s *defaultDBSeeder) createDefaultRoles() error {
 	if err !=nil {
 		return err
 	}
+	operatorRole.RequireMFA = true
 	insertion = append(insertion, operatorRole)
 	adminRole, err := roleFactory.Create("ROLE_ADMIN",3)
 	if err !=nil {
 		return err
 	}
+	adminRole.RequireMFA = true
 	insertion = append(insertion, adminRole)
 
 	collection := tools.DB.Collection("roles")
@@ -81,20 +86,34 @@ func (s *defaultDBSeeder) createUser(c context.Context,email string, password st
 	return &admin, nil
 }
 
+// createDefaultUsers seeds an admin with a generated password and the token to enroll its second factor with,
+// both are printed once and never stored in plain
 func (s *defaultDBSeeder) createDefaultUsers() error {
 	ctx := context.Background()
 	var insert []interface{}
 	var err error
 	userCollection :=tools.DB.Collection("users")
-	admin, err := s.createUser(ctx, "admin", "1234", "ROLE_ADMIN")
+	password, _, err := auth.GenerateOpaqueToken()
 	if err != nil {
 		return err
 	}
+	admin, err := s.createUser(ctx, "admin", password, "ROLE_ADMIN")
+	if err != nil {
+		return err
+	}
+	enrollmentToken, enrollmentHash, err := auth.GenerateOpaqueToken()
+	if err != nil {
+		return err
+	}
+	admin.MFA.EnrollmentTokenHash = enrollmentHash
+	admin.MFA.EnrollmentExpiresAt = int(time.Now().Add(auth.MFAEnrollmentExpiration).Unix())
 	insert = append(insert, admin)
 
 	_,err = userCollection.InsertMany(ctx, insert)
 	if err!=nil {
 		return err
 	}
+	slog.Warn("seeded the admin user, sign in and enroll two-factor authentication with these before they expire",
+		"email", admin.Email, "password", password, "enrollmentToken", enrollmentToken)
 	return nil
 }
\ No newline at end of file
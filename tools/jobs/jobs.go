@@ -0,0 +1,37 @@
+package jobs
+
+import (
+	"context"
+	"log/slog"
+	"palyvoua/tools/logging"
+	"time"
+)
+
+// Every runs job right away and then every interval until c is done.
+// A pass gets a context without c's cancel so shutdown doesn't cut it short,
+// a failing pass is logged as "<name> failed" and runs again on the next tick.
+func Every(c context.Context, interval time.Duration, name string, job func(c context.Context) error) {
+	pass := context.WithoutCancel(c)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := job(pass); err != nil {
+			slog.ErrorContext(c, name+" failed", logging.Err(err))
+		}
+		select {
+		case <-c.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Backoff is the delay before the next attempt after attempts failed ones,
+// first after the first one and doubling with every other up to limit
+func Backoff(attempts int, first time.Duration, limit time.Duration) time.Duration {
+	delay := first
+	for i := 1; i < attempts && delay < limit; i++ {
+		delay *= 2
+	}
+	return min(delay, limit)
+}
@@ -0,0 +1,57 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want time.Duration
+	}{
+		{attempts: 0, want: 30 * time.Second},
+		{attempts: 1, want: 30 * time.Second},
+		{attempts: 2, want: time.Minute},
+		{attempts: 4, want: 4 * time.Minute},
+		{attempts: 8, want: time.Hour},
+		{attempts: 1000, want: time.Hour},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.attempts, 30*time.Second, time.Hour); got != tt.want {
+			t.Fatalf("Backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestEvery(t *testing.T) {
+	c, cancel := context.WithCancel(context.Background())
+	var passes atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Every(c, time.Millisecond, "test job", func(pass context.Context) error {
+			if pass.Err() != nil {
+				t.Error("pass context canceled with the job's")
+			}
+			// a failing pass doesn't stop the job
+			if passes.Add(1) == 3 {
+				cancel()
+			}
+			return errors.New("failed")
+		})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job didn't stop after its context was canceled")
+	}
+	// a tick ready along with the cancel may still run another pass
+	if got := passes.Load(); got < 3 {
+		t.Fatalf("%d passes, want the job to go on after failing ones", got)
+	}
+}
@@ -1,6 +1,9 @@
 package jsonHelper
 
-import "github.com/gin-gonic/gin"
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+)
 
 var DefaultHttpErrors = map[string]ApiError{
 	"BadRequest": {Err: "Bad request", Status: 400},
@@ -18,11 +21,25 @@ func (e ApiError) Error() string {
 	return e.Err
 }
 
+// status falls back to 500 for errors built without one
+func (e ApiError) status() int {
+	if e.Status < 100 {
+		return 500
+	}
+	return e.Status
+}
+
 func MakeHttpHandler(f apiFunction) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if err:=f(c);err!=nil {
 			if e, ok := err.(*ApiError); ok {
-				c.JSON(e.Status, gin.H{"error":e})
+				c.JSON(e.status(), gin.H{"error":e})
+				c.Abort()
+				return
+			}
+			var e ApiError
+			if errors.As(err, &e) {
+				c.JSON(e.status(), gin.H{"error":e})
 				c.Abort()
 				return
 			}
@@ -0,0 +1,113 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+
+	REDACTED = "[REDACTED]"
+)
+
+// sensitiveKeys are redacted wherever they appear in an attribute key, matching ignores case
+var sensitiveKeys = []string{"password", "secret", "token", "authorization", "cookie", "apikey", "signature", "otp", "iban"}
+
+// New builds a logger writing level and above to w in format, every record carries the request ID of its context
+func New(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var handlerLevel slog.Level
+	if err := handlerLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("LOG_LEVEL: %w", err)
+	}
+	options := &slog.HandlerOptions{Level: handlerLevel, ReplaceAttr: redact}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case FORMAT_TEXT:
+		handler = slog.NewTextHandler(w, options)
+	case FORMAT_JSON:
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return nil, fmt.Errorf("LOG_FORMAT: unknown format %q", format)
+	}
+	return slog.New(contextHandler{Handler: handler}), nil
+}
+
+// Setup makes a logger from LOG_LEVEL and LOG_FORMAT the default, the standard log package writes through it too
+func Setup(level string, format string) error {
+	logger, err := New(os.Stderr, level, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return slog.String(a.Key, REDACTED)
+		}
+	}
+	if a.Value.Kind() != slog.KindString {
+		return a
+	}
+	switch {
+	case strings.Contains(key, "email"):
+		return slog.String(a.Key, MaskEmail(a.Value.String()))
+	case strings.Contains(key, "phone"):
+		return slog.String(a.Key, MaskPhone(a.Value.String()))
+	}
+	return a
+}
+
+// MaskEmail keeps enough of an address to tell users apart in the logs
+func MaskEmail(email string) string {
+	name, domain, found := strings.Cut(email, "@")
+	if !found || name == "" {
+		return REDACTED
+	}
+	return name[:1] + "***@" + domain
+}
+
+// MaskPhone keeps the last digits of a number only
+func MaskPhone(phone string) string {
+	if len(phone) <= 3 {
+		return REDACTED
+	}
+	return "***" + phone[len(phone)-3:]
+}
+
+// Err is the attribute errors are logged under
+func Err(err error) slog.Attr {
+	return slog.Any("error", err)
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(c context.Context, record slog.Record) error {
+	if id := RequestID(c); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if span := trace.SpanContextFromContext(c); span.IsValid() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+	}
+	return h.Handler.Handle(c, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{Handler: h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,93 @@
+package logging
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"log/slog"
+	"time"
+)
+
+const (
+	REQUEST_ID_HEADER = "X-Request-ID"
+	// REQUEST_ID_KEY is where the ID is kept on the gin context, gin only looks up string keys
+	REQUEST_ID_KEY = "requestId"
+	MAX_REQUEST_ID_LENGTH = 128
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying id, for work that outlives the request
+func WithRequestID(c context.Context, id string) context.Context {
+	return context.WithValue(c, requestIDKey{}, id)
+}
+
+// RequestID returns the ID of the request c was derived from, empty outside of requests
+func RequestID(c context.Context) string {
+	if c == nil {
+		return ""
+	}
+	if id, ok := c.Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	// contexts derived from a gin context, like a transaction's, only reach the gin keys
+	if id, ok := c.Value(REQUEST_ID_KEY).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// validRequestID accepts IDs of callers that are short and printable, anything else gets a fresh one
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MAX_REQUEST_ID_LENGTH {
+		return false
+	}
+	for _, r := range id {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware gives every request an ID, taken from X-Request-ID when the caller sent one, and logs the request when it is done
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		started := time.Now()
+		id := c.GetHeader(REQUEST_ID_HEADER)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		c.Set(REQUEST_ID_KEY, id)
+		c.Request = c.Request.WithContext(WithRequestID(c.Request.Context(), id))
+		c.Header(REQUEST_ID_HEADER, id)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		// the route rather than the path keeps ids and query strings with tokens out of the log
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("route", route),
+			slog.Int("status", status),
+			slog.Int64("duration_ms", time.Since(started).Milliseconds()),
+			slog.String("client_ip", c.ClientIP()),
+			slog.Int("bytes", max(c.Writer.Size(), 0)),
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("errors", c.Errors.String()))
+		}
+		slog.LogAttrs(c, level, "request", attrs...)
+	}
+}
@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"log/slog"
+	"palyvoua/internal/models"
+	"palyvoua/tools/logging"
+	"sync"
+	"time"
+)
+
+const (
+	TICKETS_CREATED = "created"
+	TICKETS_REDEEMED = "redeemed"
+	TICKETS_EXPIRED = "expired"
+
+	WEBHOOK_PROCESSED = "processed"
+	// WEBHOOK_REJECTED callbacks could not be parsed or verified, WEBHOOK_FAILED ones are retried by the provider
+	WEBHOOK_REJECTED = "rejected"
+	WEBHOOK_FAILED = "failed"
+
+	unknownLabel = "unknown"
+	inventoryTimeout = 5 * time.Second
+)
+
+var (
+	tickets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "tickets_total",
+		Help:      "Tickets created, redeemed and expired by fuel type and seller, partial redemptions count too.",
+	}, []string{"event", "fuel_type", "seller"})
+	paymentWebhooks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "payment",
+		Name:      "webhooks_total",
+		Help:      "Payment provider callbacks by provider, event type and result.",
+	}, []string{"provider", "event", "result"})
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "webhook",
+		Name:      "delivery_attempts_total",
+		Help:      "Attempts to deliver seller webhooks by event type and result.",
+	}, []string{"event", "result"})
+)
+
+type productTicketGetter interface {
+	GetByID(c context.Context, id uuid.UUID) (models.ProductTicket, error)
+}
+
+var (
+	productTickets productTicketGetter
+	// ticketLabels caches the fuel type and seller of a product ticket, neither changes once it is on sale
+	ticketLabels sync.Map
+)
+
+// UseProductTickets makes CountTickets label tickets with the fuel type and seller of their product ticket
+func UseProductTickets(repo productTicketGetter) {
+	productTickets = repo
+}
+
+// CountTickets adds tickets to the count of event
+func CountTickets(c context.Context, event string, counted ...models.Ticket) {
+	for i := range counted {
+		fuelType, seller := labelsOf(c, counted[i].ProductTicketID)
+		tickets.WithLabelValues(event, fuelType, seller).Inc()
+	}
+}
+
+func labelsOf(c context.Context, productTicketID uuid.UUID) (string, string) {
+	if cached, ok := ticketLabels.Load(productTicketID); ok {
+		labels := cached.([2]string)
+		return labels[0], labels[1]
+	}
+	if productTickets == nil || productTicketID == uuid.Nil {
+		return unknownLabel, unknownLabel
+	}
+	productTicket, err := productTickets.GetByID(c, productTicketID)
+	if err != nil {
+		slog.WarnContext(c, "labeling ticket metrics failed", "product_ticket_id", productTicketID, logging.Err(err))
+		return unknownLabel, unknownLabel
+	}
+	labels := [2]string{productTicket.FuelType, productTicket.Seller}
+	ticketLabels.Store(productTicketID, labels)
+	return labels[0], labels[1]
+}
+
+// CountPaymentWebhook records how a callback of a payment provider was handled
+func CountPaymentWebhook(provider string, eventType string, result string) {
+	if eventType == "" {
+		eventType = unknownLabel
+	}
+	paymentWebhooks.WithLabelValues(provider, eventType, result).Inc()
+}
+
+// CountWebhookDelivery records an attempt to deliver a seller webhook, result is the delivery status after it
+func CountWebhookDelivery(eventType string, result string) {
+	webhookDeliveries.WithLabelValues(eventType, result).Inc()
+}
+
+type productLister interface {
+	GetAllProducts(c context.Context) ([]models.Product, error)
+}
+
+// UseInventory reports the liters left of every product, read from repo whenever metrics are scraped
+func UseInventory(repo productLister) {
+	prometheus.MustRegister(&inventoryCollector{products: repo})
+}
+
+var inventoryDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(NAMESPACE, "inventory", "liters"),
+	"Liters in stock by product.",
+	[]string{"product_id", "title", "fuel_type", "seller"}, nil,
+)
+
+type inventoryCollector struct {
+	products productLister
+}
+
+func (i *inventoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- inventoryDesc
+}
+
+func (i *inventoryCollector) Collect(ch chan<- prometheus.Metric) {
+	c, cancel := context.WithTimeout(context.Background(), inventoryTimeout)
+	defer cancel()
+	products, err := i.products.GetAllProducts(c)
+	if err != nil {
+		// a scrape without the inventory beats a failed one
+		slog.Warn("collecting inventory metrics failed", logging.Err(err))
+		return
+	}
+	for _, p := range products {
+		ch <- prometheus.MustNewConstMetric(inventoryDesc, prometheus.GaugeValue, float64(p.Amount), p.ID.String(), p.Title, p.FuelType, p.Seller)
+	}
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/event"
+	"palyvoua/tools/caller"
+	"sync"
+	"time"
+)
+
+const (
+	DB_MONGO = "mongo"
+	DB_POSTGRES = "postgres"
+)
+
+var queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: NAMESPACE,
+	Subsystem: "db",
+	Name:      "query_duration_seconds",
+	Help:      "Time taken by database queries by repository method, queries made outside the repositories are labeled by command.",
+	Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+}, []string{"database", "repository", "method", "outcome"})
+
+// MongoMonitor times every command sent to mongo. The driver reports the start of a command
+// on the goroutine that issued it, which is where the calling repository method is looked up.
+func MongoMonitor() *event.CommandMonitor {
+	var started sync.Map
+	finish := func(requestID int64, duration time.Duration, outcome string) {
+		labels, ok := started.LoadAndDelete(requestID)
+		if !ok {
+			return
+		}
+		caller := labels.(queryCaller)
+		queryDuration.WithLabelValues(DB_MONGO, caller.repository, caller.method, outcome).Observe(duration.Seconds())
+	}
+	return &event.CommandMonitor{
+		Started: func(c context.Context, e *event.CommandStartedEvent) {
+			caller, ok := repositoryCaller()
+			if !ok {
+				caller = queryCaller{repository: "none", method: e.CommandName}
+			}
+			started.Store(e.RequestID, caller)
+		},
+		Succeeded: func(c context.Context, e *event.CommandSucceededEvent) {
+			finish(e.RequestID, e.Duration, "ok")
+		},
+		Failed: func(c context.Context, e *event.CommandFailedEvent) {
+			finish(e.RequestID, e.Duration, "error")
+		},
+	}
+}
+
+// ObserveQuery times a query of a repository method, it is deferred at the top of the method:
+//
+//	defer metrics.ObserveQuery(metrics.DB_POSTGRES, &err)()
+func ObserveQuery(database string, err *error) func() {
+	start := time.Now()
+	caller, ok := repositoryCaller()
+	if !ok {
+		caller = queryCaller{repository: "none", method: "unknown"}
+	}
+	return func() {
+		outcome := "ok"
+		if err != nil && *err != nil {
+			outcome = "error"
+		}
+		queryDuration.WithLabelValues(database, caller.repository, caller.method, outcome).Observe(time.Since(start).Seconds())
+	}
+}
+
+type queryCaller struct {
+	repository string
+	method string
+}
+
+// repositoryCaller labels a query with the repository method that made it
+func repositoryCaller() (queryCaller, bool) {
+	repository, method, ok := caller.Repository()
+	return queryCaller{repository: repository, method: method}, ok
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"strconv"
+	"time"
+)
+
+const NAMESPACE = "palyvo"
+
+var httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: NAMESPACE,
+	Subsystem: "http",
+	Name:      "request_duration_seconds",
+	Help:      "Time taken to answer HTTP requests by route and status.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"method", "route", "status"})
+
+// Middleware times every request, routes are labeled with their pattern to keep ids out of the labels
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequestDuration.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Handler serves everything registered with the default registry, the Go runtime and process metrics included
+func Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
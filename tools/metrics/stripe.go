@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	stripeRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "stripe",
+		Name:      "requests_total",
+		Help:      "Stripe API calls by endpoint and outcome, every network retry counts.",
+	}, []string{"method", "endpoint", "outcome"})
+	stripeRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Subsystem: "stripe",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken by Stripe API calls by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "endpoint"})
+)
+
+// StripeTransport counts the calls made through base, it is set on the client of the Stripe backend
+func StripeTransport(base http.RoundTripper) http.RoundTripper {
+	return stripeTransport{base: base}
+}
+
+type stripeTransport struct {
+	base http.RoundTripper
+}
+
+func (t stripeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	endpoint := stripeEndpoint(req.URL.Path)
+	stripeRequestDuration.WithLabelValues(req.Method, endpoint).Observe(time.Since(start).Seconds())
+	outcome := "network_error"
+	switch {
+	case err != nil:
+	case res.StatusCode >= 500:
+		outcome = "server_error"
+	case res.StatusCode == http.StatusTooManyRequests:
+		outcome = "rate_limited"
+	case res.StatusCode >= 400:
+		outcome = "client_error"
+	default:
+		outcome = "ok"
+	}
+	stripeRequests.WithLabelValues(req.Method, endpoint, outcome).Inc()
+	return res, err
+}
+
+// stripeEndpoint replaces object ids with :id, "/v1/customers/cus_NffrFeUfNV2Hib/sources" is "/v1/customers/:id/sources".
+// Stripe ids always hold digits or capitals, the resource names never do.
+func stripeEndpoint(path string) string {
+	segments := strings.Split(path, "/")
+	for i := 2; i < len(segments); i++ {
+		if strings.ContainsAny(segments[i], "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -2,10 +2,16 @@ package tools
 
 import (
 	"github.com/stripe/stripe-go/v75"
-	"os"
+	"net/http"
+	"palyvoua/tools/metrics"
+	"palyvoua/tools/tracing"
+	"time"
 )
 
-func StripeInit() {
-	stripeSecretKey := os.Getenv("STRIPE_SECRET_KEY")
-	stripe.Key = stripeSecretKey
+func StripeInit(secretKey string) {
+	stripe.Key = secretKey
+	// the client the library would make itself, only counted and traced
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		HTTPClient: &http.Client{Timeout: 80 * time.Second, Transport: tracing.Transport("stripe", metrics.StripeTransport(http.DefaultTransport))},
+	}))
 }
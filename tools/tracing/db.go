@@ -0,0 +1,72 @@
+package tracing
+
+import (
+	"context"
+	"database/sql"
+	"github.com/XSAM/otelsql"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"palyvoua/tools/caller"
+	"sync"
+)
+
+// MongoMonitor traces every command sent to mongo and hands the events on to next,
+// spans are named after the repository method that sent the command
+func MongoMonitor(next *event.CommandMonitor) *event.CommandMonitor {
+	if next == nil {
+		next = &event.CommandMonitor{}
+	}
+	var spans sync.Map
+	return &event.CommandMonitor{
+		Started: func(c context.Context, e *event.CommandStartedEvent) {
+			attributes := []attribute.KeyValue{semconv.DBSystemMongoDB, semconv.DBName(e.DatabaseName), semconv.DBOperation(e.CommandName)}
+			if collection, ok := e.Command.Lookup(e.CommandName).StringValueOK(); ok {
+				attributes = append(attributes, semconv.DBMongoDBCollection(collection))
+			}
+			_, span := Tracer.Start(c, spanName(e.CommandName), trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+			spans.Store(e.RequestID, span)
+			if next.Started != nil {
+				next.Started(c, e)
+			}
+		},
+		Succeeded: func(c context.Context, e *event.CommandSucceededEvent) {
+			if span, ok := spans.LoadAndDelete(e.RequestID); ok {
+				span.(trace.Span).End()
+			}
+			if next.Succeeded != nil {
+				next.Succeeded(c, e)
+			}
+		},
+		Failed: func(c context.Context, e *event.CommandFailedEvent) {
+			if span, ok := spans.LoadAndDelete(e.RequestID); ok {
+				span.(trace.Span).SetStatus(codes.Error, e.Failure)
+				span.(trace.Span).End()
+			}
+			if next.Failed != nil {
+				next.Failed(c, e)
+			}
+		},
+	}
+}
+
+// OpenSQL opens a database whose statements are traced, spans are named like the mongo ones
+func OpenSQL(driverName string, dataSourceName string, system string) (*sql.DB, error) {
+	return otelsql.Open(driverName, dataSourceName,
+		otelsql.WithAttributes(semconv.DBSystemKey.String(system)),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{OmitRows: true, OmitConnResetSession: true}),
+		otelsql.WithSpanNameFormatter(func(c context.Context, method otelsql.Method, query string) string {
+			return spanName(string(method))
+		}),
+	)
+}
+
+// spanName puts the repository method making a query before the operation, "ticketRepo.GetByID find"
+func spanName(operation string) string {
+	if repository, method, ok := caller.Repository(); ok {
+		return repository + "." + method + " " + operation
+	}
+	return operation
+}
@@ -0,0 +1,89 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	EXPORTER_NONE = "none"
+	EXPORTER_STDOUT = "stdout"
+	// EXPORTER_OTLP sends spans over OTLP/HTTP, the endpoint and headers come from the standard OTEL_EXPORTER_OTLP_* variables
+	EXPORTER_OTLP = "otlp"
+
+	DEFAULT_SERVICE_NAME = "palyvo-api"
+)
+
+// Tracer is the tracer of the app's own spans, it records nothing until Setup installs a provider
+var Tracer = otel.Tracer("palyvoua")
+
+type Options struct {
+	Exporter string
+	ServiceName string
+	// SampleRatio is the share of new traces kept, spans of a sampled parent are always kept
+	SampleRatio float64
+}
+
+// Setup installs the global tracer provider and W3C propagation, the returned func flushes the spans left on shutdown
+func Setup(c context.Context, options Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(options.Exporter) {
+	case EXPORTER_NONE, "":
+		return func(context.Context) error { return nil }, nil
+	case EXPORTER_STDOUT:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	case EXPORTER_OTLP:
+		exporter, err = otlptracehttp.New(c)
+	default:
+		return nil, fmt.Errorf("OTEL_TRACES_EXPORTER: unknown exporter %q", options.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if options.ServiceName == "" {
+		options.ServiceName = DEFAULT_SERVICE_NAME
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(options.ServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(options.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// End records err on span before ending it, it is deferred with a pointer to the named error of the caller
+func End(span trace.Span, err *error) {
+	if err != nil && *err != nil {
+		Fail(span, *err)
+	}
+	span.End()
+}
+
+// Fail marks span as failed with err
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Transport traces the calls made through base to service, the trace context goes along in the headers
+func Transport(service string, base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base, otelhttp.WithSpanNameFormatter(func(operation string, req *http.Request) string {
+		return service + " " + req.Method
+	}))
+}